@@ -0,0 +1,468 @@
+package credentials
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DIN-center/din-caddy-plugins/lib/auth"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+// Auth types, as set in the Caddyfile and in the registry NetworkServiceAuthConfig.Type
+const (
+	// A static API key, sent in a header or in the query string of the request URL
+	TypeAPIKey = "api_key"
+	// A static bearer token, sent in the Authorization header
+	TypeBearer = "bearer"
+	// HTTP Basic auth
+	TypeBasic = "basic"
+	// A bearer token obtained with the OAuth2 client credentials grant, and fetched again before it expires
+	TypeOAuth2 = "oauth2"
+)
+
+const (
+	// The header API keys are sent in, unless Header or QueryParam is set
+	DefaultAPIKeyHeader = "x-api-key"
+	// OAuth2 tokens are fetched again TokenRefreshMargin before they expire
+	TokenRefreshMargin = 30 * time.Second
+	// A failed OAuth2 token request is retried after TokenRetryInterval
+	TokenRetryInterval = 15 * time.Second
+)
+
+var ErrNoToken = errors.New("credentials not loaded")
+
+// IsType returns whether the auth type is handled by ClientAuth
+func IsType(authType string) bool {
+	switch authType {
+	case TypeAPIKey, TypeBearer, TypeBasic, TypeOAuth2:
+		return true
+	}
+	return false
+}
+
+// ClientAuth authenticates requests to a provider with static credentials or an OAuth2 client credentials token.
+// Secrets may be placeholders such as {env.PROVIDER_KEY}, replaced at start, or be read from files, read again on Refresh.
+type ClientAuth struct {
+	// The auth type: api_key, bearer, basic or oauth2
+	Type string `json:"type"`
+
+	// The header the API key is sent in. DefaultAPIKeyHeader unless QueryParam is set.
+	Header string `json:"header,omitempty"`
+	// The query parameter the API key is sent in, instead of a header
+	QueryParam string `json:"query_param,omitempty"`
+	// The API key, or the path to a file holding it
+	Key     string `json:"key,omitempty"`
+	KeyFile string `json:"key_file,omitempty"`
+
+	// The bearer token, or the path to a file holding it
+	Token     string `json:"token,omitempty"`
+	TokenFile string `json:"token_file,omitempty"`
+
+	// The HTTP Basic credentials
+	Username     string `json:"username,omitempty"`
+	Password     string `json:"password,omitempty"`
+	PasswordFile string `json:"password_file,omitempty"`
+
+	// The OAuth2 token endpoint, client credentials and requested scopes
+	TokenURL         string   `json:"token_url,omitempty"`
+	ClientID         string   `json:"client_id,omitempty"`
+	ClientSecret     string   `json:"client_secret,omitempty"`
+	ClientSecretFile string   `json:"client_secret_file,omitempty"`
+	Scopes           []string `json:"scopes,omitempty"`
+
+	// Guards token and err, which are replaced by the refresh goroutine while requests are signed
+	mu sync.RWMutex
+	// The header or query parameter and value requests are signed with
+	token auth.AuthToken
+	query url.Values
+	err   error
+
+	client *http.Client
+	logger *zap.Logger
+	quit   chan struct{}
+	once   sync.Once
+}
+
+// Validate checks that the credentials of the auth type are set
+func (c *ClientAuth) Validate() error {
+	switch c.Type {
+	case TypeAPIKey:
+		if c.Key == "" && c.KeyFile == "" {
+			return errors.New("api_key auth requires key or key_file")
+		}
+		if c.Header != "" && c.QueryParam != "" {
+			return errors.New("api_key auth takes header or query_param, not both")
+		}
+	case TypeBearer:
+		if c.Token == "" && c.TokenFile == "" {
+			return errors.New("bearer auth requires token or token_file")
+		}
+	case TypeBasic:
+		if c.Username == "" {
+			return errors.New("basic auth requires username")
+		}
+		if c.Password == "" && c.PasswordFile == "" {
+			return errors.New("basic auth requires password or password_file")
+		}
+	case TypeOAuth2:
+		u, err := url.Parse(c.TokenURL)
+		if c.TokenURL == "" || err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("oauth2 auth requires token_url to be an http(s) url, got %q", c.TokenURL)
+		}
+		if c.ClientID == "" {
+			return errors.New("oauth2 auth requires client_id")
+		}
+		if c.ClientSecret == "" && c.ClientSecretFile == "" {
+			return errors.New("oauth2 auth requires client_secret or client_secret_file")
+		}
+	default:
+		return fmt.Errorf("unknown auth type %q", c.Type)
+	}
+	return nil
+}
+
+// Copy returns a new client with the same configuration, of the auth type.
+// Providers from the registry get their own copy of the configured credentials.
+func (c *ClientAuth) Copy(authType string) *ClientAuth {
+	return &ClientAuth{
+		Type:             authType,
+		Header:           c.Header,
+		QueryParam:       c.QueryParam,
+		Key:              c.Key,
+		KeyFile:          c.KeyFile,
+		Token:            c.Token,
+		TokenFile:        c.TokenFile,
+		Username:         c.Username,
+		Password:         c.Password,
+		PasswordFile:     c.PasswordFile,
+		TokenURL:         c.TokenURL,
+		ClientID:         c.ClientID,
+		ClientSecret:     c.ClientSecret,
+		ClientSecretFile: c.ClientSecretFile,
+		Scopes:           c.Scopes,
+	}
+}
+
+// Start loads the credentials, fetching a first token for OAuth2, which is then fetched again before it expires.
+// A failure is reported by Error, and retried for OAuth2.
+func (c *ClientAuth) Start(logger *zap.Logger) error {
+	c.logger = logger
+	if c.client == nil {
+		c.client = &http.Client{Timeout: 10 * time.Second}
+	}
+	c.quit = make(chan struct{})
+	if c.Type != TypeOAuth2 {
+		return c.Refresh()
+	}
+	token, err := c.GetToken(nil)
+	c.setToken(token, nil, err)
+	if err != nil {
+		c.logger.Info("Error fetching oauth2 token. Will retry in 15 seconds", zap.String("token_url", c.TokenURL), zap.Error(err))
+		c.renew(TokenRetryInterval)
+		return nil
+	}
+	c.renewBefore(token)
+	return nil
+}
+
+// renewBefore schedules fetching a new OAuth2 token before the token expires
+func (c *ClientAuth) renewBefore(token auth.AuthToken) {
+	if token.Expiration == nil {
+		return
+	}
+	wait := time.Until(time.Time(*token.Expiration)) - TokenRefreshMargin
+	if wait < time.Second {
+		wait = time.Second
+	}
+	c.renew(wait)
+}
+
+func (c *ClientAuth) renew(d time.Duration) {
+	go func() {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		select {
+		case <-t.C:
+			token, err := c.GetToken(nil)
+			if err != nil {
+				c.logger.Warn("Error fetching oauth2 token, will try again in 15 seconds", zap.String("token_url", c.TokenURL), zap.Error(err))
+				c.mu.Lock()
+				c.err = err
+				c.mu.Unlock()
+				c.renew(TokenRetryInterval)
+				return
+			}
+			c.setToken(token, nil, nil)
+			c.renewBefore(token)
+		case <-c.quit:
+		}
+	}()
+}
+
+func (c *ClientAuth) setToken(token auth.AuthToken, query url.Values, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err == nil {
+		c.token, c.query = token, query
+	}
+	c.err = err
+}
+
+// Error returns why requests can't be authenticated, or nil if they can
+func (c *ClientAuth) Error() error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.token.Headers == nil && c.query == nil {
+		if c.err != nil {
+			return c.err
+		}
+		return ErrNoToken
+	}
+	// A token that is still valid is used while a new one can't be fetched
+	if err := c.token.Peek(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetToken returns the headers requests are signed with. For OAuth2, a new token is fetched.
+func (c *ClientAuth) GetToken(map[string]interface{}) (auth.AuthToken, error) {
+	token, _, err := c.load()
+	return token, err
+}
+
+// load returns the headers and query parameters requests are signed with
+func (c *ClientAuth) load() (auth.AuthToken, url.Values, error) {
+	repl := caddy.NewReplacer()
+	if c.Type == TypeAPIKey {
+		key, err := secret(repl, c.Key, c.KeyFile)
+		if err != nil {
+			return auth.AuthToken{}, nil, err
+		}
+		if c.QueryParam != "" {
+			return auth.AuthToken{}, url.Values{c.QueryParam: {key}}, nil
+		}
+		header := c.Header
+		if header == "" {
+			header = DefaultAPIKeyHeader
+		}
+		return auth.AuthToken{Headers: map[string]string{header: key}}, nil, nil
+	}
+	token, err := c.headers(repl)
+	return token, nil, err
+}
+
+// headers returns the Authorization header of the bearer, basic and oauth2 auth types
+func (c *ClientAuth) headers(repl *caddy.Replacer) (auth.AuthToken, error) {
+	switch c.Type {
+	case TypeBearer:
+		token, err := secret(repl, c.Token, c.TokenFile)
+		if err != nil {
+			return auth.AuthToken{}, err
+		}
+		return auth.AuthToken{Headers: map[string]string{"Authorization": "Bearer " + token}}, nil
+	case TypeBasic:
+		password, err := secret(repl, c.Password, c.PasswordFile)
+		if err != nil {
+			return auth.AuthToken{}, err
+		}
+		credentials := base64.StdEncoding.EncodeToString([]byte(repl.ReplaceAll(c.Username, "") + ":" + password))
+		return auth.AuthToken{Headers: map[string]string{"Authorization": "Basic " + credentials}}, nil
+	case TypeOAuth2:
+		return c.fetchToken(repl)
+	}
+	return auth.AuthToken{}, fmt.Errorf("unknown auth type %q", c.Type)
+}
+
+// tokenResponse is the body of a successful response of an OAuth2 token endpoint (RFC 6749 section 5.1)
+type tokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	TokenType        string `json:"token_type"`
+	ExpiresIn        int64  `json:"expires_in"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// fetchToken requests a token with the client credentials grant (RFC 6749 section 4.4)
+func (c *ClientAuth) fetchToken(repl *caddy.Replacer) (auth.AuthToken, error) {
+	clientSecret, err := secret(repl, c.ClientSecret, c.ClientSecretFile)
+	if err != nil {
+		return auth.AuthToken{}, err
+	}
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(c.Scopes) > 0 {
+		form.Set("scope", strings.Join(c.Scopes, " "))
+	}
+	req, err := http.NewRequest(http.MethodPost, repl.ReplaceAll(c.TokenURL, ""), strings.NewReader(form.Encode()))
+	if err != nil {
+		return auth.AuthToken{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(repl.ReplaceAll(c.ClientID, "")), url.QueryEscape(clientSecret))
+	issued := time.Now()
+	res, err := c.client.Do(req)
+	if err != nil {
+		return auth.AuthToken{}, err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return auth.AuthToken{}, err
+	}
+	var tr tokenResponse
+	if err := json.Unmarshal(body, &tr); err != nil {
+		return auth.AuthToken{}, fmt.Errorf("invalid token response with status %d: %v", res.StatusCode, err)
+	}
+	if res.StatusCode != http.StatusOK || tr.Error != "" {
+		return auth.AuthToken{}, fmt.Errorf("token request failed with status %d: %s %s", res.StatusCode, tr.Error, tr.ErrorDescription)
+	}
+	if tr.AccessToken == "" {
+		return auth.AuthToken{}, errors.New("token response without access_token")
+	}
+	if tr.TokenType != "" && !strings.EqualFold(tr.TokenType, "bearer") {
+		return auth.AuthToken{}, fmt.Errorf("unsupported token type %q", tr.TokenType)
+	}
+	token := auth.AuthToken{Headers: map[string]string{"Authorization": "Bearer " + tr.AccessToken}}
+	if tr.ExpiresIn > 0 {
+		exp := auth.UnixTime(issued.Add(time.Duration(tr.ExpiresIn) * time.Second))
+		token.Expiration = &exp
+	}
+	return token, nil
+}
+
+// Refresh loads the credentials again, reading the secret files again, or fetches a new OAuth2 token
+func (c *ClientAuth) Refresh() error {
+	token, query, err := c.load()
+	c.setToken(token, query, err)
+	return err
+}
+
+// Sign adds the credentials to the request, in its headers or its query string
+func (c *ClientAuth) Sign(r *http.Request) error {
+	c.mu.RLock()
+	token, query := c.token, c.query
+	c.mu.RUnlock()
+	if token.Headers == nil && query == nil {
+		return c.Error()
+	}
+	for k, v := range token.Headers {
+		r.Header.Set(k, v)
+	}
+	if query != nil {
+		r.URL.RawQuery = signQuery(r.URL.RawQuery, query)
+	}
+	return nil
+}
+
+// SignURL adds the credentials sent in the query string to the URL, for requests that aren't signed with Sign, such
+// as the WebSocket handshake
+func (c *ClientAuth) SignURL(rawURL string) (string, error) {
+	c.mu.RLock()
+	query := c.query
+	c.mu.RUnlock()
+	if query == nil {
+		return rawURL, nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	u.RawQuery = signQuery(u.RawQuery, query)
+	return u.String(), nil
+}
+
+func signQuery(rawQuery string, query url.Values) string {
+	values, _ := url.ParseQuery(rawQuery)
+	for k, vs := range query {
+		values[k] = vs
+	}
+	return values.Encode()
+}
+
+// Stop ends the OAuth2 token refreshes
+func (c *ClientAuth) Stop() {
+	c.once.Do(func() {
+		if c.quit != nil {
+			close(c.quit)
+		}
+	})
+}
+
+// secret returns the value with placeholders replaced, or else the trimmed content of the file
+func secret(repl *caddy.Replacer, value string, file string) (string, error) {
+	if value != "" {
+		return repl.ReplaceAll(value, ""), nil
+	}
+	data, err := os.ReadFile(repl.ReplaceAll(file, ""))
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret file: %v", err)
+	}
+	s := strings.TrimSpace(string(data))
+	if s == "" {
+		return "", fmt.Errorf("secret file %s is empty", file)
+	}
+	return s, nil
+}
+
+// UnmarshalCaddyfileOption parses the credentials option at the cursor of the dispenser, such as:
+//
+//	key_file /etc/din/provider.key
+//	header Api-Key
+//	scopes rpc:read rpc:write
+//
+// It returns false if the option isn't a credentials option.
+func (c *ClientAuth) UnmarshalCaddyfileOption(d *caddyfile.Dispenser) (bool, error) {
+	var field *string
+	switch d.Val() {
+	case "header":
+		field = &c.Header
+	case "query_param":
+		field = &c.QueryParam
+	case "key":
+		field = &c.Key
+	case "key_file":
+		field = &c.KeyFile
+	case "token":
+		field = &c.Token
+	case "token_file":
+		field = &c.TokenFile
+	case "username":
+		field = &c.Username
+	case "password":
+		field = &c.Password
+	case "password_file":
+		field = &c.PasswordFile
+	case "token_url":
+		field = &c.TokenURL
+	case "client_id":
+		field = &c.ClientID
+	case "client_secret":
+		field = &c.ClientSecret
+	case "client_secret_file":
+		field = &c.ClientSecretFile
+	case "scopes":
+		c.Scopes = append(c.Scopes, d.RemainingArgs()...)
+		if len(c.Scopes) == 0 {
+			return true, d.ArgErr()
+		}
+		return true, nil
+	default:
+		return false, nil
+	}
+	if !d.Args(field) {
+		return true, d.ArgErr()
+	}
+	return true, nil
+}
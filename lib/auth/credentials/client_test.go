@@ -0,0 +1,194 @@
+package credentials
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestClientAuthValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		auth  *ClientAuth
+		valid bool
+	}{
+		{"api key", &ClientAuth{Type: TypeAPIKey, Key: "key"}, true},
+		{"api key file", &ClientAuth{Type: TypeAPIKey, KeyFile: "/etc/din/key", QueryParam: "apikey"}, true},
+		{"api key without key", &ClientAuth{Type: TypeAPIKey}, false},
+		{"api key in header and query", &ClientAuth{Type: TypeAPIKey, Key: "key", Header: "x-key", QueryParam: "key"}, false},
+		{"bearer", &ClientAuth{Type: TypeBearer, TokenFile: "/etc/din/token"}, true},
+		{"bearer without token", &ClientAuth{Type: TypeBearer}, false},
+		{"basic", &ClientAuth{Type: TypeBasic, Username: "user", Password: "pass"}, true},
+		{"basic without username", &ClientAuth{Type: TypeBasic, Password: "pass"}, false},
+		{"basic without password", &ClientAuth{Type: TypeBasic, Username: "user"}, false},
+		{"oauth2", &ClientAuth{Type: TypeOAuth2, TokenURL: "https://auth.example.com/token", ClientID: "id", ClientSecret: "secret"}, true},
+		{"oauth2 without token url", &ClientAuth{Type: TypeOAuth2, ClientID: "id", ClientSecret: "secret"}, false},
+		{"oauth2 with invalid token url", &ClientAuth{Type: TypeOAuth2, TokenURL: "auth.example.com", ClientID: "id", ClientSecret: "secret"}, false},
+		{"oauth2 without client secret", &ClientAuth{Type: TypeOAuth2, TokenURL: "https://auth.example.com/token", ClientID: "id"}, false},
+		{"unknown type", &ClientAuth{Type: "digest"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.auth.Validate(); (err == nil) != tt.valid {
+				t.Errorf("Validate() = %v, expected valid %v", err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestClientAuthSign(t *testing.T) {
+	t.Setenv("DIN_TEST_PROVIDER_KEY", "env-key")
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("file-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		auth    *ClientAuth
+		headers map[string]string
+		query   string
+	}{
+		{"api key header", &ClientAuth{Type: TypeAPIKey, Key: "{env.DIN_TEST_PROVIDER_KEY}"}, map[string]string{"x-api-key": "env-key"}, "id=1"},
+		{"api key custom header", &ClientAuth{Type: TypeAPIKey, Key: "key", Header: "Api-Key"}, map[string]string{"Api-Key": "key"}, "id=1"},
+		{"api key query", &ClientAuth{Type: TypeAPIKey, Key: "key", QueryParam: "apikey"}, nil, "apikey=key&id=1"},
+		{"bearer file", &ClientAuth{Type: TypeBearer, TokenFile: tokenFile}, map[string]string{"Authorization": "Bearer file-token"}, "id=1"},
+		{"basic", &ClientAuth{Type: TypeBasic, Username: "user", Password: "pass"}, map[string]string{"Authorization": "Basic dXNlcjpwYXNz"}, "id=1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.auth.Start(zap.NewNop()); err != nil {
+				t.Fatalf("Start() = %v", err)
+			}
+			defer tt.auth.Stop()
+			if err := tt.auth.Error(); err != nil {
+				t.Errorf("Error() = %v", err)
+			}
+			req, _ := http.NewRequest(http.MethodPost, "https://provider.example.com/eth?id=1", nil)
+			if err := tt.auth.Sign(req); err != nil {
+				t.Fatalf("Sign() = %v", err)
+			}
+			for k, v := range tt.headers {
+				if got := req.Header.Get(k); got != v {
+					t.Errorf("expected header %s to be %q, got %q", k, v, got)
+				}
+			}
+			if req.URL.RawQuery != tt.query {
+				t.Errorf("expected query %q, got %q", tt.query, req.URL.RawQuery)
+			}
+			signed, err := tt.auth.SignURL("wss://provider.example.com/eth?id=1")
+			if err != nil {
+				t.Fatalf("SignURL() = %v", err)
+			}
+			if signed != "wss://provider.example.com/eth?"+tt.query {
+				t.Errorf("unexpected signed url %s", signed)
+			}
+		})
+	}
+}
+
+func TestClientAuthRefreshSecretFile(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "key")
+	c := &ClientAuth{Type: TypeAPIKey, KeyFile: keyFile}
+	if err := c.Start(zap.NewNop()); err == nil {
+		t.Errorf("expected a missing key file to fail")
+	}
+	if err := c.Error(); err == nil {
+		t.Errorf("expected the auth to be unhealthy without a key")
+	}
+	req, _ := http.NewRequest(http.MethodPost, "https://provider.example.com/eth", nil)
+	if err := c.Sign(req); err == nil {
+		t.Errorf("expected signing to fail without a key")
+	}
+
+	if err := os.WriteFile(keyFile, []byte("rotated"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Refresh(); err != nil {
+		t.Fatalf("Refresh() = %v", err)
+	}
+	if err := c.Sign(req); err != nil || req.Header.Get(DefaultAPIKeyHeader) != "rotated" {
+		t.Errorf("expected the key to be read again on refresh, got %q (%v)", req.Header.Get(DefaultAPIKeyHeader), err)
+	}
+}
+
+func TestClientAuthOAuth2(t *testing.T) {
+	var requests int32
+	var fail atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&requests, 1)
+		id, secret, ok := r.BasicAuth()
+		if !ok || id != "client" || secret != "s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error": "invalid_client"}`))
+			return
+		}
+		if r.PostFormValue("grant_type") != "client_credentials" || r.PostFormValue("scope") != "rpc:read rpc:write" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": "invalid_request"}`))
+			return
+		}
+		if fail.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`{"error": "temporarily_unavailable"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		// The first token expires right away, so it is fetched again
+		if n == 1 {
+			w.Write([]byte(`{"access_token": "first", "token_type": "Bearer", "expires_in": 1}`))
+			return
+		}
+		w.Write([]byte(`{"access_token": "second", "token_type": "bearer", "expires_in": 3600}`))
+	}))
+	defer server.Close()
+
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(secretFile, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c := &ClientAuth{Type: TypeOAuth2, TokenURL: server.URL, ClientID: "client", ClientSecretFile: secretFile, Scopes: []string{"rpc:read", "rpc:write"}}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("Validate() = %v", err)
+	}
+	if err := c.Start(zap.NewNop()); err != nil {
+		t.Fatalf("Start() = %v", err)
+	}
+	defer c.Stop()
+	req, _ := http.NewRequest(http.MethodPost, "https://provider.example.com/eth", nil)
+	if err := c.Sign(req); err != nil || req.Header.Get("Authorization") != "Bearer first" {
+		t.Fatalf("expected the first token, got %q (%v)", req.Header.Get("Authorization"), err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for req.Header.Get("Authorization") != "Bearer second" && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+		c.Sign(req)
+	}
+	if req.Header.Get("Authorization") != "Bearer second" {
+		t.Fatalf("expected the token to be fetched again before it expires, got %q", req.Header.Get("Authorization"))
+	}
+
+	// A token that is still valid is kept when a new one can't be fetched
+	fail.Store(true)
+	if err := c.Refresh(); err == nil {
+		t.Errorf("expected the failed token request to be returned")
+	}
+	if err := c.Error(); err != nil {
+		t.Errorf("expected the auth to stay healthy with a valid token, got %v", err)
+	}
+
+	c = &ClientAuth{Type: TypeOAuth2, TokenURL: server.URL, ClientID: "client", ClientSecret: "wrong"}
+	if err := c.Start(zap.NewNop()); err != nil {
+		t.Fatalf("Start() = %v", err)
+	}
+	defer c.Stop()
+	if err := c.Error(); err == nil {
+		t.Errorf("expected the auth to be unhealthy when no token can be fetched")
+	}
+}
@@ -34,7 +34,7 @@ func (ut *UnixTime) UnmarshalJSON(data []byte) error {
 }
 
 type AuthToken struct {
-	Headers    map[string]string `json:"headers`
+	Headers    map[string]string `json:"headers"`
 	Expiration *UnixTime         `json:"exp,omitempty"`
 	Uses       *int64            `json:"uses,omitempty"`
 	Error      string            `json:"error,omitempty"`
@@ -71,6 +71,8 @@ type IAuthClient interface {
 	Error() error
 	// GetToken should take a map of parameters for a token, and return a map of Header -> Value for a session
 	GetToken(map[string]interface{}) (AuthToken, error)
+	// Refresh should try to establish new sessions in place of the ones that are no longer usable
+	Refresh() error
 	// Sign should add headers to the client request such that it would be accepted by the server
 	Sign(*http.Request) error
 	// Stop should end any Goroutines associated with this client. Once an AuthClient is stopped it cannot be started again
@@ -64,6 +64,20 @@ func (mr *MockIAuthClientMockRecorder) GetToken(arg0 interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetToken", reflect.TypeOf((*MockIAuthClient)(nil).GetToken), arg0)
 }
 
+// Refresh mocks base method.
+func (m *MockIAuthClient) Refresh() error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Refresh")
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Refresh indicates an expected call of Refresh.
+func (mr *MockIAuthClientMockRecorder) Refresh() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Refresh", reflect.TypeOf((*MockIAuthClient)(nil).Refresh))
+}
+
 // Sign mocks base method.
 func (m *MockIAuthClient) Sign(arg0 *http.Request) error {
 	m.ctrl.T.Helper()
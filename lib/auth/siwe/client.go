@@ -3,6 +3,7 @@ package siwe
 import (
 	"bytes"
 	"crypto/ecdsa"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -11,9 +12,14 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/DIN-center/din-caddy-plugins/lib/auth"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/crypto"
@@ -29,11 +35,221 @@ type ISIWESignerClient interface {
 
 type SIWESignerClient struct{}
 
+// SigningConfig holds the key used to sign SIWE messages.
+// Key material is referenced in the config rather than stored inline, and is loaded by LoadKey() at provision time.
 type SigningConfig struct {
-	PrivateKey []byte
+	// The hex encoded private key. Placeholders such as {env.DIN_SIGNER_KEY} are replaced when the key is loaded.
+	Secret string `json:"secret,omitempty"`
+	// The path to a file holding the hex encoded private key
+	SecretFile string `json:"secret_file,omitempty"`
+	// The path to an encrypted JSON keystore file (Web3 Secret Storage) holding the private key
+	KeystoreFile string `json:"keystore_file,omitempty"`
+	// The password of the keystore file. Placeholders such as {env.DIN_KEYSTORE_PASSWORD} are replaced when the key is loaded.
+	Password string `json:"password,omitempty"`
+	// The path to a file holding the password of the keystore file
+	PasswordFile string `json:"password_file,omitempty"`
+	// The URL of a remote signer, used when no private key is configured. See remote_signer.go for the protocol.
+	SignerURL string `json:"signer_url,omitempty"`
+	// The bearer token sent to the remote signer. Placeholders are replaced.
+	SignerToken string `json:"signer_token,omitempty"`
+	// The client certificate and key presented to the remote signer, for mTLS
+	SignerCertFile string `json:"signer_cert_file,omitempty"`
+	SignerKeyFile  string `json:"signer_key_file,omitempty"`
+	// The CA certificates the remote signer's certificate is verified against. The system roots are used if not set.
+	SignerCAFile string `json:"signer_ca_file,omitempty"`
+	// The timeout of a request to the remote signer, DefaultSignerTimeout if not set
+	SignerTimeout caddy.Duration `json:"signer_timeout,omitempty"`
+	// The number of times a request to the remote signer is retried on network and server errors, DefaultSignerRetries if not set.
+	// 0 disables the retries.
+	SignerRetries *int `json:"signer_retries,omitempty"`
+	// The address of the signer. Derived from the private key, or asked of the remote signer, if not set.
+	Address string `json:"address,omitempty"`
+
+	// The raw private key, loaded from Secret, SecretFile or KeystoreFile
+	PrivateKey []byte `json:"-"`
 	privateKey *ecdsa.PrivateKey
-	SignerURL  string
-	Address    string
+
+	// Guards the key material and Address, which are replaced when the key is reloaded,
+	// or set on first use when signing with a remote signer
+	mu     sync.Mutex
+	remote *remoteSigner
+}
+
+// LoadKey reads the private key referenced by Secret, SecretFile or KeystoreFile, unless it has already been loaded.
+// Without a private key, it sets up the client of the remote signer at SignerURL.
+func (sc *SigningConfig) LoadKey() error {
+	if sc.hasLocalKey() {
+		return nil
+	}
+	if sc.Secret == "" && sc.SecretFile == "" && sc.KeystoreFile == "" {
+		if sc.SignerURL != "" {
+			_, err := sc.remoteSigner()
+			return err
+		}
+		return nil
+	}
+	key, err := sc.readKey()
+	if err != nil {
+		return err
+	}
+	sc.mu.Lock()
+	sc.PrivateKey = key
+	sc.mu.Unlock()
+	return NewSIWESignerClient().GenPrivKey(sc)
+}
+
+// Reload reads the private key from SecretFile or KeystoreFile again, and replaces the loaded key if it changed,
+// along with the address derived from it. It returns whether the key changed.
+// Keys set inline with Secret, and remote signers, are never reloaded.
+func (sc *SigningConfig) Reload() (bool, error) {
+	if sc.Secret != "" || (sc.SecretFile == "" && sc.KeystoreFile == "") {
+		return false, nil
+	}
+	key, err := sc.readKey()
+	if err != nil {
+		return false, err
+	}
+	privateKey, err := crypto.ToECDSA(key)
+	if err != nil {
+		return false, fmt.Errorf("error converting private key: %w", err)
+	}
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if bytes.Equal(key, sc.PrivateKey) {
+		return false, nil
+	}
+	sc.PrivateKey = key
+	sc.privateKey = privateKey
+	sc.Address = crypto.PubkeyToAddress(privateKey.PublicKey).String()
+	return true, nil
+}
+
+// readKey reads the raw private key referenced by Secret, SecretFile or KeystoreFile
+func (sc *SigningConfig) readKey() ([]byte, error) {
+	repl := caddy.NewReplacer()
+	var hexKey string
+	switch {
+	case sc.Secret != "":
+		hexKey = repl.ReplaceAll(sc.Secret, "")
+	case sc.SecretFile != "":
+		hexKeyBytes, err := os.ReadFile(repl.ReplaceAll(sc.SecretFile, ""))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read secret file: %w", err)
+		}
+		hexKey = string(hexKeyBytes)
+	default:
+		return sc.readKeystore(repl)
+	}
+	key, err := hex.DecodeString(strings.TrimPrefix(strings.TrimSpace(hexKey), "0x"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode secret: %w", err)
+	}
+	if len(key) == 0 {
+		return nil, errors.New("secret is empty")
+	}
+	return key, nil
+}
+
+// readKeystore decrypts the private key in the keystore file with its password
+func (sc *SigningConfig) readKeystore(repl *caddy.Replacer) ([]byte, error) {
+	keyJSON, err := os.ReadFile(repl.ReplaceAll(sc.KeystoreFile, ""))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keystore file: %w", err)
+	}
+	password := repl.ReplaceAll(sc.Password, "")
+	if sc.PasswordFile != "" {
+		passwordBytes, err := os.ReadFile(repl.ReplaceAll(sc.PasswordFile, ""))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read password file: %w", err)
+		}
+		password = strings.TrimRight(string(passwordBytes), "\r\n")
+	}
+	key, err := keystore.DecryptKey(keyJSON, password)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt keystore file: %w", err)
+	}
+	return crypto.FromECDSA(key.PrivateKey), nil
+}
+
+// Validate checks that the signing config holds usable key material
+func (sc *SigningConfig) Validate() error {
+	if len(sc.PrivateKey) == 0 && sc.Secret == "" && sc.SecretFile == "" && sc.KeystoreFile == "" && sc.SignerURL == "" {
+		return errors.New("no key material in signing config")
+	}
+	if sc.KeystoreFile != "" && sc.Password == "" && sc.PasswordFile == "" {
+		return errors.New("keystore_file requires a password or password_file")
+	}
+	if len(sc.PrivateKey) > 0 {
+		if _, err := crypto.ToECDSA(sc.PrivateKey); err != nil {
+			return fmt.Errorf("invalid private key: %w", err)
+		}
+	}
+	if sc.SignerURL != "" {
+		signerURL, err := url.Parse(sc.SignerURL)
+		if err != nil {
+			return fmt.Errorf("invalid signer url: %w", err)
+		}
+		if signerURL.Scheme != "http" && signerURL.Scheme != "https" {
+			return fmt.Errorf("signer url must be http or https, got %s", sc.SignerURL)
+		}
+	}
+	if (sc.SignerCertFile == "") != (sc.SignerKeyFile == "") {
+		return errors.New("signer_cert_file and signer_key_file must be set together")
+	}
+	if sc.SignerTimeout < 0 {
+		return errors.New("signer timeout must not be negative")
+	}
+	if sc.SignerRetries != nil && *sc.SignerRetries < 0 {
+		return errors.New("signer retries must not be negative")
+	}
+	return nil
+}
+
+// hasLocalKey returns whether a private key is loaded
+func (sc *SigningConfig) hasLocalKey() bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.privateKey != nil || len(sc.PrivateKey) > 0
+}
+
+// address returns the address of the signer
+func (sc *SigningConfig) address() string {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.Address
+}
+
+// remoteSigner returns the client of the remote signer, setting it up on first use
+func (sc *SigningConfig) remoteSigner() (*remoteSigner, error) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.remote == nil {
+		remote, err := newRemoteSigner(sc)
+		if err != nil {
+			return nil, err
+		}
+		sc.remote = remote
+	}
+	return sc.remote, nil
+}
+
+// remoteAddress returns the address of the remote signer, asking the signer for it if not configured
+func (sc *SigningConfig) remoteAddress() (string, error) {
+	remote, err := sc.remoteSigner()
+	if err != nil {
+		return "", err
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.Address == "" {
+		address, err := remote.address()
+		if err != nil {
+			return "", fmt.Errorf("error getting remote signer address: %w", err)
+		}
+		sc.Address = address
+	}
+	return sc.Address, nil
 }
 
 func NewSIWESignerClient() *SIWESignerClient {
@@ -41,18 +257,40 @@ func NewSIWESignerClient() *SIWESignerClient {
 }
 
 func (s *SIWESignerClient) Sign(msg string, sc *SigningConfig) ([]byte, error) {
-	if sc.privateKey == nil && len(sc.PrivateKey) > 0 {
-		s.GenPrivKey(sc)
-	}
-	if sc.privateKey != nil {
+	if sc.hasLocalKey() {
+		if err := s.GenPrivKey(sc); err != nil {
+			return nil, err
+		}
+		sc.mu.Lock()
+		privateKey := sc.privateKey
+		sc.mu.Unlock()
 		// Sign Locally
-		return signMessage(msg, sc.privateKey)
+		return signMessage(msg, privateKey)
+	}
+	if sc.SignerURL == "" {
+		return nil, errors.New("private key or signer url must be set in signing config")
 	}
 	// Call signer
-	return nil, errors.New("private key must be set in signing config")
+	address, err := sc.remoteAddress()
+	if err != nil {
+		return nil, err
+	}
+	remote, err := sc.remoteSigner()
+	if err != nil {
+		return nil, err
+	}
+	return remote.sign(msg, address)
 }
 
+// GenPrivKey derives the private key and address of the signing config.
+// Without a private key, the address is asked of the remote signer instead.
 func (s *SIWESignerClient) GenPrivKey(sc *SigningConfig) error {
+	if !sc.hasLocalKey() && sc.SignerURL != "" {
+		_, err := sc.remoteAddress()
+		return err
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
 	if sc.privateKey == nil {
 		privateKey, err := crypto.ToECDSA(sc.PrivateKey)
 		sc.privateKey = privateKey
@@ -91,15 +329,25 @@ func signMessage(message string, privateKey *ecdsa.PrivateKey) ([]byte, error) {
 }
 
 type SIWEClientAuth struct {
-	ProviderURL   string
-	SessionTokens []auth.AuthToken
-	SessionCount  int
-	Signer        *SigningConfig
-	err           error
-	quitCh        chan struct{}
-	client        *http.Client
-	domain        string
-	logger        *zap.Logger
+	// The URL of the provider's auth endpoint
+	ProviderURL string `json:"url"`
+	// The number of sessions to keep open with the provider
+	SessionCount int `json:"sessions"`
+	// The signer for this provider. The din handler's default signer is used if not set.
+	Signer *SigningConfig `json:"signer,omitempty"`
+	// Sign SIWE messages with a nonce issued by the provider at <url>/nonce, rather than one generated locally
+	ServerNonce bool `json:"server_nonce,omitempty"`
+
+	SessionTokens []auth.AuthToken `json:"-"`
+	// Guards SessionTokens, which are replaced by the renewal goroutines while requests are signed, and renewing
+	tokensMu sync.RWMutex
+	// The sessions whose token ran out of uses and are being renewed ahead of their expiration
+	renewing map[int]bool
+	err      error
+	quitCh   chan struct{}
+	client   *http.Client
+	domain   string
+	logger   *zap.Logger
 }
 
 func NewSIWEClient(url string, sessionCount int, signer *SigningConfig) *SIWEClientAuth {
@@ -123,6 +371,33 @@ func NewSIWEClient(url string, sessionCount int, signer *SigningConfig) *SIWECli
 	}
 }
 
+// UseTransport sets the transport sessions are established with, such as one with the TLS settings of the provider.
+// It must be called before Start.
+func (c *SIWEClientAuth) UseTransport(transport http.RoundTripper) {
+	c.client = &http.Client{Transport: transport}
+}
+
+// Validate checks the client configuration, so that errors are reported before Start is called
+func (c *SIWEClientAuth) Validate() error {
+	url, err := url.Parse(c.ProviderURL)
+	if err != nil {
+		return fmt.Errorf("invalid url: %w", err)
+	}
+	if (url.Scheme != "http" && url.Scheme != "https") || url.Host == "" {
+		return fmt.Errorf("url must be an http or https url, got %q", c.ProviderURL)
+	}
+	if c.SessionCount < 1 {
+		return fmt.Errorf("sessions must be at least 1, got %d", c.SessionCount)
+	}
+	if c.Signer == nil {
+		return errors.New("signer must be set")
+	}
+	if err := c.Signer.Validate(); err != nil {
+		return fmt.Errorf("invalid signer: %w", err)
+	}
+	return nil
+}
+
 // Start a series of sessions with the provider. The AuthClient should automatically
 // establish new sessions as they near expiration
 func (c *SIWEClientAuth) Start(logger *zap.Logger) error {
@@ -149,20 +424,23 @@ func (c *SIWEClientAuth) Start(logger *zap.Logger) error {
 	if c.SessionCount == 0 {
 		return errors.New("session count must be > 0")
 	}
+	c.tokensMu.Lock()
 	c.SessionTokens = make([]auth.AuthToken, c.SessionCount)
+	c.tokensMu.Unlock()
 	for i := 0; i < c.SessionCount; i++ {
 		c.logger.Debug("Making session tokens", zap.Int("i", i), zap.Int("of", c.SessionCount))
-		var err error
-		c.SessionTokens[i], err = c.GetToken(nil)
+		token, err := c.GetToken(nil)
 		if err != nil {
 			c.logger.Info("Error establishing session. Will retry in 15 seconds", zap.Int("i", i), zap.String("error", err.Error()))
 			now := auth.UnixTime(time.Now())
-			c.SessionTokens[i].Expiration = &now
+			token.Expiration = &now
+			c.setSessionToken(i, token)
 			c.Renew(i, 15*time.Second)
 			continue
 		}
-		if c.SessionTokens[i].Expiration != nil {
-			c.Renew(i, time.Until(time.Time(*c.SessionTokens[i].Expiration)))
+		c.setSessionToken(i, token)
+		if token.Expiration != nil {
+			c.Renew(i, time.Until(time.Time(*token.Expiration)))
 		}
 	}
 	return nil
@@ -173,17 +451,17 @@ func (c *SIWEClientAuth) Renew(i int, d time.Duration) {
 		t := time.NewTimer(d - (time.Second * 5))
 		select {
 		case <-t.C:
-			var err error
 			c.logger.Debug("Attempting renewal", zap.Int("i", i))
-			c.SessionTokens[i], err = c.GetToken(nil)
+			token, err := c.GetToken(nil)
+			c.setSessionToken(i, token)
 			if err != nil {
 				c.logger.Warn("Error getting token, will try again in 1 minute\n", zap.Int("i", i))
 				c.Renew(i, time.Minute) // Attempt renewal in 1 minute
 				return
 			}
 			c.logger.Debug("Renewal successful", zap.Int("i", i))
-			if c.SessionTokens[i].Expiration != nil {
-				c.Renew(i, time.Until(time.Time(*c.SessionTokens[i].Expiration)))
+			if token.Expiration != nil {
+				c.Renew(i, time.Until(time.Time(*token.Expiration)))
 			}
 		case <-c.quitCh:
 			c.err = auth.ErrSessionClosed
@@ -197,6 +475,8 @@ func (c *SIWEClientAuth) Error() error {
 	if c.err != nil {
 		return c.err
 	}
+	c.tokensMu.RLock()
+	defer c.tokensMu.RUnlock()
 	for _, token := range c.SessionTokens {
 		if err := token.Peek(); err == nil {
 			// If any token is non-nil, this client is okay
@@ -206,6 +486,70 @@ func (c *SIWEClientAuth) Error() error {
 	return auth.ErrNoTokensAvailable
 }
 
+// Refresh tries to establish new sessions in place of the ones that are expired or used up.
+// The renewal of each session carries on as scheduled, a refreshed session is only usable sooner.
+// It returns an error if no session could be refreshed while none is usable.
+func (c *SIWEClientAuth) Refresh() error {
+	c.tokensMu.RLock()
+	stale := make([]int, 0, len(c.SessionTokens))
+	for i, token := range c.SessionTokens {
+		if err := token.Peek(); err != nil {
+			stale = append(stale, i)
+		}
+	}
+	c.tokensMu.RUnlock()
+
+	var lastErr error
+	for _, i := range stale {
+		token, err := c.GetToken(nil)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		c.setSessionToken(i, token)
+	}
+	if err := c.Error(); err != nil {
+		if lastErr != nil {
+			return fmt.Errorf("%w: %v", err, lastErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// Rotate establishes every session again, after the key of the signer changed.
+// A session keeps its current token if it can't be established again, as the token stays valid until it expires.
+func (c *SIWEClientAuth) Rotate() error {
+	c.tokensMu.RLock()
+	sessionCount := len(c.SessionTokens)
+	c.tokensMu.RUnlock()
+
+	var failed int
+	var lastErr error
+	for i := 0; i < sessionCount; i++ {
+		token, err := c.GetToken(nil)
+		if err != nil {
+			failed++
+			lastErr = err
+			continue
+		}
+		c.setSessionToken(i, token)
+	}
+	if lastErr != nil {
+		return fmt.Errorf("%d of %d sessions not established with the new key: %w", failed, sessionCount, lastErr)
+	}
+	return nil
+}
+
+// setSessionToken replaces the token of a session
+func (c *SIWEClientAuth) setSessionToken(i int, token auth.AuthToken) {
+	c.tokensMu.Lock()
+	defer c.tokensMu.Unlock()
+	if i < len(c.SessionTokens) {
+		c.SessionTokens[i] = token
+	}
+}
+
 type signedMessage struct {
 	Message   string        `json:"msg"`
 	Signature hexutil.Bytes `json:"sig"`
@@ -222,7 +566,13 @@ func (c *SIWEClientAuth) GetToken(map[string]interface{}) (auth.AuthToken, error
 		return auth.AuthToken{}, err
 	}
 
-	msg, err := siwe.InitMessage(c.domain, c.Signer.Address, c.ProviderURL, siwe.GenerateNonce(), options)
+	nonce := siwe.GenerateNonce()
+	if c.ServerNonce {
+		if nonce, err = c.fetchNonce(); err != nil {
+			return auth.AuthToken{}, err
+		}
+	}
+	msg, err := siwe.InitMessage(c.domain, c.Signer.address(), c.ProviderURL, nonce, options)
 	if err != nil {
 		return auth.AuthToken{}, err
 	}
@@ -258,16 +608,37 @@ func (c *SIWEClientAuth) GetToken(map[string]interface{}) (auth.AuthToken, error
 	return tok, err
 }
 
-// Sign should add headers to the client request such that it would be accepted by the server
+// fetchNonce returns a nonce issued by the provider for the SIWE message of a new session
+func (c *SIWEClientAuth) fetchNonce() (string, error) {
+	r, err := c.client.Get(strings.TrimSuffix(c.ProviderURL, "/") + "/nonce")
+	if err != nil {
+		return "", err
+	}
+	defer r.Body.Close()
+	var res nonceResponse
+	if err := json.NewDecoder(r.Body).Decode(&res); err != nil {
+		return "", fmt.Errorf("error decoding nonce response: %w", err)
+	}
+	if r.StatusCode != http.StatusOK || res.Nonce == "" {
+		return "", fmt.Errorf("provider returned no nonce, status code %d", r.StatusCode)
+	}
+	return res.Nonce, nil
+}
+
+// Sign should add headers to the client request such that it would be accepted by the server.
+// A session whose token has run out of uses is renewed right away, and the request signed with the next session.
 func (c *SIWEClientAuth) Sign(r *http.Request) error {
-	at := c.selectAuthToken(r)
+	i, at := c.selectAuthToken(r, 0)
 	counter := 0
 	for err := at.Use(); err != nil; err = at.Use() {
+		if err == auth.ErrRequestLimit {
+			c.renewExhausted(i)
+		}
 		if counter == 10 {
 			return err
 		}
 		counter++
-		at = c.selectAuthToken(r)
+		i, at = c.selectAuthToken(r, counter)
 	}
 	for k, v := range at.Headers {
 		r.Header.Set(k, v)
@@ -275,6 +646,32 @@ func (c *SIWEClientAuth) Sign(r *http.Request) error {
 	return nil
 }
 
+// renewExhausted replaces the token of a session that has run out of uses, unless it is already being replaced.
+// The renewal scheduled for the expiration of the old token still runs, and keeps the session renewed from then on.
+func (c *SIWEClientAuth) renewExhausted(i int) {
+	c.tokensMu.Lock()
+	defer c.tokensMu.Unlock()
+	if c.renewing[i] {
+		return
+	}
+	if c.renewing == nil {
+		c.renewing = make(map[int]bool)
+	}
+	c.renewing[i] = true
+	go func() {
+		c.logger.Debug("Renewing exhausted session", zap.Int("i", i))
+		token, err := c.GetToken(nil)
+		if err != nil {
+			c.logger.Warn("Error renewing exhausted session", zap.Int("i", i), zap.String("error", err.Error()))
+		} else {
+			c.setSessionToken(i, token)
+		}
+		c.tokensMu.Lock()
+		delete(c.renewing, i)
+		c.tokensMu.Unlock()
+	}()
+}
+
 func hashStringToIndex(s string, listSize int) int {
 	hasher := fnv.New32a()        // Initialize a new 32-bit FNV-1a hash
 	hasher.Write([]byte(s))       // Hash the string
@@ -283,11 +680,17 @@ func hashStringToIndex(s string, listSize int) int {
 	return index
 }
 
-func (c *SIWEClientAuth) selectAuthToken(r *http.Request) auth.AuthToken {
+// selectAuthToken returns the session a request is signed with, and its token. Each attempt moves on to the next
+// session, so that a request isn't held up by a session that can't be used.
+func (c *SIWEClientAuth) selectAuthToken(r *http.Request, attempt int) (int, auth.AuthToken) {
+	c.tokensMu.RLock()
+	defer c.tokensMu.RUnlock()
+	i := 0
 	if sessionId := r.Header.Get("Din-Session-Id"); sessionId != "" {
-		return c.SessionTokens[hashStringToIndex(sessionId, c.SessionCount)]
+		i = hashStringToIndex(sessionId, c.SessionCount)
 	}
-	return c.SessionTokens[0]
+	i = (i + attempt) % len(c.SessionTokens)
+	return i, c.SessionTokens[i]
 }
 
 // Stop should end any Goroutines associated with this client. Once an AuthClient is stopped it cannot be started again
@@ -1,11 +1,18 @@
 package siwe
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/ethereum/go-ethereum/accounts/keystore"
 	"github.com/ethereum/go-ethereum/crypto"
 	"go.uber.org/zap"
 	// "github.com/DIN-center/din-caddy-plugins/auth"
@@ -40,7 +47,7 @@ func TestClientBasic(t *testing.T) {
 	}
 	req := httptest.NewRequest("GET", "/", nil)
 	req.Header.Add("Din-Session-Id", "foo")
-	at := client.selectAuthToken(req)
+	_, at := client.selectAuthToken(req, 0)
 	if at.Headers == nil {
 		t.Errorf("Auth token should have non-nil headers")
 	}
@@ -51,3 +58,212 @@ func TestClientBasic(t *testing.T) {
 		t.Errorf("Expected x-api-key header to be set")
 	}
 }
+
+func TestSigningConfigLoadKey(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	hexKey := fmt.Sprintf("%x", crypto.FromECDSA(key))
+	address := crypto.PubkeyToAddress(key.PublicKey).String()
+
+	keyFile := filepath.Join(t.TempDir(), "din-secret-key")
+	if err := os.WriteFile(keyFile, []byte("0x"+hexKey+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("DIN_SIGNER_TEST_KEY", hexKey)
+
+	ks := keystore.NewKeyStore(t.TempDir(), keystore.LightScryptN, keystore.LightScryptP)
+	account, err := ks.ImportECDSA(key, "keystore-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	passwordFile := filepath.Join(t.TempDir(), "din-keystore-password")
+	if err := os.WriteFile(passwordFile, []byte("keystore-password\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("DIN_KEYSTORE_TEST_PASSWORD", "keystore-password")
+
+	tests := []struct {
+		name   string
+		signer *SigningConfig
+		hasErr bool
+	}{
+		{name: "inline secret", signer: &SigningConfig{Secret: hexKey}},
+		{name: "secret placeholder", signer: &SigningConfig{Secret: "{env.DIN_SIGNER_TEST_KEY}"}},
+		{name: "secret file", signer: &SigningConfig{SecretFile: keyFile}},
+		{name: "invalid secret", signer: &SigningConfig{Secret: "not-hex"}, hasErr: true},
+		{name: "missing secret file", signer: &SigningConfig{SecretFile: filepath.Join(t.TempDir(), "missing")}, hasErr: true},
+		{name: "keystore with password file", signer: &SigningConfig{KeystoreFile: account.URL.Path, PasswordFile: passwordFile}},
+		{name: "keystore with password placeholder", signer: &SigningConfig{KeystoreFile: account.URL.Path, Password: "{env.DIN_KEYSTORE_TEST_PASSWORD}"}},
+		{name: "keystore without password", signer: &SigningConfig{KeystoreFile: account.URL.Path}, hasErr: true},
+		{name: "keystore with wrong password", signer: &SigningConfig{KeystoreFile: account.URL.Path, Password: "wrong"}, hasErr: true},
+		{name: "missing password file", signer: &SigningConfig{KeystoreFile: account.URL.Path, PasswordFile: filepath.Join(t.TempDir(), "missing")}, hasErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.signer.LoadKey()
+			if (err != nil) != tt.hasErr {
+				t.Fatalf("LoadKey() = %v, want error %v", err, tt.hasErr)
+			}
+			if !tt.hasErr && tt.signer.Address != address {
+				t.Errorf("expected address %v, got %v", address, tt.signer.Address)
+			}
+		})
+	}
+}
+
+func TestSigningConfigReload(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	keyFile := filepath.Join(t.TempDir(), "din-secret-key")
+	if err := os.WriteFile(keyFile, []byte(fmt.Sprintf("%x", crypto.FromECDSA(key))), 0600); err != nil {
+		t.Fatal(err)
+	}
+	signer := &SigningConfig{SecretFile: keyFile}
+	if err := signer.LoadKey(); err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := signer.Reload(); changed || err != nil {
+		t.Errorf("Reload() = %v, %v, want no change", changed, err)
+	}
+
+	rotated, _ := crypto.GenerateKey()
+	if err := os.WriteFile(keyFile, []byte(fmt.Sprintf("%x", crypto.FromECDSA(rotated))), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := signer.Reload(); !changed || err != nil {
+		t.Errorf("Reload() = %v, %v, want a change", changed, err)
+	}
+	if address := crypto.PubkeyToAddress(rotated.PublicKey).String(); signer.Address != address {
+		t.Errorf("expected address %v after the reload, got %v", address, signer.Address)
+	}
+
+	// A key file that can't be read leaves the loaded key in place
+	if err := os.WriteFile(keyFile, []byte("not-hex"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := signer.Reload(); err == nil {
+		t.Errorf("expected an error reloading an invalid key")
+	}
+	if address := crypto.PubkeyToAddress(rotated.PublicKey).String(); signer.Address != address {
+		t.Errorf("expected address %v to be kept, got %v", address, signer.Address)
+	}
+
+	inline := &SigningConfig{Secret: fmt.Sprintf("%x", crypto.FromECDSA(key))}
+	if err := inline.LoadKey(); err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := inline.Reload(); changed || err != nil {
+		t.Errorf("Reload() = %v, %v, want inline secrets never reloaded", changed, err)
+	}
+}
+
+func TestClientRefresh(t *testing.T) {
+	var available atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !available.Load() {
+			w.Write([]byte(`{"error": "auth unavailable"}`))
+			return
+		}
+		w.Write([]byte(`{"headers": {"x-api-key": "refreshed"}}`))
+	}))
+	defer server.Close()
+	key, _ := crypto.GenerateKey()
+	signer := &SigningConfig{PrivateKey: crypto.FromECDSA(key)}
+	client := NewSIWEClient(server.URL+"/auth", 2, signer)
+	if err := client.Start(zap.NewNop()); err != nil {
+		t.Fatal(err)
+	}
+	if client.Error() == nil {
+		t.Fatalf("Expected no usable session before the auth endpoint is available")
+	}
+	if err := client.Refresh(); err == nil {
+		t.Fatalf("Expected refresh to fail while the auth endpoint is unavailable")
+	}
+
+	available.Store(true)
+	if err := client.Refresh(); err != nil {
+		t.Fatalf("error refreshing sessions: %v", err)
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	if err := client.Sign(req); err != nil {
+		t.Fatalf("error signing request: %v", err)
+	}
+	if req.Header.Get("x-api-key") != "refreshed" {
+		t.Errorf("Expected x-api-key header to be set by the refreshed session")
+	}
+}
+
+func TestClientRenewsExhaustedSession(t *testing.T) {
+	var issued atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(fmt.Sprintf(`{"headers": {"x-api-key": "%d"}, "uses": 1}`, issued.Add(1))))
+	}))
+	defer server.Close()
+	key, _ := crypto.GenerateKey()
+	client := NewSIWEClient(server.URL+"/auth", 1, &SigningConfig{PrivateKey: crypto.FromECDSA(key)})
+	if err := client.Start(zap.NewNop()); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	if err := client.Sign(req); err != nil {
+		t.Fatalf("error signing request: %v", err)
+	}
+	if req.Header.Get("x-api-key") != "1" {
+		t.Errorf("Expected the request to be signed with the first token, got %q", req.Header.Get("x-api-key"))
+	}
+	// The token is used up, so the session is renewed
+	client.Sign(httptest.NewRequest("GET", "/", nil))
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		req = httptest.NewRequest("GET", "/", nil)
+		if err := client.Sign(req); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the exhausted session to be renewed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if req.Header.Get("x-api-key") != "2" {
+		t.Errorf("Expected the request to be signed with the renewed token, got %q", req.Header.Get("x-api-key"))
+	}
+	if n := issued.Load(); n != 2 {
+		t.Errorf("Expected a single renewal, got %d tokens issued", n)
+	}
+}
+
+func TestClientUseTransport(t *testing.T) {
+	dir := t.TempDir()
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(writeClientCertificate(t, dir))
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"headers": {"x-api-key": "session"}}`))
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	server.StartTLS()
+	defer server.Close()
+
+	key, _ := crypto.GenerateKey()
+	signer := &SigningConfig{PrivateKey: crypto.FromECDSA(key)}
+	NewSIWESignerClient().GenPrivKey(signer)
+	client := NewSIWEClient(server.URL+"/auth", 1, signer)
+	client.domain = "127.0.0.1"
+	if _, err := client.GetToken(nil); err == nil {
+		t.Errorf("expected sessions to fail without the TLS settings of the provider")
+	}
+
+	cert, err := tls.LoadX509KeyPair(filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(server.Certificate())
+	client.UseTransport(&http.Transport{TLSClientConfig: &tls.Config{Certificates: []tls.Certificate{cert}, RootCAs: rootCAs}})
+	token, err := client.GetToken(nil)
+	if err != nil {
+		t.Fatalf("expected a session with the client certificate, got %v", err)
+	}
+	if token.Headers["x-api-key"] != "session" {
+		t.Errorf("unexpected session headers %v", token.Headers)
+	}
+}
@@ -0,0 +1,157 @@
+package siwe
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Session token signing algorithms
+const (
+	// Tokens are signed with a secret shared by every node that verifies them
+	AlgorithmHS256 = "HS256"
+	// Tokens are signed with a P-256 private key, and verified with the public key published at JWKSPath
+	AlgorithmES256 = "ES256"
+	// Tokens are signed with an Ed25519 private key, and verified with the public key published at JWKSPath
+	AlgorithmEdDSA = "EdDSA"
+
+	// The path the public keys session tokens are verified with are published at, for ES256 and EdDSA
+	JWKSPath = "/.well-known/jwks.json"
+)
+
+// jwk is a public key in the JSON Web Key format (RFC 7517)
+type jwk struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y,omitempty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+}
+
+// jwks is a JSON Web Key Set
+type jwks struct {
+	Keys []jwk `json:"keys"`
+}
+
+// newPrivateKeySessionKey returns the session key of a PEM encoded private key for the ES256 or EdDSA algorithm.
+// The kid is derived from the public key.
+func newPrivateKeySessionKey(pemBytes []byte, algorithm string) (sessionKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return sessionKey{}, errors.New("no PEM encoded private key found")
+	}
+	privateKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		ecKey, ecErr := x509.ParseECPrivateKey(block.Bytes)
+		if ecErr != nil {
+			return sessionKey{}, fmt.Errorf("failed to parse private key: %w", err)
+		}
+		privateKey = ecKey
+	}
+	return asymmetricSessionKey(privateKey, algorithm)
+}
+
+// generatePrivateKeySessionKey returns the session key of a random private key for the ES256 or EdDSA algorithm
+func generatePrivateKeySessionKey(algorithm string) (sessionKey, error) {
+	var privateKey interface{}
+	var err error
+	switch algorithm {
+	case AlgorithmES256:
+		privateKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case AlgorithmEdDSA:
+		_, privateKey, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return sessionKey{}, fmt.Errorf("unsupported algorithm %q", algorithm)
+	}
+	if err != nil {
+		return sessionKey{}, err
+	}
+	return asymmetricSessionKey(privateKey, algorithm)
+}
+
+// asymmetricSessionKey returns the session key of the private key, which must suit the algorithm
+func asymmetricSessionKey(privateKey interface{}, algorithm string) (sessionKey, error) {
+	var method jwt.SigningMethod
+	var publicKey interface{}
+	switch key := privateKey.(type) {
+	case *ecdsa.PrivateKey:
+		if algorithm != AlgorithmES256 || key.Curve != elliptic.P256() {
+			return sessionKey{}, fmt.Errorf("a %s private key is not usable for %s", key.Curve.Params().Name, algorithm)
+		}
+		method, publicKey = jwt.SigningMethodES256, &key.PublicKey
+	case ed25519.PrivateKey:
+		if algorithm != AlgorithmEdDSA {
+			return sessionKey{}, fmt.Errorf("an Ed25519 private key is not usable for %s", algorithm)
+		}
+		method, publicKey = jwt.SigningMethodEdDSA, key.Public()
+	default:
+		return sessionKey{}, fmt.Errorf("unsupported private key type %T", privateKey)
+	}
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return sessionKey{}, err
+	}
+	return sessionKey{kid: keyID(der), method: method, signingKey: privateKey, verificationKey: publicKey}, nil
+}
+
+// jwk returns the public key of the session key as a JSON Web Key, or false for HS256 keys, which have none
+func (k sessionKey) jwk() (jwk, bool) {
+	encode := base64.RawURLEncoding.EncodeToString
+	switch key := k.verificationKey.(type) {
+	case *ecdsa.PublicKey:
+		// Coordinates are padded to the size of the curve (RFC 7518 section 6.2.1.2)
+		size := (key.Curve.Params().BitSize + 7) / 8
+		return jwk{
+			Kty: "EC",
+			Crv: key.Curve.Params().Name,
+			X:   encode(key.X.FillBytes(make([]byte, size))),
+			Y:   encode(key.Y.FillBytes(make([]byte, size))),
+			Kid: k.kid,
+			Alg: k.method.Alg(),
+			Use: "sig",
+		}, true
+	case ed25519.PublicKey:
+		return jwk{Kty: "OKP", Crv: "Ed25519", X: encode(key), Kid: k.kid, Alg: k.method.Alg(), Use: "sig"}, true
+	default:
+		return jwk{}, false
+	}
+}
+
+// serveJWKS writes the public keys of the session keys whose tokens are still accepted, so that token verifiers
+// pick up a rotated key while the tokens signed with the previous one are still valid
+func (d *SIWEAuthMiddleware) serveJWKS(rw http.ResponseWriter) error {
+	set := jwks{Keys: []jwk{}}
+	for _, key := range d.keys.accepted(time.Now()) {
+		if k, ok := key.jwk(); ok {
+			set.Keys = append(set.Keys, k)
+		}
+	}
+	if len(set.Keys) == 0 {
+		err := errors.New("session tokens are not signed with a public key algorithm")
+		handleError(err, rw, http.StatusNotFound)
+		return nil
+	}
+	data, err := json.Marshal(set)
+	if err != nil {
+		handleError(err, rw, http.StatusInternalServerError)
+		return err
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "max-age=300")
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(data)
+	return nil
+}
@@ -0,0 +1,271 @@
+package siwe
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// The period quotas are counted over, unless set
+const DefaultQuotaPeriod = 24 * time.Hour
+
+var (
+	ErrRateLimited   = errors.New("rate limit exceeded")
+	ErrQuotaExceeded = errors.New("quota exceeded")
+)
+
+// The results of the requests din_auth authenticated, as metered by signer address
+const (
+	resultAllowed         = "allowed"
+	resultForbidden       = "forbidden"
+	resultBudgetExhausted = "budget_exhausted"
+	resultRateLimited     = "rate_limited"
+	resultQuotaExceeded   = "quota_exceeded"
+)
+
+// The method label of the metered calls to methods that aren't metered by name
+const otherMethod = "other"
+
+// DefaultMeteredMethods are the JSON-RPC methods the authenticated calls are metered by, along with the methods set in
+// metered_methods and the methods of the token policies. The method of a call is chosen by the client, so the calls
+// to any other method are metered as "other" to keep the number of series bounded.
+var DefaultMeteredMethods = []string{
+	"eth_accounts", "eth_blobBaseFee", "eth_blockNumber", "eth_call", "eth_chainId", "eth_createAccessList",
+	"eth_estimateGas", "eth_feeHistory", "eth_gasPrice", "eth_getBalance", "eth_getBlockByHash", "eth_getBlockByNumber",
+	"eth_getBlockReceipts", "eth_getBlockTransactionCountByHash", "eth_getBlockTransactionCountByNumber", "eth_getCode",
+	"eth_getFilterChanges", "eth_getFilterLogs", "eth_getLogs", "eth_getProof", "eth_getStorageAt",
+	"eth_getTransactionByBlockHashAndIndex", "eth_getTransactionByBlockNumberAndIndex", "eth_getTransactionByHash",
+	"eth_getTransactionCount", "eth_getTransactionReceipt", "eth_getUncleByBlockHashAndIndex",
+	"eth_getUncleByBlockNumberAndIndex", "eth_getUncleCountByBlockHash", "eth_getUncleCountByBlockNumber",
+	"eth_maxPriorityFeePerGas", "eth_newBlockFilter", "eth_newFilter", "eth_newPendingTransactionFilter",
+	"eth_sendRawTransaction", "eth_subscribe", "eth_syncing", "eth_uninstallFilter", "eth_unsubscribe",
+	"net_listening", "net_peerCount", "net_version", "web3_clientVersion", "web3_sha3",
+}
+
+// AddressLimit limits the requests of a signer, across all of its sessions
+type AddressLimit struct {
+	// The sustained number of requests per second. Unlimited if not set.
+	Rate float64 `json:"rate,omitempty"`
+	// The number of requests that may be made at once, above the rate. The rate rounded up if not set.
+	Burst int `json:"burst,omitempty"`
+	// The number of JSON-RPC calls per quota period, each call of a batch counting. Unlimited if not set.
+	Quota int64 `json:"quota,omitempty"`
+	// The period the quota is counted over, from the first call after the previous period ended.
+	// DefaultQuotaPeriod if not set.
+	QuotaPeriod caddy.Duration `json:"quota_period,omitempty"`
+}
+
+func (l *AddressLimit) validate() error {
+	if l.Rate < 0 || math.IsInf(l.Rate, 0) || math.IsNaN(l.Rate) {
+		return fmt.Errorf("rate must be a positive number, got %v", l.Rate)
+	}
+	if l.Burst < 0 {
+		return fmt.Errorf("burst must not be negative, got %d", l.Burst)
+	}
+	if l.Quota < 0 {
+		return fmt.Errorf("quota must not be negative, got %d", l.Quota)
+	}
+	if l.QuotaPeriod < 0 {
+		return fmt.Errorf("quota_period must not be negative, got %s", time.Duration(l.QuotaPeriod))
+	}
+	return nil
+}
+
+func (l *AddressLimit) burst() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+	return math.Ceil(l.Rate)
+}
+
+func (l *AddressLimit) quotaPeriod() time.Duration {
+	if l.QuotaPeriod == 0 {
+		return DefaultQuotaPeriod
+	}
+	return time.Duration(l.QuotaPeriod)
+}
+
+// meteredMethodSet returns the methods the authenticated calls are metered by
+func (d *SIWEAuthMiddleware) meteredMethodSet() map[string]struct{} {
+	methods := make(map[string]struct{}, len(DefaultMeteredMethods)+len(d.MeteredMethods))
+	add := func(names []string) {
+		for _, name := range names {
+			methods[name] = struct{}{}
+		}
+	}
+	add(DefaultMeteredMethods)
+	add(d.MeteredMethods)
+	if d.DefaultPolicy != nil {
+		add(d.DefaultPolicy.Methods)
+	}
+	for _, policy := range d.Policies {
+		add(policy.Methods)
+	}
+	return methods
+}
+
+// methodLabels returns the methods of the calls of a request as they are metered, with the methods that aren't
+// metered by name replaced by "other"
+func (d *SIWEAuthMiddleware) methodLabels(methods []string) []string {
+	labels := make([]string, len(methods))
+	for i, method := range methods {
+		if _, ok := d.meteredMethods[method]; ok {
+			labels[i] = method
+		} else {
+			labels[i] = otherMethod
+		}
+	}
+	return labels
+}
+
+// limitFor returns the limit of the signer, its own if set or else the default limit
+func (d *SIWEAuthMiddleware) limitFor(address string) *AddressLimit {
+	if limit, ok := d.Limits[address]; ok {
+		return limit
+	}
+	return d.DefaultLimit
+}
+
+// addressLimiter tracks the request rate and quota use of each signer
+type addressLimiter struct {
+	mu    sync.Mutex
+	state map[string]*limitState
+	// The idle signers are swept at most once every SecretReloadInterval
+	lastSweep time.Time
+}
+
+type limitState struct {
+	// The token bucket of the rate limit
+	tokens float64
+	last   time.Time
+	// The calls counted against the quota in the current period
+	used        int64
+	periodStart time.Time
+	// The state can be dropped after then, as the bucket is full again and the quota period has ended
+	idleAfter time.Time
+}
+
+func newAddressLimiter() *addressLimiter {
+	return &addressLimiter{state: make(map[string]*limitState)}
+}
+
+// allow counts a request of the signer with the number of JSON-RPC calls in it against its limit.
+// A rejected request isn't counted, and the time to wait before retrying is returned with the error.
+func (a *addressLimiter) allow(address string, limit *AddressLimit, calls int, now time.Time) (time.Duration, error) {
+	if limit == nil || (limit.Rate == 0 && limit.Quota == 0) {
+		return 0, nil
+	}
+	if calls < 1 {
+		calls = 1
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if now.Sub(a.lastSweep) >= SecretReloadInterval {
+		a.lastSweep = now
+		for address, state := range a.state {
+			if now.After(state.idleAfter) {
+				delete(a.state, address)
+			}
+		}
+	}
+	state, ok := a.state[address]
+	if !ok {
+		state = &limitState{tokens: limit.burst(), last: now, periodStart: now}
+		a.state[address] = state
+	}
+
+	if limit.Rate > 0 {
+		state.tokens = math.Min(limit.burst(), state.tokens+now.Sub(state.last).Seconds()*limit.Rate)
+		state.last = now
+		if state.tokens < 1 {
+			return time.Duration((1 - state.tokens) / limit.Rate * float64(time.Second)), ErrRateLimited
+		}
+	}
+	period := limit.quotaPeriod()
+	if limit.Quota > 0 {
+		if !now.Before(state.periodStart.Add(period)) {
+			state.used, state.periodStart = 0, now
+		}
+		if state.used+int64(calls) > limit.Quota {
+			return state.periodStart.Add(period).Sub(now), ErrQuotaExceeded
+		}
+		state.used += int64(calls)
+	}
+	if limit.Rate > 0 {
+		state.tokens--
+	}
+
+	state.idleAfter = state.periodStart.Add(period)
+	if limit.Rate > 0 {
+		if refilled := now.Add(time.Duration((limit.burst() - state.tokens) / limit.Rate * float64(time.Second))); refilled.After(state.idleAfter) {
+			state.idleAfter = refilled
+		}
+	}
+	return 0, nil
+}
+
+// retryAfter formats the time to wait before retrying for the Retry-After header, in whole seconds
+func retryAfter(wait time.Duration) string {
+	return strconv.FormatInt(int64(math.Ceil(wait.Seconds())), 10)
+}
+
+// parseAddressLimit parses a limit block of the din_auth directive:
+//
+//	limit <address|default> {
+//		rate 10
+//		burst 20
+//		quota 1000000
+//		quota_period 24h
+//	}
+func parseAddressLimit(dispenser *caddyfile.Dispenser) (*AddressLimit, error) {
+	limit := &AddressLimit{}
+	for nesting := dispenser.Nesting(); dispenser.NextBlock(nesting); {
+		switch dispenser.Val() {
+		case "rate":
+			if !dispenser.NextArg() {
+				return nil, dispenser.ArgErr()
+			}
+			rate, err := strconv.ParseFloat(dispenser.Val(), 64)
+			if err != nil {
+				return nil, dispenser.Errf("invalid rate: %v", err)
+			}
+			limit.Rate = rate
+		case "burst":
+			if !dispenser.NextArg() {
+				return nil, dispenser.ArgErr()
+			}
+			burst, err := strconv.Atoi(dispenser.Val())
+			if err != nil {
+				return nil, dispenser.Errf("invalid burst: %v", err)
+			}
+			limit.Burst = burst
+		case "quota":
+			if !dispenser.NextArg() {
+				return nil, dispenser.ArgErr()
+			}
+			quota, err := strconv.ParseInt(dispenser.Val(), 10, 64)
+			if err != nil {
+				return nil, dispenser.Errf("invalid quota: %v", err)
+			}
+			limit.Quota = quota
+		case "quota_period":
+			if !dispenser.NextArg() {
+				return nil, dispenser.ArgErr()
+			}
+			period, err := caddy.ParseDuration(dispenser.Val())
+			if err != nil {
+				return nil, dispenser.Errf("invalid quota_period: %v", err)
+			}
+			limit.QuotaPeriod = caddy.Duration(period)
+		default:
+			return nil, dispenser.Errf("unknown limit option: %s", dispenser.Val())
+		}
+	}
+	return limit, nil
+}
@@ -0,0 +1,192 @@
+package siwe
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	prom "github.com/DIN-center/din-caddy-plugins/lib/prometheus"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+)
+
+func TestAddressLimiter(t *testing.T) {
+	address := "0x0000000000000000000000000000000000000001"
+	now := time.Now()
+	limiter := newAddressLimiter()
+
+	rate := &AddressLimit{Rate: 1, Burst: 2}
+	for i := 0; i < 2; i++ {
+		if _, err := limiter.allow(address, rate, 1, now); err != nil {
+			t.Errorf("expected request %d within the burst to be allowed, got %v", i, err)
+		}
+	}
+	if wait, err := limiter.allow(address, rate, 1, now); err != ErrRateLimited || wait != time.Second {
+		t.Errorf("expected the request over the burst to wait 1s, got %v, %v", wait, err)
+	}
+	if _, err := limiter.allow(address, rate, 1, now.Add(time.Second)); err != nil {
+		t.Errorf("expected a request to be allowed once the bucket refilled, got %v", err)
+	}
+
+	quota := &AddressLimit{Quota: 3, QuotaPeriod: caddy.Duration(time.Hour)}
+	other := "0x0000000000000000000000000000000000000002"
+	if _, err := limiter.allow(other, quota, 2, now); err != nil {
+		t.Errorf("expected calls within the quota to be allowed, got %v", err)
+	}
+	if wait, err := limiter.allow(other, quota, 2, now.Add(time.Minute)); err != ErrQuotaExceeded || wait != 59*time.Minute {
+		t.Errorf("expected a batch over the quota to wait for the next period, got %v, %v", wait, err)
+	}
+	if _, err := limiter.allow(other, quota, 1, now.Add(time.Minute)); err != nil {
+		t.Errorf("expected a rejected batch not to count against the quota, got %v", err)
+	}
+	if _, err := limiter.allow(other, quota, 1, now.Add(2*time.Minute)); err != ErrQuotaExceeded {
+		t.Errorf("expected the quota to be used up, got %v", err)
+	}
+	if _, err := limiter.allow(other, quota, 3, now.Add(time.Hour)); err != nil {
+		t.Errorf("expected the quota to be reset for the next period, got %v", err)
+	}
+
+	if _, err := limiter.allow(address, nil, 1, now); err != nil {
+		t.Errorf("expected a signer without a limit to be allowed, got %v", err)
+	}
+	// Signers are forgotten once their bucket is full and their quota period has ended
+	limiter.allow(address, rate, 1, now.Add(3*time.Hour))
+	if _, ok := limiter.state[other]; ok {
+		t.Errorf("expected the idle signer to be swept")
+	}
+}
+
+func TestSIWEAuthMiddlewareLimits(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	address := crypto.PubkeyToAddress(key.PublicKey).String()
+	middleware := &SIWEAuthMiddleware{
+		Secret:    "secret",
+		Whitelist: map[string]struct{}{address: {}},
+		Limits:    map[string]*AddressLimit{strings.ToLower(address): {Quota: 2}},
+	}
+	if err := middleware.Provision(caddy.Context{}); err != nil {
+		t.Fatalf("Provision() = %v", err)
+	}
+	defer middleware.Cleanup()
+	if err := middleware.Validate(); err != nil {
+		t.Fatalf("Validate() = %v", err)
+	}
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.WriteHeader(http.StatusOK)
+		return nil
+	})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		middleware.ServeHTTP(w, r, next)
+	}))
+	defer server.Close()
+
+	client := NewSIWEClient(server.URL+"/auth", 1, &SigningConfig{PrivateKey: crypto.FromECDSA(key)})
+	if err := client.Start(zap.NewNop()); err != nil {
+		t.Fatal(err)
+	}
+	post := func(body string) *http.Response {
+		req, _ := http.NewRequest(http.MethodPost, server.URL+"/eth", strings.NewReader(body))
+		req.Header.Set("x-api-key", client.SessionTokens[0].Headers["x-api-key"])
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	count := func(method string, result string) float64 {
+		return testutil.ToFloat64(prom.DinAuthRequestCount.WithLabelValues("eth", address, method, result, prom.MachineID()))
+	}
+
+	res := post(`{"method":"eth_blockNumber"}`)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected a request within the quota to be allowed, got %d", res.StatusCode)
+	}
+	res = post(`[{"method":"eth_blockNumber"},{"method":"eth_chainId"}]`)
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected a batch over the quota to be rejected, got %d", res.StatusCode)
+	}
+	var body struct {
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil || body.Error != ErrQuotaExceeded.Error() {
+		t.Errorf("expected a JSON error body, got %q, %v", body.Error, err)
+	}
+	if res.Header.Get("Retry-After") == "" {
+		t.Errorf("expected a Retry-After header")
+	}
+
+	if c := count("eth_blockNumber", resultAllowed); c != 1 {
+		t.Errorf("expected 1 allowed eth_blockNumber call, got %v", c)
+	}
+	if c := count("eth_blockNumber", resultQuotaExceeded) + count("eth_chainId", resultQuotaExceeded); c != 2 {
+		t.Errorf("expected the 2 calls of the rejected batch to be counted, got %v", c)
+	}
+}
+
+func TestSIWEAuthMiddlewareCaddyfileLimit(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`din_auth {
+		whitelist 0x9Ab1a6D2B5F4b87F5d0b5D3E1c0B6f2fA4A7c9E1
+		limit default {
+			rate 10
+		}
+		limit 0x9Ab1a6D2B5F4b87F5d0b5D3E1c0B6f2fA4A7c9E1 {
+			rate 2.5
+			burst 5
+			quota 1000
+			quota_period 1h
+		}
+	}`)
+	middleware := &SIWEAuthMiddleware{}
+	if err := middleware.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("UnmarshalCaddyfile() = %v", err)
+	}
+	if middleware.DefaultLimit == nil || middleware.DefaultLimit.Rate != 10 {
+		t.Errorf("expected a default limit of 10 requests per second, got %+v", middleware.DefaultLimit)
+	}
+	expected := AddressLimit{Rate: 2.5, Burst: 5, Quota: 1000, QuotaPeriod: caddy.Duration(time.Hour)}
+	if limit := middleware.Limits["0x9Ab1a6D2B5F4b87F5d0b5D3E1c0B6f2fA4A7c9E1"]; limit == nil || *limit != expected {
+		t.Errorf("unexpected limit %+v", limit)
+	}
+
+	middleware.Secret, middleware.Algorithm = "secret", AlgorithmHS256
+	middleware.Limits["0x0000000000000000000000000000000000000001"] = &AddressLimit{}
+	if err := middleware.Validate(); err == nil {
+		t.Errorf("expected a limit for a signer that isn't whitelisted to be rejected")
+	}
+	delete(middleware.Limits, "0x0000000000000000000000000000000000000001")
+	middleware.DefaultLimit.Rate = -1
+	if err := middleware.Validate(); err == nil {
+		t.Errorf("expected a negative rate to be rejected")
+	}
+}
+
+func TestSIWEAuthMiddlewareMeteredMethods(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`din_auth {
+		whitelist 0x9Ab1a6D2B5F4b87F5d0b5D3E1c0B6f2fA4A7c9E1
+		metered_methods debug_traceTransaction
+		policy default {
+			methods trace_block
+		}
+	}`)
+	middleware := &SIWEAuthMiddleware{}
+	if err := middleware.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("UnmarshalCaddyfile() = %v", err)
+	}
+	middleware.meteredMethods = middleware.meteredMethodSet()
+
+	labels := middleware.methodLabels([]string{"eth_blockNumber", "debug_traceTransaction", "trace_block", "made_up_0x1234"})
+	expected := []string{"eth_blockNumber", "debug_traceTransaction", "trace_block", otherMethod}
+	if !reflect.DeepEqual(labels, expected) {
+		t.Errorf("expected the method labels %v, got %v", expected, labels)
+	}
+}
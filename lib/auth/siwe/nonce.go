@@ -0,0 +1,157 @@
+package siwe
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/DIN-center/din-caddy-plugins/lib/auth"
+)
+
+const (
+	// The path of the endpoint handing out server issued nonces
+	NoncePath = "/auth/nonce"
+	// Server issued nonces must be used within NonceTTL, and SIWE messages issued longer than NonceTTL ago are rejected
+	NonceTTL = 5 * time.Minute
+	// The tolerated drift between the clocks of the signer and the server
+	MaxClockSkew = time.Minute
+)
+
+var (
+	ErrNonceReplayed = errors.New("nonce already used")
+	ErrNonceUnknown  = errors.New("nonce not issued by this server")
+	ErrNonceExpired  = errors.New("nonce expired")
+)
+
+// A server issued nonce is the hex encoding of its expiration, random bytes, and the truncated HMAC of both,
+// which keeps it alphanumeric as SIWE nonces must be
+const (
+	nonceExpirationSize = 8
+	nonceRandomSize     = 8
+	nonceMACSize        = 16
+	nonceSize           = nonceExpirationSize + nonceRandomSize + nonceMACSize
+)
+
+// nonceResponse is the body of a response of the nonce endpoint
+type nonceResponse struct {
+	Nonce      string         `json:"nonce"`
+	Expiration *auth.UnixTime `json:"exp"`
+}
+
+// nonceStore hands out nonces signed with its key, which carry their expiration so that nothing is kept for them until
+// they are used, and tracks the nonces of the SIWE messages sessions were opened with, so that a signed message can't
+// be replayed for a new session.
+// Used nonces are remembered for as long as a message with them is accepted, NonceTTL plus MaxClockSkew.
+type nonceStore struct {
+	key  []byte
+	mu   sync.Mutex
+	used map[string]time.Time
+	// The expired nonces are swept at most once every NonceTTL
+	lastSweep time.Time
+}
+
+func newNonceStore() (*nonceStore, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce key: %v", err)
+	}
+	return &nonceStore{key: key, used: make(map[string]time.Time)}, nil
+}
+
+// issue returns a new nonce, which must be used by the returned time
+func (s *nonceStore) issue(now time.Time) (string, time.Time, error) {
+	expiration := now.Add(NonceTTL)
+	b := make([]byte, nonceSize)
+	binary.BigEndian.PutUint64(b, uint64(expiration.UnixNano()))
+	if _, err := rand.Read(b[nonceExpirationSize : nonceExpirationSize+nonceRandomSize]); err != nil {
+		return "", time.Time{}, err
+	}
+	copy(b[nonceExpirationSize+nonceRandomSize:], s.mac(b[:nonceExpirationSize+nonceRandomSize]))
+	return hex.EncodeToString(b), expiration, nil
+}
+
+// verify returns the expiration of a nonce issued by the store, and false for any other nonce
+func (s *nonceStore) verify(nonce string) (time.Time, bool) {
+	b, err := hex.DecodeString(nonce)
+	if err != nil || len(b) != nonceSize {
+		return time.Time{}, false
+	}
+	if !hmac.Equal(b[nonceExpirationSize+nonceRandomSize:], s.mac(b[:nonceExpirationSize+nonceRandomSize])) {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(b))), true
+}
+
+// mac returns the truncated HMAC of the expiration and random bytes of a nonce
+func (s *nonceStore) mac(data []byte) []byte {
+	h := hmac.New(sha256.New, s.key)
+	h.Write(data)
+	return h.Sum(nil)[:nonceMACSize]
+}
+
+// use records the nonce of a SIWE message a session is opened with. It fails if the nonce was used before, or if it
+// was issued by the server and has expired. Nonces generated by the client are only accepted unless requireIssued.
+func (s *nonceStore) use(nonce string, now time.Time, requireIssued bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep(now, false)
+	if until, ok := s.used[nonce]; ok && now.Before(until) {
+		return ErrNonceReplayed
+	}
+	if expiration, issued := s.verify(nonce); issued {
+		if !now.Before(expiration) {
+			return ErrNonceExpired
+		}
+	} else if requireIssued {
+		return ErrNonceUnknown
+	}
+	s.used[nonce] = now.Add(NonceTTL + MaxClockSkew)
+	return nil
+}
+
+// sweep drops the used nonces that are no longer accepted, if they haven't been swept for NonceTTL or if forced
+func (s *nonceStore) sweep(now time.Time, force bool) {
+	if !force && now.Sub(s.lastSweep) < NonceTTL {
+		return
+	}
+	s.lastSweep = now
+	for nonce, until := range s.used {
+		if !now.Before(until) {
+			delete(s.used, nonce)
+		}
+	}
+}
+
+// serveNonce hands out a nonce for the SIWE message of a new session
+func (d *SIWEAuthMiddleware) serveNonce(rw http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		err := errors.New("method not allowed")
+		handleError(err, rw, http.StatusMethodNotAllowed)
+		return err
+	}
+	nonce, expiration, err := d.nonces.issue(time.Now())
+	if err != nil {
+		handleError(err, rw, http.StatusInternalServerError)
+		return err
+	}
+	exp := auth.UnixTime(expiration)
+	data, err := json.Marshal(nonceResponse{Nonce: nonce, Expiration: &exp})
+	if err != nil {
+		handleError(err, rw, http.StatusInternalServerError)
+		return err
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(data)
+	rw.Write([]byte("\n"))
+	return nil
+}
@@ -0,0 +1,175 @@
+package siwe
+
+import (
+	"crypto/ecdsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/spruceid/siwe-go"
+	"go.uber.org/zap"
+)
+
+// signedSIWEMessage returns the body of a session request with a SIWE message signed by the key
+func signedSIWEMessage(t *testing.T, key *ecdsa.PrivateKey, domain string, uri string, nonce string, options map[string]interface{}) string {
+	msg, err := siwe.InitMessage(domain, crypto.PubkeyToAddress(key.PublicKey).String(), uri, nonce, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := signMessage(msg.String(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := json.Marshal(signedMessage{Message: msg.String(), Signature: sig})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestSIWEAuthMiddlewareVerifiesMessages(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	now := time.Now()
+	replayed := signedSIWEMessage(t, key, "din.example", "https://din.example/auth", siwe.GenerateNonce(), nil)
+
+	tests := []struct {
+		name string
+		body string
+		code int
+	}{
+		{name: "valid message", body: signedSIWEMessage(t, key, "din.example", "https://din.example/auth", siwe.GenerateNonce(), nil), code: http.StatusOK},
+		{name: "first use of a nonce", body: replayed, code: http.StatusOK},
+		{name: "replayed nonce", body: replayed, code: http.StatusUnauthorized},
+		{name: "other domain", body: signedSIWEMessage(t, key, "other.example", "https://din.example/auth", siwe.GenerateNonce(), nil), code: http.StatusUnauthorized},
+		{name: "uri of another server", body: signedSIWEMessage(t, key, "din.example", "https://other.example/auth", siwe.GenerateNonce(), nil), code: http.StatusUnauthorized},
+		{name: "unexpected chain id", body: signedSIWEMessage(t, key, "din.example", "https://din.example/auth", siwe.GenerateNonce(), map[string]interface{}{"chainId": 5}), code: http.StatusUnauthorized},
+		{name: "accepted chain id", body: signedSIWEMessage(t, key, "din.example", "https://din.example/auth", siwe.GenerateNonce(), map[string]interface{}{"chainId": 59144}), code: http.StatusOK},
+		{name: "expired", body: signedSIWEMessage(t, key, "din.example", "https://din.example/auth", siwe.GenerateNonce(), map[string]interface{}{"expirationTime": now.Add(-time.Minute)}), code: http.StatusUnauthorized},
+		{name: "not yet valid", body: signedSIWEMessage(t, key, "din.example", "https://din.example/auth", siwe.GenerateNonce(), map[string]interface{}{"notBefore": now.Add(time.Hour)}), code: http.StatusUnauthorized},
+		{name: "issued too long ago", body: signedSIWEMessage(t, key, "din.example", "https://din.example/auth", siwe.GenerateNonce(), map[string]interface{}{"issuedAt": now.Add(-time.Hour)}), code: http.StatusUnauthorized},
+		{name: "issued in the future", body: signedSIWEMessage(t, key, "din.example", "https://din.example/auth", siwe.GenerateNonce(), map[string]interface{}{"issuedAt": now.Add(time.Hour)}), code: http.StatusUnauthorized},
+	}
+
+	middleware := &SIWEAuthMiddleware{
+		Secret:    "secret",
+		ChainIDs:  []int{1, 59144},
+		Whitelist: map[string]struct{}{crypto.PubkeyToAddress(key.PublicKey).String(): {}},
+	}
+	if err := middleware.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			middleware.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "http://din.example/auth", strings.NewReader(tt.body)), nil)
+			if rec.Code != tt.code {
+				t.Errorf("expected status %d, got %d: %s", tt.code, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestSIWEAuthMiddlewareServerNonce(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	middleware := &SIWEAuthMiddleware{
+		Secret:             "secret",
+		RequireServerNonce: true,
+		Whitelist:          map[string]struct{}{crypto.PubkeyToAddress(key.PublicKey).String(): {}},
+	}
+	if err := middleware.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		middleware.ServeHTTP(w, r, nil)
+	}))
+	defer server.Close()
+
+	// A client generated nonce is refused
+	client := NewSIWEClient(server.URL+"/auth", 1, &SigningConfig{PrivateKey: crypto.FromECDSA(key)})
+	if err := client.Start(zap.NewNop()); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Error(); err == nil {
+		t.Errorf("expected no session with a client generated nonce")
+	}
+
+	// A server issued nonce is accepted once
+	client = NewSIWEClient(server.URL+"/auth", 1, &SigningConfig{PrivateKey: crypto.FromECDSA(key)})
+	client.ServerNonce = true
+	if err := client.Start(zap.NewNop()); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Error(); err != nil {
+		t.Errorf("expected a session with a server issued nonce: %v", err)
+	}
+}
+
+func TestNonceStore(t *testing.T) {
+	store, err := newNonceStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+
+	nonce, expiration, err := store.issue(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !expiration.Equal(now.Add(NonceTTL)) {
+		t.Errorf("expected the nonce to expire after %v, got %v", NonceTTL, expiration.Sub(now))
+	}
+	if _, err := siwe.InitMessage("din.example", "0x0000000000000000000000000000000000000001", "https://din.example/auth", nonce, nil); err != nil {
+		t.Errorf("expected an issued nonce to be a valid SIWE nonce: %v", err)
+	}
+	// Issuing keeps nothing in the store
+	if len(store.used) != 0 {
+		t.Errorf("expected no nonce to be stored when issued, got %d", len(store.used))
+	}
+	if err := store.use(nonce, now, true); err != nil {
+		t.Errorf("expected an issued nonce to be accepted: %v", err)
+	}
+	if err := store.use(nonce, now, true); err != ErrNonceReplayed {
+		t.Errorf("expected a used nonce to be refused as replayed, got %v", err)
+	}
+
+	expired, _, _ := store.issue(now)
+	if err := store.use(expired, now.Add(NonceTTL), true); err != ErrNonceExpired {
+		t.Errorf("expected an expired nonce to be refused, got %v", err)
+	}
+	if err := store.use("client-nonce", now, true); err != ErrNonceUnknown {
+		t.Errorf("expected a client nonce to be refused when server nonces are required, got %v", err)
+	}
+	if err := store.use("client-nonce", now, false); err != nil {
+		t.Errorf("expected a client nonce to be accepted: %v", err)
+	}
+
+	// A nonce with a changed expiration, or issued by another store, isn't accepted as issued
+	forged, _, _ := store.issue(now)
+	if forged[0] == '0' {
+		forged = "1" + forged[1:]
+	} else {
+		forged = "0" + forged[1:]
+	}
+	if err := store.use(forged, now, true); err != ErrNonceUnknown {
+		t.Errorf("expected a forged nonce to be refused, got %v", err)
+	}
+	other, err := newNonceStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	foreign, _, _ := other.issue(now)
+	if err := store.use(foreign, now, true); err != ErrNonceUnknown {
+		t.Errorf("expected a nonce of another store to be refused, got %v", err)
+	}
+
+	// Used nonces are forgotten once messages with them are too old to be accepted
+	store.sweep(now.Add(NonceTTL+MaxClockSkew+time.Second), true)
+	if len(store.used) != 0 {
+		t.Errorf("expected every nonce to be swept, got %d used", len(store.used))
+	}
+}
@@ -0,0 +1,203 @@
+package siwe
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// Remote signer protocol
+//
+// A remote signer holds the private key and signs messages on request, so that the key doesn't have to live next to Caddy.
+// It serves a single URL:
+//
+//	GET  <signer_url>  -> {"address": "0x..."}
+//	POST <signer_url>  {"message": "..."} -> {"address": "0x...", "signature": "0x..."}
+//
+// The signature is an EIP-191 personal_sign signature of the message: the 65 byte secp256k1 signature of
+// keccak256("\x19Ethereum Signed Message:\n" + len(message) + message), with a recovery id of 27 or 28.
+// Requests are authenticated with a bearer token, a TLS client certificate, or both.
+// See SignerServer for a reference implementation.
+
+const (
+	DefaultSignerTimeout = 5 * time.Second
+	DefaultSignerRetries = 2
+	// The delay before the first retry of a failed request to the remote signer, doubled on every retry
+	signerRetryBackoff = 100 * time.Millisecond
+)
+
+// signRequest is the body of a signing request to a remote signer
+type signRequest struct {
+	Message string `json:"message"`
+}
+
+// signResponse is the body of a response of a remote signer
+type signResponse struct {
+	Address   string        `json:"address"`
+	Signature hexutil.Bytes `json:"signature,omitempty"`
+	Error     string        `json:"error,omitempty"`
+}
+
+// remoteSigner is the client of a remote signer
+type remoteSigner struct {
+	url     string
+	token   string
+	client  *http.Client
+	retries int
+	backoff time.Duration
+}
+
+// newRemoteSigner returns a client of the remote signer of the signing config
+func newRemoteSigner(sc *SigningConfig) (*remoteSigner, error) {
+	repl := caddy.NewReplacer()
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if sc.SignerCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(repl.ReplaceAll(sc.SignerCertFile, ""), repl.ReplaceAll(sc.SignerKeyFile, ""))
+		if err != nil {
+			return nil, fmt.Errorf("failed to load signer client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if sc.SignerCAFile != "" {
+		caBytes, err := os.ReadFile(repl.ReplaceAll(sc.SignerCAFile, ""))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read signer ca file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caBytes) {
+			return nil, errors.New("no certificates in signer ca file")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	timeout := time.Duration(sc.SignerTimeout)
+	if timeout == 0 {
+		timeout = DefaultSignerTimeout
+	}
+	retries := DefaultSignerRetries
+	if sc.SignerRetries != nil {
+		retries = *sc.SignerRetries
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &remoteSigner{
+		url:     repl.ReplaceAll(sc.SignerURL, ""),
+		token:   repl.ReplaceAll(sc.SignerToken, ""),
+		client:  &http.Client{Transport: transport, Timeout: timeout},
+		retries: retries,
+		backoff: signerRetryBackoff,
+	}, nil
+}
+
+// address returns the address of the key held by the remote signer
+func (r *remoteSigner) address() (string, error) {
+	res, err := r.do(http.MethodGet, nil)
+	if err != nil {
+		return "", err
+	}
+	if !common.IsHexAddress(res.Address) {
+		return "", fmt.Errorf("remote signer returned an invalid address %q", res.Address)
+	}
+	return common.HexToAddress(res.Address).String(), nil
+}
+
+// sign returns the EIP-191 signature of the message by the remote signer.
+// The signature is verified to recover to the given address, so that a misconfigured signer is caught before the
+// signature is sent to a provider.
+func (r *remoteSigner) sign(msg string, address string) ([]byte, error) {
+	body, err := json.Marshal(signRequest{Message: msg})
+	if err != nil {
+		return nil, err
+	}
+	res, err := r.do(http.MethodPost, body)
+	if err != nil {
+		return nil, err
+	}
+	recovered, err := recoverAddress(msg, res.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("remote signer returned an invalid signature: %w", err)
+	}
+	if !strings.EqualFold(recovered, address) {
+		return nil, fmt.Errorf("remote signer signed with %s, expected %s", recovered, address)
+	}
+	return res.Signature, nil
+}
+
+// do sends a request to the remote signer, retrying network errors and server errors with exponential backoff
+func (r *remoteSigner) do(method string, body []byte) (*signResponse, error) {
+	backoff := r.backoff
+	for attempt := 0; ; attempt++ {
+		res, retry, err := r.attempt(method, body)
+		if err == nil || !retry || attempt >= r.retries {
+			return res, err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// attempt sends a single request to the remote signer, and returns whether a failure is worth retrying
+func (r *remoteSigner) attempt(method string, body []byte) (*signResponse, bool, error) {
+	req, err := http.NewRequest(method, r.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, false, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if r.token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.token)
+	}
+	httpRes, err := r.client.Do(req)
+	if err != nil {
+		return nil, true, fmt.Errorf("error calling remote signer: %w", err)
+	}
+	defer httpRes.Body.Close()
+	resBytes, err := io.ReadAll(httpRes.Body)
+	if err != nil {
+		return nil, true, fmt.Errorf("error reading remote signer response: %w", err)
+	}
+
+	var res signResponse
+	if err := json.Unmarshal(resBytes, &res); err != nil && httpRes.StatusCode == http.StatusOK {
+		return nil, false, fmt.Errorf("error decoding remote signer response: %w", err)
+	}
+	if httpRes.StatusCode != http.StatusOK {
+		err := fmt.Errorf("remote signer returned status code %d", httpRes.StatusCode)
+		if res.Error != "" {
+			err = fmt.Errorf("%w: %s", err, res.Error)
+		}
+		return nil, httpRes.StatusCode >= http.StatusInternalServerError, err
+	}
+	return &res, false, nil
+}
+
+// recoverAddress returns the address of the key that produced the EIP-191 signature of the message
+func recoverAddress(msg string, signature []byte) (string, error) {
+	if len(signature) != crypto.SignatureLength {
+		return "", fmt.Errorf("expected %d bytes, got %d", crypto.SignatureLength, len(signature))
+	}
+	sig := make([]byte, crypto.SignatureLength)
+	copy(sig, signature)
+	if sig[64] >= 27 {
+		sig[64] -= 27
+	}
+	publicKey, err := crypto.SigToPub(signHash([]byte(msg)).Bytes(), sig)
+	if err != nil {
+		return "", err
+	}
+	return crypto.PubkeyToAddress(*publicKey).String(), nil
+}
@@ -0,0 +1,197 @@
+package siwe
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestRemoteSigner(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	address := crypto.PubkeyToAddress(key.PublicKey).String()
+	otherKey, _ := crypto.GenerateKey()
+	signerServer := NewSignerServer(key, "signer-token")
+
+	var failures, unretriedFailures int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Fail the first request to /flaky and /unretried, to exercise retries
+		if r.URL.Path == "/flaky" && atomic.AddInt32(&failures, 1) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		if r.URL.Path == "/unretried" && atomic.AddInt32(&unretriedFailures, 1) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		signerServer.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	otherServer := httptest.NewServer(NewSignerServer(otherKey, ""))
+	defer otherServer.Close()
+
+	tests := []struct {
+		name   string
+		signer *SigningConfig
+		hasErr bool
+	}{
+		{name: "bearer token", signer: &SigningConfig{SignerURL: server.URL, SignerToken: "signer-token"}},
+		{name: "configured address", signer: &SigningConfig{SignerURL: server.URL, SignerToken: "signer-token", Address: address}},
+		{name: "retried server error", signer: &SigningConfig{SignerURL: server.URL + "/flaky", SignerToken: "signer-token"}},
+		{name: "retries disabled", signer: &SigningConfig{SignerURL: server.URL + "/unretried", SignerToken: "signer-token", SignerRetries: intPtr(0)}, hasErr: true},
+		{name: "wrong token", signer: &SigningConfig{SignerURL: server.URL, SignerToken: "wrong"}, hasErr: true},
+		{name: "signed by another key", signer: &SigningConfig{SignerURL: otherServer.URL, Address: address}, hasErr: true},
+		{name: "no retries left", signer: &SigningConfig{SignerURL: "http://127.0.0.1:1", SignerRetries: intPtr(1), SignerTimeout: caddy.Duration(time.Second)}, hasErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.signer.Validate(); err != nil {
+				t.Fatalf("unexpected validation error: %v", err)
+			}
+			if err := tt.signer.LoadKey(); err != nil {
+				t.Fatalf("unexpected error loading signer: %v", err)
+			}
+			signerClient := NewSIWESignerClient()
+			msg := "din remote signer test"
+			sig, err := signerClient.Sign(msg, tt.signer)
+			if tt.hasErr {
+				if err == nil {
+					t.Errorf("expected an error signing with the remote signer")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error signing with the remote signer: %v", err)
+			}
+			if tt.signer.Address != address {
+				t.Errorf("expected address %v, got %v", address, tt.signer.Address)
+			}
+			recovered, err := recoverAddress(msg, sig)
+			if err != nil || recovered != address {
+				t.Errorf("expected the signature to recover to %v, got %v (%v)", address, recovered, err)
+			}
+		})
+	}
+}
+
+func TestRemoteSignerMTLS(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	address := crypto.PubkeyToAddress(key.PublicKey).String()
+
+	dir := t.TempDir()
+	clientCert := writeClientCertificate(t, dir)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+
+	server := httptest.NewUnstartedServer(NewSignerServer(key, ""))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	server.StartTLS()
+	defer server.Close()
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	signer := &SigningConfig{
+		SignerURL:      server.URL,
+		SignerCertFile: filepath.Join(dir, "client.pem"),
+		SignerKeyFile:  filepath.Join(dir, "client-key.pem"),
+		SignerCAFile:   caFile,
+	}
+	if err := signer.LoadKey(); err != nil {
+		t.Fatalf("unexpected error loading signer: %v", err)
+	}
+	if err := NewSIWESignerClient().GenPrivKey(signer); err != nil {
+		t.Fatalf("unexpected error getting the remote signer address: %v", err)
+	}
+	if signer.Address != address {
+		t.Errorf("expected address %v, got %v", address, signer.Address)
+	}
+
+	// Without the client certificate, the signer refuses the connection
+	noCert := &SigningConfig{SignerURL: server.URL, SignerCAFile: caFile, SignerRetries: intPtr(1)}
+	if _, err := NewSIWESignerClient().Sign("msg", noCert); err == nil {
+		t.Errorf("expected an error signing without a client certificate")
+	}
+}
+
+func TestSigningConfigValidateRemoteSigner(t *testing.T) {
+	tests := []struct {
+		name   string
+		signer *SigningConfig
+		hasErr bool
+	}{
+		{name: "https signer", signer: &SigningConfig{SignerURL: "https://signer.internal/sign"}},
+		{name: "mtls signer", signer: &SigningConfig{SignerURL: "https://signer.internal/sign", SignerCertFile: "client.pem", SignerKeyFile: "client-key.pem"}},
+		{name: "non http signer", signer: &SigningConfig{SignerURL: "unix:///run/signer.sock"}, hasErr: true},
+		{name: "cert without key", signer: &SigningConfig{SignerURL: "https://signer.internal/sign", SignerCertFile: "client.pem"}, hasErr: true},
+		{name: "negative retries", signer: &SigningConfig{SignerURL: "https://signer.internal/sign", SignerRetries: intPtr(-1)}, hasErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.signer.Validate()
+			if tt.hasErr && err == nil {
+				t.Errorf("expected a validation error")
+			}
+			if !tt.hasErr && err != nil {
+				t.Errorf("unexpected validation error: %v", err)
+			}
+		})
+	}
+}
+
+// writeClientCertificate writes a self signed client certificate and its key to client.pem and client-key.pem in dir
+func writeClientCertificate(t *testing.T, dir string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "din-caddy"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "client.pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "client-key.pem"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func intPtr(i int) *int {
+	return &i
+}
@@ -7,14 +7,21 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/DIN-center/din-caddy-plugins/lib/auth"
+	prom "github.com/DIN-center/din-caddy-plugins/lib/prometheus"
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/spruceid/siwe-go"
@@ -30,8 +37,17 @@ var (
 	_ caddy.Provisioner           = (*SIWEAuthMiddleware)(nil)
 	_ caddyhttp.MiddlewareHandler = (*SIWEAuthMiddleware)(nil)
 	_ caddyfile.Unmarshaler       = (*SIWEAuthMiddleware)(nil)
-	// TODO: validate provision step
-	// _ caddy.Validator			= (*mod.DinMiddleware)(nil)
+	_ caddy.Validator             = (*SIWEAuthMiddleware)(nil)
+	_ caddy.CleanerUpper          = (*SIWEAuthMiddleware)(nil)
+)
+
+const (
+	// The chain id SIWE messages are accepted for, unless ChainIDs is set
+	DefaultChainID = 1
+	// The lifetime of the session tokens issued by the middleware
+	SessionTokenLifetime = time.Hour
+	// The secret file is read again every SecretReloadInterval, to pick up a rotated secret
+	SecretReloadInterval = 10 * time.Second
 )
 
 func handleError(err error, rw http.ResponseWriter, code int) {
@@ -41,9 +57,58 @@ func handleError(err error, rw http.ResponseWriter, code int) {
 }
 
 type SIWEAuthMiddleware struct {
+	// The signer addresses allowed to open sessions
 	Whitelist map[string]struct{} `json:"whitelist"`
-	Secret    string              `json:"secret"`
-	logger    *zap.Logger
+	// The path to a file listing more signer addresses, one per line. The file is watched, and the tokens of the
+	// signers removed from it are revoked.
+	WhitelistFile string `json:"whitelist_file,omitempty"`
+	// The domain SIWE messages must be signed for, and their uri must point to. The Host of the request if not set.
+	Domain string `json:"domain,omitempty"`
+	// The chain ids SIWE messages are accepted for. Only DefaultChainID if not set.
+	ChainIDs []int `json:"chain_ids,omitempty"`
+	// Only accept SIWE messages with a nonce issued by the nonce endpoint at NoncePath.
+	// Nonces generated by the client are accepted otherwise, but never twice.
+	RequireServerNonce bool `json:"require_server_nonce,omitempty"`
+	// The token policies of whitelisted signers, keyed by address
+	Policies map[string]*TokenPolicy `json:"policies,omitempty"`
+	// The token policy of the signers without a policy of their own. Tokens live SessionTokenLifetime and are
+	// unrestricted if not set.
+	DefaultPolicy *TokenPolicy `json:"default_policy,omitempty"`
+	// The rate limits and quotas of whitelisted signers, keyed by address
+	Limits map[string]*AddressLimit `json:"limits,omitempty"`
+	// The rate limit and quota of the signers without a limit of their own. Unlimited if not set.
+	DefaultLimit *AddressLimit `json:"default_limit,omitempty"`
+	// The JSON-RPC methods the authenticated calls are metered by, besides DefaultMeteredMethods and the methods
+	// of the token policies. The calls to other methods are metered as "other".
+	MeteredMethods []string `json:"metered_methods,omitempty"`
+	// The algorithm session tokens are signed with: HS256 (the default), ES256 or EdDSA.
+	// With ES256 and EdDSA, the public keys tokens are verified with are published at JWKSPath,
+	// so that nodes verifying tokens don't need to hold the signing key.
+	Algorithm string `json:"algorithm,omitempty"`
+	// The path to a file holding the PEM encoded private key session tokens are signed with, for ES256 and EdDSA.
+	// A random key is generated if not set.
+	SigningKeyFile string `json:"signing_key_file,omitempty"`
+	// The secret used to sign session tokens with HS256. Placeholders such as {env.DIN_AUTH_SECRET} are replaced at provision time.
+	Secret string `json:"secret,omitempty"`
+	// The path to a file holding the secret, read at provision time when Secret is not set.
+	// A random secret is generated if neither is set.
+	SecretFile string `json:"secret_file,omitempty"`
+	// Secrets that session tokens are still verified with, but no longer signed with, such as the secret in use
+	// before the last rotation. Tokens name the secret they are signed with in their kid header.
+	PreviousSecrets []string `json:"previous_secrets,omitempty"`
+	logger          *zap.Logger
+
+	keys    *sessionKeys
+	nonces  *nonceStore
+	usage   *tokenUsage
+	limiter *addressLimiter
+	// Meters the authenticated requests by signer address and method
+	metrics        prom.IPrometheusClient
+	meteredMethods map[string]struct{}
+	// The signers allowed to open sessions, from every whitelist source
+	signers *signerSet
+	// The channel to stop reloading the secret file and the whitelist
+	quit chan struct{}
 }
 
 // CaddyModule returns the Caddy module information.
@@ -56,6 +121,244 @@ func (SIWEAuthMiddleware) CaddyModule() caddy.ModuleInfo {
 
 func (d *SIWEAuthMiddleware) Provision(context caddy.Context) error {
 	d.logger = context.Logger(d)
+	if d.Algorithm == "" {
+		d.Algorithm = AlgorithmHS256
+	}
+	if len(d.ChainIDs) == 0 {
+		d.ChainIDs = []int{DefaultChainID}
+	}
+	nonces, err := newNonceStore()
+	if err != nil {
+		return err
+	}
+	d.nonces = nonces
+	d.usage = newTokenUsage()
+	d.limiter = newAddressLimiter()
+	if d.metrics == nil {
+		d.metrics = prom.NewPrometheusClient(d.logger, prom.MachineID())
+	}
+
+	repl := caddy.NewReplacer()
+	var keyFile string
+	if d.Algorithm == AlgorithmHS256 {
+		if d.Secret == "" && d.SecretFile != "" {
+			keyFile = repl.ReplaceAll(d.SecretFile, "")
+		}
+		if err := d.provisionSecret(repl); err != nil {
+			return err
+		}
+	} else {
+		var key sessionKey
+		var err error
+		if d.SigningKeyFile != "" {
+			keyFile = repl.ReplaceAll(d.SigningKeyFile, "")
+			pemBytes, readErr := os.ReadFile(keyFile)
+			if readErr != nil {
+				return fmt.Errorf("failed to read signing key file: %v", readErr)
+			}
+			key, err = newPrivateKeySessionKey(pemBytes, d.Algorithm)
+		} else {
+			key, err = generatePrivateKeySessionKey(d.Algorithm)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to load signing key: %v", err)
+		}
+		d.keys = newSessionKeys(key)
+	}
+
+	// Signer addresses are compared in their checksummed form
+	whitelist := make(map[string]struct{}, len(d.Whitelist))
+	for address := range d.Whitelist {
+		if common.IsHexAddress(address) {
+			address = common.HexToAddress(address).Hex()
+		}
+		whitelist[address] = struct{}{}
+	}
+	d.Whitelist = whitelist
+	policies := make(map[string]*TokenPolicy, len(d.Policies))
+	for address, policy := range d.Policies {
+		if common.IsHexAddress(address) {
+			address = common.HexToAddress(address).Hex()
+		}
+		policies[address] = policy
+	}
+	d.Policies = policies
+	limits := make(map[string]*AddressLimit, len(d.Limits))
+	for address, limit := range d.Limits {
+		if common.IsHexAddress(address) {
+			address = common.HexToAddress(address).Hex()
+		}
+		limits[address] = limit
+	}
+	d.Limits = limits
+	d.meteredMethods = d.meteredMethodSet()
+
+	d.signers = newSignerSet(d.Whitelist, d.maxTokenLifetime())
+	adminWhitelist.register(d.signers)
+	var whitelistFile string
+	if d.WhitelistFile != "" {
+		whitelistFile = repl.ReplaceAll(d.WhitelistFile, "")
+		if err := d.reloadWhitelistFile(whitelistFile, time.Now()); err != nil {
+			return err
+		}
+	}
+
+	if keyFile != "" || whitelistFile != "" {
+		d.quit = make(chan struct{})
+	}
+	if keyFile != "" {
+		go d.watchKeyFile(keyFile)
+	}
+	if whitelistFile != "" {
+		go d.watchWhitelist(whitelistFile)
+	}
+	return nil
+}
+
+// provisionSecret sets up the HS256 session keys from the secret, the secret file or a random secret, and the previous secrets
+func (d *SIWEAuthMiddleware) provisionSecret(repl *caddy.Replacer) error {
+	switch {
+	case d.Secret != "":
+		d.Secret = repl.ReplaceAll(d.Secret, "")
+	case d.SecretFile != "":
+		secret, err := os.ReadFile(repl.ReplaceAll(d.SecretFile, ""))
+		if err != nil {
+			return fmt.Errorf("failed to read secret file: %v", err)
+		}
+		d.Secret = string(secret)
+	default:
+		secret, err := generateRandomSecret()
+		if err != nil {
+			return fmt.Errorf("failed to generate random secret: %v", err)
+		}
+		d.Secret = secret
+	}
+	previous := make([]sessionKey, 0, len(d.PreviousSecrets))
+	for _, secret := range d.PreviousSecrets {
+		previous = append(previous, newHMACKey(repl.ReplaceAll(secret, "")))
+	}
+	d.keys = newSessionKeys(newHMACKey(d.Secret), previous...)
+	return nil
+}
+
+// watchKeyFile reads the secret file or signing key file every SecretReloadInterval, and rotates the session keys when it changes
+func (d *SIWEAuthMiddleware) watchKeyFile(path string) {
+	ticker := time.NewTicker(SecretReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.quit:
+			return
+		case <-ticker.C:
+			if err := d.reloadKey(path, time.Now()); err != nil {
+				d.logger.Warn("Error reloading session token key", zap.String("file", path), zap.Error(err))
+			}
+		}
+	}
+}
+
+// reloadKey rotates the session keys if the key in the key file changed.
+// Tokens signed with the previous key are still accepted until they expire.
+func (d *SIWEAuthMiddleware) reloadKey(path string, now time.Time) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read key file: %v", err)
+	}
+	var key sessionKey
+	if d.Algorithm == AlgorithmHS256 {
+		if len(data) == 0 {
+			return errors.New("secret file is empty")
+		}
+		key = newHMACKey(string(data))
+	} else if key, err = newPrivateKeySessionKey(data, d.Algorithm); err != nil {
+		return err
+	}
+	if d.keys.rotate(key, now, d.maxTokenLifetime()) {
+		d.logger.Info("Session token key rotated", zap.String("kid", key.kid))
+	}
+	return nil
+}
+
+// Cleanup is called by Caddy when the config this middleware belongs to is unloaded, and stops reloading the secret
+// file and the whitelist
+func (d *SIWEAuthMiddleware) Cleanup() error {
+	if d.quit != nil {
+		close(d.quit)
+	}
+	if d.signers != nil {
+		adminWhitelist.unregister(d.signers)
+	}
+	return nil
+}
+
+// Validate is called by Caddy after Provision to check the configuration before the server starts
+func (d *SIWEAuthMiddleware) Validate() error {
+	switch d.Algorithm {
+	case AlgorithmHS256:
+		if d.Secret == "" {
+			return errors.New("secret must be set")
+		}
+		if d.SigningKeyFile != "" {
+			return errors.New("signing_key_file is only used with the ES256 and EdDSA algorithms")
+		}
+	case AlgorithmES256, AlgorithmEdDSA:
+		if d.Secret != "" || d.SecretFile != "" || len(d.PreviousSecrets) > 0 {
+			return fmt.Errorf("secrets are only used with the HS256 algorithm, not %s", d.Algorithm)
+		}
+	default:
+		return fmt.Errorf("unsupported algorithm %q, expected HS256, ES256 or EdDSA", d.Algorithm)
+	}
+	if len(d.Whitelist) == 0 && d.WhitelistFile == "" {
+		return errors.New("whitelist must contain at least one address, or whitelist_file must be set")
+	}
+	for address := range d.Whitelist {
+		if !common.IsHexAddress(address) {
+			return fmt.Errorf("whitelist entry %q is not a hex address", address)
+		}
+	}
+	if d.DefaultPolicy != nil {
+		if err := d.DefaultPolicy.validate(); err != nil {
+			return fmt.Errorf("default policy: %v", err)
+		}
+	}
+	for address, policy := range d.Policies {
+		if err := d.validateSigner(address); err != nil {
+			return fmt.Errorf("policy for %v", err)
+		}
+		if err := policy.validate(); err != nil {
+			return fmt.Errorf("policy for %s: %v", address, err)
+		}
+	}
+	if d.DefaultLimit != nil {
+		if err := d.DefaultLimit.validate(); err != nil {
+			return fmt.Errorf("default limit: %v", err)
+		}
+	}
+	for address, limit := range d.Limits {
+		if err := d.validateSigner(address); err != nil {
+			return fmt.Errorf("limit for %v", err)
+		}
+		if err := limit.validate(); err != nil {
+			return fmt.Errorf("limit for %s: %v", address, err)
+		}
+	}
+	for _, chainID := range d.ChainIDs {
+		if chainID < 1 {
+			return fmt.Errorf("chain id must be positive, got %d", chainID)
+		}
+	}
+	return nil
+}
+
+// validateSigner checks the address a policy or limit is set for. Signers of the whitelist file are only known at
+// runtime, so any address is accepted when it is set.
+func (d *SIWEAuthMiddleware) validateSigner(address string) error {
+	if !common.IsHexAddress(address) {
+		return fmt.Errorf("%q, which is not a hex address", address)
+	}
+	if _, ok := d.Whitelist[address]; !ok && d.WhitelistFile == "" {
+		return fmt.Errorf("%q, which is not a whitelisted address", address)
+	}
 	return nil
 }
 
@@ -74,35 +377,40 @@ func (d *SIWEAuthMiddleware) createSession(rw http.ResponseWriter, r *http.Reque
 		handleError(err, rw, 400)
 		return err
 	}
+	issued := time.Now()
+	if err := d.verifyMessage(message, r, issued); err != nil {
+		handleError(err, rw, 401)
+		return err
+	}
 	publicKey, err := message.VerifyEIP191(sm.Signature.String())
 	if err != nil {
+		handleError(err, rw, 401)
 		return err
 	}
-	if _, ok := d.Whitelist[crypto.PubkeyToAddress(*publicKey).String()]; !ok {
+	address := crypto.PubkeyToAddress(*publicKey).String()
+	if !d.signers.contains(address) {
 		err := errors.New("unauthorized signer")
 		handleError(err, rw, 401)
 		return err
 	}
-	issued := time.Now()
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, &jwt.RegisteredClaims{
-		IssuedAt:  jwt.NewNumericDate(issued),
-		ExpiresAt: jwt.NewNumericDate(issued.Add(time.Hour)),
-	})
-	tokenString, err := token.SignedString([]byte(d.Secret))
+	// The nonce is only spent by a message that opens a session, so that it can't be burnt by a forged message
+	if err := d.nonces.use(message.GetNonce(), issued, d.RequireServerNonce); err != nil {
+		handleError(err, rw, 401)
+		return err
+	}
+	key := d.keys.signing()
+	claims := newSessionClaims(address, d.policyFor(address), issued)
+	token := jwt.NewWithClaims(key.method, claims)
+	token.Header["kid"] = key.kid
+	tokenString, err := token.SignedString(key.signingKey)
 	if err != nil {
-		d.logger.Warn("Signing error", zap.String("error", err.Error()), zap.String("key", d.Secret))
+		d.logger.Warn("Signing error", zap.String("error", err.Error()), zap.String("kid", key.kid))
 		handleError(err, rw, 500)
 		return err
 	}
 	d.logger.Debug("token issued")
 
-	exp := auth.UnixTime(issued.Add(time.Hour))
-	data, err := json.Marshal(auth.AuthToken{
-		Headers: map[string]string{
-			"x-api-key": tokenString,
-		},
-		Expiration: &exp,
-	})
+	data, err := json.Marshal(claims.authToken(tokenString))
 	if err != nil {
 		handleError(err, rw, 500)
 		return err
@@ -113,10 +421,70 @@ func (d *SIWEAuthMiddleware) createSession(rw http.ResponseWriter, r *http.Reque
 	return nil
 }
 
+// verifyMessage checks the fields of the SIWE message per EIP-4361, before its signature is checked: the domain and
+// uri must name this server, the chain id must be accepted, and the message must be valid now and issued less than
+// NonceTTL ago, as its nonce is only remembered for that long.
+func (d *SIWEAuthMiddleware) verifyMessage(message *siwe.Message, r *http.Request, now time.Time) error {
+	if message.GetVersion() != "1" {
+		return fmt.Errorf("unsupported message version %q", message.GetVersion())
+	}
+	domain := d.Domain
+	if domain == "" {
+		domain = r.Host
+	}
+	if !sameAuthority(message.GetDomain(), domain) {
+		return fmt.Errorf("message domain %q doesn't match %q", message.GetDomain(), domain)
+	}
+	if uri := message.GetURI(); !sameAuthority(uri.Host, domain) {
+		return fmt.Errorf("message uri %q doesn't point to %q", uri.String(), domain)
+	}
+	if !slices.Contains(d.ChainIDs, message.GetChainID()) {
+		return fmt.Errorf("unexpected chain id %d", message.GetChainID())
+	}
+	if _, err := message.ValidAt(now); err != nil {
+		return err
+	}
+	issuedAt, err := time.Parse(time.RFC3339, message.GetIssuedAt())
+	if err != nil {
+		return fmt.Errorf("invalid issued at time: %v", err)
+	}
+	if issuedAt.After(now.Add(MaxClockSkew)) {
+		return errors.New("message issued in the future")
+	}
+	if now.Sub(issuedAt) > NonceTTL {
+		return errors.New("message issued too long ago")
+	}
+	return nil
+}
+
+// sameAuthority returns whether the authorities name the same host. Ports are only compared if both carry one,
+// as clients sign for the host name of the auth URL, while the Host of the request may carry the port.
+func sameAuthority(a, b string) bool {
+	hostA, portA := splitAuthority(a)
+	hostB, portB := splitAuthority(b)
+	if !strings.EqualFold(hostA, hostB) {
+		return false
+	}
+	return portA == "" || portB == "" || portA == portB
+}
+
+// splitAuthority splits an authority into its host and port, if it has one
+func splitAuthority(authority string) (string, string) {
+	host, port, err := net.SplitHostPort(authority)
+	if err != nil {
+		return strings.Trim(authority, "[]"), ""
+	}
+	return host, port
+}
+
 func (d *SIWEAuthMiddleware) ServeHTTP(rw http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
 	switch r.URL.Path {
 	case "/auth":
 		return d.createSession(rw, r)
+	case NoncePath:
+		return d.serveNonce(rw, r)
+	case JWKSPath:
+		return d.serveJWKS(rw)
 	case "/":
 		// Used for proxy health checks
 		return next.ServeHTTP(rw, r)
@@ -128,11 +496,17 @@ func (d *SIWEAuthMiddleware) ServeHTTP(rw http.ResponseWriter, r *http.Request,
 		handleError(err, rw, 401)
 		return err
 	}
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+	claims := &sessionClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, ok := d.keys.verification(kid, time.Now())
+		if !ok {
+			return nil, fmt.Errorf("unknown key id %q", kid)
+		}
+		if token.Method.Alg() != key.method.Alg() {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
-		return []byte(d.Secret), nil
+		return key.verificationKey, nil
 	})
 	if err != nil {
 		handleError(err, rw, 403)
@@ -143,6 +517,48 @@ func (d *SIWEAuthMiddleware) ServeHTTP(rw http.ResponseWriter, r *http.Request,
 		handleError(err, rw, 403)
 		return err
 	}
+	// Tokens issued before the signer was removed from the whitelist are revoked. Tokens issued before tokens named
+	// their signer can't be told apart, and are accepted until they expire.
+	if claims.Subject != "" {
+		var issued time.Time
+		if claims.IssuedAt != nil {
+			issued = claims.IssuedAt.Time
+		}
+		if !d.signers.accepts(claims.Subject, issued) {
+			handleError(ErrSignerRevoked, rw, 401)
+			return ErrSignerRevoked
+		}
+	}
+	network := requestNetwork(r)
+	methods, methodsErr := peekMethods(r)
+	meter := func(result string) {
+		d.metrics.HandleAuthRequestMetric(&prom.PromAuthRequestMetricData{Network: network, Address: claims.Subject, Methods: d.methodLabels(methods), Result: result})
+	}
+	if code, err := enforceScope(claims, network, methods, methodsErr); err != nil {
+		meter(resultForbidden)
+		handleError(err, rw, code)
+		return err
+	}
+	now := time.Now()
+	if claims.Uses > 0 && !d.usage.use(claims, now) {
+		meter(resultBudgetExhausted)
+		handleError(auth.ErrRequestLimit, rw, http.StatusTooManyRequests)
+		return auth.ErrRequestLimit
+	}
+	if claims.Subject != "" {
+		if wait, err := d.limiter.allow(claims.Subject, d.limitFor(claims.Subject), len(methods), now); err != nil {
+			if err == ErrQuotaExceeded {
+				meter(resultQuotaExceeded)
+			} else {
+				meter(resultRateLimited)
+			}
+			rw.Header().Set("Content-Type", "application/json")
+			rw.Header().Set("Retry-After", retryAfter(wait))
+			handleError(err, rw, http.StatusTooManyRequests)
+			return err
+		}
+	}
+	meter(resultAllowed)
 	return next.ServeHTTP(rw, r)
 
 }
@@ -157,33 +573,95 @@ func (d *SIWEAuthMiddleware) UnmarshalCaddyfile(dispenser *caddyfile.Dispenser)
 				for _, v := range dispenser.RemainingArgs() {
 					d.Whitelist[v] = struct{}{}
 				}
+			case "whitelist_file":
+				if !dispenser.Args(&d.WhitelistFile) {
+					return dispenser.ArgErr()
+				}
 			case "secret":
 				dispenser.NextBlock(0)
 				d.Secret = dispenser.Val()
 			case "secret_file":
-				var secretFilePath string
-				if !dispenser.Args(&secretFilePath) {
+				if !dispenser.Args(&d.SecretFile) {
+					return dispenser.ArgErr()
+				}
+			case "domain":
+				if !dispenser.Args(&d.Domain) {
+					return dispenser.ArgErr()
+				}
+			case "chain_ids":
+				args := dispenser.RemainingArgs()
+				if len(args) == 0 {
+					return dispenser.ArgErr()
+				}
+				for _, arg := range args {
+					chainID, err := strconv.Atoi(arg)
+					if err != nil {
+						return dispenser.Errf("invalid chain id %q: %v", arg, err)
+					}
+					d.ChainIDs = append(d.ChainIDs, chainID)
+				}
+			case "require_server_nonce":
+				d.RequireServerNonce = true
+			case "algorithm":
+				if !dispenser.Args(&d.Algorithm) {
+					return dispenser.ArgErr()
+				}
+			case "signing_key_file":
+				if !dispenser.Args(&d.SigningKeyFile) {
 					return dispenser.ArgErr()
 				}
-				secret, err := ioutil.ReadFile(secretFilePath)
+			case "limit":
+				var address string
+				if !dispenser.Args(&address) {
+					return dispenser.ArgErr()
+				}
+				limit, err := parseAddressLimit(dispenser)
+				if err != nil {
+					return err
+				}
+				if address == "default" {
+					d.DefaultLimit = limit
+					continue
+				}
+				if d.Limits == nil {
+					d.Limits = make(map[string]*AddressLimit)
+				}
+				d.Limits[address] = limit
+			case "policy":
+				var address string
+				if !dispenser.Args(&address) {
+					return dispenser.ArgErr()
+				}
+				policy, err := parseTokenPolicy(dispenser)
 				if err != nil {
-					return dispenser.Errf("failed to read secret file: %v", err)
+					return err
+				}
+				if address == "default" {
+					d.DefaultPolicy = policy
+					continue
+				}
+				if d.Policies == nil {
+					d.Policies = make(map[string]*TokenPolicy)
 				}
-				d.Secret = string(secret)
+				d.Policies[address] = policy
+			case "metered_methods":
+				methods := dispenser.RemainingArgs()
+				if len(methods) == 0 {
+					return dispenser.ArgErr()
+				}
+				d.MeteredMethods = append(d.MeteredMethods, methods...)
+			case "previous_secret":
+				var secret string
+				if !dispenser.Args(&secret) {
+					return dispenser.ArgErr()
+				}
+				d.PreviousSecrets = append(d.PreviousSecrets, secret)
 			default:
 				return dispenser.Errf("unknown subdirective: %s", dispenser.Val())
 			}
 		}
 	}
-	// If the secret is still empty, generate a random one
-	if d.Secret == "" {
-		secret, err := generateRandomSecret()
-		if err != nil {
-			return dispenser.Errf("failed to generate random secret: %v", err)
-		}
-		d.Secret = secret
-	}
-
+	// The secret file or signing key file is read, or a random key generated, at provision time
 	return nil
 }
 
@@ -0,0 +1,363 @@
+package siwe
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	prom "github.com/DIN-center/din-caddy-plugins/lib/prometheus"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/golang-jwt/jwt/v5"
+	"go.uber.org/zap"
+)
+
+func TestMain(m *testing.M) {
+	// The middleware meters the requests it authenticates
+	prom.RegisterMetrics()
+	os.Exit(m.Run())
+}
+
+func TestSIWEAuthMiddlewareValidate(t *testing.T) {
+	tests := []struct {
+		name       string
+		middleware *SIWEAuthMiddleware
+		hasErr     bool
+	}{
+		{
+			name: "valid config",
+			middleware: &SIWEAuthMiddleware{
+				Secret:    "secret",
+				Whitelist: map[string]struct{}{"0x8f1c4fbcf0a2b5e6e3ea5a8b5a6f5e5d3c2b1a09": {}},
+			},
+			hasErr: false,
+		},
+		{
+			name: "generated secret",
+			middleware: &SIWEAuthMiddleware{
+				Whitelist: map[string]struct{}{"0x8f1c4fbcf0a2b5e6e3ea5a8b5a6f5e5d3c2b1a09": {}},
+			},
+			hasErr: false,
+		},
+		{
+			name: "generated EdDSA key",
+			middleware: &SIWEAuthMiddleware{
+				Algorithm: AlgorithmEdDSA,
+				Whitelist: map[string]struct{}{"0x8f1c4fbcf0a2b5e6e3ea5a8b5a6f5e5d3c2b1a09": {}},
+			},
+			hasErr: false,
+		},
+		{
+			name: "secret with ES256",
+			middleware: &SIWEAuthMiddleware{
+				Algorithm: AlgorithmES256,
+				Secret:    "secret",
+				Whitelist: map[string]struct{}{"0x8f1c4fbcf0a2b5e6e3ea5a8b5a6f5e5d3c2b1a09": {}},
+			},
+			hasErr: true,
+		},
+		{
+			name: "empty whitelist",
+			middleware: &SIWEAuthMiddleware{
+				Secret:    "secret",
+				Whitelist: map[string]struct{}{},
+			},
+			hasErr: true,
+		},
+		{
+			name: "invalid whitelist address",
+			middleware: &SIWEAuthMiddleware{
+				Secret:    "secret",
+				Whitelist: map[string]struct{}{"not-an-address": {}},
+			},
+			hasErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.middleware.Provision(caddy.Context{}); err != nil {
+				t.Fatalf("Provision() = %v", err)
+			}
+			err := tt.middleware.Validate()
+			if (err != nil) != tt.hasErr {
+				t.Errorf("Validate() = %v, want error %v", err, tt.hasErr)
+			}
+		})
+	}
+}
+
+func TestSIWEAuthMiddlewareProvisionChecksumsWhitelist(t *testing.T) {
+	middleware := &SIWEAuthMiddleware{
+		Secret:    "secret",
+		Whitelist: map[string]struct{}{"0x8f1c4fbcf0a2b5e6e3ea5a8b5a6f5e5d3c2b1a09": {}},
+	}
+	if err := middleware.Provision(caddy.Context{}); err != nil {
+		t.Fatalf("Provision() = %v", err)
+	}
+	checksummed := common.HexToAddress("0x8f1c4fbcf0a2b5e6e3ea5a8b5a6f5e5d3c2b1a09").Hex()
+	if _, ok := middleware.Whitelist[checksummed]; !ok {
+		t.Errorf("expected whitelist to contain the checksummed address, got %v", middleware.Whitelist)
+	}
+}
+
+func TestSIWEAuthMiddlewareProvisionSecret(t *testing.T) {
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(secretFile, []byte("file-secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("DIN_AUTH_TEST_SECRET", "env-secret")
+
+	tests := []struct {
+		name       string
+		middleware *SIWEAuthMiddleware
+		expected   string
+		hasErr     bool
+	}{
+		{
+			name:       "inline secret",
+			middleware: &SIWEAuthMiddleware{Secret: "secret"},
+			expected:   "secret",
+		},
+		{
+			name:       "secret placeholder",
+			middleware: &SIWEAuthMiddleware{Secret: "{env.DIN_AUTH_TEST_SECRET}"},
+			expected:   "env-secret",
+		},
+		{
+			name:       "secret file",
+			middleware: &SIWEAuthMiddleware{SecretFile: secretFile},
+			expected:   "file-secret",
+		},
+		{
+			name:       "missing secret file",
+			middleware: &SIWEAuthMiddleware{SecretFile: filepath.Join(t.TempDir(), "missing")},
+			hasErr:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.middleware.Provision(caddy.Context{})
+			if (err != nil) != tt.hasErr {
+				t.Fatalf("Provision() = %v, want error %v", err, tt.hasErr)
+			}
+			if !tt.hasErr && tt.middleware.Secret != tt.expected {
+				t.Errorf("expected secret %q, got %q", tt.expected, tt.middleware.Secret)
+			}
+		})
+	}
+}
+
+func TestSIWEAuthMiddlewareSecretRotation(t *testing.T) {
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(secretFile, []byte("secret-1"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	key, _ := crypto.GenerateKey()
+	signer := &SigningConfig{PrivateKey: crypto.FromECDSA(key)}
+	middleware := &SIWEAuthMiddleware{
+		SecretFile:      secretFile,
+		PreviousSecrets: []string{"secret-0"},
+		Whitelist:       map[string]struct{}{crypto.PubkeyToAddress(key.PublicKey).String(): {}},
+	}
+	if err := middleware.Provision(caddy.Context{}); err != nil {
+		t.Fatalf("Provision() = %v", err)
+	}
+	defer middleware.Cleanup()
+
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.WriteHeader(http.StatusOK)
+		return nil
+	})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		middleware.ServeHTTP(w, r, next)
+	}))
+	defer server.Close()
+	status := func(token string) int {
+		req, _ := http.NewRequest(http.MethodPost, server.URL+"/eth", nil)
+		req.Header.Set("x-api-key", token)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	sign := func(secret string, kid string) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, &jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute))})
+		if kid != "" {
+			token.Header["kid"] = kid
+		}
+		tokenString, err := token.SignedString([]byte(secret))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tokenString
+	}
+
+	client := NewSIWEClient(server.URL+"/auth", 1, signer)
+	if err := client.Start(zap.NewNop()); err != nil {
+		t.Fatal(err)
+	}
+	oldToken := client.SessionTokens[0].Headers["x-api-key"]
+	if code := status(oldToken); code != http.StatusOK {
+		t.Errorf("expected a token signed with the current secret to be accepted, got %d", code)
+	}
+	if code := status(sign("secret-0", newHMACKey("secret-0").kid)); code != http.StatusOK {
+		t.Errorf("expected a token signed with a previous secret to be accepted, got %d", code)
+	}
+	if code := status(sign("secret-1", "")); code != http.StatusOK {
+		t.Errorf("expected a token without kid signed with the current secret to be accepted, got %d", code)
+	}
+	if code := status(sign("other-secret", newHMACKey("other-secret").kid)); code != http.StatusForbidden {
+		t.Errorf("expected a token signed with an unknown secret to be rejected, got %d", code)
+	}
+
+	// Rotate the secret. Tokens signed with the previous secret stay valid until they expire.
+	if err := os.WriteFile(secretFile, []byte("secret-2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := middleware.reloadKey(secretFile, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	newToken := client.SessionTokens[0].Headers["x-api-key"]
+	if code := status(newToken); code != http.StatusOK {
+		t.Errorf("expected a token signed with the rotated secret to be accepted, got %d", code)
+	}
+	if code := status(oldToken); code != http.StatusOK {
+		t.Errorf("expected a token signed before the rotation to be accepted, got %d", code)
+	}
+	if code := status(sign("secret-1", "")); code != http.StatusForbidden {
+		t.Errorf("expected a token without kid signed with the retired secret to be rejected, got %d", code)
+	}
+	if _, ok := middleware.keys.verification(newHMACKey("secret-1").kid, time.Now().Add(SessionTokenLifetime+time.Minute)); ok {
+		t.Errorf("expected the retired secret to be dropped once the tokens signed with it have expired")
+	}
+}
+
+func TestSIWEAuthMiddlewareJWKS(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, _ := x509.MarshalPKCS8PrivateKey(ecKey)
+	keyFile := filepath.Join(t.TempDir(), "signing-key.pem")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		middleware *SIWEAuthMiddleware
+		kty        string
+		hasErr     bool
+	}{
+		{name: "ES256 signing key file", middleware: &SIWEAuthMiddleware{Algorithm: AlgorithmES256, SigningKeyFile: keyFile}, kty: "EC"},
+		{name: "generated EdDSA key", middleware: &SIWEAuthMiddleware{Algorithm: AlgorithmEdDSA}, kty: "OKP"},
+		{name: "ES256 key for EdDSA", middleware: &SIWEAuthMiddleware{Algorithm: AlgorithmEdDSA, SigningKeyFile: keyFile}, hasErr: true},
+		{name: "unsupported algorithm", middleware: &SIWEAuthMiddleware{Algorithm: "RS256"}, hasErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, _ := crypto.GenerateKey()
+			tt.middleware.Whitelist = map[string]struct{}{crypto.PubkeyToAddress(key.PublicKey).String(): {}}
+			err := tt.middleware.Provision(caddy.Context{})
+			if tt.hasErr {
+				if err == nil {
+					t.Errorf("expected a provision error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Provision() = %v", err)
+			}
+			defer tt.middleware.Cleanup()
+			if err := tt.middleware.Validate(); err != nil {
+				t.Fatalf("Validate() = %v", err)
+			}
+
+			next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				w.WriteHeader(http.StatusOK)
+				return nil
+			})
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				tt.middleware.ServeHTTP(w, r, next)
+			}))
+			defer server.Close()
+
+			client := NewSIWEClient(server.URL+"/auth", 1, &SigningConfig{PrivateKey: crypto.FromECDSA(key)})
+			if err := client.Start(zap.NewNop()); err != nil {
+				t.Fatal(err)
+			}
+			tokenString := client.SessionTokens[0].Headers["x-api-key"]
+
+			res, err := http.Get(server.URL + JWKSPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+			var set jwks
+			if err := json.NewDecoder(res.Body).Decode(&set); err != nil {
+				t.Fatal(err)
+			}
+			if len(set.Keys) != 1 || set.Keys[0].Kty != tt.kty {
+				t.Fatalf("expected a single %s key, got %+v", tt.kty, set.Keys)
+			}
+
+			// The token is verified with the published public key alone, as a node without the signing key would
+			_, err = jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+				if token.Header["kid"] != set.Keys[0].Kid {
+					return nil, fmt.Errorf("unexpected kid %v", token.Header["kid"])
+				}
+				return publicKeyFromJWK(t, set.Keys[0]), nil
+			}, jwt.WithValidMethods([]string{set.Keys[0].Alg}))
+			if err != nil {
+				t.Errorf("expected the token to verify with the published key: %v", err)
+			}
+		})
+	}
+}
+
+func TestSIWEAuthMiddlewareJWKSWithHS256(t *testing.T) {
+	middleware := &SIWEAuthMiddleware{Secret: "secret"}
+	if err := middleware.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	middleware.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, JWKSPath, nil), nil)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected no keys to be published for HS256, got %d", rec.Code)
+	}
+}
+
+func publicKeyFromJWK(t *testing.T, k jwk) interface{} {
+	x, err := base64.RawURLEncoding.DecodeString(k.X)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.Kty == "OKP" {
+		return ed25519.PublicKey(x)
+	}
+	y, err := base64.RawURLEncoding.DecodeString(k.Y)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+}
@@ -0,0 +1,116 @@
+package siwe
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// sessionKey is a key session tokens are signed and verified with, identified by the kid header of the tokens
+type sessionKey struct {
+	kid    string
+	method jwt.SigningMethod
+	// The key tokens are signed with: the secret for HS256, the private key for ES256 and EdDSA
+	signingKey interface{}
+	// The key tokens are verified with: the secret for HS256, the public key for ES256 and EdDSA
+	verificationKey interface{}
+	// Tokens signed with a retired key are accepted until then. Zero for keys that are not retired.
+	retiredUntil time.Time
+}
+
+// newHMACKey returns the HS256 session key of the secret. The kid is derived from the secret, so that it is the same
+// across reloads and instances sharing the secret, without revealing it.
+func newHMACKey(secret string) sessionKey {
+	return sessionKey{
+		kid:             keyID([]byte(secret)),
+		method:          jwt.SigningMethodHS256,
+		signingKey:      []byte(secret),
+		verificationKey: []byte(secret),
+	}
+}
+
+// keyID returns a key id derived from the key material
+func keyID(material []byte) string {
+	sum := sha256.Sum256(material)
+	return hex.EncodeToString(sum[:8])
+}
+
+// accepted returns whether tokens signed with the key are still accepted
+func (k sessionKey) accepted(now time.Time) bool {
+	return k.retiredUntil.IsZero() || now.Before(k.retiredUntil)
+}
+
+// sessionKeys holds the key new session tokens are signed with, and the retired keys the tokens issued before a
+// rotation are still verified with until they expire
+type sessionKeys struct {
+	mu      sync.RWMutex
+	current sessionKey
+	retired []sessionKey
+}
+
+// newSessionKeys returns the session keys signing with the current key, and verifying with the previous keys as well.
+// Previous keys come from a rotation before the last reload, so they are kept until the process exits.
+func newSessionKeys(current sessionKey, previous ...sessionKey) *sessionKeys {
+	return &sessionKeys{current: current, retired: previous}
+}
+
+// signing returns the key new session tokens are signed with
+func (k *sessionKeys) signing() sessionKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.current
+}
+
+// verification returns the key with the kid, if the tokens signed with it are still accepted.
+// Tokens issued without a kid, before keys were rotated, are verified with the current key.
+func (k *sessionKeys) verification(kid string, now time.Time) (sessionKey, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if kid == "" || kid == k.current.kid {
+		return k.current, true
+	}
+	for _, key := range k.retired {
+		if key.kid == kid && key.accepted(now) {
+			return key, true
+		}
+	}
+	return sessionKey{}, false
+}
+
+// accepted returns the current key and the retired keys whose tokens are still accepted
+func (k *sessionKeys) accepted(now time.Time) []sessionKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	keys := []sessionKey{k.current}
+	for _, key := range k.retired {
+		if key.accepted(now) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// rotate makes the key the current key, and retires the previous current key for the lifetime of the tokens
+// signed with it. It returns whether the key changed.
+func (k *sessionKeys) rotate(key sessionKey, now time.Time, tokenLifetime time.Duration) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if key.kid == k.current.kid {
+		return false
+	}
+	retired := k.current
+	retired.retiredUntil = now.Add(tokenLifetime)
+	// Drop the retired keys whose tokens have all expired, and the new key if it was retired before
+	kept := k.retired[:0]
+	for _, r := range k.retired {
+		if r.kid != key.kid && r.accepted(now) {
+			kept = append(kept, r)
+		}
+	}
+	k.retired = append(kept, retired)
+	k.current = key
+	return true
+}
@@ -0,0 +1,56 @@
+package siwe
+
+import (
+	"crypto/ecdsa"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// SignerServer is a reference implementation of the remote signer protocol, see remote_signer.go.
+// It signs messages with a private key held in memory. If Token is set, requests must carry it as a bearer token.
+// TLS client certificates are enforced by the TLS config of the server it is mounted on.
+type SignerServer struct {
+	Key   *ecdsa.PrivateKey
+	Token string
+}
+
+// NewSignerServer returns a signer server for the private key
+func NewSignerServer(key *ecdsa.PrivateKey, token string) *SignerServer {
+	return &SignerServer{Key: key, Token: token}
+}
+
+func (s *SignerServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.Token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+s.Token)) != 1 {
+		s.writeResponse(w, http.StatusUnauthorized, signResponse{Error: "unauthorized"})
+		return
+	}
+	address := crypto.PubkeyToAddress(s.Key.PublicKey).String()
+
+	switch r.Method {
+	case http.MethodGet:
+		s.writeResponse(w, http.StatusOK, signResponse{Address: address})
+	case http.MethodPost:
+		var req signRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Message == "" {
+			s.writeResponse(w, http.StatusBadRequest, signResponse{Error: "expected a message to sign"})
+			return
+		}
+		signature, err := signMessage(req.Message, s.Key)
+		if err != nil {
+			s.writeResponse(w, http.StatusInternalServerError, signResponse{Error: err.Error()})
+			return
+		}
+		s.writeResponse(w, http.StatusOK, signResponse{Address: address, Signature: signature})
+	default:
+		s.writeResponse(w, http.StatusMethodNotAllowed, signResponse{Error: "method not allowed"})
+	}
+}
+
+func (s *SignerServer) writeResponse(w http.ResponseWriter, statusCode int, res signResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(res)
+}
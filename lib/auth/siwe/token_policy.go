@@ -0,0 +1,299 @@
+package siwe
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DIN-center/din-caddy-plugins/lib/auth"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// The largest request body read for the JSON-RPC methods of a request, to check the methods of a token scoped to
+// methods and to meter them
+const MaxScopedRequestSize = 4 << 20
+
+var (
+	ErrNetworkNotAllowed = errors.New("network not allowed for this session")
+	ErrMethodNotAllowed  = errors.New("method not allowed for this session")
+	errRequestTooLarge   = errors.New("request body too large")
+)
+
+// TokenPolicy sets the lifetime, request budget and scope of the session tokens issued to a signer
+type TokenPolicy struct {
+	// The lifetime of the tokens, SessionTokenLifetime if not set
+	TTL caddy.Duration `json:"ttl,omitempty"`
+	// The number of requests a token is good for, unlimited if not set
+	Uses int64 `json:"uses,omitempty"`
+	// The networks a token may be used for, named by the first segment of the request path. Any network if not set.
+	Networks []string `json:"networks,omitempty"`
+	// The JSON-RPC methods a token may be used for. Any method if not set.
+	Methods []string `json:"methods,omitempty"`
+}
+
+func (p *TokenPolicy) validate() error {
+	if p.TTL < 0 {
+		return fmt.Errorf("ttl must not be negative, got %s", time.Duration(p.TTL))
+	}
+	if p.Uses < 0 {
+		return fmt.Errorf("uses must not be negative, got %d", p.Uses)
+	}
+	return nil
+}
+
+// lifetime returns the lifetime of the tokens issued under the policy
+func (p *TokenPolicy) lifetime() time.Duration {
+	if p == nil || p.TTL == 0 {
+		return SessionTokenLifetime
+	}
+	return time.Duration(p.TTL)
+}
+
+// sessionClaims are the claims of a session token. The scope and request budget of the token travel in the token,
+// so that every node verifying it enforces the same policy.
+type sessionClaims struct {
+	jwt.RegisteredClaims
+	Uses     int64    `json:"uses,omitempty"`
+	Networks []string `json:"networks,omitempty"`
+	Methods  []string `json:"methods,omitempty"`
+}
+
+// newSessionClaims returns the claims of a token issued to the address under the policy
+func newSessionClaims(address string, policy *TokenPolicy, issued time.Time) *sessionClaims {
+	claims := &sessionClaims{RegisteredClaims: jwt.RegisteredClaims{
+		ID:        generateTokenID(),
+		Subject:   address,
+		IssuedAt:  jwt.NewNumericDate(issued),
+		ExpiresAt: jwt.NewNumericDate(issued.Add(policy.lifetime())),
+	}}
+	if policy != nil {
+		claims.Uses = policy.Uses
+		claims.Networks = policy.Networks
+		claims.Methods = policy.Methods
+	}
+	return claims
+}
+
+// generateTokenID returns a random id for a session token, which its request budget is counted under
+func generateTokenID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// authToken returns the token the client is handed, carrying the expiration and request budget of the claims
+func (c *sessionClaims) authToken(tokenString string) auth.AuthToken {
+	exp := auth.UnixTime(c.ExpiresAt.Time)
+	token := auth.AuthToken{
+		Headers:    map[string]string{"x-api-key": tokenString},
+		Expiration: &exp,
+	}
+	if c.Uses > 0 {
+		uses := c.Uses
+		token.Uses = &uses
+	}
+	return token
+}
+
+// policyFor returns the token policy of the signer, its own if set or else the default policy
+func (d *SIWEAuthMiddleware) policyFor(address string) *TokenPolicy {
+	if policy, ok := d.Policies[address]; ok {
+		return policy
+	}
+	return d.DefaultPolicy
+}
+
+// maxTokenLifetime returns the lifetime of the longest lived tokens, for which retired keys are kept
+func (d *SIWEAuthMiddleware) maxTokenLifetime() time.Duration {
+	lifetime := d.DefaultPolicy.lifetime()
+	for _, policy := range d.Policies {
+		if l := policy.lifetime(); l > lifetime {
+			lifetime = l
+		}
+	}
+	return lifetime
+}
+
+// enforceScope checks that the request is for a network and methods the token is scoped to. The methods are those
+// read by peekMethods, which fails for bodies that aren't JSON-RPC requests.
+func enforceScope(claims *sessionClaims, network string, methods []string, methodsErr error) (int, error) {
+	if len(claims.Networks) > 0 && !slices.Contains(claims.Networks, network) {
+		return http.StatusForbidden, ErrNetworkNotAllowed
+	}
+	if len(claims.Methods) == 0 {
+		return 0, nil
+	}
+	if errors.Is(methodsErr, errRequestTooLarge) {
+		return http.StatusRequestEntityTooLarge, methodsErr
+	}
+	if methodsErr != nil {
+		return http.StatusBadRequest, methodsErr
+	}
+	if len(methods) == 0 {
+		return http.StatusBadRequest, errors.New("no JSON-RPC request")
+	}
+	for _, method := range methods {
+		if !slices.Contains(claims.Methods, method) {
+			return http.StatusForbidden, fmt.Errorf("%w: %s", ErrMethodNotAllowed, method)
+		}
+	}
+	return 0, nil
+}
+
+// requestNetwork returns the network a request is for, the first segment of its path
+func requestNetwork(r *http.Request) string {
+	network, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	return network
+}
+
+// peekMethods returns the methods of the JSON-RPC request or batch in the request body, and restores the body for the
+// next handler. Bodies larger than MaxScopedRequestSize are not parsed.
+func peekMethods(r *http.Request) ([]string, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, MaxScopedRequestSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > MaxScopedRequestSize {
+		r.Body = readCloser{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		return nil, errRequestTooLarge
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil, nil
+	}
+	return requestMethods(body)
+}
+
+// readCloser reads the peeked start of a request body followed by its rest, and closes the original body
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// requestMethods returns the methods of a JSON-RPC request or batch
+func requestMethods(body []byte) ([]string, error) {
+	type rpcRequest struct {
+		Method string `json:"method"`
+	}
+	var requests []rpcRequest
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(trimmed, &requests); err != nil {
+			return nil, fmt.Errorf("invalid JSON-RPC batch: %w", err)
+		}
+	} else {
+		var request rpcRequest
+		if err := json.Unmarshal(body, &request); err != nil {
+			return nil, fmt.Errorf("invalid JSON-RPC request: %w", err)
+		}
+		requests = append(requests, request)
+	}
+	methods := make([]string, 0, len(requests))
+	for _, request := range requests {
+		methods = append(methods, request.Method)
+	}
+	return methods, nil
+}
+
+// tokenUsage counts the requests made with the tokens that have a request budget.
+// Budgets are counted per node: a token verified by several nodes is good for its uses on each of them.
+type tokenUsage struct {
+	mu   sync.Mutex
+	used map[string]*tokenUses
+	// The expired tokens are swept at most once every SecretReloadInterval
+	lastSweep time.Time
+}
+
+type tokenUses struct {
+	count   int64
+	expires time.Time
+}
+
+func newTokenUsage() *tokenUsage {
+	return &tokenUsage{used: make(map[string]*tokenUses)}
+}
+
+// use counts a request made with the token, and returns false if the token has used up its budget
+func (u *tokenUsage) use(claims *sessionClaims, now time.Time) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if now.Sub(u.lastSweep) >= SecretReloadInterval {
+		u.lastSweep = now
+		for id, uses := range u.used {
+			if !now.Before(uses.expires) {
+				delete(u.used, id)
+			}
+		}
+	}
+	uses, ok := u.used[claims.ID]
+	if !ok {
+		uses = &tokenUses{expires: claims.ExpiresAt.Time}
+		u.used[claims.ID] = uses
+	}
+	if uses.count >= claims.Uses {
+		return false
+	}
+	uses.count++
+	return true
+}
+
+// parseTokenPolicy parses a policy block of the din_auth directive:
+//
+//	policy <address|default> {
+//		ttl 10m
+//		uses 1000
+//		networks eth polygon
+//		methods eth_blockNumber eth_call
+//	}
+func parseTokenPolicy(dispenser *caddyfile.Dispenser) (*TokenPolicy, error) {
+	policy := &TokenPolicy{}
+	for nesting := dispenser.Nesting(); dispenser.NextBlock(nesting); {
+		switch dispenser.Val() {
+		case "ttl":
+			if !dispenser.NextArg() {
+				return nil, dispenser.ArgErr()
+			}
+			ttl, err := caddy.ParseDuration(dispenser.Val())
+			if err != nil {
+				return nil, dispenser.Errf("invalid ttl: %v", err)
+			}
+			policy.TTL = caddy.Duration(ttl)
+		case "uses":
+			if !dispenser.NextArg() {
+				return nil, dispenser.ArgErr()
+			}
+			uses, err := strconv.ParseInt(dispenser.Val(), 10, 64)
+			if err != nil {
+				return nil, dispenser.Errf("invalid uses: %v", err)
+			}
+			policy.Uses = uses
+		case "networks":
+			policy.Networks = dispenser.RemainingArgs()
+			if len(policy.Networks) == 0 {
+				return nil, dispenser.ArgErr()
+			}
+		case "methods":
+			policy.Methods = dispenser.RemainingArgs()
+			if len(policy.Methods) == 0 {
+				return nil, dispenser.ArgErr()
+			}
+		default:
+			return nil, dispenser.Errf("unknown policy option: %s", dispenser.Val())
+		}
+	}
+	return policy, nil
+}
@@ -0,0 +1,173 @@
+package siwe
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/ethereum/go-ethereum/crypto"
+	"go.uber.org/zap"
+)
+
+func TestSIWEAuthMiddlewareTokenPolicy(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	address := crypto.PubkeyToAddress(key.PublicKey).String()
+	middleware := &SIWEAuthMiddleware{
+		Secret:    "secret",
+		Whitelist: map[string]struct{}{address: {}},
+		Policies: map[string]*TokenPolicy{strings.ToLower(address): {
+			TTL:      caddy.Duration(10 * time.Minute),
+			Uses:     2,
+			Networks: []string{"eth"},
+			Methods:  []string{"eth_blockNumber", "eth_chainId"},
+		}},
+	}
+	if err := middleware.Provision(caddy.Context{}); err != nil {
+		t.Fatalf("Provision() = %v", err)
+	}
+	defer middleware.Cleanup()
+	if err := middleware.Validate(); err != nil {
+		t.Fatalf("Validate() = %v", err)
+	}
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.WriteHeader(http.StatusOK)
+		return nil
+	})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		middleware.ServeHTTP(w, r, next)
+	}))
+	defer server.Close()
+
+	client := NewSIWEClient(server.URL+"/auth", 1, &SigningConfig{PrivateKey: crypto.FromECDSA(key)})
+	if err := client.Start(zap.NewNop()); err != nil {
+		t.Fatal(err)
+	}
+	token := client.SessionTokens[0]
+	if token.Uses == nil || *token.Uses != 2 {
+		t.Errorf("expected the token to carry 2 uses, got %v", token.Uses)
+	}
+	if ttl := time.Until(time.Time(*token.Expiration)); ttl > 10*time.Minute || ttl < 9*time.Minute {
+		t.Errorf("expected the token to expire in 10m, got %v", ttl)
+	}
+
+	status := func(path string, body string) int {
+		req, _ := http.NewRequest(http.MethodPost, server.URL+path, strings.NewReader(body))
+		req.Header.Set("x-api-key", token.Headers["x-api-key"])
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	tests := []struct {
+		name string
+		path string
+		body string
+		code int
+	}{
+		{"network not allowed", "/polygon", `{"method":"eth_blockNumber"}`, http.StatusForbidden},
+		{"method not allowed", "/eth", `{"method":"eth_call"}`, http.StatusForbidden},
+		{"batch with a method not allowed", "/eth", `[{"method":"eth_blockNumber"},{"method":"eth_call"}]`, http.StatusForbidden},
+		{"invalid body", "/eth", `not json`, http.StatusBadRequest},
+		{"allowed", "/eth", `{"method":"eth_blockNumber"}`, http.StatusOK},
+		{"allowed batch", "/eth/", `[{"method":"eth_blockNumber"},{"method":"eth_chainId"}]`, http.StatusOK},
+		{"budget used up", "/eth", `{"method":"eth_blockNumber"}`, http.StatusTooManyRequests},
+	}
+	for _, tt := range tests {
+		if code := status(tt.path, tt.body); code != tt.code {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.code, code)
+		}
+	}
+}
+
+func TestSIWEAuthMiddlewareDefaultPolicy(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	middleware := &SIWEAuthMiddleware{
+		Secret:        "secret",
+		Whitelist:     map[string]struct{}{crypto.PubkeyToAddress(key.PublicKey).String(): {}},
+		DefaultPolicy: &TokenPolicy{TTL: caddy.Duration(2 * time.Hour)},
+	}
+	if err := middleware.Provision(caddy.Context{}); err != nil {
+		t.Fatalf("Provision() = %v", err)
+	}
+	defer middleware.Cleanup()
+	if lifetime := middleware.maxTokenLifetime(); lifetime != 2*time.Hour {
+		t.Errorf("expected retired keys to be kept for 2h, got %v", lifetime)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		middleware.ServeHTTP(w, r, nil)
+	}))
+	defer server.Close()
+
+	client := NewSIWEClient(server.URL+"/auth", 1, &SigningConfig{PrivateKey: crypto.FromECDSA(key)})
+	if err := client.Start(zap.NewNop()); err != nil {
+		t.Fatal(err)
+	}
+	token := client.SessionTokens[0]
+	if token.Uses != nil {
+		t.Errorf("expected a token without a budget, got %d uses", *token.Uses)
+	}
+	if ttl := time.Until(time.Time(*token.Expiration)); ttl < 119*time.Minute {
+		t.Errorf("expected the token to expire in 2h, got %v", ttl)
+	}
+}
+
+func TestSIWEAuthMiddlewareValidatePolicies(t *testing.T) {
+	address := "0x9Ab1a6D2B5F4b87F5d0b5D3E1c0B6f2fA4A7c9E1"
+	tests := []struct {
+		name     string
+		policies map[string]*TokenPolicy
+		wantErr  bool
+	}{
+		{"valid", map[string]*TokenPolicy{address: {Uses: 10}}, false},
+		{"not whitelisted", map[string]*TokenPolicy{"0x0000000000000000000000000000000000000001": {}}, true},
+		{"negative uses", map[string]*TokenPolicy{address: {Uses: -1}}, true},
+		{"negative ttl", map[string]*TokenPolicy{address: {TTL: caddy.Duration(-time.Minute)}}, true},
+	}
+	for _, tt := range tests {
+		middleware := &SIWEAuthMiddleware{Secret: "secret", Algorithm: AlgorithmHS256, Whitelist: map[string]struct{}{address: {}}, Policies: tt.policies}
+		if err := middleware.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: Validate() = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestSIWEAuthMiddlewareCaddyfilePolicy(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`din_auth {
+		whitelist 0x9Ab1a6D2B5F4b87F5d0b5D3E1c0B6f2fA4A7c9E1
+		policy default {
+			ttl 30m
+		}
+		policy 0x9Ab1a6D2B5F4b87F5d0b5D3E1c0B6f2fA4A7c9E1 {
+			uses 1000
+			networks eth polygon
+			methods eth_blockNumber eth_call
+		}
+	}`)
+	middleware := &SIWEAuthMiddleware{}
+	if err := middleware.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("UnmarshalCaddyfile() = %v", err)
+	}
+	if middleware.DefaultPolicy == nil || time.Duration(middleware.DefaultPolicy.TTL) != 30*time.Minute {
+		t.Errorf("expected a default policy with a 30m ttl, got %+v", middleware.DefaultPolicy)
+	}
+	policy := middleware.Policies["0x9Ab1a6D2B5F4b87F5d0b5D3E1c0B6f2fA4A7c9E1"]
+	if policy == nil || policy.Uses != 1000 || len(policy.Networks) != 2 || len(policy.Methods) != 2 {
+		t.Errorf("unexpected policy %+v", policy)
+	}
+
+	d = caddyfile.NewTestDispenser(`din_auth {
+		policy default {
+			budget 10
+		}
+	}`)
+	if err := (&SIWEAuthMiddleware{}).UnmarshalCaddyfile(d); err == nil {
+		t.Errorf("expected an unknown policy option to be rejected")
+	}
+}
@@ -0,0 +1,165 @@
+package siwe
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"go.uber.org/zap"
+)
+
+// The whitelist file is read again every WhitelistReloadInterval, to pick up added and removed signers
+const WhitelistReloadInterval = 10 * time.Second
+
+var ErrSignerRevoked = errors.New("signer no longer whitelisted")
+
+// signerSet is the set of signers allowed to open sessions, the union of the static whitelist and the whitelist file,
+// plus the signers added on the admin API, minus the signers removed on it.
+// When a signer leaves the set, the tokens issued to it before are revoked, even if it is added back later.
+type signerSet struct {
+	mu      sync.RWMutex
+	static  map[string]struct{}
+	file    map[string]struct{}
+	allowed map[string]struct{}
+	// The time each signer was last removed. Kept for the lifetime of the tokens issued before.
+	revoked       map[string]time.Time
+	tokenLifetime time.Duration
+}
+
+func newSignerSet(static map[string]struct{}, tokenLifetime time.Duration) *signerSet {
+	s := &signerSet{
+		static:        static,
+		allowed:       make(map[string]struct{}),
+		revoked:       make(map[string]time.Time),
+		tokenLifetime: tokenLifetime,
+	}
+	s.update(time.Now())
+	return s
+}
+
+// contains returns whether the signer may open a session
+func (s *signerSet) contains(address string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.allowed[address]
+	return ok
+}
+
+// accepts returns whether a token issued to the signer at the time is still accepted
+func (s *signerSet) accepts(address string, issued time.Time) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if _, ok := s.allowed[address]; !ok {
+		return false
+	}
+	revoked, ok := s.revoked[address]
+	return !ok || issued.After(revoked)
+}
+
+// list returns the allowed signers, sorted
+func (s *signerSet) list() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	addresses := make([]string, 0, len(s.allowed))
+	for address := range s.allowed {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+	return addresses
+}
+
+// setFile replaces the signers of the whitelist file, and returns the signers removed from the set
+func (s *signerSet) setFile(addresses map[string]struct{}, now time.Time) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.file = addresses
+	return s.updateLocked(now)
+}
+
+// update recomputes the set after a change on the admin API, and returns the signers removed from the set
+func (s *signerSet) update(now time.Time) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.updateLocked(now)
+}
+
+func (s *signerSet) updateLocked(now time.Time) []string {
+	allowed := make(map[string]struct{}, len(s.static)+len(s.file))
+	for _, source := range []map[string]struct{}{s.static, s.file} {
+		for address := range source {
+			allowed[address] = struct{}{}
+		}
+	}
+	adminWhitelist.apply(allowed)
+	var removed []string
+	for address := range s.allowed {
+		if _, ok := allowed[address]; !ok {
+			removed = append(removed, address)
+			s.revoked[address] = now
+		}
+	}
+	for address, revoked := range s.revoked {
+		if now.Sub(revoked) > s.tokenLifetime {
+			delete(s.revoked, address)
+		}
+	}
+	s.allowed = allowed
+	sort.Strings(removed)
+	return removed
+}
+
+// parseWhitelistFile parses a whitelist file: one address per line, with blank lines and lines starting with # ignored
+func parseWhitelistFile(data []byte) (map[string]struct{}, error) {
+	addresses := make(map[string]struct{})
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		address := strings.TrimSpace(scanner.Text())
+		if address == "" || strings.HasPrefix(address, "#") {
+			continue
+		}
+		if !common.IsHexAddress(address) {
+			return nil, fmt.Errorf("line %d: %q is not a hex address", line, address)
+		}
+		addresses[common.HexToAddress(address).Hex()] = struct{}{}
+	}
+	return addresses, scanner.Err()
+}
+
+// reloadWhitelistFile reads the whitelist file into the signer set. The previous signers are kept if it can't be read.
+func (d *SIWEAuthMiddleware) reloadWhitelistFile(path string, now time.Time) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read whitelist file: %v", err)
+	}
+	addresses, err := parseWhitelistFile(data)
+	if err != nil {
+		return fmt.Errorf("invalid whitelist file: %v", err)
+	}
+	if removed := d.signers.setFile(addresses, now); len(removed) > 0 {
+		d.logger.Info("Signers removed from the whitelist file, their tokens are revoked", zap.Strings("addresses", removed))
+	}
+	return nil
+}
+
+// watchWhitelist reads the whitelist file every WhitelistReloadInterval, to pick up added and removed signers
+func (d *SIWEAuthMiddleware) watchWhitelist(path string) {
+	ticker := time.NewTicker(WhitelistReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.quit:
+			return
+		case <-ticker.C:
+			if err := d.reloadWhitelistFile(path, time.Now()); err != nil {
+				d.logger.Warn("Error reloading whitelist file", zap.String("file", path), zap.Error(err))
+			}
+		}
+	}
+}
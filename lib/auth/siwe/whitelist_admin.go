@@ -0,0 +1,180 @@
+package siwe
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+var (
+	// din_auth Whitelist Admin API Module
+	_ caddy.Module      = (*WhitelistAdmin)(nil)
+	_ caddy.AdminRouter = (*WhitelistAdmin)(nil)
+)
+
+// The admin API path of the din_auth whitelist
+const WhitelistAdminPath = "/din_auth/whitelist"
+
+// adminWhitelist holds the signers added and removed on the admin API, which apply to every din_auth handler.
+// They outlive config reloads, but not a restart: permanent changes belong in the config or the whitelist file.
+var adminWhitelist = &adminSigners{
+	added:    make(map[string]struct{}),
+	removed:  make(map[string]struct{}),
+	handlers: make(map[*signerSet]struct{}),
+}
+
+type adminSigners struct {
+	mu      sync.Mutex
+	added   map[string]struct{}
+	removed map[string]struct{}
+	// The signer sets of the provisioned din_auth handlers, updated when the admin signers change
+	handlers map[*signerSet]struct{}
+}
+
+// apply adds the signers added on the admin API to the allowed signers, and drops the removed ones
+func (a *adminSigners) apply(allowed map[string]struct{}) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for address := range a.added {
+		allowed[address] = struct{}{}
+	}
+	for address := range a.removed {
+		delete(allowed, address)
+	}
+}
+
+func (a *adminSigners) register(s *signerSet) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.handlers[s] = struct{}{}
+}
+
+func (a *adminSigners) unregister(s *signerSet) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.handlers, s)
+}
+
+// set adds or removes a signer, and updates the signer sets of the din_auth handlers
+func (a *adminSigners) set(address string, allow bool) {
+	a.mu.Lock()
+	if allow {
+		a.added[address] = struct{}{}
+		delete(a.removed, address)
+	} else {
+		a.removed[address] = struct{}{}
+		delete(a.added, address)
+	}
+	handlers := make([]*signerSet, 0, len(a.handlers))
+	for s := range a.handlers {
+		handlers = append(handlers, s)
+	}
+	a.mu.Unlock()
+	// The handler sets read the admin signers while updating, so they are updated without holding the lock
+	now := time.Now()
+	for _, s := range handlers {
+		s.update(now)
+	}
+}
+
+// whitelistStatus is the din_auth whitelist shown on the admin API
+type whitelistStatus struct {
+	// The signers allowed by any din_auth handler
+	Allowed []string `json:"allowed"`
+	// The signers added and removed on the admin API
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+}
+
+func (a *adminSigners) status() whitelistStatus {
+	a.mu.Lock()
+	status := whitelistStatus{Added: sortedAddresses(a.added), Removed: sortedAddresses(a.removed)}
+	handlers := make([]*signerSet, 0, len(a.handlers))
+	for s := range a.handlers {
+		handlers = append(handlers, s)
+	}
+	a.mu.Unlock()
+	allowed := make(map[string]struct{})
+	for _, s := range handlers {
+		for _, address := range s.list() {
+			allowed[address] = struct{}{}
+		}
+	}
+	status.Allowed = sortedAddresses(allowed)
+	return status
+}
+
+func sortedAddresses(set map[string]struct{}) []string {
+	addresses := make([]string, 0, len(set))
+	for address := range set {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+	return addresses
+}
+
+// WhitelistAdmin manages the din_auth whitelist on the Caddy admin API:
+//
+//	GET    /din_auth/whitelist            lists the allowed signers, and those added and removed on the admin API
+//	POST   /din_auth/whitelist            adds the signer {"address": "0x..."}
+//	DELETE /din_auth/whitelist/<address>  removes the signer, whatever whitelist it comes from, and revokes its tokens
+type WhitelistAdmin struct{}
+
+// CaddyModule returns the Caddy module information.
+func (WhitelistAdmin) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.din_auth",
+		New: func() caddy.Module { return new(WhitelistAdmin) },
+	}
+}
+
+// Routes returns the admin routes of the din_auth whitelist
+func (a *WhitelistAdmin) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: WhitelistAdminPath,
+			Handler: caddy.AdminHandlerFunc(a.handleWhitelist),
+		},
+		{
+			Pattern: WhitelistAdminPath + "/",
+			Handler: caddy.AdminHandlerFunc(a.handleWhitelist),
+		},
+	}
+}
+
+func (a *WhitelistAdmin) handleWhitelist(w http.ResponseWriter, r *http.Request) error {
+	address := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, WhitelistAdminPath), "/")
+	switch {
+	case r.Method == http.MethodGet && address == "":
+	case r.Method == http.MethodPost && address == "":
+		var body struct {
+			Address string `json:"address"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("invalid request body: %v", err)}
+		}
+		if !common.IsHexAddress(body.Address) {
+			return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("%q is not a hex address", body.Address)}
+		}
+		adminWhitelist.set(common.HexToAddress(body.Address).Hex(), true)
+	case r.Method == http.MethodDelete && address != "":
+		if !common.IsHexAddress(address) {
+			return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("%q is not a hex address", address)}
+		}
+		adminWhitelist.set(common.HexToAddress(address).Hex(), false)
+	default:
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(adminWhitelist.status())
+}
@@ -0,0 +1,218 @@
+package siwe
+
+import (
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// whitelistTestServer serves the middleware, and returns a function opening a session for a key and a function
+// returning the status of a request made with a session token
+func whitelistTestServer(t *testing.T, middleware *SIWEAuthMiddleware) (func(*ecdsa.PrivateKey) (string, error), func(string) int) {
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.WriteHeader(http.StatusOK)
+		return nil
+	})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		middleware.ServeHTTP(w, r, next)
+	}))
+	t.Cleanup(server.Close)
+	u, _ := url.Parse(server.URL)
+	open := func(key *ecdsa.PrivateKey) (string, error) {
+		client := NewSIWEClient(server.URL+"/auth", 1, &SigningConfig{PrivateKey: crypto.FromECDSA(key)})
+		client.domain = u.Hostname()
+		token, err := client.GetToken(nil)
+		return token.Headers["x-api-key"], err
+	}
+	status := func(token string) int {
+		req, _ := http.NewRequest(http.MethodPost, server.URL+"/eth", nil)
+		req.Header.Set("x-api-key", token)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	return open, status
+}
+
+func TestSIWEAuthMiddlewareWhitelistFile(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	address := crypto.PubkeyToAddress(key.PublicKey).String()
+	whitelistFile := filepath.Join(t.TempDir(), "whitelist")
+	if err := os.WriteFile(whitelistFile, []byte("# gateways\n"+strings.ToLower(address)+"\n\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	middleware := &SIWEAuthMiddleware{Secret: "secret", WhitelistFile: whitelistFile}
+	if err := middleware.Provision(caddy.Context{}); err != nil {
+		t.Fatalf("Provision() = %v", err)
+	}
+	defer middleware.Cleanup()
+	if err := middleware.Validate(); err != nil {
+		t.Fatalf("Validate() = %v", err)
+	}
+	open, status := whitelistTestServer(t, middleware)
+
+	token, err := open(key)
+	if err != nil {
+		t.Fatalf("expected a signer of the whitelist file to open a session, got %v", err)
+	}
+	if code := status(token); code != http.StatusOK {
+		t.Errorf("expected the token to be accepted, got %d", code)
+	}
+
+	// An invalid file keeps the previous signers
+	if err := os.WriteFile(whitelistFile, []byte("not-an-address\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := middleware.reloadWhitelistFile(whitelistFile, time.Now()); err == nil {
+		t.Errorf("expected an invalid whitelist file to be rejected")
+	}
+	if code := status(token); code != http.StatusOK {
+		t.Errorf("expected the token to be accepted after an invalid reload, got %d", code)
+	}
+
+	if err := os.WriteFile(whitelistFile, []byte(""), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := middleware.reloadWhitelistFile(whitelistFile, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if code := status(token); code != http.StatusUnauthorized {
+		t.Errorf("expected the token of a removed signer to be revoked, got %d", code)
+	}
+	if _, err := open(key); err == nil {
+		t.Errorf("expected a removed signer not to open a session")
+	}
+}
+
+func TestWhitelistAdmin(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	address := crypto.PubkeyToAddress(key.PublicKey).String()
+	other, _ := crypto.GenerateKey()
+	otherAddress := crypto.PubkeyToAddress(other.PublicKey).String()
+	defer func() {
+		adminWhitelist.mu.Lock()
+		delete(adminWhitelist.added, address)
+		delete(adminWhitelist.removed, otherAddress)
+		adminWhitelist.mu.Unlock()
+	}()
+
+	middleware := &SIWEAuthMiddleware{Secret: "secret", Whitelist: map[string]struct{}{otherAddress: {}}}
+	if err := middleware.Provision(caddy.Context{}); err != nil {
+		t.Fatalf("Provision() = %v", err)
+	}
+	defer middleware.Cleanup()
+	open, status := whitelistTestServer(t, middleware)
+	admin := func(method string, path string, body string) (int, whitelistStatus) {
+		rec := httptest.NewRecorder()
+		var status whitelistStatus
+		if err := new(WhitelistAdmin).handleWhitelist(rec, httptest.NewRequest(method, path, strings.NewReader(body))); err != nil {
+			var apiErr caddy.APIError
+			if errors.As(err, &apiErr) {
+				return apiErr.HTTPStatus, status
+			}
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+			t.Fatal(err)
+		}
+		return http.StatusOK, status
+	}
+
+	if _, err := open(key); err == nil {
+		t.Fatalf("expected a signer that isn't whitelisted not to open a session")
+	}
+	if code, _ := admin(http.MethodPost, WhitelistAdminPath, `{"address": "`+strings.ToLower(address)+`"}`); code != http.StatusOK {
+		t.Fatalf("expected the signer to be added, got %d", code)
+	}
+	token, err := open(key)
+	if err != nil {
+		t.Fatalf("expected a signer added on the admin API to open a session, got %v", err)
+	}
+	if code := status(token); code != http.StatusOK {
+		t.Errorf("expected the token to be accepted, got %d", code)
+	}
+
+	otherToken, err := open(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, whitelist := admin(http.MethodDelete, WhitelistAdminPath+"/"+otherAddress, "")
+	if code != http.StatusOK {
+		t.Fatalf("expected the signer to be removed, got %d", code)
+	}
+	if code := status(otherToken); code != http.StatusUnauthorized {
+		t.Errorf("expected the token of a signer removed on the admin API to be revoked, got %d", code)
+	}
+	if !strings.Contains(strings.Join(whitelist.Allowed, ","), address) || strings.Contains(strings.Join(whitelist.Allowed, ","), otherAddress) {
+		t.Errorf("unexpected allowed signers %v", whitelist.Allowed)
+	}
+	if len(whitelist.Removed) == 0 || whitelist.Removed[0] != otherAddress {
+		t.Errorf("expected the removed signer to be listed, got %v", whitelist.Removed)
+	}
+
+	if code, _ := admin(http.MethodPost, WhitelistAdminPath, `{"address": "nope"}`); code != http.StatusBadRequest {
+		t.Errorf("expected an invalid address to be rejected, got %d", code)
+	}
+	if code, _ := admin(http.MethodPut, WhitelistAdminPath, ""); code != http.StatusMethodNotAllowed {
+		t.Errorf("expected an unsupported method to be rejected, got %d", code)
+	}
+}
+
+func TestSignerSetRevocation(t *testing.T) {
+	address := "0x0000000000000000000000000000000000000001"
+	now := time.Now()
+	s := newSignerSet(map[string]struct{}{}, time.Hour)
+	s.setFile(map[string]struct{}{address: {}}, now)
+	if !s.accepts(address, now) {
+		t.Errorf("expected the token of a whitelisted signer to be accepted")
+	}
+	if removed := s.setFile(nil, now.Add(time.Minute)); len(removed) != 1 || removed[0] != address {
+		t.Errorf("expected the signer to be removed, got %v", removed)
+	}
+	s.setFile(map[string]struct{}{address: {}}, now.Add(2*time.Minute))
+	if s.accepts(address, now) {
+		t.Errorf("expected a token issued before the signer was removed to stay revoked once it is added back")
+	}
+	if !s.accepts(address, now.Add(2*time.Minute)) {
+		t.Errorf("expected a token issued after the signer was added back to be accepted")
+	}
+	// Revocations are forgotten once the tokens issued before have expired
+	s.setFile(map[string]struct{}{address: {}}, now.Add(2*time.Hour))
+	if _, ok := s.revoked[address]; ok {
+		t.Errorf("expected the revocation to be dropped after the token lifetime")
+	}
+}
+
+func TestSIWEAuthMiddlewareCaddyfileWhitelistSources(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`din_auth {
+		whitelist_file /etc/din/whitelist
+	}`)
+	middleware := &SIWEAuthMiddleware{}
+	if err := middleware.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("UnmarshalCaddyfile() = %v", err)
+	}
+	if middleware.WhitelistFile != "/etc/din/whitelist" {
+		t.Errorf("unexpected whitelist file %q", middleware.WhitelistFile)
+	}
+
+	middleware = &SIWEAuthMiddleware{Secret: "secret", Algorithm: AlgorithmHS256}
+	if err := middleware.Validate(); err == nil {
+		t.Errorf("expected a middleware without whitelist sources to be rejected")
+	}
+}
@@ -2,6 +2,7 @@ package http
 
 import (
 	"bytes"
+	"crypto/tls"
 	"io"
 	"net"
 	"net/http"
@@ -13,24 +14,38 @@ import (
 	"github.com/pkg/errors"
 )
 
+// DefaultRequestTimeout bounds the time a request of the client takes, including reading the response body,
+// so that a provider that doesn't answer can't hold up a health check indefinitely
+const DefaultRequestTimeout = 10 * time.Second
+
 type HTTPClient struct {
 	httpClient *http.Client
 }
 
 func NewHTTPClient() *HTTPClient {
-	return &HTTPClient{
-		httpClient: &http.Client{Transport: &http.Transport{
-			Proxy: http.ProxyFromEnvironment,
-			DialContext: (&net.Dialer{
-				Timeout:   30 * time.Second,
-				KeepAlive: 30 * time.Second,
-			}).DialContext,
-			MaxIdleConnsPerHost:   16,
-			MaxIdleConns:          16,
-			IdleConnTimeout:       90 * time.Second,
-			TLSHandshakeTimeout:   10 * time.Second,
-			ExpectContinueTimeout: 1 * time.Second,
-		}},
+	return NewHTTPClientWithTransport(NewTransport(nil))
+}
+
+// NewHTTPClientWithTransport returns a client sending its requests with the transport, such as one with the TLS
+// settings of a provider
+func NewHTTPClientWithTransport(transport http.RoundTripper) *HTTPClient {
+	return &HTTPClient{httpClient: &http.Client{Transport: transport, Timeout: DefaultRequestTimeout}}
+}
+
+// NewTransport returns the transport requests to providers are sent with, using the TLS config if not nil
+func NewTransport(tlsConfig *tls.Config) *http.Transport {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:       tlsConfig,
+		MaxIdleConnsPerHost:   16,
+		MaxIdleConns:          16,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
 	}
 }
 
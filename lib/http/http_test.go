@@ -4,6 +4,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/DIN-center/din-caddy-plugins/lib/auth"
 	"github.com/golang/mock/gomock"
@@ -105,3 +106,19 @@ func TestHTTPClientPost(t *testing.T) {
 		})
 	}
 }
+
+func TestHTTPClientPostTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	client := NewHTTPClient()
+	assert.Equal(t, DefaultRequestTimeout, client.httpClient.Timeout)
+	client.httpClient.Timeout = 50 * time.Millisecond
+
+	_, _, err := client.Post(server.URL, nil, []byte(`{}`), nil)
+	assert.Error(t, err)
+}
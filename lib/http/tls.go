@@ -0,0 +1,70 @@
+package http
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddytls"
+)
+
+// TLSConfig is the TLS configuration of the connections to a provider, for providers requiring mutual TLS or
+// serving a certificate of a private CA. File paths may be placeholders such as {env.PROVIDER_CERT}.
+type TLSConfig struct {
+	// The PEM-encoded client certificate and key presented to the provider
+	CertFile string `json:"cert_file,omitempty"`
+	KeyFile  string `json:"key_file,omitempty"`
+	// The PEM-encoded CA bundle the provider certificate is verified with, instead of the system roots
+	CAFile string `json:"ca_file,omitempty"`
+	// The name the provider certificate is verified against, and sent as SNI, instead of the host of the provider url
+	ServerName string `json:"server_name,omitempty"`
+	// The minimum TLS version, tls1.2 or tls1.3. tls1.2 if not set.
+	MinVersion string `json:"min_version,omitempty"`
+}
+
+// Validate checks the TLS configuration, without reading the files
+func (c *TLSConfig) Validate() error {
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return errors.New("cert_file and key_file must be set together")
+	}
+	if c.MinVersion != "" {
+		if _, ok := caddytls.SupportedProtocols[c.MinVersion]; !ok {
+			return fmt.Errorf("min_version must be tls1.2 or tls1.3, got %q", c.MinVersion)
+		}
+	}
+	return nil
+}
+
+// Load reads the certificate files and returns the TLS config of the connections to the provider
+func (c *TLSConfig) Load() (*tls.Config, error) {
+	repl := caddy.NewReplacer()
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: repl.ReplaceAll(c.ServerName, ""),
+	}
+	if c.MinVersion != "" {
+		tlsConfig.MinVersion = caddytls.SupportedProtocols[c.MinVersion]
+	}
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(repl.ReplaceAll(c.CertFile, ""), repl.ReplaceAll(c.KeyFile, ""))
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if c.CAFile != "" {
+		caBytes, err := os.ReadFile(repl.ReplaceAll(c.CAFile, ""))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ca file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caBytes) {
+			return nil, errors.New("no certificates in ca file")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
@@ -0,0 +1,50 @@
+package http
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTLSConfigValidate(t *testing.T) {
+	testCases := []struct {
+		name        string
+		tlsConfig   *TLSConfig
+		expectError bool
+	}{
+		{name: "client certificate", tlsConfig: &TLSConfig{CertFile: "client.pem", KeyFile: "client-key.pem"}},
+		{name: "ca and server name", tlsConfig: &TLSConfig{CAFile: "ca.pem", ServerName: "node.internal", MinVersion: "tls1.3"}},
+		{name: "cert without key", tlsConfig: &TLSConfig{CertFile: "client.pem"}, expectError: true},
+		{name: "key without cert", tlsConfig: &TLSConfig{KeyFile: "client-key.pem"}, expectError: true},
+		{name: "unsupported min version", tlsConfig: &TLSConfig{MinVersion: "tls1.1"}, expectError: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.tlsConfig.Validate()
+			if tc.expectError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestTLSConfigLoad(t *testing.T) {
+	t.Setenv("DIN_TEST_SERVER_NAME", "node.internal")
+	tlsConfig, err := (&TLSConfig{ServerName: "{env.DIN_TEST_SERVER_NAME}"}).Load()
+	assert.NoError(t, err)
+	assert.Equal(t, "node.internal", tlsConfig.ServerName)
+	assert.Equal(t, uint16(tls.VersionTLS12), tlsConfig.MinVersion)
+
+	tlsConfig, err = (&TLSConfig{MinVersion: "tls1.3"}).Load()
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS13), tlsConfig.MinVersion)
+
+	_, err = (&TLSConfig{CertFile: "/nonexistent/client.pem", KeyFile: "/nonexistent/client-key.pem"}).Load()
+	assert.Error(t, err)
+	_, err = (&TLSConfig{CAFile: "/nonexistent/ca.pem"}).Load()
+	assert.Error(t, err)
+}
@@ -5,4 +5,11 @@ import "time"
 type IPrometheusClient interface {
 	HandleRequestMetrics(data *PromRequestMetricData, reqBodyBytes []byte, duration time.Duration)
 	HandleLatestBlockMetric(data *PromLatestBlockMetricData)
+	HandleChainIDMismatchMetric(data *PromChainIDMismatchMetricData)
+	HandleProbeFailureMetric(data *PromProbeFailureMetricData)
+	HandleForkMetric(data *PromForkMetricData)
+	HandleReorgMetric(data *PromReorgMetricData)
+	HandleHeadMetric(data *PromHeadMetricData)
+	HandleAuthMetric(data *PromAuthMetricData)
+	HandleAuthRequestMetric(data *PromAuthRequestMetricData)
 }
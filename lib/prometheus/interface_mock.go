@@ -34,6 +34,66 @@ func (m *MockIPrometheusClient) EXPECT() *MockIPrometheusClientMockRecorder {
 	return m.recorder
 }
 
+// HandleAuthMetric mocks base method.
+func (m *MockIPrometheusClient) HandleAuthMetric(data *PromAuthMetricData) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "HandleAuthMetric", data)
+}
+
+// HandleAuthMetric indicates an expected call of HandleAuthMetric.
+func (mr *MockIPrometheusClientMockRecorder) HandleAuthMetric(data interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "HandleAuthMetric", reflect.TypeOf((*MockIPrometheusClient)(nil).HandleAuthMetric), data)
+}
+
+// HandleAuthRequestMetric mocks base method.
+func (m *MockIPrometheusClient) HandleAuthRequestMetric(data *PromAuthRequestMetricData) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "HandleAuthRequestMetric", data)
+}
+
+// HandleAuthRequestMetric indicates an expected call of HandleAuthRequestMetric.
+func (mr *MockIPrometheusClientMockRecorder) HandleAuthRequestMetric(data interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "HandleAuthRequestMetric", reflect.TypeOf((*MockIPrometheusClient)(nil).HandleAuthRequestMetric), data)
+}
+
+// HandleChainIDMismatchMetric mocks base method.
+func (m *MockIPrometheusClient) HandleChainIDMismatchMetric(data *PromChainIDMismatchMetricData) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "HandleChainIDMismatchMetric", data)
+}
+
+// HandleChainIDMismatchMetric indicates an expected call of HandleChainIDMismatchMetric.
+func (mr *MockIPrometheusClientMockRecorder) HandleChainIDMismatchMetric(data interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "HandleChainIDMismatchMetric", reflect.TypeOf((*MockIPrometheusClient)(nil).HandleChainIDMismatchMetric), data)
+}
+
+// HandleForkMetric mocks base method.
+func (m *MockIPrometheusClient) HandleForkMetric(data *PromForkMetricData) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "HandleForkMetric", data)
+}
+
+// HandleForkMetric indicates an expected call of HandleForkMetric.
+func (mr *MockIPrometheusClientMockRecorder) HandleForkMetric(data interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "HandleForkMetric", reflect.TypeOf((*MockIPrometheusClient)(nil).HandleForkMetric), data)
+}
+
+// HandleHeadMetric mocks base method.
+func (m *MockIPrometheusClient) HandleHeadMetric(data *PromHeadMetricData) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "HandleHeadMetric", data)
+}
+
+// HandleHeadMetric indicates an expected call of HandleHeadMetric.
+func (mr *MockIPrometheusClientMockRecorder) HandleHeadMetric(data interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "HandleHeadMetric", reflect.TypeOf((*MockIPrometheusClient)(nil).HandleHeadMetric), data)
+}
+
 // HandleLatestBlockMetric mocks base method.
 func (m *MockIPrometheusClient) HandleLatestBlockMetric(data *PromLatestBlockMetricData) {
 	m.ctrl.T.Helper()
@@ -46,6 +106,30 @@ func (mr *MockIPrometheusClientMockRecorder) HandleLatestBlockMetric(data interf
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "HandleLatestBlockMetric", reflect.TypeOf((*MockIPrometheusClient)(nil).HandleLatestBlockMetric), data)
 }
 
+// HandleProbeFailureMetric mocks base method.
+func (m *MockIPrometheusClient) HandleProbeFailureMetric(data *PromProbeFailureMetricData) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "HandleProbeFailureMetric", data)
+}
+
+// HandleProbeFailureMetric indicates an expected call of HandleProbeFailureMetric.
+func (mr *MockIPrometheusClientMockRecorder) HandleProbeFailureMetric(data interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "HandleProbeFailureMetric", reflect.TypeOf((*MockIPrometheusClient)(nil).HandleProbeFailureMetric), data)
+}
+
+// HandleReorgMetric mocks base method.
+func (m *MockIPrometheusClient) HandleReorgMetric(data *PromReorgMetricData) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "HandleReorgMetric", data)
+}
+
+// HandleReorgMetric indicates an expected call of HandleReorgMetric.
+func (mr *MockIPrometheusClientMockRecorder) HandleReorgMetric(data interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "HandleReorgMetric", reflect.TypeOf((*MockIPrometheusClient)(nil).HandleReorgMetric), data)
+}
+
 // HandleRequestMetrics mocks base method.
 func (m *MockIPrometheusClient) HandleRequestMetrics(data *PromRequestMetricData, reqBodyBytes []byte, duration time.Duration) {
 	m.ctrl.T.Helper()
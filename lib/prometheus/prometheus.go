@@ -2,7 +2,9 @@ package prometheus
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -35,8 +37,18 @@ var (
 	DinRequestBodyBytes            *prometheus.HistogramVec
 
 	// Din Health Check Metrics
-	DinHealthCheckCount    *prometheus.CounterVec
-	DinProviderBlockNumber *prometheus.GaugeVec
+	DinHealthCheckCount           *prometheus.CounterVec
+	DinProviderBlockNumber        *prometheus.GaugeVec
+	DinHealthCheckChainIDMismatch *prometheus.CounterVec
+	DinHealthCheckProbeFailure    *prometheus.CounterVec
+	DinHealthCheckFork            *prometheus.CounterVec
+	DinChainReorgDepth            *prometheus.HistogramVec
+	DinProviderHeadBlockNumber    *prometheus.GaugeVec
+	DinNetworkHeadBlockNumber     *prometheus.GaugeVec
+	DinProviderAuthHealthy        *prometheus.GaugeVec
+
+	// Din Auth Metrics
+	DinAuthRequestCount *prometheus.CounterVec
 )
 
 // RegisterMetrics registers the prometheus metrics
@@ -84,7 +96,79 @@ func RegisterMetrics() {
 		[]string{"service", "provider", "response_status", "health_status", "machine_id"},
 	)
 
-	prometheus.MustRegister(DinRequestCount, DinHealthCheckCount, DinRequestDurationMilliseconds, DinRequestBodyBytes, DinProviderBlockNumber)
+	// Register chain id mismatch count metric for providers reporting a different chain than their network
+	DinHealthCheckChainIDMismatch = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "din_health_check_chain_id_mismatch_count",
+			Help: "Metric for counting din health checks where the provider reported a different chain id than the network expects",
+		},
+		[]string{"service", "provider", "expected_chain_id", "reported_chain_id", "machine_id"},
+	)
+
+	// Register probe failure count metric for failed health check probes
+	DinHealthCheckProbeFailure = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "din_health_check_probe_failure_count",
+			Help: "Metric for counting failed din health check probes with network, provider and probe name",
+		},
+		[]string{"service", "provider", "probe", "machine_id"},
+	)
+
+	// Register fork count metric for providers on a minority fork
+	DinHealthCheckFork = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "din_health_check_fork_count",
+			Help: "Metric for counting din health checks that found a provider on a minority fork, with network and provider",
+		},
+		[]string{"service", "provider", "machine_id"},
+	)
+
+	// Register reorg depth metric for chain reorganizations seen by the health checks
+	DinChainReorgDepth = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "din_chain_reorg_depth",
+			Help:    "Histogram of the depth in blocks of the chain reorganizations seen by the din health checks",
+			Buckets: []float64{1, 2, 3, 5, 8, 13, 21, 34, 64},
+		},
+		[]string{"service", "machine_id"},
+	)
+
+	// Register head block number metrics for the safe and finalized heads of each provider and network
+	DinProviderHeadBlockNumber = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "din_provider_head_block_number",
+			Help: "Metric for the safe and finalized head block numbers reported by each provider",
+		},
+		[]string{"service", "provider", "tag", "machine_id"},
+	)
+	DinNetworkHeadBlockNumber = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "din_network_head_block_number",
+			Help: "Metric for the safe and finalized head block numbers of each network, as seen across its providers",
+		},
+		[]string{"service", "tag", "machine_id"},
+	)
+
+	// Register auth health metric for the providers that authenticate requests
+	DinProviderAuthHealthy = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "din_provider_auth_healthy",
+			Help: "Metric for the auth health of each provider with auth, 1 if requests to it can be authenticated and 0 otherwise",
+		},
+		[]string{"service", "provider", "machine_id"},
+	)
+
+	// Register auth request count metric for the requests din_auth verified the session token of
+	DinAuthRequestCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "din_auth_request_count",
+			Help: "Metric for counting the JSON-RPC calls of the requests authenticated by din_auth, with network, signer address, method and result",
+		},
+		[]string{"service", "address", "method", "result", "machine_id"},
+	)
+
+	prometheus.MustRegister(DinRequestCount, DinHealthCheckCount, DinRequestDurationMilliseconds, DinRequestBodyBytes, DinProviderBlockNumber, DinHealthCheckChainIDMismatch, DinHealthCheckProbeFailure, DinHealthCheckFork, DinChainReorgDepth,
+		DinProviderHeadBlockNumber, DinNetworkHeadBlockNumber, DinProviderAuthHealthy, DinAuthRequestCount)
 }
 
 type PromRequestMetricData struct {
@@ -151,3 +235,139 @@ func (p *PrometheusClient) HandleLatestBlockMetric(data *PromLatestBlockMetricDa
 	// Disabled to avoid high metric count on prometheus
 	// DinProviderBlockNumber.WithLabelValues(network, data.Provider, p.machineID).Set(float64(data.BlockNumber))
 }
+
+type PromChainIDMismatchMetricData struct {
+	Network         string
+	Provider        string
+	ExpectedChainID uint64
+	ReportedChainID uint64
+}
+
+// HandleChainIDMismatchMetric increments prometheus metric when a provider reports a different chain id than its network
+func (p *PrometheusClient) HandleChainIDMismatchMetric(data *PromChainIDMismatchMetricData) {
+	network := strings.TrimPrefix(data.Network, "/")
+	expected := strconv.FormatUint(data.ExpectedChainID, 10)
+	reported := strconv.FormatUint(data.ReportedChainID, 10)
+
+	p.logger.Debug("Chain id mismatch metric data", zap.String("network", network), zap.String("provider", data.Provider), zap.String("expected_chain_id", expected), zap.String("reported_chain_id", reported), zap.String("machine_id", p.machineID))
+
+	DinHealthCheckChainIDMismatch.WithLabelValues(network, data.Provider, expected, reported, p.machineID).Inc()
+}
+
+type PromProbeFailureMetricData struct {
+	Network  string
+	Provider string
+	Probe    string
+}
+
+// HandleProbeFailureMetric increments prometheus metric when a provider fails a health check probe
+func (p *PrometheusClient) HandleProbeFailureMetric(data *PromProbeFailureMetricData) {
+	network := strings.TrimPrefix(data.Network, "/")
+
+	p.logger.Debug("Probe failure metric data", zap.String("network", network), zap.String("provider", data.Provider), zap.String("probe", data.Probe), zap.String("machine_id", p.machineID))
+
+	DinHealthCheckProbeFailure.WithLabelValues(network, data.Provider, data.Probe, p.machineID).Inc()
+}
+
+type PromForkMetricData struct {
+	Network  string
+	Provider string
+}
+
+// HandleForkMetric increments prometheus metric when a provider disagrees with the majority of its network on a block hash
+func (p *PrometheusClient) HandleForkMetric(data *PromForkMetricData) {
+	network := strings.TrimPrefix(data.Network, "/")
+
+	p.logger.Debug("Fork metric data", zap.String("network", network), zap.String("provider", data.Provider), zap.String("machine_id", p.machineID))
+
+	DinHealthCheckFork.WithLabelValues(network, data.Provider, p.machineID).Inc()
+}
+
+type PromReorgMetricData struct {
+	Network string
+	Depth   int64
+}
+
+// HandleReorgMetric records the depth of a chain reorganization seen on a network
+func (p *PrometheusClient) HandleReorgMetric(data *PromReorgMetricData) {
+	network := strings.TrimPrefix(data.Network, "/")
+
+	p.logger.Debug("Reorg metric data", zap.String("network", network), zap.Int64("depth", data.Depth), zap.String("machine_id", p.machineID))
+
+	DinChainReorgDepth.WithLabelValues(network, p.machineID).Observe(float64(data.Depth))
+}
+
+type PromHeadMetricData struct {
+	Network string
+	// The provider reporting the head, empty for the head of the network
+	Provider    string
+	Tag         string
+	BlockNumber int64
+}
+
+// HandleHeadMetric sets the head block number of a block tag, such as safe or finalized, for a provider or a network
+func (p *PrometheusClient) HandleHeadMetric(data *PromHeadMetricData) {
+	network := strings.TrimPrefix(data.Network, "/")
+
+	p.logger.Debug("Head metric data", zap.String("network", network), zap.String("provider", data.Provider), zap.String("tag", data.Tag), zap.Int64("block_number", data.BlockNumber), zap.String("machine_id", p.machineID))
+
+	if data.Provider == "" {
+		DinNetworkHeadBlockNumber.WithLabelValues(network, data.Tag, p.machineID).Set(float64(data.BlockNumber))
+		return
+	}
+	DinProviderHeadBlockNumber.WithLabelValues(network, data.Provider, data.Tag, p.machineID).Set(float64(data.BlockNumber))
+}
+
+type PromAuthMetricData struct {
+	Network  string
+	Provider string
+	Healthy  bool
+}
+
+// HandleAuthMetric sets the auth health of a provider
+func (p *PrometheusClient) HandleAuthMetric(data *PromAuthMetricData) {
+	network := strings.TrimPrefix(data.Network, "/")
+
+	p.logger.Debug("Auth metric data", zap.String("network", network), zap.String("provider", data.Provider), zap.Bool("healthy", data.Healthy), zap.String("machine_id", p.machineID))
+
+	var healthy float64
+	if data.Healthy {
+		healthy = 1
+	}
+	DinProviderAuthHealthy.WithLabelValues(network, data.Provider, p.machineID).Set(healthy)
+}
+
+type PromAuthRequestMetricData struct {
+	Network string
+	// The signer address the session token was issued to
+	Address string
+	// The methods of the JSON-RPC request or batch, empty if the body isn't one.
+	// They are used as label values, so the caller must keep them to a bounded set.
+	Methods []string
+	// Whether the request was let through, or why it was rejected
+	Result string
+}
+
+// HandleAuthRequestMetric counts the JSON-RPC calls of a request din_auth authenticated, by signer address and method
+func (p *PrometheusClient) HandleAuthRequestMetric(data *PromAuthRequestMetricData) {
+	network := strings.TrimPrefix(data.Network, "/")
+
+	p.logger.Debug("Auth request metric data", zap.String("network", network), zap.String("address", data.Address), zap.Strings("methods", data.Methods), zap.String("result", data.Result), zap.String("machine_id", p.machineID))
+
+	if len(data.Methods) == 0 {
+		DinAuthRequestCount.WithLabelValues(network, data.Address, "", data.Result, p.machineID).Inc()
+		return
+	}
+	for _, method := range data.Methods {
+		DinAuthRequestCount.WithLabelValues(network, data.Address, method, data.Result, p.machineID).Inc()
+	}
+}
+
+// MachineID returns the id of this process the metrics are labeled with
+func MachineID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "UNKNOWN"
+	}
+	return fmt.Sprintf("@%s:%d", hostname, os.Getpid())
+}
@@ -182,3 +182,89 @@ func TestHandleLatestBlockMetric(t *testing.T) {
 		})
 	}
 }
+
+func TestHandleChainIDMismatchMetric(t *testing.T) {
+	client := NewPrometheusClient(zap.NewNop(), "test-machine-id")
+
+	client.HandleChainIDMismatchMetric(&PromChainIDMismatchMetricData{
+		Network:         "/ethereum",
+		Provider:        "infura",
+		ExpectedChainID: 1,
+		ReportedChainID: 11155111,
+	})
+
+	metric := testutil.ToFloat64(DinHealthCheckChainIDMismatch.WithLabelValues("ethereum", "infura", "1", "11155111", client.machineID))
+	assert.Equal(t, float64(1), metric)
+}
+
+func TestHandleProbeFailureMetric(t *testing.T) {
+	client := NewPrometheusClient(zap.NewNop(), "test-machine-id")
+
+	client.HandleProbeFailureMetric(&PromProbeFailureMetricData{
+		Network:  "/ethereum",
+		Provider: "infura",
+		Probe:    "syncing",
+	})
+
+	metric := testutil.ToFloat64(DinHealthCheckProbeFailure.WithLabelValues("ethereum", "infura", "syncing", client.machineID))
+	assert.Equal(t, float64(1), metric)
+}
+
+func TestHandleForkMetric(t *testing.T) {
+	client := NewPrometheusClient(zap.NewNop(), "test-machine-id")
+
+	client.HandleForkMetric(&PromForkMetricData{
+		Network:  "/ethereum",
+		Provider: "infura",
+	})
+
+	metric := testutil.ToFloat64(DinHealthCheckFork.WithLabelValues("ethereum", "infura", client.machineID))
+	assert.Equal(t, float64(1), metric)
+}
+
+func TestHandleReorgMetric(t *testing.T) {
+	client := NewPrometheusClient(zap.NewNop(), "test-machine-id")
+
+	client.HandleReorgMetric(&PromReorgMetricData{
+		Network: "/ethereum",
+		Depth:   2,
+	})
+
+	assert.Equal(t, 1, testutil.CollectAndCount(DinChainReorgDepth, "din_chain_reorg_depth"))
+}
+
+func TestHandleHeadMetric(t *testing.T) {
+	client := NewPrometheusClient(zap.NewNop(), "test-machine-id")
+
+	client.HandleHeadMetric(&PromHeadMetricData{
+		Network:     "/ethereum",
+		Provider:    "infura",
+		Tag:         "finalized",
+		BlockNumber: 100,
+	})
+	client.HandleHeadMetric(&PromHeadMetricData{
+		Network:     "/ethereum",
+		Tag:         "finalized",
+		BlockNumber: 99,
+	})
+
+	assert.Equal(t, float64(100), testutil.ToFloat64(DinProviderHeadBlockNumber.WithLabelValues("ethereum", "infura", "finalized", client.machineID)))
+	assert.Equal(t, float64(99), testutil.ToFloat64(DinNetworkHeadBlockNumber.WithLabelValues("ethereum", "finalized", client.machineID)))
+}
+
+func TestHandleAuthMetric(t *testing.T) {
+	client := NewPrometheusClient(zap.NewNop(), "test-machine-id")
+
+	client.HandleAuthMetric(&PromAuthMetricData{
+		Network:  "/ethereum",
+		Provider: "rivet",
+		Healthy:  true,
+	})
+	assert.Equal(t, float64(1), testutil.ToFloat64(DinProviderAuthHealthy.WithLabelValues("ethereum", "rivet", client.machineID)))
+
+	client.HandleAuthMetric(&PromAuthMetricData{
+		Network:  "/ethereum",
+		Provider: "rivet",
+	})
+	assert.Equal(t, float64(0), testutil.ToFloat64(DinProviderAuthHealthy.WithLabelValues("ethereum", "rivet", client.machineID)))
+}
@@ -11,8 +11,11 @@ import (
 func init() {
 	caddy.RegisterModule(mod.DinUpstreams{})
 	caddy.RegisterModule(mod.DinSelect{})
-	caddy.RegisterModule(mod.DinMiddleware{})
+	caddy.RegisterModule(new(mod.DinTransport))
+	caddy.RegisterModule(new(mod.DinMiddleware))
+	caddy.RegisterModule(mod.DinAdmin{})
 	caddy.RegisterModule(siwe.SIWEAuthMiddleware{})
+	caddy.RegisterModule(siwe.WhitelistAdmin{})
 
 	m := new(mod.DinMiddleware)
 	m2 := new(siwe.SIWEAuthMiddleware)
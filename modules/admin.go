@@ -0,0 +1,111 @@
+package modules
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+var (
+	// Din Admin API Module
+	_ caddy.Module      = (*DinAdmin)(nil)
+	_ caddy.AdminRouter = (*DinAdmin)(nil)
+)
+
+// DinAdmin serves the state of the din providers on the Caddy admin API.
+// GET /din/providers lists the providers of every loaded network with their health and auth status.
+type DinAdmin struct{}
+
+// CaddyModule returns the Caddy module information.
+func (DinAdmin) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.din",
+		New: func() caddy.Module { return new(DinAdmin) },
+	}
+}
+
+// Routes returns the admin routes of the din handler
+func (a *DinAdmin) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: "/din/providers",
+			Handler: caddy.AdminHandlerFunc(a.handleProviders),
+		},
+	}
+}
+
+// providerStatus is the state of a provider shown on the admin API
+type providerStatus struct {
+	Network      string `json:"network"`
+	Provider     string `json:"provider"`
+	HealthStatus string `json:"health_status"`
+	// Why the provider last moved to Warning or Unhealthy, empty while it is healthy
+	HealthReason string `json:"health_reason,omitempty"`
+	// "healthy" or "unhealthy" for providers with auth, "none" otherwise
+	AuthStatus   string `json:"auth_status"`
+	AuthError    string `json:"auth_error,omitempty"`
+	Available    bool   `json:"available"`
+	LatencyP50Ms int64  `json:"latency_p50_ms"`
+	LatencyP95Ms int64  `json:"latency_p95_ms"`
+}
+
+func (a *DinAdmin) handleProviders(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(providerStatuses())
+}
+
+// providerStatuses returns the state of every provider of the loaded configs, sorted by network and provider
+func providerStatuses() []providerStatus {
+	statuses := make([]providerStatus, 0)
+	providerStates.Range(func(key, value any) bool {
+		record := value.(*providerStateRecord)
+		record.mu.Lock()
+		n, p := record.network, record.provider
+		record.mu.Unlock()
+		if p == nil {
+			return true
+		}
+		statuses = append(statuses, newProviderStatus(n, p))
+		return true
+	})
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].Network != statuses[j].Network {
+			return statuses[i].Network < statuses[j].Network
+		}
+		return statuses[i].Provider < statuses[j].Provider
+	})
+	return statuses
+}
+
+// newProviderStatus returns the state of a provider of the network
+func newProviderStatus(n *network, p *provider) providerStatus {
+	status := providerStatus{
+		Network:      n.Name,
+		Provider:     p.host,
+		HealthStatus: p.getHealthStatus().String(),
+		AuthStatus:   "none",
+		LatencyP50Ms: p.LatencyP50().Milliseconds(),
+		LatencyP95Ms: p.LatencyP95().Milliseconds(),
+	}
+	if !p.Healthy() {
+		status.HealthReason = p.getHealthReason()
+	}
+	if ac := p.AuthClient(); ac != nil {
+		status.AuthStatus = "healthy"
+		if err := ac.Error(); err != nil {
+			status.AuthStatus = "unhealthy"
+			status.AuthError = err.Error()
+		}
+	}
+	status.Available = p.upstream != nil && (p.Available() || p.IsAvailableWithWarning())
+	return status
+}
@@ -0,0 +1,51 @@
+package modules
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DIN-center/din-caddy-plugins/lib/auth/siwe"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestAdminProviders(t *testing.T) {
+	d := &DinMiddleware{logger: zap.NewNop()}
+	n := NewNetwork("admin-test")
+	healthy := &provider{host: "healthy", HttpUrl: "https://healthy", upstream: &reverseproxy.Upstream{Dial: "healthy"}}
+	unauthenticated := &provider{host: "unauthenticated", HttpUrl: "https://unauthenticated", upstream: &reverseproxy.Upstream{Dial: "unauthenticated"}, Auth: &siwe.SIWEClientAuth{}}
+	unhealthy := &provider{host: "unhealthy", HttpUrl: "https://unhealthy", upstream: &reverseproxy.Upstream{Dial: "unhealthy"}}
+	unhealthy.markUnhealthy(HealthReasonFork)
+	for _, p := range []*provider{healthy, unauthenticated, unhealthy} {
+		n.Providers[p.host] = p
+		d.trackProviderState(n, p)
+	}
+	defer d.releaseProviderStates()
+
+	rec := httptest.NewRecorder()
+	err := new(DinAdmin).handleProviders(rec, httptest.NewRequest(http.MethodGet, "/din/providers", nil))
+	assert.NoError(t, err)
+
+	var statuses []providerStatus
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &statuses))
+	byProvider := make(map[string]providerStatus)
+	for _, status := range statuses {
+		if status.Network == "admin-test" {
+			byProvider[status.Provider] = status
+		}
+	}
+	assert.Equal(t, 3, len(byProvider))
+	assert.Equal(t, providerStatus{Network: "admin-test", Provider: "healthy", HealthStatus: "Healthy", AuthStatus: "none", Available: true}, byProvider["healthy"])
+	assert.Equal(t, "unhealthy", byProvider["unauthenticated"].AuthStatus)
+	assert.NotEmpty(t, byProvider["unauthenticated"].AuthError)
+	assert.False(t, byProvider["unauthenticated"].Available)
+	assert.Equal(t, "Unhealthy", byProvider["unhealthy"].HealthStatus)
+	assert.Equal(t, HealthReasonFork, byProvider["unhealthy"].HealthReason)
+	assert.False(t, byProvider["unhealthy"].Available)
+
+	err = new(DinAdmin).handleProviders(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/din/providers", nil))
+	assert.Error(t, err)
+}
@@ -0,0 +1,72 @@
+package modules
+
+import (
+	"sync/atomic"
+
+	prom "github.com/DIN-center/din-caddy-plugins/lib/prometheus"
+	"go.uber.org/zap"
+)
+
+// authHealthCheck checks that requests to the providers with auth can be authenticated, and reports their auth health.
+// Requests are not routed to a provider while its auth is unhealthy, see authAvailable().
+// When the auth of a provider goes unhealthy, new sessions are established right away
+// rather than at the next scheduled renewal.
+func (n *network) authHealthCheck() {
+	for name, provider := range n.Providers {
+		ac := provider.AuthClient()
+		if ac == nil {
+			continue
+		}
+		err := ac.Error()
+		healthy := err == nil
+		n.PrometheusClient.HandleAuthMetric(&prom.PromAuthMetricData{
+			Network:  n.Name,
+			Provider: provider.host,
+			Healthy:  healthy,
+		})
+
+		wasFaulty := provider.swapAuthFault(!healthy)
+		if healthy {
+			if wasFaulty {
+				n.logger.Info("Provider auth is healthy again", zap.String("provider", name), zap.String("network", n.Name), zap.String("machine_id", n.machineID))
+			}
+			continue
+		}
+		if wasFaulty {
+			continue
+		}
+		n.logger.Warn("Provider auth is unhealthy, re-establishing sessions",
+			zap.String("provider", name),
+			zap.String("network", n.Name),
+			zap.String("reason", HealthReasonAuthUnavailable),
+			zap.Error(err),
+			zap.String("machine_id", n.machineID))
+		go func(providerName string) {
+			if err := ac.Refresh(); err != nil {
+				n.logger.Warn("Failed to re-establish provider auth sessions", zap.String("provider", providerName), zap.String("network", n.Name), zap.Error(err), zap.String("machine_id", n.machineID))
+				return
+			}
+			n.logger.Info("Re-established provider auth sessions", zap.String("provider", providerName), zap.String("network", n.Name), zap.String("machine_id", n.machineID))
+		}(name)
+	}
+}
+
+// authAvailable returns true if the provider has no auth, or if requests to it can be authenticated
+func (p *provider) authAvailable() bool {
+	ac := p.AuthClient()
+	return ac == nil || ac.Error() == nil
+}
+
+// hasAuthFault returns true if the auth of the provider was unhealthy at the last auth health check
+func (p *provider) hasAuthFault() bool {
+	return atomic.LoadInt32(&p.authFault) == 1
+}
+
+// swapAuthFault atomically stores whether the auth of the provider is unhealthy, and returns the previous value
+func (p *provider) swapAuthFault(fault bool) bool {
+	var value int32
+	if fault {
+		value = 1
+	}
+	return atomic.SwapInt32(&p.authFault, value) == 1
+}
@@ -0,0 +1,59 @@
+package modules
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DIN-center/din-caddy-plugins/lib/auth/siwe"
+	prom "github.com/DIN-center/din-caddy-plugins/lib/prometheus"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestAuthHealthCheck(t *testing.T) {
+	var available atomic.Bool
+	authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !available.Load() {
+			w.Write([]byte(`{"error": "auth unavailable"}`))
+			return
+		}
+		w.Write([]byte(`{"headers": {"x-api-key": "key"}}`))
+	}))
+	defer authServer.Close()
+
+	key, _ := crypto.GenerateKey()
+	client := siwe.NewSIWEClient(authServer.URL, 1, &siwe.SigningConfig{PrivateKey: crypto.FromECDSA(key)})
+	assert.NoError(t, client.Start(zap.NewNop()))
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockPrometheusClient := prom.NewMockIPrometheusClient(ctrl)
+
+	n := NewNetwork("eth")
+	n.logger = zap.NewNop()
+	n.PrometheusClient = mockPrometheusClient
+	p := &provider{host: "provider1", Auth: client, upstream: &reverseproxy.Upstream{Dial: "provider1"}}
+	n.Providers["provider1"] = p
+	n.Providers["provider2"] = &provider{host: "provider2", upstream: &reverseproxy.Upstream{Dial: "provider2"}}
+
+	// A provider whose sessions are unusable is not available, even though it is healthy
+	assert.False(t, p.Available())
+	assert.True(t, n.Providers["provider2"].Available())
+
+	// Sessions are re-established as soon as the auth goes unhealthy
+	available.Store(true)
+	mockPrometheusClient.EXPECT().HandleAuthMetric(&prom.PromAuthMetricData{Network: "eth", Provider: "provider1", Healthy: false}).Times(1)
+	n.authHealthCheck()
+	assert.True(t, p.hasAuthFault())
+	assert.Eventually(t, p.Available, time.Second, 10*time.Millisecond)
+
+	mockPrometheusClient.EXPECT().HandleAuthMetric(&prom.PromAuthMetricData{Network: "eth", Provider: "provider1", Healthy: true}).Times(1)
+	n.authHealthCheck()
+	assert.False(t, p.hasAuthFault())
+}
@@ -0,0 +1,149 @@
+package modules
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/DIN-center/din-caddy-plugins/lib/auth"
+	prom "github.com/DIN-center/din-caddy-plugins/lib/prometheus"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// verifyChainIDs asks every provider of the network for its chain id. If the network has no configured chain id,
+// the chain id reported by a majority of the providers becomes the expected chain id of the network.
+// Providers that can't report a chain id, for example on networks that don't support eth_chainId, are not judged on it.
+func (n *network) verifyChainIDs() {
+	var wg sync.WaitGroup
+	for name, currentProvider := range n.Providers {
+		wg.Add(1)
+		go func(providerName string, provider *provider) {
+			defer wg.Done()
+			chainID, err := n.getChainID(provider.HttpUrl, provider.Headers, provider.AuthClient())
+			if err != nil {
+				n.logger.Debug("Error getting chain id for provider", zap.String("provider", providerName), zap.String("network", n.Name), zap.Error(err), zap.String("machine_id", n.machineID))
+				return
+			}
+			provider.storeChainID(chainID)
+		}(name, currentProvider)
+	}
+	wg.Wait()
+
+	if n.ChainID == 0 {
+		n.learnChainID()
+	}
+}
+
+// learnChainID sets the expected chain id of the network to the chain id reported by a majority of its providers
+func (n *network) learnChainID() {
+	counts := make(map[uint64]int)
+	for _, provider := range n.Providers {
+		if chainID := provider.loadChainID(); chainID != 0 {
+			counts[chainID]++
+		}
+	}
+	for chainID, count := range counts {
+		if count*2 > len(n.Providers) {
+			n.storeExpectedChainID(chainID)
+			n.logger.Info("Learned network chain id", zap.String("network", n.Name), zap.Uint64("chain_id", chainID), zap.Int("providers", count), zap.String("machine_id", n.machineID))
+			return
+		}
+	}
+}
+
+// chainIDMismatch returns the chain id last reported by the provider, and whether it differs from the expected chain id of the network
+func (n *network) chainIDMismatch(provider *provider) (uint64, bool) {
+	expected := n.loadExpectedChainID()
+	reported := provider.loadChainID()
+	return reported, expected != 0 && reported != 0 && reported != expected
+}
+
+// handleChainIDMismatch marks a provider that serves another chain than its network as unhealthy
+func (n *network) handleChainIDMismatch(providerName string, provider *provider, reportedChainID uint64) {
+	n.logger.Warn("Provider is serving the wrong chain",
+		zap.String("provider", providerName),
+		zap.String("network", n.Name),
+		zap.String("reason", HealthReasonChainIDMismatch),
+		zap.Uint64("expected_chain_id", n.loadExpectedChainID()),
+		zap.Uint64("reported_chain_id", reportedChainID),
+		zap.String("machine_id", n.machineID))
+	provider.markUnhealthy(HealthReasonChainIDMismatch)
+	n.PrometheusClient.HandleChainIDMismatchMetric(&prom.PromChainIDMismatchMetricData{
+		Network:         n.Name,
+		Provider:        provider.host,
+		ExpectedChainID: n.loadExpectedChainID(),
+		ReportedChainID: reportedChainID,
+	})
+}
+
+// getChainID returns the chain id reported by eth_chainId. net_version is not used as a fallback, as networks
+// such as Ethereum Classic report a network id there that differs from their chain id, so providers of networks
+// without eth_chainId support stay unknown rather than being judged on it.
+func (n *network) getChainID(httpUrl string, headers map[string]string, ac auth.IAuthClient) (uint64, error) {
+	payload := []byte(`{"jsonrpc":"2.0","method": "eth_chainId","params":[],"id":1}`)
+
+	resBytes, statusCode, err := n.providerClient(httpUrl).Post(httpUrl, headers, payload, ac)
+	if err != nil {
+		return 0, errors.Wrap(err, "Error sending POST request")
+	}
+	if *statusCode != http.StatusOK {
+		return 0, errors.Errorf("unexpected status code %d", *statusCode)
+	}
+
+	var respObject struct {
+		Result *string `json:"result"`
+	}
+	if err := json.Unmarshal(resBytes, &respObject); err != nil {
+		return 0, errors.Wrap(err, "Error unmarshalling response")
+	}
+	if respObject.Result == nil {
+		return 0, errors.New("Error getting chain id from response")
+	}
+	return parseChainID(*respObject.Result)
+}
+
+// parseChainID parses a chain id given as a hex or decimal string
+func parseChainID(value string) (uint64, error) {
+	var chainID uint64
+	var err error
+	if strings.HasPrefix(value, "0x") || strings.HasPrefix(value, "0X") {
+		chainID, err = strconv.ParseUint(value[2:], 16, 64)
+	} else {
+		chainID, err = strconv.ParseUint(value, 10, 64)
+	}
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid chain id %q", value)
+	}
+	if chainID == 0 {
+		return 0, errors.New("chain id must not be 0")
+	}
+	return chainID, nil
+}
+
+// loadExpectedChainID returns the chain id the providers of the network are expected to report, 0 if not known yet.
+// A configured chain id takes precedence over the learned one.
+func (n *network) loadExpectedChainID() uint64 {
+	if n.ChainID != 0 {
+		return n.ChainID
+	}
+	return atomic.LoadUint64(&n.expectedChainID)
+}
+
+// storeExpectedChainID atomically stores the chain id learned from the providers of the network
+func (n *network) storeExpectedChainID(chainID uint64) {
+	atomic.StoreUint64(&n.expectedChainID, chainID)
+}
+
+// loadChainID atomically loads the chain id last reported by the provider, 0 if not known
+func (p *provider) loadChainID() uint64 {
+	return atomic.LoadUint64(&p.chainID)
+}
+
+// storeChainID atomically stores the chain id reported by the provider
+func (p *provider) storeChainID(chainID uint64) {
+	atomic.StoreUint64(&p.chainID, chainID)
+}
@@ -0,0 +1,202 @@
+package modules
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/DIN-center/din-caddy-plugins/lib/auth"
+	din_http "github.com/DIN-center/din-caddy-plugins/lib/http"
+	prom "github.com/DIN-center/din-caddy-plugins/lib/prometheus"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestParseChainID(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		expected uint64
+		hasErr   bool
+	}{
+		{name: "hex", value: "0x1", expected: 1},
+		{name: "hex sepolia", value: "0xaa36a7", expected: 11155111},
+		{name: "decimal", value: "137", expected: 137},
+		{name: "zero", value: "0x0", hasErr: true},
+		{name: "starknet felt", value: "0x534e5f5345504f4c49414e5f54455354", hasErr: true},
+		{name: "not a number", value: "mainnet", hasErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chainID, err := parseChainID(tt.value)
+			if tt.hasErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, chainID)
+		})
+	}
+}
+
+// chainIDResponses returns a mock Post handler answering eth_chainId and net_version per provider URL.
+// Providers missing from the map don't support either method, and every other method returns block 0x4c4b40.
+func chainIDResponses(chainIDs map[string]string, netVersions map[string]string) func(string, map[string]string, []byte, auth.IAuthClient) ([]byte, *int, error) {
+	return func(url string, headers map[string]string, payload []byte, ac auth.IAuthClient) ([]byte, *int, error) {
+		statusCode := http.StatusOK
+		switch {
+		case strings.Contains(string(payload), "eth_chainId"):
+			if chainID, ok := chainIDs[url]; ok {
+				return []byte(`{"jsonrpc": "2.0", "id": 1, "result": "` + chainID + `"}`), &statusCode, nil
+			}
+			return []byte(`{"jsonrpc": "2.0", "id": 1, "error": {"code": -32601, "message": "method not found"}}`), &statusCode, nil
+		case strings.Contains(string(payload), "net_version"):
+			if netVersion, ok := netVersions[url]; ok {
+				return []byte(`{"jsonrpc": "2.0", "id": 1, "result": "` + netVersion + `"}`), &statusCode, nil
+			}
+			statusCode = http.StatusBadRequest
+			return nil, &statusCode, nil
+		}
+		return []byte(`{"jsonrpc": "2.0", "id": 1, "result": "0x4c4b40"}`), &statusCode, nil
+	}
+}
+
+func newChainIDTestNetwork(t *testing.T, httpClient din_http.IHTTPClient, promClient prom.IPrometheusClient, urls ...string) *network {
+	n := NewNetwork("eth")
+	n.HttpClient = httpClient
+	n.PrometheusClient = promClient
+	n.logger = zap.NewNop()
+	for _, url := range urls {
+		p, err := NewProvider(url)
+		assert.NoError(t, err)
+		n.Providers[p.host] = p
+	}
+	return n
+}
+
+func TestVerifyChainIDs(t *testing.T) {
+	tests := []struct {
+		name             string
+		configured       uint64
+		chainIDs         map[string]string
+		netVersions      map[string]string
+		expectedChainID  uint64
+		mismatched       []string
+		expectedReported map[string]uint64
+	}{
+		{
+			name: "learns the majority chain id",
+			chainIDs: map[string]string{
+				"http://provider1": "0x1",
+				"http://provider2": "0x1",
+				"http://provider3": "0xaa36a7",
+			},
+			expectedChainID: 1,
+			mismatched:      []string{"provider3"},
+		},
+		{
+			name: "no majority",
+			chainIDs: map[string]string{
+				"http://provider1": "0x1",
+				"http://provider2": "0xaa36a7",
+			},
+			expectedChainID: 0,
+		},
+		{
+			name:       "configured chain id wins over the majority",
+			configured: 11155111,
+			chainIDs: map[string]string{
+				"http://provider1": "0x1",
+				"http://provider2": "0x1",
+				"http://provider3": "0xaa36a7",
+			},
+			expectedChainID: 11155111,
+			mismatched:      []string{"provider1", "provider2"},
+		},
+		{
+			name: "net_version is not taken for the chain id",
+			chainIDs: map[string]string{
+				"http://provider1": "0x3d",
+				"http://provider2": "0x3d",
+			},
+			netVersions: map[string]string{
+				"http://provider3": "1",
+			},
+			expectedChainID: 61,
+		},
+		{
+			name:            "providers without chain id support are not judged",
+			chainIDs:        map[string]string{"http://provider1": "0x1"},
+			expectedChainID: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			mockHttpClient := din_http.NewMockIHTTPClient(mockCtrl)
+			mockPrometheusClient := prom.NewMockIPrometheusClient(mockCtrl)
+			mockHttpClient.EXPECT().Post(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(chainIDResponses(tt.chainIDs, tt.netVersions)).AnyTimes()
+
+			n := newChainIDTestNetwork(t, mockHttpClient, mockPrometheusClient, "http://provider1", "http://provider2", "http://provider3")
+			n.ChainID = tt.configured
+			n.verifyChainIDs()
+
+			assert.Equal(t, tt.expectedChainID, n.loadExpectedChainID())
+			for host, p := range n.Providers {
+				_, mismatch := n.chainIDMismatch(p)
+				assert.Equal(t, contains(tt.mismatched, host), mismatch, host)
+			}
+		})
+	}
+}
+
+func TestHealthCheckChainIDMismatch(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	mockHttpClient := din_http.NewMockIHTTPClient(mockCtrl)
+	mockPrometheusClient := prom.NewMockIPrometheusClient(mockCtrl)
+	chainIDs := map[string]string{
+		"http://provider1": "0x1",
+		"http://provider2": "0x1",
+		"http://provider3": "0xaa36a7",
+	}
+	mockHttpClient.EXPECT().Post(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(chainIDResponses(chainIDs, nil)).AnyTimes()
+	mockPrometheusClient.EXPECT().HandleLatestBlockMetric(gomock.Any()).AnyTimes()
+	mockPrometheusClient.EXPECT().HandleChainIDMismatchMetric(&prom.PromChainIDMismatchMetricData{
+		Network:         "eth",
+		Provider:        "provider3",
+		ExpectedChainID: 1,
+		ReportedChainID: 11155111,
+	}).Times(2)
+
+	n := newChainIDTestNetwork(t, mockHttpClient, mockPrometheusClient, "http://provider1", "http://provider2", "http://provider3")
+	n.verifyChainIDs()
+
+	// The mismatched provider stays unhealthy even though its block number is in line with the network
+	for i := 0; i < 2; i++ {
+		checkProviders(t, n)
+		assert.Equal(t, Healthy, n.Providers["provider1"].getHealthStatus())
+		assert.Equal(t, Healthy, n.Providers["provider2"].getHealthStatus())
+		assert.Equal(t, Unhealthy, n.Providers["provider3"].getHealthStatus())
+	}
+	_, ok := n.getCheckedProviderHCList("provider3")
+	assert.False(t, ok)
+
+	// Once the provider reports the expected chain id again it is checked like the others
+	chainIDs["http://provider3"] = "0x1"
+	n.verifyChainIDs()
+	checkProviders(t, n)
+	_, ok = n.getCheckedProviderHCList("provider3")
+	assert.True(t, ok)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -1,6 +1,8 @@
 package modules
 
-type HealthStatus int
+import "time"
+
+type HealthStatus int32
 
 const (
 	// Health status enums
@@ -13,10 +15,12 @@ const (
 
 	// Module Context Key constants
 	DinUpstreamsContextKey = "din.internal.upstreams"
-	RequestProviderKey     = "request_provider"
-	RequestBodyKey         = "request_body"
-	HealthStatusKey        = "health_status"
-	BlockNumberKey         = "block_number"
+	// The headers and query of the request before the selected provider's were added, restored on retries
+	DinRequestOriginKey = "din.internal.request_origin"
+	RequestProviderKey  = "request_provider"
+	RequestBodyKey      = "request_body"
+	HealthStatusKey     = "health_status"
+	BlockNumberKey      = "block_number"
 
 	// Health check constants
 	DefaultHCMethod                = "eth_blockNumber"
@@ -24,8 +28,39 @@ const (
 	DefaultHCInterval              = 5
 	DefaultBlockLagLimit           = int64(5)
 	DefaultBlockNumberDelta        = int64(10)
+	DefaultFinalizedLagLimit       = int64(64)
+	DefaultStaleBlockMultiplier    = 3
+	DefaultForkCheckOffset         = int64(2)
 	DefaultMaxRequestPayloadSizeKB = int64(4096)
 	DefaultRequestAttemptCount     = 5
+	// The providers due for a health check are looked up every HealthCheckTick
+	HealthCheckTick = 250 * time.Millisecond
+	// Health check delays are moved at random by up to this fraction of them
+	HealthCheckJitter = 0.1
+	// The longest delay between the health checks of a failing or rate limited provider, unless its interval is longer
+	MaxHealthCheckBackoff = 2 * time.Minute
+	// Unhealthy providers that answer their health checks are rechecked this many times faster than their interval
+	RecoveringHealthCheckSpeedup = 4
+	// The delay before resubscribing to the heads of a provider after its subscription dropped, doubled on every failed attempt
+	HeadSubscriptionRetryDelay    = time.Second
+	MaxHeadSubscriptionRetryDelay = time.Minute
+	// The number of new heads buffered per subscription
+	HeadSubscriptionBufferSize = 16
+	// The chain id of every provider is verified once every ChainIDCheckRounds health checks
+	ChainIDCheckRounds = 12
+	// The number of majority block hashes recorded per network to detect reorgs
+	ForkHistorySize = 32
+
+	// Health webhook constants
+	DefaultHealthWebhookTimeout = 5 * time.Second
+	DefaultHealthWebhookRetries = 3
+	// The number of events buffered for delivery before new events are dropped
+	HealthWebhookQueueSize = 100
+	// The delay before the first retry of a failed delivery, doubled on every retry
+	HealthWebhookRetryBackoff = time.Second
+
+	// The key files of the siwe signers are read again every SignerReloadInterval, to pick up rotated keys
+	SignerReloadInterval = 10 * time.Second
 
 	// Registry constants
 	DefaultRegistryBlockCheckIntervalSec = uint64(60)
@@ -37,6 +72,8 @@ const (
 
 	// Request/Response Header Keys
 	DinProviderInfo = "din-provider-info"
+	// Requests with the same session id are sent to the same upstream
+	DinSessionIdHeader = "Din-Session-Id"
 
 	// Upstream/Selector Constants
 	MaxPriority = 9
@@ -2,14 +2,11 @@ package modules
 
 import (
 	"bytes"
-	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net/http"
 	"net/url"
-	"os"
 	"strconv"
 	"strings"
 	"sync"
@@ -21,11 +18,14 @@ import (
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyevents"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
 
+	"github.com/DIN-center/din-caddy-plugins/lib/auth/credentials"
 	"github.com/DIN-center/din-caddy-plugins/lib/auth/siwe"
 )
 
@@ -36,59 +36,77 @@ var (
 	// Din Middleware Module
 	_ caddy.Module                = (*DinMiddleware)(nil)
 	_ caddy.Provisioner           = (*DinMiddleware)(nil)
+	_ caddy.CleanerUpper          = (*DinMiddleware)(nil)
 	_ caddyhttp.MiddlewareHandler = (*DinMiddleware)(nil)
 	_ caddyfile.Unmarshaler       = (*DinMiddleware)(nil)
-	// _ caddy.Validator			= (*mod.DinMiddleware)(nil)
+	_ caddy.Validator             = (*DinMiddleware)(nil)
 )
 
 type DinMiddleware struct {
-	// A map of network paths to network objects
+	// A map of network paths to network objects.
+	// Once provisioned, the map and the networks in it are never modified in place. Registry updates build a new map
+	// and swap it in under mu, see getNetworks() and setNetwork().
 	Networks map[string]*network `json:"networks"`
 	mu       sync.RWMutex
 
-	// The default siwe signer object
-	DefaultSiweSigner *siwe.SigningConfig
+	// The default siwe signer object, used by providers with siwe auth that don't define their own signer
+	DefaultSiweSigner *siwe.SigningConfig `json:"siwe_signer,omitempty"`
 
 	// The default siwe signer client
-	SiweSignerClient siwe.ISIWESignerClient
+	SiweSignerClient siwe.ISIWESignerClient `json:"-"`
 
 	// The prometheus client object
-	PrometheusClient *prom.PrometheusClient
+	PrometheusClient *prom.PrometheusClient `json:"-"`
 
 	// The dingo client object
-	DingoClient din.IDingoClient
+	DingoClient din.IDingoClient `json:"-"`
 
 	logger *zap.Logger
 
 	// The unique machine ID for the current running server instance
 	machineID string
 
+	// The webhook the health transitions of the providers are posted to, if any
+	HealthWebhook *healthWebhook `json:"health_webhook,omitempty"`
+	// The Caddy events app the health transitions of the providers are emitted to, nil in test mode
+	events *caddyevents.App
+	ctx    caddy.Context
+
 	// Test mode flag, should only be used for unit/integration testing purposes.
 	testMode bool
 
 	// DIN Registry configuration
 	// The flag to enable or disable the din registry
-	RegistryEnabled bool
+	RegistryEnabled bool `json:"registry_enabled,omitempty"`
 	// The interval in seconds to check the latest block number from the registry
-	RegistryBlockCheckIntervalSec uint64
+	RegistryBlockCheckIntervalSec uint64 `json:"registry_block_check_interval_sec,omitempty"`
 	// The epoch in blocks to check the latest block number from the registry.
 	// For example, if the epoch is 10, then the din registry will be synced every 10 blocks.
-	RegistryBlockEpoch uint64
+	RegistryBlockEpoch uint64 `json:"registry_block_epoch,omitempty"`
 	// The block number in which the registry was updated last
 	registryLastUpdatedEpochBlockNumber uint64
 	// The blockchain network to pull the registry data from. ie linea-mainnet or linea-sepolia
-	RegistryEndpointUrl string
+	RegistryEndpointUrl string `json:"registry_endpoint_url,omitempty"`
 	// The contract address of the registry contract
-	RegistryContractAddress string
+	RegistryContractAddress string `json:"registry_contract_address,omitempty"`
 	// The priority of the registry providers
-	RegistryPriority int
+	RegistryPriority int `json:"registry_priority,omitempty"`
+	// The credentials of the registry providers with the api_key, bearer, basic or oauth2 auth type, by provider host.
+	// The registry sets the auth type, and the token URL of oauth2 providers unless set here.
+	RegistryCredentials map[string]*credentials.ClientAuth `json:"registry_credentials,omitempty"`
+	// The health check intervals in seconds of the registry providers, by provider host, overriding the interval of their network
+	RegistryHCIntervals map[string]int `json:"registry_healthcheck_intervals,omitempty"`
 
 	// The channel to quit the goroutines
 	quit chan struct{}
+
+	// The process-wide provider health states referenced by this middleware instance, keyed by network and provider URL
+	providerStates map[string]*providerStateRecord
+	stateMu        sync.Mutex
 }
 
 // CaddyModule returns the Caddy module information.
-func (DinMiddleware) CaddyModule() caddy.ModuleInfo {
+func (*DinMiddleware) CaddyModule() caddy.ModuleInfo {
 	return caddy.ModuleInfo{
 		ID:  "http.handlers.din",
 		New: func() caddy.Module { return new(DinMiddleware) },
@@ -132,6 +150,54 @@ func (d *DinMiddleware) Provision(context caddy.Context) error {
 	return nil
 }
 
+// Validate() is called by Caddy after Provision() to check the configuration before the server starts.
+func (d *DinMiddleware) Validate() error {
+	if len(d.Networks) == 0 && !d.RegistryEnabled {
+		return fmt.Errorf("expected at least 1 network or registry to be defined")
+	}
+	for name, network := range d.getNetworks() {
+		if err := network.validate(); err != nil {
+			return fmt.Errorf("network %s: %v", name, err)
+		}
+	}
+	if d.DefaultSiweSigner != nil {
+		if err := d.DefaultSiweSigner.Validate(); err != nil {
+			return fmt.Errorf("siwe-signer: %v", err)
+		}
+	}
+	if d.HealthWebhook != nil {
+		if err := d.HealthWebhook.validate(); err != nil {
+			return fmt.Errorf("health_webhook: %v", err)
+		}
+	}
+	if d.RegistryEnabled {
+		if d.RegistryEndpointUrl != "" {
+			url, err := url.Parse(d.RegistryEndpointUrl)
+			if err != nil || url.Host == "" || (url.Scheme != "http" && url.Scheme != "https" && url.Scheme != "ws" && url.Scheme != "wss") {
+				return fmt.Errorf("registry_endpoint_url must be an http(s) or ws(s) url, got %q", d.RegistryEndpointUrl)
+			}
+		}
+		if d.RegistryContractAddress != "" && !common.IsHexAddress(d.RegistryContractAddress) {
+			return fmt.Errorf("registry_contract_address must be a hex address, got %q", d.RegistryContractAddress)
+		}
+		if d.RegistryBlockEpoch == 0 {
+			return fmt.Errorf("registry_block_epoch must be at least 1")
+		}
+		if d.RegistryBlockCheckIntervalSec == 0 {
+			return fmt.Errorf("registry_block_check_interval_sec must be at least 1")
+		}
+		if d.RegistryPriority < 0 || d.RegistryPriority >= MaxPriority {
+			return fmt.Errorf("registry_priority must be between 0 and %d, got %d", MaxPriority-1, d.RegistryPriority)
+		}
+		for host, interval := range d.RegistryHCIntervals {
+			if interval < 1 {
+				return fmt.Errorf("registry_healthcheck_interval of %s must be at least 1 second, got %d", host, interval)
+			}
+		}
+	}
+	return nil
+}
+
 // initialize initializes the din middleware object with the necessary configuration values
 func (d *DinMiddleware) initialize(context caddy.Context) error {
 	var err error
@@ -160,14 +226,42 @@ func (d *DinMiddleware) initialize(context caddy.Context) error {
 		return fmt.Errorf("error initializing din client: %v", err)
 	}
 
+	// Load the key of the default signer, so that it is shared by the providers that use it
+	if d.DefaultSiweSigner != nil {
+		if err := d.DefaultSiweSigner.LoadKey(); err != nil {
+			return fmt.Errorf("error loading siwe-signer key: %v", err)
+		}
+	}
+
+	// Health transitions are emitted to the Caddy events app and posted to the health webhook
+	d.ctx = context
+	if !d.testMode {
+		eventsApp, err := context.App("events")
+		if err != nil {
+			return fmt.Errorf("error loading events app: %v", err)
+		}
+		d.events = eventsApp.(*caddyevents.App)
+	}
+	if d.HealthWebhook != nil {
+		if err := d.HealthWebhook.provision(logger); err != nil {
+			return fmt.Errorf("error provisioning health_webhook: %v", err)
+		}
+		d.HealthWebhook.start()
+	}
+
 	// Initialize the HTTP client for each network and provider
 	httpClient := din_http.NewHTTPClient()
 	for networkName, network := range d.Networks {
 		d.logger.Debug("Registered network", zap.String("name", networkName))
+		// Networks loaded from JSON are named by their key
+		if network.Name == "" {
+			network.Name = networkName
+		}
 		network.HttpClient = httpClient
 		network.logger = d.logger
 		network.PrometheusClient = promClient
 		network.machineID = d.machineID
+		network.healthEvents = d
 
 		// Initialize the provider's upstream, path, and HTTP client
 		for _, provider := range network.Providers {
@@ -175,6 +269,8 @@ func (d *DinMiddleware) initialize(context caddy.Context) error {
 			if err != nil {
 				return fmt.Errorf("error initializing provider: %v", err)
 			}
+			// Pick up the health state of the provider from a previously loaded config
+			d.trackProviderState(network, provider)
 		}
 	}
 
@@ -192,6 +288,7 @@ func (d *DinMiddleware) initialize(context caddy.Context) error {
 		if err != nil {
 			return fmt.Errorf("error starting healthchecks: %v", err)
 		}
+		d.startSignerReload()
 
 		// Pull data from the din registry
 		// This will pull the latest networks and providers from the din registry and update the networks and providers in the middleware object
@@ -221,10 +318,16 @@ func (d *DinMiddleware) initializeProvider(provider *provider, httpClient *din_h
 	provider.path = url.Path
 	provider.host = url.Host
 	provider.httpClient = httpClient
-	if provider.Auth != nil {
-		if err := provider.Auth.Start(logger); err != nil {
-			d.logger.Warn("Error starting authentication", zap.String("provider", provider.HttpUrl), zap.String("machine_id", d.machineID))
+	if provider.TLS != nil {
+		tlsConfig, err := provider.TLS.Load()
+		if err != nil {
+			return fmt.Errorf("error loading provider tls config: %v", err)
 		}
+		provider.transport = din_http.NewTransport(tlsConfig)
+		provider.httpClient = din_http.NewHTTPClientWithTransport(provider.transport)
+	}
+	if err := d.startProviderAuth(provider, logger); err != nil {
+		return err
 	}
 	provider.logger = d.logger
 	d.logger.Debug("Provider provisioned", zap.String("Provider", provider.HttpUrl), zap.String("Host", provider.host), zap.Int("Priority", provider.Priority), zap.Any("Headers", provider.Headers), zap.Any("Auth", provider.Auth), zap.Any("Upstream", provider.upstream), zap.Any("Path", provider.path))
@@ -232,17 +335,40 @@ func (d *DinMiddleware) initializeProvider(provider *provider, httpClient *din_h
 	return nil
 }
 
+// startProviderAuth starts the SIWE sessions or loads the credentials of the provider
+func (d *DinMiddleware) startProviderAuth(provider *provider, logger *zap.Logger) error {
+	if provider.Auth != nil {
+		if provider.transport != nil {
+			provider.Auth.UseTransport(provider.transport)
+		}
+		if provider.Auth.Signer == nil {
+			provider.Auth.Signer = d.DefaultSiweSigner
+		}
+		if provider.Auth.Signer != nil {
+			if err := provider.Auth.Signer.LoadKey(); err != nil {
+				return fmt.Errorf("error loading signer key: %v", err)
+			}
+		}
+		if err := provider.Auth.Start(logger); err != nil {
+			d.logger.Warn("Error starting authentication", zap.String("provider", provider.HttpUrl), zap.String("machine_id", d.machineID))
+		}
+	}
+	if provider.Credentials != nil {
+		if err := provider.Credentials.Start(logger); err != nil {
+			d.logger.Warn("Error loading provider credentials", zap.String("provider", provider.HttpUrl), zap.Error(err), zap.String("machine_id", d.machineID))
+		}
+	}
+	return nil
+}
+
 // ServeHTTP is the main handler for the middleware that is ran for every request.
 // It checks if the network path is defined in the networks map and sets the provider in the context.
 func (d *DinMiddleware) ServeHTTP(rw http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
-	d.mu.RLock()
-	defer d.mu.RUnlock()
-
 	// Caddy replacer is used to set the context for the request
 	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
 
 	networkPath := strings.TrimPrefix(r.URL.Path, "/")
-	network, ok := d.Networks[networkPath]
+	network, ok := d.getNetworks()[networkPath]
 	if !ok {
 		// If the network is not defined, return a 404. If the network path is empty, return an empty JSON object with a 200
 		if networkPath == "" {
@@ -275,8 +401,13 @@ func (d *DinMiddleware) ServeHTTP(rw http.ResponseWriter, r *http.Request, next
 	// Create a new response writer wrapper to capture the response body and status code
 	var rww *ResponseWriterWrapper
 
-	// Set the upstreams in the context for the request
-	repl.Set(DinUpstreamsContextKey, network.Providers)
+	// Set the upstreams in the context for the request. Requests for the safe or finalized block
+	// only go to providers whose head of the tag is consistent with the network's view.
+	providers := network.Providers
+	if tag := requestBlockTag(bodyBytes); tag != "" {
+		providers = network.providersForBlockTag(tag)
+	}
+	repl.Set(DinUpstreamsContextKey, providers)
 
 	reqStartTime := time.Now()
 
@@ -343,7 +474,10 @@ func (d *DinMiddleware) ServeHTTP(rw http.ResponseWriter, r *http.Request, next
 			}
 		}
 	}
-	healthStatus := network.Providers[provider].healthStatus.String()
+	var healthStatus string
+	if p, ok := network.Providers[provider]; ok {
+		healthStatus = p.getHealthStatus().String()
+	}
 
 	// If the request body is empty, do not increment the prometheus metric. specifically for OPTIONS requests
 	if len(bodyBytes) == 0 {
@@ -368,195 +502,55 @@ func (d *DinMiddleware) ServeHTTP(rw http.ResponseWriter, r *http.Request, next
 
 // UnmarshalCaddyfile sets up reverse proxy provider and method data on the serve based on the configuration of the Caddyfile
 func (d *DinMiddleware) UnmarshalCaddyfile(dispenser *caddyfile.Dispenser) error {
-	var err error
 	if d.Networks == nil {
 		d.Networks = make(map[string]*network)
 	}
 	siweSignerClient := siwe.NewSIWESignerClient()
+	defs := newCaddyfileDefinitions()
 	for dispenser.Next() { // Skip the directive name
 		switch dispenser.Val() {
 		case "siwe-signer":
-			var key []byte
-			for n1 := dispenser.Nesting(); dispenser.NextBlock(n1); {
-				switch dispenser.Val() {
-				case "secret_file":
-					dispenser.NextBlock(n1)
-					hexKeyBytes, err := ioutil.ReadFile(dispenser.Val())
-					if err != nil {
-						return dispenser.Errf("failed to read secret file: %v", err)
-					}
-					hexKey := string(hexKeyBytes)
-					hexKey = strings.TrimSpace(strings.TrimPrefix(hexKey, "0x"))
-					key, err = hex.DecodeString(hexKey)
-					if err != nil {
-						return err
-					}
-				case "secret":
-					dispenser.NextBlock(n1)
-					hexKey := dispenser.Val()
-					hexKey = strings.TrimPrefix(hexKey, "0x")
-					key, err = hex.DecodeString(hexKey)
-					if err != nil {
-						return dispenser.Errf("error parsing %v: %v", hexKey, err.Error())
-					}
-				}
+			signer, err := parseSigningConfig(dispenser, dispenser.Nesting())
+			if err != nil {
+				return err
 			}
-			if len(key) == 0 {
+			if signer.Secret == "" && signer.SecretFile == "" && signer.KeystoreFile == "" && signer.SignerURL == "" {
 				return dispenser.Errf("no key material in siwe-signer definition")
 			}
-			d.DefaultSiweSigner = &siwe.SigningConfig{
-				PrivateKey: key,
+			d.DefaultSiweSigner = signer
+		case "health_webhook":
+			webhook, err := parseHealthWebhook(dispenser)
+			if err != nil {
+				return err
+			}
+			d.HealthWebhook = webhook
+		case "method_set":
+			var name string
+			if !dispenser.Args(&name) {
+				return dispenser.ArgErr()
+			}
+			if err := defs.defineMethodSet(dispenser, name); err != nil {
+				return err
+			}
+		case "network_template":
+			var name string
+			if !dispenser.Args(&name) {
+				return dispenser.ArgErr()
+			}
+			if _, ok := defs.templates[name]; ok {
+				return dispenser.Errf("network template %s is already defined", name)
 			}
-			if err := siweSignerClient.GenPrivKey(d.DefaultSiweSigner); err != nil {
+			template := NewNetwork(name)
+			if err := d.parseNetworkOptions(dispenser, template, defs, siweSignerClient, false); err != nil {
 				return err
 			}
+			defs.templates[name] = template
 		case "networks":
 			for n1 := dispenser.Nesting(); dispenser.NextBlock(n1); {
 				networkName := dispenser.Val()
 				d.Networks[networkName] = NewNetwork(networkName) // Create a new network object
-				for nesting := dispenser.Nesting(); dispenser.NextBlock(nesting); {
-					switch dispenser.Val() {
-					case "methods":
-						d.Networks[networkName].Methods = make([]*string, dispenser.CountRemainingArgs())
-						for i := 0; i < dispenser.CountRemainingArgs(); i++ {
-							d.Networks[networkName].Methods[i] = new(string)
-						}
-						if !dispenser.Args(d.Networks[networkName].Methods...) {
-							return dispenser.Errf("invalid 'methods' argument for network %s", networkName)
-						}
-					case "providers":
-						for dispenser.NextBlock(nesting + 1) {
-							providerObj, err := NewProvider(dispenser.Val())
-							if err != nil {
-								return fmt.Errorf("error creating provider: %v", err)
-							}
-							for dispenser.NextBlock(nesting + 2) {
-								switch dispenser.Val() {
-								case "auth":
-									auth := siweSignerClient.CreateNewSIWEAuth(strings.TrimSuffix(providerObj.HttpUrl, "/")+"/auth", 16)
-									for dispenser.NextBlock(nesting + 3) {
-										switch dispenser.Val() {
-										case "type":
-											dispenser.NextBlock(nesting + 3)
-											if dispenser.Val() != "siwe" {
-												return fmt.Errorf("unknown auth type")
-											}
-										case "url":
-											dispenser.NextBlock(nesting + 3)
-											auth.ProviderURL = dispenser.Val()
-										case "sessions":
-											dispenser.NextBlock(nesting + 3)
-											auth.SessionCount, err = strconv.Atoi(dispenser.Val())
-											if err != nil {
-												return fmt.Errorf("invalid session count: %v", err)
-											}
-										case "signer":
-											var key []byte
-											for dispenser.NextBlock(nesting + 4) {
-												switch dispenser.Val() {
-												case "secret_file":
-													dispenser.NextBlock(nesting + 4)
-													hexKeyBytes, err := os.ReadFile(dispenser.Val())
-													if err != nil {
-														return dispenser.Errf("failed to read secret file: %v", err)
-													}
-													hexKey := string(hexKeyBytes)
-													hexKey = strings.TrimSpace(strings.TrimPrefix(hexKey, "0x"))
-													key, err = hex.DecodeString(hexKey)
-													if err != nil {
-														return fmt.Errorf("failed to decode secret file: %v", err)
-													}
-												case "secret":
-													dispenser.NextBlock(nesting + 4)
-													hexKey := dispenser.Val()
-													hexKey = strings.TrimPrefix(hexKey, "0x")
-													key, err = hex.DecodeString(hexKey)
-													if err != nil {
-														return fmt.Errorf("failed to decode secret: %v", err)
-													}
-												}
-											}
-											auth.Signer = &siwe.SigningConfig{
-												PrivateKey: key,
-											}
-											if err := siweSignerClient.GenPrivKey(auth.Signer); err != nil {
-												return fmt.Errorf("failed to generate private key: %v", err)
-											}
-										}
-									}
-									if auth.Signer == nil {
-										if d.DefaultSiweSigner == nil {
-											return dispenser.Errf("signer must be set")
-										}
-										auth.Signer = d.DefaultSiweSigner
-									}
-									providerObj.Auth = auth
-								case "headers":
-									for dispenser.NextBlock(nesting + 3) {
-										k := dispenser.Val()
-										var v string
-										if dispenser.Args(&v) {
-											providerObj.Headers[k] = v
-										} else {
-											return dispenser.Errf("header should have key and value")
-										}
-									}
-								case "priority":
-									dispenser.NextBlock(nesting + 2)
-									providerObj.Priority, err = strconv.Atoi(dispenser.Val())
-									if err != nil {
-										return fmt.Errorf("invalid priority: %v", err)
-									}
-								}
-							}
-							d.Networks[networkName].Providers[providerObj.host] = providerObj
-						}
-					case "healthcheck_method":
-						dispenser.Next()
-						d.Networks[networkName].HCMethod = dispenser.Val()
-					case "healthcheck_threshold":
-						dispenser.Next()
-						d.Networks[networkName].HCThreshold, err = strconv.Atoi(dispenser.Val())
-						if err != nil {
-							return fmt.Errorf("invalid healthcheck threshold: %v", err)
-						}
-					case "healthcheck_interval":
-						dispenser.Next()
-						d.Networks[networkName].HCInterval, err = strconv.Atoi(dispenser.Val())
-						if err != nil {
-							return fmt.Errorf("invalid healthcheck interval: %v", err)
-						}
-					case "healthcheck_blocklag_limit":
-						dispenser.Next()
-						limit, err := strconv.Atoi(dispenser.Val())
-						if err != nil {
-							return fmt.Errorf("invalid healthcheck blocklag limit: %v", err)
-						}
-						d.Networks[networkName].BlockLagLimit = int64(limit)
-					case "healthcheck_blocknumber_delta":
-						dispenser.Next()
-						blockNumberDelta, err := strconv.Atoi(dispenser.Val())
-						if err != nil {
-							return fmt.Errorf("invalid healthcheck blocknumber delta: %v", err)
-						}
-						d.Networks[networkName].BlockNumberDelta = int64(blockNumberDelta)
-					case "max_request_payload_size_kb":
-						dispenser.Next()
-						size, err := strconv.Atoi(dispenser.Val())
-						if err != nil {
-							return fmt.Errorf("invalid max request payload size: %v", err)
-						}
-						d.Networks[networkName].MaxRequestPayloadSizeKB = int64(size)
-					case "request_attempt_count":
-						dispenser.Next()
-						requestAttemptCount, err := strconv.Atoi(dispenser.Val())
-						if err != nil {
-							return fmt.Errorf("invalid request attempt count: %v", err)
-						}
-						d.Networks[networkName].RequestAttemptCount = requestAttemptCount
-					default:
-						return dispenser.Errf("unrecognized option: %s", dispenser.Val())
-					}
+				if err := d.parseNetworkOptions(dispenser, d.Networks[networkName], defs, siweSignerClient, true); err != nil {
+					return err
 				}
 				if len(d.Networks[networkName].Providers) == 0 {
 					return dispenser.Errf("expected at least one provider for network %s", networkName)
@@ -608,6 +602,38 @@ func (d *DinMiddleware) UnmarshalCaddyfile(dispenser *caddyfile.Dispenser) error
 						return dispenser.Errf("Error converting string to int: %v", err)
 					}
 					d.RegistryPriority = intValue
+				case "registry_credentials":
+					var host string
+					if !dispenser.Args(&host) {
+						return dispenser.ArgErr()
+					}
+					creds := &credentials.ClientAuth{}
+					for nesting := dispenser.Nesting(); dispenser.NextBlock(nesting); {
+						ok, err := creds.UnmarshalCaddyfileOption(dispenser)
+						if err != nil {
+							return err
+						}
+						if !ok {
+							return dispenser.Errf("unknown registry_credentials option %s", dispenser.Val())
+						}
+					}
+					if d.RegistryCredentials == nil {
+						d.RegistryCredentials = make(map[string]*credentials.ClientAuth)
+					}
+					d.RegistryCredentials[host] = creds
+				case "registry_healthcheck_interval":
+					var host, intervalVal string
+					if !dispenser.Args(&host, &intervalVal) {
+						return dispenser.ArgErr()
+					}
+					interval, err := strconv.Atoi(intervalVal)
+					if err != nil {
+						return dispenser.Errf("invalid registry_healthcheck_interval of %s: %v", host, err)
+					}
+					if d.RegistryHCIntervals == nil {
+						d.RegistryHCIntervals = make(map[string]int)
+					}
+					d.RegistryHCIntervals[host] = interval
 				}
 			}
 		}
@@ -617,6 +643,357 @@ func (d *DinMiddleware) UnmarshalCaddyfile(dispenser *caddyfile.Dispenser) error
 	return nil
 }
 
+// parseNetworkOptions parses the options block of a network or network template into n.
+// A template option must come first, the options that follow override the settings inherited from the template.
+func (d *DinMiddleware) parseNetworkOptions(dispenser *caddyfile.Dispenser, n *network, defs *caddyfileDefinitions, siweSignerClient *siwe.SIWESignerClient, allowProviders bool) error {
+	var err error
+	var methods []string
+	methodsSet := false
+	first := true
+	for nesting := dispenser.Nesting(); dispenser.NextBlock(nesting); first = false {
+		switch dispenser.Val() {
+		case "template":
+			if !first {
+				return dispenser.Errf("template must be the first option of %s", n.Name)
+			}
+			var name string
+			if !dispenser.Args(&name) {
+				return dispenser.ArgErr()
+			}
+			template, ok := defs.templates[name]
+			if !ok {
+				return dispenser.Errf("unknown network template %s", name)
+			}
+			n.applyTemplate(template)
+		case "methods":
+			methods = append(methods, dispenser.RemainingArgs()...)
+			methodsSet = true
+		case "method_set":
+			expanded, err := defs.expandMethodSets(dispenser.RemainingArgs())
+			if err != nil {
+				return dispenser.Err(err.Error())
+			}
+			methods = append(methods, expanded...)
+			methodsSet = true
+		case "providers":
+			if !allowProviders {
+				return dispenser.Errf("providers can't be defined in network template %s", n.Name)
+			}
+			for dispenser.NextBlock(nesting + 1) {
+				providerObj, err := NewProvider(dispenser.Val())
+				if err != nil {
+					return fmt.Errorf("error creating provider: %v", err)
+				}
+				for dispenser.NextBlock(nesting + 2) {
+					switch dispenser.Val() {
+					case "auth":
+						auth := siweSignerClient.CreateNewSIWEAuth(strings.TrimSuffix(providerObj.HttpUrl, "/")+"/auth", 16)
+						creds := &credentials.ClientAuth{}
+						// The first siwe and credentials options, to reject the options of the other auth types
+						var siweOption, credentialsOption string
+						authType := "siwe"
+						for dispenser.NextBlock(nesting + 3) {
+							option := dispenser.Val()
+							switch option {
+							case "type":
+								if !dispenser.Args(&authType) {
+									return dispenser.ArgErr()
+								}
+								if authType != "siwe" && !credentials.IsType(authType) {
+									return dispenser.Errf("unknown auth type %s", authType)
+								}
+								continue
+							case "url":
+								dispenser.NextBlock(nesting + 3)
+								auth.ProviderURL = dispenser.Val()
+							case "sessions":
+								dispenser.NextBlock(nesting + 3)
+								auth.SessionCount, err = strconv.Atoi(dispenser.Val())
+								if err != nil {
+									return fmt.Errorf("invalid session count: %v", err)
+								}
+							case "server_nonce":
+								auth.ServerNonce = true
+							case "signer":
+								auth.Signer, err = parseSigningConfig(dispenser, nesting+4)
+								if err != nil {
+									return err
+								}
+							default:
+								ok, err := creds.UnmarshalCaddyfileOption(dispenser)
+								if err != nil {
+									return err
+								}
+								if !ok {
+									return dispenser.Errf("unknown auth option %s", option)
+								}
+								if credentialsOption == "" {
+									credentialsOption = option
+								}
+								continue
+							}
+							if siweOption == "" {
+								siweOption = option
+							}
+						}
+						if authType == "siwe" {
+							if credentialsOption != "" {
+								return dispenser.Errf("%s is not an option of siwe auth", credentialsOption)
+							}
+							// Providers without a signer use the default signer, which is resolved at provision time
+							if auth.Signer == nil && d.DefaultSiweSigner == nil {
+								return dispenser.Errf("signer must be set")
+							}
+							providerObj.Auth = auth
+						} else {
+							if siweOption != "" {
+								return dispenser.Errf("%s is not an option of %s auth", siweOption, authType)
+							}
+							creds.Type = authType
+							providerObj.Credentials = creds
+						}
+					case "headers":
+						for dispenser.NextBlock(nesting + 3) {
+							k := dispenser.Val()
+							var v string
+							if dispenser.Args(&v) {
+								providerObj.Headers[k] = v
+							} else {
+								return dispenser.Errf("header should have key and value")
+							}
+						}
+					case "priority":
+						dispenser.NextBlock(nesting + 2)
+						providerObj.Priority, err = strconv.Atoi(dispenser.Val())
+						if err != nil {
+							return fmt.Errorf("invalid priority: %v", err)
+						}
+					case "ws_url":
+						if !dispenser.NextArg() {
+							return dispenser.ArgErr()
+						}
+						providerObj.WsUrl = dispenser.Val()
+					case "tls":
+						providerObj.TLS, err = parseTLSConfig(dispenser, nesting+3)
+						if err != nil {
+							return err
+						}
+					case "healthcheck_interval":
+						dispenser.NextBlock(nesting + 2)
+						providerObj.HCInterval, err = strconv.Atoi(dispenser.Val())
+						if err != nil {
+							return fmt.Errorf("invalid healthcheck interval: %v", err)
+						}
+					}
+				}
+				// URLs without a scheme have no host, they are rejected in Validate()
+				if existing, ok := n.Providers[providerObj.host]; ok && providerObj.host != "" {
+					return dispenser.Errf("providers %s and %s of network %s have the same host", existing.HttpUrl, providerObj.HttpUrl, n.Name)
+				}
+				n.Providers[providerObj.host] = providerObj
+			}
+		case "healthcheck_method":
+			dispenser.Next()
+			n.HCMethod = dispenser.Val()
+		case "healthcheck_threshold":
+			dispenser.Next()
+			n.HCThreshold, err = strconv.Atoi(dispenser.Val())
+			if err != nil {
+				return fmt.Errorf("invalid healthcheck threshold: %v", err)
+			}
+		case "healthcheck_interval":
+			dispenser.Next()
+			n.HCInterval, err = strconv.Atoi(dispenser.Val())
+			if err != nil {
+				return fmt.Errorf("invalid healthcheck interval: %v", err)
+			}
+		case "healthcheck_blocklag_limit":
+			dispenser.Next()
+			limit, err := strconv.Atoi(dispenser.Val())
+			if err != nil {
+				return fmt.Errorf("invalid healthcheck blocklag limit: %v", err)
+			}
+			n.BlockLagLimit = int64(limit)
+		case "healthcheck_blocknumber_delta":
+			dispenser.Next()
+			blockNumberDelta, err := strconv.Atoi(dispenser.Val())
+			if err != nil {
+				return fmt.Errorf("invalid healthcheck blocknumber delta: %v", err)
+			}
+			n.BlockNumberDelta = int64(blockNumberDelta)
+		case "healthcheck_latency_threshold_ms":
+			dispenser.Next()
+			threshold, err := strconv.Atoi(dispenser.Val())
+			if err != nil {
+				return fmt.Errorf("invalid healthcheck latency threshold: %v", err)
+			}
+			n.LatencyThresholdMs = int64(threshold)
+		case "stale_block_multiplier":
+			dispenser.Next()
+			n.StaleBlockMultiplier, err = strconv.Atoi(dispenser.Val())
+			if err != nil {
+				return fmt.Errorf("invalid stale block multiplier: %v", err)
+			}
+		case "fork_check_offset":
+			dispenser.Next()
+			offset, err := strconv.Atoi(dispenser.Val())
+			if err != nil {
+				return fmt.Errorf("invalid fork check offset: %v", err)
+			}
+			n.ForkCheckOffset = int64(offset)
+		case "finalized_lag_limit":
+			dispenser.Next()
+			limit, err := strconv.Atoi(dispenser.Val())
+			if err != nil {
+				return fmt.Errorf("invalid finalized lag limit: %v", err)
+			}
+			n.FinalizedLagLimit = int64(limit)
+		case "max_request_payload_size_kb":
+			dispenser.Next()
+			size, err := strconv.Atoi(dispenser.Val())
+			if err != nil {
+				return fmt.Errorf("invalid max request payload size: %v", err)
+			}
+			n.MaxRequestPayloadSizeKB = int64(size)
+		case "request_attempt_count":
+			dispenser.Next()
+			requestAttemptCount, err := strconv.Atoi(dispenser.Val())
+			if err != nil {
+				return fmt.Errorf("invalid request attempt count: %v", err)
+			}
+			n.RequestAttemptCount = requestAttemptCount
+		case "probes":
+			// Probes set in the block replace the probes inherited from a template
+			n.Probes, err = parseProbes(dispenser)
+			if err != nil {
+				return err
+			}
+		case "chain_id":
+			if !dispenser.NextArg() {
+				return dispenser.ArgErr()
+			}
+			n.ChainID, err = parseChainID(dispenser.Val())
+			if err != nil {
+				return dispenser.Errf("invalid chain id: %v", err)
+			}
+		default:
+			return dispenser.Errf("unrecognized option: %s", dispenser.Val())
+		}
+	}
+	// Methods set in the block replace the methods inherited from a template
+	if methodsSet {
+		n.Methods = toMethodList(methods)
+	}
+	return nil
+}
+
+// parseTLSConfig parses the tls block of a provider. The certificate files are only referenced here, they are loaded
+// at provision time.
+func parseTLSConfig(dispenser *caddyfile.Dispenser, nesting int) (*din_http.TLSConfig, error) {
+	tlsConfig := &din_http.TLSConfig{}
+	for dispenser.NextBlock(nesting) {
+		var field *string
+		switch dispenser.Val() {
+		case "cert_file":
+			field = &tlsConfig.CertFile
+		case "key_file":
+			field = &tlsConfig.KeyFile
+		case "ca_file":
+			field = &tlsConfig.CAFile
+		case "server_name":
+			field = &tlsConfig.ServerName
+		case "min_version":
+			field = &tlsConfig.MinVersion
+		default:
+			return nil, dispenser.Errf("unknown tls option %s", dispenser.Val())
+		}
+		if !dispenser.Args(field) {
+			return nil, dispenser.ArgErr()
+		}
+	}
+	return tlsConfig, nil
+}
+
+// parseSigningConfig parses a siwe signer block. Key material is only referenced here, it is loaded at provision time.
+func parseSigningConfig(dispenser *caddyfile.Dispenser, nesting int) (*siwe.SigningConfig, error) {
+	signer := &siwe.SigningConfig{}
+	for dispenser.NextBlock(nesting) {
+		switch dispenser.Val() {
+		case "secret_file":
+			if !dispenser.NextArg() {
+				return nil, dispenser.ArgErr()
+			}
+			signer.SecretFile = dispenser.Val()
+		case "secret":
+			if !dispenser.NextArg() {
+				return nil, dispenser.ArgErr()
+			}
+			signer.Secret = dispenser.Val()
+		case "keystore_file":
+			if !dispenser.NextArg() {
+				return nil, dispenser.ArgErr()
+			}
+			signer.KeystoreFile = dispenser.Val()
+		case "password":
+			if !dispenser.NextArg() {
+				return nil, dispenser.ArgErr()
+			}
+			signer.Password = dispenser.Val()
+		case "password_file":
+			if !dispenser.NextArg() {
+				return nil, dispenser.ArgErr()
+			}
+			signer.PasswordFile = dispenser.Val()
+		case "signer_url":
+			if !dispenser.NextArg() {
+				return nil, dispenser.ArgErr()
+			}
+			signer.SignerURL = dispenser.Val()
+		case "signer_token":
+			if !dispenser.NextArg() {
+				return nil, dispenser.ArgErr()
+			}
+			signer.SignerToken = dispenser.Val()
+		case "signer_cert_file":
+			if !dispenser.NextArg() {
+				return nil, dispenser.ArgErr()
+			}
+			signer.SignerCertFile = dispenser.Val()
+		case "signer_key_file":
+			if !dispenser.NextArg() {
+				return nil, dispenser.ArgErr()
+			}
+			signer.SignerKeyFile = dispenser.Val()
+		case "signer_ca_file":
+			if !dispenser.NextArg() {
+				return nil, dispenser.ArgErr()
+			}
+			signer.SignerCAFile = dispenser.Val()
+		case "signer_timeout":
+			if !dispenser.NextArg() {
+				return nil, dispenser.ArgErr()
+			}
+			timeout, err := caddy.ParseDuration(dispenser.Val())
+			if err != nil {
+				return nil, dispenser.Errf("invalid signer_timeout: %v", err)
+			}
+			signer.SignerTimeout = caddy.Duration(timeout)
+		case "signer_retries":
+			if !dispenser.NextArg() {
+				return nil, dispenser.ArgErr()
+			}
+			retries, err := strconv.Atoi(dispenser.Val())
+			if err != nil {
+				return nil, dispenser.Errf("invalid signer_retries: %v", err)
+			}
+			signer.SignerRetries = &retries
+		default:
+			return nil, dispenser.Errf("unrecognized signer option: %s", dispenser.Val())
+		}
+	}
+	return signer, nil
+}
+
 func (d *DinMiddleware) ParseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
 	err := d.UnmarshalCaddyfile(h.Dispenser)
 	if err != nil {
@@ -629,7 +1006,7 @@ func (d *DinMiddleware) ParseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.Middle
 // StartHealthchecks starts a background goroutine to monitor all of the networks' overall health and the health of its providers
 func (d *DinMiddleware) startHealthChecks() error {
 	d.logger.Info("Starting healthchecks", zap.String("machine_id", d.machineID))
-	for _, network := range d.Networks {
+	for _, network := range d.getNetworks() {
 		d.logger.Info("Starting healthcheck for network", zap.String("network", network.Name), zap.String("machine_id", d.machineID))
 		network.startHealthcheck()
 	}
@@ -665,13 +1042,39 @@ func (d *DinMiddleware) startRegistrySync() {
 	}()
 }
 
+// Cleanup is called by Caddy when the config this middleware belongs to is unloaded, for example on a config reload.
+// It stops the background goroutines and releases the provider health states, which are kept for the next instance.
+func (d *DinMiddleware) Cleanup() error {
+	d.closeAll()
+	d.releaseProviderStates()
+	return nil
+}
+
 func (d *DinMiddleware) closeAll() {
-	for _, network := range d.Networks {
+	for _, network := range d.getNetworks() {
 		network.close()
+		for _, provider := range network.Providers {
+			provider.stopCredentials()
+		}
 	}
 	d.close()
 }
 
 func (d *DinMiddleware) close() {
-	close(d.quit)
+	if d.quit != nil {
+		close(d.quit)
+	}
+	if d.HealthWebhook != nil {
+		d.HealthWebhook.stop()
+	}
+}
+
+// emitHealthEvent emits a health transition of a provider to the Caddy events app and queues it for the health webhook
+func (d *DinMiddleware) emitHealthEvent(event *healthEvent) {
+	if d.events != nil {
+		d.events.Emit(d.ctx, HealthChangedEvent, event.data())
+	}
+	if d.HealthWebhook != nil {
+		d.HealthWebhook.enqueue(event)
+	}
 }
@@ -2,9 +2,10 @@ package modules
 
 import (
 	"fmt"
-	"os"
 
+	"github.com/DIN-center/din-caddy-plugins/lib/auth/credentials"
 	din_http "github.com/DIN-center/din-caddy-plugins/lib/http"
+	prom "github.com/DIN-center/din-caddy-plugins/lib/prometheus"
 	"github.com/DIN-center/din-sc/apps/din-go/lib/din"
 	dinreg "github.com/DIN-center/din-sc/apps/din-go/pkg/dinregistry"
 	"go.uber.org/zap"
@@ -47,9 +48,6 @@ func (d *DinMiddleware) processRegistryData(registryData *din.DinRegistryData) {
 		d.logger.Error("Registry data is nil. Check registry connection")
 		return
 	}
-	// Lock the middleware object to prevent race condition when updating the networks and providers
-	d.mu.RLock()
-	defer d.mu.RUnlock()
 
 	// Loop through the networks in the din registry
 	for _, regNetwork := range registryData.Networks {
@@ -59,7 +57,7 @@ func (d *DinMiddleware) processRegistryData(registryData *din.DinRegistryData) {
 		}
 
 		// Check if the network exists in the local network list within the middleware object
-		network, ok := d.Networks[regNetwork.ProxyName]
+		network, ok := d.getNetworks()[regNetwork.ProxyName]
 		if !ok {
 			if regNetwork.Status != dinreg.Active {
 				d.logger.Debug("Network is not active, skipping", zap.String("network", regNetwork.ProxyName))
@@ -77,10 +75,10 @@ func (d *DinMiddleware) processRegistryData(registryData *din.DinRegistryData) {
 			if regNetwork.Status != dinreg.Active {
 				// Skip over network for now if it is not active
 				d.logger.Debug("Network is not active, removing from middleware: ", zap.String("network", regNetwork.ProxyName))
-				delete(d.Networks, regNetwork.ProxyName)
+				d.removeNetwork(regNetwork.ProxyName)
 				continue
 			}
-			// if active, update the existing network in place with the registry data
+			// if active, replace the existing network with a copy updated with the registry data
 			err := d.updateNetworkWithRegistryData(regNetwork, network)
 			if err != nil {
 				d.logger.Error("Failed to update network with registry data", zap.Error(err))
@@ -104,6 +102,7 @@ func (d *DinMiddleware) addNetworkWithRegistryData(regNetwork *din.Network) erro
 	network.logger = d.logger
 	network.PrometheusClient = d.PrometheusClient
 	network.machineID = d.machineID
+	network.healthEvents = d
 
 	for _, regProvider := range regNetwork.Providers {
 		for _, networkService := range regProvider.NetworkServices {
@@ -126,31 +125,31 @@ func (d *DinMiddleware) addNetworkWithRegistryData(regNetwork *din.Network) erro
 
 			// Add the provider to the network object
 			network.Providers[provider.host] = provider
+			d.trackProviderState(network, provider)
 		}
 	}
 	if len(network.Providers) == 0 {
 		d.logger.Debug("Network has no active providers", zap.String("network", network.Name))
 		return nil
 	}
-	// Add the network to the middleware object
-	d.Networks[network.Name] = network
-
-	// Start the healthcheck for the network if the middleware is not in test mode
-	if !d.testMode {
-		network.startHealthcheck()
-		d.logger.Info("Starting healthcheck for network", zap.String("network", network.Name), zap.String("machine_id", d.machineID))
-	}
+	// Add the network to the middleware object, and start its healthcheck
+	d.updateNetworkData(network)
 	return nil
 }
 
-// updateNetworkWithRegistryData updates the network object in the middleware object with the latest registry network data
-func (d *DinMiddleware) updateNetworkWithRegistryData(regNetwork *din.Network, newNetwork *network) error {
+// updateNetworkWithRegistryData replaces the network object in the middleware object with a copy updated with the latest registry network data.
+// The current network object is left untouched, so that in flight requests and health checks keep a consistent view of it.
+// The network is only swapped, and its health check restarted, if the registry data changed its config or its providers.
+func (d *DinMiddleware) updateNetworkWithRegistryData(regNetwork *din.Network, currentNetwork *network) error {
 	// Sync the network config data from the registry network to the copied network object
-	newNetwork, err := d.syncNetworkConfig(regNetwork, newNetwork)
+	newNetwork, err := d.syncNetworkConfig(regNetwork, currentNetwork.clone())
 	if err != nil {
 		d.logger.Error("Failed to sync network config", zap.Error(err))
 		return err
 	}
+	changed := !newNetwork.sameRegistryConfig(currentNetwork)
+	// The providers replaced or removed by the update, whose credentials are stopped once the network is swapped
+	var replaced []*provider
 
 	// Loop through the providers/network services in the registry network and update the copied network.providers map with the registry provider data
 	for _, regProvider := range regNetwork.Providers {
@@ -163,7 +162,7 @@ func (d *DinMiddleware) updateNetworkWithRegistryData(regNetwork *din.Network, n
 			}
 
 			// check to see if the provider exists in the local network object
-			_, ok := newNetwork.Providers[newProvider.host]
+			currentProvider, ok := newNetwork.Providers[newProvider.host]
 			if !ok {
 				// if the provider doesn't exist
 				// check if the network service is active, if not, skip the provider
@@ -180,25 +179,62 @@ func (d *DinMiddleware) updateNetworkWithRegistryData(regNetwork *din.Network, n
 
 				// add the new provider to the copied network object
 				newNetwork.Providers[newProvider.host] = newProvider
+				changed = true
 			} else {
 				// if the provider exists in the copied network object,
-				// check if the network service is active, if not, don't update the provider data and remove the provider from the copied network object
+				// check if the network service is active, if not, remove the provider from the copied network object
 				if networkService.Status != dinreg.Active {
 					delete(newNetwork.Providers, newProvider.host)
 					d.logger.Debug("Network service is not active", zap.String("network_service", networkService.Url))
+					replaced = append(replaced, currentProvider)
+					changed = true
 					continue
 				}
-				// if the provider does exist in the copied network object, then update the provider data on the middleware object.
-				d.updateProviderData(newNetwork.Name, newProvider)
-
-				// remove the provider from the copied network object to keep track of the providers that are not in the registry network
-				delete(newNetwork.Providers, newProvider.host)
+				// a change of auth type replaces the auth of the provider, which is started before the provider is swapped in
+				newProvider.authType = registryAuthType(regProvider.AuthConfig)
+				if newProvider.authType != currentProvider.authType {
+					newProvider.transport = currentProvider.transport
+					if err := d.setRegistryAuth(newProvider, regProvider.AuthConfig); err != nil {
+						d.logger.Error("Failed to update provider auth", zap.String("provider", currentProvider.host), zap.Error(err))
+						continue
+					}
+					if err := d.startProviderAuth(newProvider, d.logger); err != nil {
+						d.logger.Error("Failed to start provider auth", zap.String("provider", currentProvider.host), zap.Error(err))
+						newProvider.stopCredentials()
+						continue
+					}
+				}
+				// if the provider does exist in the copied network object, then replace it with a copy holding the registry provider data.
+				updatedProvider := d.updateProviderData(currentProvider, newProvider)
+				if updatedProvider != currentProvider {
+					newNetwork.Providers[newProvider.host] = updatedProvider
+					if updatedProvider.Credentials != currentProvider.Credentials {
+						replaced = append(replaced, currentProvider)
+					}
+					changed = true
+				}
 			}
 		}
 	}
 
-	// safely update the middleware network object with the copied network data.
+	// keep the current network and its health check running if nothing changed
+	if !changed {
+		return nil
+	}
+	for _, provider := range newNetwork.Providers {
+		d.trackProviderState(newNetwork, provider)
+	}
+	// swap the copied network into the middleware object
 	d.updateNetworkData(newNetwork)
+	for _, provider := range replaced {
+		provider.stopCredentials()
+	}
+	for host, provider := range currentNetwork.Providers {
+		if _, ok := newNetwork.Providers[host]; !ok {
+			d.untrackProviderState(newNetwork.Name, provider)
+			releaseProviderTransports(provider)
+		}
+	}
 	return nil
 }
 
@@ -243,6 +279,39 @@ func (d *DinMiddleware) syncNetworkConfig(regNetwork *din.Network, network *netw
 func (d *DinMiddleware) createNewProvider(provider *provider, authConfig *dinreg.NetworkServiceAuthConfig, networkServiceAddress string) (*provider, error) {
 	httpClient := din_http.NewHTTPClient()
 
+	if err := d.setRegistryAuth(provider, authConfig); err != nil {
+		return nil, err
+	}
+
+	err := d.initializeProvider(provider, httpClient, d.logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize provider: %w", err)
+	}
+	provider.Priority = d.RegistryPriority
+	// The registry has no health check interval per provider, it can be overridden by host in the din_registry block
+	provider.HCInterval = d.RegistryHCIntervals[provider.host]
+	// Get the network service methods from the din registry
+	networkServiceMethods, err := d.DingoClient.GetNetworkServiceMethods(networkServiceAddress)
+	if err != nil {
+		provider.stopCredentials()
+		return nil, fmt.Errorf("failed to get network service methods: %w", err)
+	}
+	provider.Methods = networkServiceMethods
+
+	return provider, nil
+}
+
+// registryAuthType returns the auth type of the registry auth config, empty if it is not set
+func registryAuthType(authConfig *dinreg.NetworkServiceAuthConfig) string {
+	if authConfig == nil {
+		return ""
+	}
+	return authConfig.Type
+}
+
+// setRegistryAuth sets the SIWE auth or the credentials of the provider for the registry auth config
+func (d *DinMiddleware) setRegistryAuth(provider *provider, authConfig *dinreg.NetworkServiceAuthConfig) error {
+	provider.authType = registryAuthType(authConfig)
 	// Set the provider auth config based on the auth type
 	if authConfig != nil {
 		switch authConfig.Type {
@@ -253,60 +322,126 @@ func (d *DinMiddleware) createNewProvider(provider *provider, authConfig *dinreg
 			// it requires a secret key defined in the caddyfile.
 			if auth.Signer == nil {
 				if d.DefaultSiweSigner == nil {
-					return nil, fmt.Errorf("siwe default signer is not configured")
+					return fmt.Errorf("siwe default signer is not configured")
 				}
 				auth.Signer = d.DefaultSiweSigner
 			}
 			provider.Auth = auth
+		case credentials.TypeAPIKey, credentials.TypeBearer, credentials.TypeBasic, credentials.TypeOAuth2:
+			creds, ok := d.RegistryCredentials[provider.host]
+			if !ok {
+				return fmt.Errorf("no registry_credentials configured for %s auth of provider %s", authConfig.Type, provider.host)
+			}
+			provider.Auth = nil
+			provider.Credentials = creds.Copy(authConfig.Type)
+			if authConfig.Type == credentials.TypeOAuth2 && provider.Credentials.TokenURL == "" {
+				provider.Credentials.TokenURL = authConfig.Url
+			}
+			if err := provider.Credentials.Validate(); err != nil {
+				return fmt.Errorf("invalid registry_credentials of provider %s: %w", provider.host, err)
+			}
 		case dinreg.None:
 			provider.Auth = nil
 		default:
 			provider.Auth = nil
 		}
 	}
+	return nil
+}
 
-	err := d.initializeProvider(provider, httpClient, d.logger)
-	if err != nil {
-		return nil, fmt.Errorf("failed to initialize provider: %w", err)
+// updateProviderData returns a copy of the current provider object updated with the registry provider data,
+// or the current provider object itself if the registry provider data doesn't change it.
+// The auth and credentials of the provider are kept unless the registry changed its auth type.
+// Methods that are not set in the registry keep the current ones.
+func (d *DinMiddleware) updateProviderData(currentProvider *provider, registryProvider *provider) *provider {
+	auth, creds, methods := currentProvider.Auth, currentProvider.Credentials, currentProvider.Methods
+	authType := currentProvider.authType
+	if registryProvider.authType != currentProvider.authType {
+		auth, creds, authType = registryProvider.Auth, registryProvider.Credentials, registryProvider.authType
 	}
-	provider.Priority = d.RegistryPriority
-	// Get the network service methods from the din registry
-	networkServiceMethods, err := d.DingoClient.GetNetworkServiceMethods(networkServiceAddress)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get network service methods: %w", err)
+	if registryProvider.Methods != nil {
+		methods = registryProvider.Methods
 	}
-	provider.Methods = networkServiceMethods
-
-	return provider, nil
+	if authType == currentProvider.authType && sameMethods(methods, currentProvider.Methods) {
+		return currentProvider
+	}
+	newProvider := currentProvider.clone()
+	newProvider.Auth = auth
+	newProvider.Credentials = creds
+	newProvider.authType = authType
+	newProvider.Methods = methods
+	return newProvider
 }
 
-func (d *DinMiddleware) updateProviderData(networkName string, provider *provider) {
-	// update the provider object with the registry provider data
-	d.Networks[networkName].Providers[provider.host].Auth = provider.Auth
-	d.Networks[networkName].Providers[provider.host].Methods = provider.Methods
+// sameMethods reports whether the two method lists hold the same methods in the same order
+func sameMethods(a, b []*string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if (a[i] == nil) != (b[i] == nil) || (a[i] != nil && *a[i] != *b[i]) {
+			return false
+		}
+	}
+	return true
 }
 
-// updateNetwork updates the network object in the middleware object with the provided registry network data
+// updateNetworkData swaps the network object into the middleware object, replacing the network with the same name if present.
+// The health check of the replaced network is stopped, and the health check of the new network is started.
 func (d *DinMiddleware) updateNetworkData(network *network) {
-	// update the network object with the registry network config data
-	d.Networks[network.Name].HCMethod = network.HCMethod
-	d.Networks[network.Name].HCInterval = network.HCInterval
-	d.Networks[network.Name].BlockLagLimit = network.BlockLagLimit
-	d.Networks[network.Name].MaxRequestPayloadSizeKB = network.MaxRequestPayloadSizeKB
-	d.Networks[network.Name].RequestAttemptCount = network.RequestAttemptCount
+	previous := d.setNetwork(network.Name, network)
+	if previous != nil && previous != network {
+		previous.close()
+	}
+
+	// Start the healthcheck for the network if the middleware is not in test mode
+	if !d.testMode {
+		network.startHealthcheck()
+		d.logger.Info("Starting healthcheck for network", zap.String("network", network.Name), zap.String("machine_id", d.machineID))
+	}
+}
+
+// removeNetwork removes the network from the middleware object and stops its health check and the credentials of its providers.
+// The states and proxy transports of its providers are released.
+func (d *DinMiddleware) removeNetwork(name string) {
+	if previous := d.setNetwork(name, nil); previous != nil {
+		previous.close()
+		for _, provider := range previous.Providers {
+			provider.stopCredentials()
+			d.untrackProviderState(name, provider)
+			releaseProviderTransports(provider)
+		}
+	}
+}
+
+// getNetworks returns the current network map of the middleware object. The map must not be modified by the caller.
+func (d *DinMiddleware) getNetworks() map[string]*network {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.Networks
+}
+
+// setNetwork swaps in a copy of the network map with the given network added, replaced or, if nil, removed.
+// It returns the network previously registered under the name.
+func (d *DinMiddleware) setNetwork(name string, n *network) *network {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 
-	// add the new providers to the middleware network.Providers map
-	for _, p := range network.Providers {
-		d.Networks[network.Name].Providers[p.host] = p
+	networks := make(map[string]*network, len(d.Networks)+1)
+	for k, v := range d.Networks {
+		networks[k] = v
+	}
+	previous := networks[name]
+	if n == nil {
+		delete(networks, name)
+	} else {
+		networks[name] = n
 	}
+	d.Networks = networks
+	return previous
 }
 
 // getMachineId returns a unique string for the current running process
 func getMachineId() string {
-	hostname, err := os.Hostname()
-	if err != nil {
-		return "UNKNOWN"
-	}
-	currentPid := os.Getpid()
-	return fmt.Sprintf("@%s:%d", hostname, currentPid)
+	return prom.MachineID()
 }
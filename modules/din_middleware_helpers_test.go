@@ -2,9 +2,9 @@ package modules
 
 import (
 	"crypto/rand"
-	"sync"
 	"testing"
 
+	"github.com/DIN-center/din-caddy-plugins/lib/auth/credentials"
 	"github.com/DIN-center/din-caddy-plugins/lib/auth/siwe"
 	din "github.com/DIN-center/din-sc/apps/din-go/lib/din"
 	dinreg "github.com/DIN-center/din-sc/apps/din-go/pkg/dinregistry"
@@ -348,11 +348,62 @@ func TestUpdateNetworkWithRegistryData(t *testing.T) {
 			}
 
 			// Assert the number of providers after the update
-			assert.Equal(t, tt.expectedProviderCount, len(tt.newNetwork.Providers))
+			assert.Equal(t, tt.expectedProviderCount, len(dinMiddleware.Networks[tt.newNetwork.Name].Providers))
 		})
 	}
 }
 
+func TestUpdateNetworkWithRegistryDataUnchanged(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockDingoClient := din.NewMockIDingoClient(mockCtrl)
+	mockDingoClient.EXPECT().GetNetworkMethodNameByBit(gomock.Any(), gomock.Any()).Return("eth_blockNumber", nil).AnyTimes()
+
+	regNetwork := &din.Network{
+		Name: "test-network",
+		Providers: map[string]*din.Provider{
+			"Provider1": {
+				NetworkServices: map[string]*din.NetworkService{
+					"http://provider.com": {
+						Url:     "http://provider.com",
+						Address: "0x1234567890abcdef",
+						Status:  dinreg.Active,
+					},
+				},
+			},
+		},
+		NetworkConfig: &dinreg.NetworkConfig{
+			HealthcheckMethodBit:   1,
+			HealthcheckIntervalSec: 10,
+		},
+		Status: dinreg.Active,
+	}
+	currentNetwork := NewNetwork("test-network")
+	currentNetwork.HCInterval = 10
+	currentProvider, _ := NewProvider("http://provider.com")
+	currentProvider.Methods = []*string{aws.String("eth_call")}
+	currentNetwork.Providers[currentProvider.host] = currentProvider
+	dinMiddleware := &DinMiddleware{
+		DingoClient: mockDingoClient,
+		logger:      zaptest.NewLogger(t),
+		Networks:    map[string]*network{currentNetwork.Name: currentNetwork},
+		testMode:    true,
+	}
+
+	// The registry data matches the network, so the network and its health check are kept
+	assert.NoError(t, dinMiddleware.updateNetworkWithRegistryData(regNetwork, currentNetwork))
+	assert.Equal(t, currentNetwork, dinMiddleware.Networks[currentNetwork.Name])
+	assert.Equal(t, currentProvider, dinMiddleware.Networks[currentNetwork.Name].Providers[currentProvider.host])
+
+	// A changed health check interval swaps in a copy of the network
+	regNetwork.NetworkConfig.HealthcheckIntervalSec = 20
+	assert.NoError(t, dinMiddleware.updateNetworkWithRegistryData(regNetwork, currentNetwork))
+	updatedNetwork := dinMiddleware.Networks[currentNetwork.Name]
+	assert.That(t, updatedNetwork != currentNetwork)
+	assert.Equal(t, 20, updatedNetwork.HCInterval)
+	assert.Equal(t, currentProvider, updatedNetwork.Providers[currentProvider.host])
+}
+
 func TestSyncNetworkConfig(t *testing.T) {
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
@@ -573,8 +624,9 @@ func TestCreateNewProvider(t *testing.T) {
 				mockSiweSignerClient.EXPECT().CreateNewSIWEAuth(gomock.Any(), gomock.Any()).Return(tt.expectedAuth).Times(1)
 			}
 
-			// Create DinMiddleware and mock logger
-			logger := zaptest.NewLogger(t)
+			// Create DinMiddleware and mock logger. The SIWE auth of the provider keeps renewing its sessions
+			// after the test, so it must not log to the test.
+			logger := zap.NewNop()
 			dinMiddleware := &DinMiddleware{
 				DingoClient:       mockDingoClient,
 				SiweSignerClient:  mockSiweSignerClient,
@@ -610,7 +662,80 @@ func TestCreateNewProvider(t *testing.T) {
 	}
 }
 
+func TestCreateNewProviderCredentials(t *testing.T) {
+	tests := []struct {
+		name          string
+		authConfig    *dinreg.NetworkServiceAuthConfig
+		expected      *credentials.ClientAuth
+		expectedError string
+	}{
+		{
+			name:       "api key from the registry credentials",
+			authConfig: &dinreg.NetworkServiceAuthConfig{Type: credentials.TypeAPIKey},
+			expected:   &credentials.ClientAuth{Type: credentials.TypeAPIKey, Key: "key"},
+		},
+		{
+			name:       "oauth2 token url from the registry",
+			authConfig: &dinreg.NetworkServiceAuthConfig{Type: credentials.TypeOAuth2, Url: "http://127.0.0.1:1/registry-token"},
+			expected:   &credentials.ClientAuth{Type: credentials.TypeOAuth2, Key: "key", TokenURL: "http://127.0.0.1:1/registry-token"},
+		},
+		{
+			name:          "invalid registry credentials for the auth type",
+			authConfig:    &dinreg.NetworkServiceAuthConfig{Type: credentials.TypeBasic},
+			expectedError: "invalid registry_credentials of provider example.com: basic auth requires username",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			mockDingoClient := din.NewMockIDingoClient(mockCtrl)
+			dinMiddleware := &DinMiddleware{
+				DingoClient: mockDingoClient,
+				logger:      zaptest.NewLogger(t),
+				testMode:    true,
+				RegistryCredentials: map[string]*credentials.ClientAuth{
+					"example.com": {Key: "key", ClientID: "din", ClientSecret: "secret"},
+				},
+			}
+			if tt.expectedError == "" {
+				mockDingoClient.EXPECT().GetNetworkServiceMethods(gomock.Any()).Return([]*string{aws.String("eth_call")}, nil)
+			}
+
+			p, err := NewProvider("https://example.com/eth")
+			assert.NoError(t, err)
+			created, err := dinMiddleware.createNewProvider(p, tt.authConfig, "0x1234567890abcdef")
+			if tt.expectedError != "" {
+				assert.Equal(t, tt.expectedError, err.Error())
+				return
+			}
+			assert.NoError(t, err)
+			defer created.Credentials.Stop()
+			assert.Nil(t, created.Auth)
+			assert.Equal(t, tt.expected.Type, created.Credentials.Type)
+			assert.Equal(t, tt.expected.Key, created.Credentials.Key)
+			assert.Equal(t, tt.expected.TokenURL, created.Credentials.TokenURL)
+			// Each provider gets its own copy of the configured credentials
+			if created.Credentials == dinMiddleware.RegistryCredentials["example.com"] {
+				t.Errorf("expected a copy of the registry credentials")
+			}
+		})
+	}
+
+	// Providers without registry credentials aren't created
+	dinMiddleware := &DinMiddleware{logger: zap.NewNop(), testMode: true}
+	p, err := NewProvider("https://example.com/eth")
+	assert.NoError(t, err)
+	_, err = dinMiddleware.createNewProvider(p, &dinreg.NetworkServiceAuthConfig{Type: credentials.TypeBearer}, "0x1234567890abcdef")
+	assert.Error(t, err)
+}
+
 func TestUpdateProviderData(t *testing.T) {
+	dinMiddleware := &DinMiddleware{
+		testMode: true,
+	}
+
 	tests := []struct {
 		name             string
 		networkName      string
@@ -635,7 +760,8 @@ func TestUpdateProviderData(t *testing.T) {
 				Auth: &siwe.SIWEClientAuth{
 					ProviderURL: "updated-url",
 				},
-				Methods: []*string{aws.String("eth_blockNumber")},
+				authType: dinreg.SIWE,
+				Methods:  []*string{aws.String("eth_blockNumber")},
 			},
 			expectedProvider: &provider{
 				host: "provider1",
@@ -645,37 +771,158 @@ func TestUpdateProviderData(t *testing.T) {
 				Methods: []*string{aws.String("eth_blockNumber")},
 			},
 		},
+		{
+			name:        "Auth kept for an unchanged auth type",
+			networkName: "test-network",
+			initialProviders: map[string]*provider{
+				"provider1": {
+					host: "provider1",
+					Auth: &siwe.SIWEClientAuth{
+						ProviderURL: "initial-url",
+					},
+					authType: dinreg.SIWE,
+					Methods:  []*string{aws.String("eth_call")},
+				},
+			},
+			updatedProvider: &provider{
+				host: "provider1",
+				Auth: &siwe.SIWEClientAuth{
+					ProviderURL: "updated-url",
+				},
+				authType: dinreg.SIWE,
+				Methods:  []*string{aws.String("eth_blockNumber")},
+			},
+			expectedProvider: &provider{
+				host: "provider1",
+				Auth: &siwe.SIWEClientAuth{
+					ProviderURL: "initial-url",
+				},
+				Methods: []*string{aws.String("eth_blockNumber")},
+			},
+		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			// Initialize DinMiddleware with the network and providers
-			dinMiddleware := &DinMiddleware{
-				Networks: map[string]*network{
-					tt.networkName: {
-						Name:      tt.networkName,
-						Providers: tt.initialProviders,
-					},
-				},
-				mu:       sync.RWMutex{},
-				testMode: true,
-			}
+			currentProvider := tt.initialProviders[tt.updatedProvider.host]
+			currentProvider.markWarning(HealthReasonLagging)
 
-			// Lock for writing
-			dinMiddleware.mu.Lock()
 			// Call the function being tested
-			dinMiddleware.updateProviderData(tt.networkName, tt.updatedProvider)
-			// Unlock
-			dinMiddleware.mu.Unlock()
+			updatedProvider := dinMiddleware.updateProviderData(currentProvider, tt.updatedProvider)
 
-			// Assert that the provider data was updated correctly
-			updatedProvider := dinMiddleware.Networks[tt.networkName].Providers[tt.updatedProvider.host]
+			// Assert that the provider data was updated correctly on a copy of the provider
 			assert.Equal(t, tt.expectedProvider.Auth.ProviderURL, updatedProvider.Auth.ProviderURL)
 			assert.DeepEqual(t, tt.expectedProvider.Methods, updatedProvider.Methods)
+			assert.Equal(t, Warning, updatedProvider.healthStatus)
+			assert.Equal(t, "initial-url", currentProvider.Auth.ProviderURL)
 		})
 	}
 }
 
+func TestUpdateNetworkWithRegistryDataCredentials(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockDingoClient := din.NewMockIDingoClient(mockCtrl)
+	mockDingoClient.EXPECT().GetNetworkMethodNameByBit(gomock.Any(), gomock.Any()).Return("eth_blockNumber", nil).AnyTimes()
+	mockDingoClient.EXPECT().GetNetworkServiceMethods(gomock.Any()).Return([]*string{aws.String("eth_blockNumber")}, nil).AnyTimes()
+
+	regNetwork := func(authType string) *din.Network {
+		return &din.Network{
+			Name:      "test-network",
+			ProxyName: "test-network",
+			Providers: map[string]*din.Provider{
+				"Provider1": {
+					AuthConfig: &dinreg.NetworkServiceAuthConfig{Type: authType},
+					NetworkServices: map[string]*din.NetworkService{
+						"http://provider.com": {Url: "http://provider.com", Address: "0x1234567890abcdef", Status: dinreg.Active},
+					},
+				},
+			},
+			NetworkConfig: &dinreg.NetworkConfig{HealthcheckMethodBit: 1},
+			Status:        dinreg.Active,
+		}
+	}
+	dinMiddleware := &DinMiddleware{
+		DingoClient: mockDingoClient,
+		logger:      zaptest.NewLogger(t),
+		Networks:    map[string]*network{},
+		testMode:    true,
+		RegistryCredentials: map[string]*credentials.ClientAuth{
+			"provider.com": {Key: "key", Token: "token"},
+		},
+	}
+	defer dinMiddleware.releaseProviderStates()
+	assert.NoError(t, dinMiddleware.addNetworkWithRegistryData(regNetwork(credentials.TypeAPIKey)))
+	current := dinMiddleware.getNetworks()["test-network"].Providers["provider.com"]
+	apiKey := current.Credentials
+	assert.NoError(t, apiKey.Error())
+
+	// The credentials are kept while the registry auth type is unchanged
+	assert.NoError(t, dinMiddleware.updateNetworkWithRegistryData(regNetwork(credentials.TypeAPIKey), dinMiddleware.getNetworks()["test-network"]))
+	assert.Equal(t, apiKey, dinMiddleware.getNetworks()["test-network"].Providers["provider.com"].Credentials)
+
+	// A new auth type swaps in started credentials of that type
+	assert.NoError(t, dinMiddleware.updateNetworkWithRegistryData(regNetwork(credentials.TypeBearer), dinMiddleware.getNetworks()["test-network"]))
+	bearer := dinMiddleware.getNetworks()["test-network"].Providers["provider.com"].Credentials
+	assert.Equal(t, credentials.TypeBearer, bearer.Type)
+	assert.NoError(t, bearer.Error())
+
+	// The credentials of the providers still in use are stopped on cleanup
+	assert.NoError(t, dinMiddleware.Cleanup())
+}
+
+func TestRegistrySyncReleasesProviderStates(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockDingoClient := din.NewMockIDingoClient(mockCtrl)
+	mockDingoClient.EXPECT().GetNetworkMethodNameByBit(gomock.Any(), gomock.Any()).Return("eth_blockNumber", nil).AnyTimes()
+	mockDingoClient.EXPECT().GetNetworkServiceMethods(gomock.Any()).Return([]*string{aws.String("eth_blockNumber")}, nil).AnyTimes()
+
+	regNetwork := func(networkStatus, serviceStatus string) *din.Network {
+		return &din.Network{
+			Name:      "state-network",
+			ProxyName: "state-network",
+			Providers: map[string]*din.Provider{
+				"Provider1": {
+					NetworkServices: map[string]*din.NetworkService{
+						"http://kept.com":    {Url: "http://kept.com", Address: "0x1", Status: dinreg.Active},
+						"http://removed.com": {Url: "http://removed.com", Address: "0x2", Status: serviceStatus},
+					},
+				},
+			},
+			NetworkConfig: &dinreg.NetworkConfig{HealthcheckMethodBit: 1},
+			Status:        networkStatus,
+		}
+	}
+	listed := func() []string {
+		var hosts []string
+		for _, status := range providerStatuses() {
+			if status.Network == "state-network" {
+				hosts = append(hosts, status.Provider)
+			}
+		}
+		return hosts
+	}
+	dinMiddleware := &DinMiddleware{
+		DingoClient: mockDingoClient,
+		logger:      zaptest.NewLogger(t),
+		Networks:    map[string]*network{},
+		testMode:    true,
+	}
+	defer dinMiddleware.releaseProviderStates()
+
+	dinMiddleware.processRegistryData(&din.DinRegistryData{Networks: map[string]*din.Network{"state-network": regNetwork(dinreg.Active, dinreg.Active)}})
+	assert.DeepEqual(t, []string{"kept.com", "removed.com"}, listed())
+
+	// A network service deactivated in the registry is no longer listed on the admin API
+	dinMiddleware.processRegistryData(&din.DinRegistryData{Networks: map[string]*din.Network{"state-network": regNetwork(dinreg.Active, dinreg.Decommissioned)}})
+	assert.DeepEqual(t, []string{"kept.com"}, listed())
+
+	// Nor are the providers of a deactivated network
+	dinMiddleware.processRegistryData(&din.DinRegistryData{Networks: map[string]*din.Network{"state-network": regNetwork(dinreg.Maintenance, dinreg.Decommissioned)}})
+	assert.Equal(t, 0, len(listed()))
+}
+
 func TestUpdateNetworkData(t *testing.T) {
 	tests := []struct {
 		name            string
@@ -719,9 +966,6 @@ func TestUpdateNetworkData(t *testing.T) {
 				MaxRequestPayloadSizeKB: 2048,
 				RequestAttemptCount:     5,
 				Providers: map[string]*provider{
-					"existing-host": {
-						host: "existing-host",
-					},
 					"new-host": {
 						host: "new-host",
 					},
@@ -759,32 +1003,28 @@ func TestUpdateNetworkData(t *testing.T) {
 				BlockLagLimit:           10,
 				MaxRequestPayloadSizeKB: 2048,
 				RequestAttemptCount:     5,
-				Providers: map[string]*provider{
-					"existing-host": {
-						host: "existing-host",
-					},
-				},
+				Providers:               map[string]*provider{},
 			},
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			// Initialize DinMiddleware and lock
+			// Initialize DinMiddleware
+			initialNetworks := map[string]*network{
+				tt.initialNetwork.Name: tt.initialNetwork,
+			}
 			dinMiddleware := &DinMiddleware{
-				Networks: map[string]*network{
-					tt.initialNetwork.Name: tt.initialNetwork,
-				},
-				mu:       sync.RWMutex{},
+				Networks: initialNetworks,
 				testMode: true,
 			}
 
-			// Lock for writing
-			dinMiddleware.mu.Lock()
 			// Call the function being tested
 			dinMiddleware.updateNetworkData(tt.updatedNetwork)
-			// Unlock
-			dinMiddleware.mu.Unlock()
+
+			// Assert that the network map was swapped rather than modified in place
+			assert.Equal(t, tt.initialNetwork, initialNetworks[tt.initialNetwork.Name])
+			assert.Equal(t, 1, len(tt.initialNetwork.Providers))
 
 			// Assert that the network data was updated correctly
 			updatedNetwork := dinMiddleware.Networks[tt.initialNetwork.Name]
@@ -2,22 +2,32 @@ package modules
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	reflect "reflect"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/DIN-center/din-caddy-plugins/lib/auth"
+	"github.com/DIN-center/din-caddy-plugins/lib/auth/credentials"
 	"github.com/DIN-center/din-caddy-plugins/lib/auth/siwe"
 	din_http "github.com/DIN-center/din-caddy-plugins/lib/http"
+	prom "github.com/DIN-center/din-caddy-plugins/lib/prometheus"
+	din "github.com/DIN-center/din-sc/apps/din-go/lib/din"
+	dinreg "github.com/DIN-center/din-sc/apps/din-go/pkg/dinregistry"
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
 	"go.uber.org/zap/zaptest"
 )
 
@@ -365,6 +375,97 @@ func TestDinMiddlewareProvision(t *testing.T) {
 		})
 	}
 }
+func TestDinMiddlewareValidate(t *testing.T) {
+	newNetworks := func() map[string]*network {
+		n := NewNetwork("eth")
+		p, _ := NewProvider("http://localhost:8000")
+		n.Providers[p.host] = p
+		return map[string]*network{"eth": n}
+	}
+
+	tests := []struct {
+		name       string
+		middleware *DinMiddleware
+		hasErr     bool
+	}{
+		{
+			name:       "valid networks",
+			middleware: &DinMiddleware{Networks: newNetworks()},
+			hasErr:     false,
+		},
+		{
+			name:       "no networks and registry disabled",
+			middleware: &DinMiddleware{Networks: map[string]*network{}},
+			hasErr:     true,
+		},
+		{
+			name: "invalid network",
+			middleware: &DinMiddleware{Networks: map[string]*network{
+				"eth": NewNetwork("eth"),
+			}},
+			hasErr: true,
+		},
+		{
+			name: "signer without key material",
+			middleware: &DinMiddleware{
+				Networks:          newNetworks(),
+				DefaultSiweSigner: &siwe.SigningConfig{},
+			},
+			hasErr: true,
+		},
+		{
+			name: "valid registry",
+			middleware: &DinMiddleware{
+				RegistryEnabled:               true,
+				RegistryEndpointUrl:           "https://linea-sepolia.infura.io/v3/key",
+				RegistryContractAddress:       "0xc55967876ff800d67400b6375eb5bb2592b491fa",
+				RegistryBlockEpoch:            DefaultRegistryBlockEpoch,
+				RegistryBlockCheckIntervalSec: DefaultRegistryBlockCheckIntervalSec,
+			},
+			hasErr: false,
+		},
+		{
+			name: "registry with invalid contract address",
+			middleware: &DinMiddleware{
+				RegistryEnabled:               true,
+				RegistryContractAddress:       "0x1234",
+				RegistryBlockEpoch:            DefaultRegistryBlockEpoch,
+				RegistryBlockCheckIntervalSec: DefaultRegistryBlockCheckIntervalSec,
+			},
+			hasErr: true,
+		},
+		{
+			name: "registry with endpoint without scheme",
+			middleware: &DinMiddleware{
+				RegistryEnabled:               true,
+				RegistryEndpointUrl:           "linea-sepolia.infura.io",
+				RegistryBlockEpoch:            DefaultRegistryBlockEpoch,
+				RegistryBlockCheckIntervalSec: DefaultRegistryBlockCheckIntervalSec,
+			},
+			hasErr: true,
+		},
+		{
+			name: "registry priority above max priority",
+			middleware: &DinMiddleware{
+				RegistryEnabled:               true,
+				RegistryPriority:              MaxPriority + 1,
+				RegistryBlockEpoch:            DefaultRegistryBlockEpoch,
+				RegistryBlockCheckIntervalSec: DefaultRegistryBlockCheckIntervalSec,
+			},
+			hasErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.middleware.Validate()
+			if (err != nil) != tt.hasErr {
+				t.Errorf("Validate() = %v, want error %v", err, tt.hasErr)
+			}
+		})
+	}
+}
+
 func TestUnmarshalCaddyfile(t *testing.T) {
 	dinMiddleware := new(DinMiddleware)
 
@@ -437,6 +538,19 @@ func TestUnmarshalCaddyfile(t *testing.T) {
 			}`,
 			hasErr: true,
 		},
+		{
+			name: "Invalid Caddyfile - Duplicate provider host",
+			caddyfile: `networks {
+				eth {
+					methods eth_blockNumber eth_getBlockByNumber
+					providers {
+						http://localhost:8000/a
+						http://localhost:8000/b
+					}
+				}
+			}`,
+			hasErr: true,
+		},
 		{
 			name: "Invalid Caddyfile - Invalid 'headers' argument",
 			caddyfile: `networks {
@@ -464,3 +578,486 @@ func TestUnmarshalCaddyfile(t *testing.T) {
 		})
 	}
 }
+
+func TestMiddlewareConcurrentRegistrySyncHealthChecksAndTraffic(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockDingoClient := din.NewMockIDingoClient(mockCtrl)
+	mockHttpClient := din_http.NewMockIHTTPClient(mockCtrl)
+	mockPrometheusClient := prom.NewMockIPrometheusClient(mockCtrl)
+	logger := zap.NewNop()
+
+	mockDingoClient.EXPECT().GetNetworkMethodNameByBit(gomock.Any(), gomock.Any()).Return("eth_blockNumber", nil).AnyTimes()
+	mockDingoClient.EXPECT().GetNetworkServiceMethods(gomock.Any()).Return([]*string{aws.String("eth_blockNumber")}, nil).AnyTimes()
+	mockHttpClient.EXPECT().Post(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(url string, headers map[string]string, payload []byte, ac auth.IAuthClient) ([]byte, *int, error) {
+			statusCode := http.StatusOK
+			return []byte(`{"jsonrpc": "2.0", "id": 1, "result": "0x4c4b40"}`), &statusCode, nil
+		}).AnyTimes()
+	mockPrometheusClient.EXPECT().HandleLatestBlockMetric(gomock.Any()).AnyTimes()
+
+	eth := NewNetwork("eth")
+	eth.HttpClient = mockHttpClient
+	eth.PrometheusClient = mockPrometheusClient
+	eth.logger = logger
+	dinMiddleware := &DinMiddleware{
+		Networks:    map[string]*network{"eth": eth},
+		DingoClient: mockDingoClient,
+		logger:      logger,
+		testMode:    true,
+	}
+	defer dinMiddleware.releaseProviderStates()
+	for _, providerUrl := range []string{"http://localhost:8001", "http://localhost:8002"} {
+		provider, err := NewProvider(providerUrl)
+		assert.NoError(t, err)
+		assert.NoError(t, dinMiddleware.initializeProvider(provider, din_http.NewHTTPClient(), logger))
+		eth.Providers[provider.host] = provider
+		dinMiddleware.trackProviderState(eth, provider)
+	}
+
+	// The registry flips a network service between active and onboarding on every sync
+	registryData := func(i int) *din.DinRegistryData {
+		status := dinreg.Active
+		if i%2 == 1 {
+			status = dinreg.Onboarding
+		}
+		return &din.DinRegistryData{
+			Networks: map[string]*din.Network{
+				"eth": {
+					ProxyName:     "eth",
+					Status:        dinreg.Active,
+					NetworkConfig: &dinreg.NetworkConfig{HealthcheckMethodBit: 1},
+					Providers: map[string]*din.Provider{
+						"Provider1": {
+							NetworkServices: map[string]*din.NetworkService{
+								"http://localhost:8002": {Url: "http://localhost:8002", Status: dinreg.Active},
+								"http://localhost:8003": {Url: "http://localhost:8003", Status: status},
+							},
+						},
+					},
+				},
+			},
+		}
+	}
+
+	selector := &DinSelect{selector: &reverseproxy.FirstSelection{}, logger: logger}
+	upstreams := &DinUpstreams{}
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		pool, err := upstreams.GetUpstreams(r)
+		if err != nil {
+			return err
+		}
+		if len(pool) > 0 {
+			selector.Select(pool, r, w)
+		}
+		w.WriteHeader(http.StatusOK)
+		return nil
+	})
+
+	const iterations = 50
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < iterations; i++ {
+			dinMiddleware.processRegistryData(registryData(i))
+		}
+	}()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < iterations; i++ {
+			for _, network := range dinMiddleware.getNetworks() {
+				checkProviders(t, network)
+				network.evaluateCheckedProviders(time.Now())
+			}
+		}
+	}()
+	for worker := 0; worker < 4; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				r := httptest.NewRequest("POST", "http://localhost:8000/eth", strings.NewReader(`{"jsonrpc":"2.0","method":"eth_blockNumber","params":[],"id":1}`))
+				r = r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+				assert.NoError(t, dinMiddleware.ServeHTTP(httptest.NewRecorder(), r, next))
+			}
+		}()
+	}
+	wg.Wait()
+
+	// The last sync left the onboarding network service out of the network
+	network := dinMiddleware.getNetworks()["eth"]
+	assert.Equal(t, 2, len(network.Providers))
+	assert.NotNil(t, network.Providers["localhost:8001"])
+	assert.NotNil(t, network.Providers["localhost:8002"])
+}
+
+func TestCaddyfileJSONRoundTrip(t *testing.T) {
+	caddyfileInput := `din {
+		siwe-signer {
+			secret_file /run/secrets/din-secret-key
+		}
+		health_webhook {env.DIN_HEALTH_WEBHOOK_URL} {
+			header Authorization "Bearer {env.DIN_HEALTH_WEBHOOK_TOKEN}"
+			timeout 2s
+			retries 5
+		}
+		networks {
+			eth {
+				methods eth_blockNumber eth_getBlockByNumber
+				healthcheck_method eth_blockNumber
+				healthcheck_threshold 4
+				healthcheck_interval 10
+				healthcheck_blocklag_limit 0
+				healthcheck_blocknumber_delta 50
+				max_request_payload_size_kb 1024
+				request_attempt_count 2
+				finalized_lag_limit 32
+				healthcheck_latency_threshold_ms 500
+				stale_block_multiplier 4
+				fork_check_offset 6
+				chain_id 0x1
+				providers {
+					https://eth.rpc.test.cloud/key {
+						priority 1
+						healthcheck_interval 15
+						ws_url wss://eth.rpc.test.cloud/key
+						headers {
+							Authorization "Bearer {env.ETH_PROVIDER_TOKEN}"
+						}
+					}
+					https://din.rivet.cloud/eth {
+						auth {
+							type siwe
+							url https://din.rivet.cloud/auth
+							sessions 4
+							server_nonce
+							signer {
+								secret {env.RIVET_SIGNER_KEY}
+							}
+						}
+					}
+				}
+			}
+		}
+		din_registry {
+			registry_enabled true
+			registry_endpoint_url https://linea-sepolia.infura.io/v3/key
+			registry_contract_address 0xc55967876ff800d67400b6375eb5bb2592b491fa
+			registry_block_check_interval_sec 30
+			registry_block_epoch 5
+			registry_priority 2
+		}
+	}`
+
+	fromCaddyfile := new(DinMiddleware)
+	err := fromCaddyfile.UnmarshalCaddyfile(caddyfile.NewTestDispenser(caddyfileInput))
+	assert.NoError(t, err)
+
+	adapted, err := json.Marshal(fromCaddyfile)
+	assert.NoError(t, err)
+
+	// Secrets are referenced, never inlined
+	var raw map[string]interface{}
+	assert.NoError(t, json.Unmarshal(adapted, &raw))
+	assert.Equal(t, map[string]interface{}{"secret_file": "/run/secrets/din-secret-key"}, raw["siwe_signer"])
+	assert.Equal(t, true, raw["registry_enabled"])
+	assert.Equal(t, "https://linea-sepolia.infura.io/v3/key", raw["registry_endpoint_url"])
+	assert.Equal(t, float64(2), raw["registry_priority"])
+	assert.Equal(t, map[string]interface{}{
+		"url":     "{env.DIN_HEALTH_WEBHOOK_URL}",
+		"headers": map[string]interface{}{"Authorization": "Bearer {env.DIN_HEALTH_WEBHOOK_TOKEN}"},
+		"timeout": float64(2 * time.Second),
+		"retries": float64(5),
+	}, raw["health_webhook"])
+	eth := raw["networks"].(map[string]interface{})["eth"].(map[string]interface{})
+	assert.Equal(t, float64(4), eth["healthcheck_threshold"])
+	assert.Equal(t, float64(0), eth["healthcheck_blocklag_limit"])
+	assert.Equal(t, float64(1), eth["chain_id"])
+	rivet := eth["providers"].(map[string]interface{})["din.rivet.cloud"].(map[string]interface{})
+	assert.Equal(t, map[string]interface{}{
+		"url":          "https://din.rivet.cloud/auth",
+		"sessions":     float64(4),
+		"server_nonce": true,
+		"signer":       map[string]interface{}{"secret": "{env.RIVET_SIGNER_KEY}"},
+	}, rivet["auth"])
+
+	// Loading the adapted JSON gives back the same configuration
+	fromJSON := new(DinMiddleware)
+	assert.NoError(t, json.Unmarshal(adapted, fromJSON))
+	readapted, err := json.Marshal(fromJSON)
+	assert.NoError(t, err)
+	assert.JSONEq(t, string(adapted), string(readapted))
+
+	network := fromJSON.Networks["eth"]
+	assert.Equal(t, 4, network.HCThreshold)
+	assert.Equal(t, int64(0), network.BlockLagLimit)
+	assert.Equal(t, int64(32), network.FinalizedLagLimit)
+	assert.Equal(t, int64(500), network.LatencyThresholdMs)
+	assert.Equal(t, 4, network.StaleBlockMultiplier)
+	assert.Equal(t, int64(6), network.ForkCheckOffset)
+	assert.Equal(t, 1, network.Providers["eth.rpc.test.cloud"].Priority)
+	assert.Equal(t, 15, network.Providers["eth.rpc.test.cloud"].HCInterval)
+	assert.Equal(t, "wss://eth.rpc.test.cloud/key", network.Providers["eth.rpc.test.cloud"].WsUrl)
+	assert.Equal(t, "Bearer {env.ETH_PROVIDER_TOKEN}", network.Providers["eth.rpc.test.cloud"].Headers["Authorization"])
+	assert.Equal(t, 4, network.Providers["din.rivet.cloud"].Auth.SessionCount)
+}
+
+func TestCaddyfileSiweSigner(t *testing.T) {
+	threeRetries, noRetries := 3, 0
+	tests := []struct {
+		name      string
+		caddyfile string
+		expected  *siwe.SigningConfig
+		hasErr    bool
+	}{
+		{
+			name: "remote signer with bearer token",
+			caddyfile: `din {
+				siwe-signer {
+					signer_url https://signer.internal/sign
+					signer_token {env.DIN_SIGNER_TOKEN}
+					signer_timeout 2s
+					signer_retries 3
+				}
+			}`,
+			expected: &siwe.SigningConfig{
+				SignerURL:     "https://signer.internal/sign",
+				SignerToken:   "{env.DIN_SIGNER_TOKEN}",
+				SignerTimeout: caddy.Duration(2 * time.Second),
+				SignerRetries: &threeRetries,
+			},
+		},
+		{
+			name: "remote signer without retries",
+			caddyfile: `din {
+				siwe-signer {
+					signer_url https://signer.internal/sign
+					signer_retries 0
+				}
+			}`,
+			expected: &siwe.SigningConfig{
+				SignerURL:     "https://signer.internal/sign",
+				SignerRetries: &noRetries,
+			},
+		},
+		{
+			name: "remote signer with mtls",
+			caddyfile: `din {
+				siwe-signer {
+					signer_url https://signer.internal/sign
+					signer_cert_file /run/secrets/signer-client.pem
+					signer_key_file /run/secrets/signer-client-key.pem
+					signer_ca_file /run/secrets/signer-ca.pem
+				}
+			}`,
+			expected: &siwe.SigningConfig{
+				SignerURL:      "https://signer.internal/sign",
+				SignerCertFile: "/run/secrets/signer-client.pem",
+				SignerKeyFile:  "/run/secrets/signer-client-key.pem",
+				SignerCAFile:   "/run/secrets/signer-ca.pem",
+			},
+		},
+		{
+			name: "keystore with password file",
+			caddyfile: `din {
+				siwe-signer {
+					keystore_file /run/secrets/din-keystore.json
+					password_file /run/secrets/din-keystore-password
+				}
+			}`,
+			expected: &siwe.SigningConfig{
+				KeystoreFile: "/run/secrets/din-keystore.json",
+				PasswordFile: "/run/secrets/din-keystore-password",
+			},
+		},
+		{
+			name: "invalid signer_retries",
+			caddyfile: `din {
+				siwe-signer {
+					signer_url https://signer.internal/sign
+					signer_retries many
+				}
+			}`,
+			hasErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dinMiddleware := new(DinMiddleware)
+			err := dinMiddleware.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tt.caddyfile))
+			if tt.hasErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, dinMiddleware.DefaultSiweSigner)
+		})
+	}
+}
+
+func TestCaddyfileProviderCredentials(t *testing.T) {
+	tests := []struct {
+		name      string
+		caddyfile string
+		expected  *credentials.ClientAuth
+		hasErr    bool
+	}{
+		{
+			name: "api key in the query string",
+			caddyfile: `auth {
+				type api_key
+				query_param apikey
+				key_file /run/secrets/provider-key
+			}`,
+			expected: &credentials.ClientAuth{Type: credentials.TypeAPIKey, QueryParam: "apikey", KeyFile: "/run/secrets/provider-key"},
+		},
+		{
+			name: "bearer token from env",
+			caddyfile: `auth {
+				type bearer
+				token {env.PROVIDER_TOKEN}
+			}`,
+			expected: &credentials.ClientAuth{Type: credentials.TypeBearer, Token: "{env.PROVIDER_TOKEN}"},
+		},
+		{
+			name: "oauth2 client credentials",
+			caddyfile: `auth {
+				type oauth2
+				token_url https://auth.provider.com/oauth/token
+				client_id din
+				client_secret_file /run/secrets/provider-secret
+				scopes rpc:read rpc:write
+			}`,
+			expected: &credentials.ClientAuth{
+				Type:             credentials.TypeOAuth2,
+				TokenURL:         "https://auth.provider.com/oauth/token",
+				ClientID:         "din",
+				ClientSecretFile: "/run/secrets/provider-secret",
+				Scopes:           []string{"rpc:read", "rpc:write"},
+			},
+		},
+		{
+			name: "unknown auth type",
+			caddyfile: `auth {
+				type digest
+			}`,
+			hasErr: true,
+		},
+		{
+			name: "siwe option with basic auth",
+			caddyfile: `auth {
+				type basic
+				username din
+				password_file /run/secrets/provider-password
+				sessions 4
+			}`,
+			hasErr: true,
+		},
+		{
+			name: "credentials option with siwe auth",
+			caddyfile: `auth {
+				key abc
+			}`,
+			hasErr: true,
+		},
+		{
+			name: "unknown auth option",
+			caddyfile: `auth {
+				type bearer
+				token abc
+				refresh_token def
+			}`,
+			hasErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dinMiddleware := new(DinMiddleware)
+			err := dinMiddleware.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`din {
+				networks {
+					eth {
+						methods eth_blockNumber
+						providers {
+							https://eth.provider.com/v1 {
+								` + tt.caddyfile + `
+							}
+						}
+					}
+				}
+			}`))
+			if tt.hasErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			provider := dinMiddleware.Networks["eth"].Providers["eth.provider.com"]
+			assert.Nil(t, provider.Auth)
+			assert.Equal(t, tt.expected, provider.Credentials)
+			assert.Equal(t, provider.Credentials, provider.AuthClient())
+			assert.NoError(t, provider.validate())
+		})
+	}
+}
+
+func TestCaddyfileRegistryCredentials(t *testing.T) {
+	dinMiddleware := new(DinMiddleware)
+	err := dinMiddleware.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`din {
+		din_registry {
+			registry_enabled true
+			registry_credentials eth.provider.com {
+				header Api-Key
+				key {env.PROVIDER_KEY}
+			}
+			registry_credentials auth.provider.com {
+				client_id din
+				client_secret {env.PROVIDER_SECRET}
+			}
+			registry_healthcheck_interval eth.provider.com 2
+		}
+	}`))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"eth.provider.com": 2}, dinMiddleware.RegistryHCIntervals)
+	assert.Equal(t, map[string]*credentials.ClientAuth{
+		"eth.provider.com":  {Header: "Api-Key", Key: "{env.PROVIDER_KEY}"},
+		"auth.provider.com": {ClientID: "din", ClientSecret: "{env.PROVIDER_SECRET}"},
+	}, dinMiddleware.RegistryCredentials)
+
+	err = new(DinMiddleware).UnmarshalCaddyfile(caddyfile.NewTestDispenser(`din {
+		din_registry {
+			registry_credentials eth.provider.com {
+				sessions 4
+			}
+		}
+	}`))
+	assert.Error(t, err)
+}
+
+func TestNetworkJSONDefaults(t *testing.T) {
+	d := new(DinMiddleware)
+	err := json.Unmarshal([]byte(`{
+		"networks": {
+			"eth": {
+				"healthcheck_interval_seconds": 10,
+				"providers": {
+					"eth.rpc.test.cloud": {"http_url": "https://eth.rpc.test.cloud/key"}
+				}
+			}
+		}
+	}`), d)
+	assert.NoError(t, err)
+
+	network := d.Networks["eth"]
+	assert.Equal(t, 10, network.HCInterval)
+	assert.Equal(t, DefaultHCMethod, network.HCMethod)
+	assert.Equal(t, DefaultHCThreshold, network.HCThreshold)
+	assert.Equal(t, int64(DefaultBlockLagLimit), network.BlockLagLimit)
+	assert.Equal(t, int64(DefaultMaxRequestPayloadSizeKB), network.MaxRequestPayloadSizeKB)
+	assert.Equal(t, DefaultRequestAttemptCount, network.RequestAttemptCount)
+	assert.NotNil(t, network.CheckedProviders)
+	assert.NotNil(t, network.quit)
+	assert.Equal(t, "https://eth.rpc.test.cloud/key", network.Providers["eth.rpc.test.cloud"].HttpUrl)
+}
@@ -1,6 +1,7 @@
 package modules
 
 import (
+	"fmt"
 	"net/http"
 	"net/url"
 
@@ -16,13 +17,16 @@ var (
 	// https://caddyserver.com/docs/extending-caddy
 
 	// Din Select Module
-	_ caddy.Module      = (*DinSelect)(nil)
-	_ caddy.Provisioner = (*DinSelect)(nil)
+	_ caddy.Module       = (*DinSelect)(nil)
+	_ caddy.Provisioner  = (*DinSelect)(nil)
+	_ caddy.CleanerUpper = (*DinSelect)(nil)
 )
 
 type DinSelect struct {
 	selector reverseproxy.Selector
 	logger   *zap.Logger
+	// The din transport the reverse proxy was switched to, nil if it was configured with it
+	transport *DinTransport
 }
 
 // CaddyModule returns the Caddy module information.
@@ -38,9 +42,48 @@ func (DinSelect) CaddyModule() caddy.ModuleInfo {
 func (d *DinSelect) Provision(context caddy.Context) error {
 	d.logger = context.Logger(d)
 
-	selector := &reverseproxy.HeaderHashSelection{Field: "Din-Session-Id"}
+	selector := &reverseproxy.HeaderHashSelection{Field: DinSessionIdHeader}
 	selector.Provision(context)
 	d.selector = selector
+
+	// The transport of the reverse proxy is loaded before its selection policy
+	for _, m := range context.Modules() {
+		if h, ok := m.(*reverseproxy.Handler); ok {
+			return d.useDinTransport(context, h)
+		}
+	}
+	return nil
+}
+
+// Cleanup closes the connections of the din transport the reverse proxy was switched to
+func (d *DinSelect) Cleanup() error {
+	if d.transport != nil {
+		return d.transport.Cleanup()
+	}
+	return nil
+}
+
+// useDinTransport switches a reverse proxy with the http transport, or the default one, to the din transport
+// with the same options, as only the din transport sends the requests to the providers with their TLS settings
+func (d *DinSelect) useDinTransport(context caddy.Context, h *reverseproxy.Handler) error {
+	switch transport := h.Transport.(type) {
+	case *DinTransport:
+		return nil
+	case *reverseproxy.HTTPTransport:
+		// The http transport is provisioned and cleaned up by Caddy, and sends the requests to the other providers
+		d.transport = &DinTransport{HTTPTransport: *transport}
+		d.transport.register(context)
+	case nil:
+		d.transport = new(DinTransport)
+		if err := d.transport.Provision(context); err != nil {
+			return fmt.Errorf("provisioning din transport: %w", err)
+		}
+	default:
+		d.logger.Warn("The reverse proxy transport sends the requests to the providers without their TLS settings",
+			zap.String("transport", fmt.Sprintf("%T", transport)), zap.String("machine_id", getMachineId()))
+		return nil
+	}
+	h.Transport = d.transport
 	return nil
 }
 
@@ -54,8 +97,11 @@ func (d *DinSelect) Select(pool reverseproxy.UpstreamPool, r *http.Request, rw h
 		providers = v.(map[string]*provider)
 	}
 	// Select upstream based on request
-	selectedUpstream := d.selector.Select(pool, r, rw)
+	selectedUpstream := d.selectUpstream(pool, providers, r, rw)
 
+	// The request is reused when the reverse proxy retries, so the headers and credentials added for the provider
+	// of the previous attempt are removed before the selected provider's are added
+	resetRequestOrigin(repl, r)
 	for _, provider := range providers {
 		// If the upstream is found in the providers, set the path and headers for the request
 		if selectedUpstream == provider.upstream {
@@ -64,8 +110,8 @@ func (d *DinSelect) Select(pool reverseproxy.UpstreamPool, r *http.Request, rw h
 			for k, v := range provider.Headers {
 				r.Header.Add(k, v)
 			}
-			if provider.Auth != nil {
-				if err := provider.Auth.Sign(r); err != nil {
+			if ac := provider.AuthClient(); ac != nil {
+				if err := ac.Sign(r); err != nil {
 					d.logger.Error("error signing request", zap.String("err", err.Error()), zap.String("machine_id", getMachineId()))
 				}
 			}
@@ -87,6 +133,45 @@ func (d *DinSelect) Select(pool reverseproxy.UpstreamPool, r *http.Request, rw h
 	return selectedUpstream
 }
 
+// requestOrigin is the request before a provider was selected for it
+type requestOrigin struct {
+	// The header map of the request. The reverse proxy copies it into the request of every attempt when header
+	// operations are configured, so it is reset in place.
+	header   http.Header
+	original http.Header
+	rawQuery string
+}
+
+// resetRequestOrigin records the headers and query of the request on the first attempt,
+// and restores them on the next attempts
+func resetRequestOrigin(repl *caddy.Replacer, r *http.Request) {
+	v, ok := repl.Get(DinRequestOriginKey)
+	if !ok {
+		repl.Set(DinRequestOriginKey, &requestOrigin{header: r.Header, original: r.Header.Clone(), rawQuery: r.URL.RawQuery})
+		return
+	}
+	origin := v.(*requestOrigin)
+	for k := range origin.header {
+		delete(origin.header, k)
+	}
+	for k, vs := range origin.original {
+		origin.header[k] = append([]string(nil), vs...)
+	}
+	r.Header = origin.header
+	r.URL.RawQuery = origin.rawQuery
+}
+
+// selectUpstream keeps the requests of a session on the same upstream. Requests without a session are spread
+// over the upstreams by the health check latency of their providers, so slow but correct providers get less traffic.
+func (d *DinSelect) selectUpstream(pool reverseproxy.UpstreamPool, providers map[string]*provider, r *http.Request, rw http.ResponseWriter) *reverseproxy.Upstream {
+	if r.Header.Get(DinSessionIdHeader) == "" {
+		if upstream := latencyWeightedSelection(pool, providers); upstream != nil {
+			return upstream
+		}
+	}
+	return d.selector.Select(pool, r, rw)
+}
+
 func (d *DinSelect) UnmarshalCaddyfile(dispenser *caddyfile.Dispenser) error {
 	return nil
 }
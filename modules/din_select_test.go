@@ -1,11 +1,17 @@
 package modules
 
 import (
+	"context"
+	"net/http"
+	"net/http/httptest"
 	reflect "reflect"
 	"testing"
 
+	"github.com/DIN-center/din-caddy-plugins/lib/auth/credentials"
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"go.uber.org/zap"
 )
 
 func TestSelectCaddyModule(t *testing.T) {
@@ -43,3 +49,67 @@ func TestDinSelectUnmarshalCaddyfile(t *testing.T) {
 		t.Errorf("UnmarshalCaddyfile() error = %v, want nil", err)
 	}
 }
+
+// sequenceSelection selects the upstreams of the pool one after the other, as retries do
+type sequenceSelection struct {
+	next int
+}
+
+func (s *sequenceSelection) Select(pool reverseproxy.UpstreamPool, r *http.Request, w http.ResponseWriter) *reverseproxy.Upstream {
+	upstream := pool[s.next%len(pool)]
+	s.next++
+	return upstream
+}
+
+func TestDinSelectRetryDropsPreviousProviderCredentials(t *testing.T) {
+	providerA := &provider{
+		host:        "a.provider.com",
+		upstream:    &reverseproxy.Upstream{Dial: "a.provider.com:443"},
+		Headers:     map[string]string{"X-Provider-A": "a"},
+		Credentials: &credentials.ClientAuth{Type: credentials.TypeAPIKey, QueryParam: "key", Key: "secret-a"},
+	}
+	providerB := &provider{
+		host:        "b.provider.com",
+		upstream:    &reverseproxy.Upstream{Dial: "b.provider.com:443"},
+		Credentials: &credentials.ClientAuth{Type: credentials.TypeBearer, Token: "secret-b"},
+	}
+	for _, p := range []*provider{providerA, providerB} {
+		if err := p.Credentials.Start(zap.NewNop()); err != nil {
+			t.Fatalf("Start() = %v", err)
+		}
+		defer p.Credentials.Stop()
+	}
+
+	repl := caddy.NewReplacer()
+	repl.Set(DinUpstreamsContextKey, map[string]*provider{"a": providerA, "b": providerB})
+	r := httptest.NewRequest(http.MethodPost, "http://localhost/eth?trace=1", nil)
+	r.Header.Set(DinSessionIdHeader, "session")
+	r = r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, repl))
+	pool := reverseproxy.UpstreamPool{providerA.upstream, providerB.upstream}
+	selector := &DinSelect{selector: &sequenceSelection{}, logger: zap.NewNop()}
+
+	if upstream := selector.Select(pool, r, httptest.NewRecorder()); upstream != providerA.upstream {
+		t.Fatalf("expected provider a to be selected first")
+	}
+	if r.URL.Query().Get("key") != "secret-a" || r.Header.Get("X-Provider-A") != "a" {
+		t.Fatalf("expected the request to carry the headers and key of provider a, got %v %v", r.Header, r.URL.RawQuery)
+	}
+
+	// The reverse proxy copies the header map of the first attempt into the request of a retry
+	reqHeader := r.Header
+	r.Header = reqHeader.Clone()
+	if upstream := selector.Select(pool, r, httptest.NewRecorder()); upstream != providerB.upstream {
+		t.Fatalf("expected provider b to be selected on the retry")
+	}
+	for _, header := range []http.Header{r.Header, reqHeader} {
+		if header.Get("X-Provider-A") != "" {
+			t.Errorf("expected the headers of provider a to be removed, got %v", header)
+		}
+		if header.Get("Authorization") != "Bearer secret-b" {
+			t.Errorf("expected the token of provider b, got %q", header.Get("Authorization"))
+		}
+	}
+	if r.URL.RawQuery != "trace=1" {
+		t.Errorf("expected the key of provider a to be removed from the query, got %q", r.URL.RawQuery)
+	}
+}
@@ -0,0 +1,166 @@
+package modules
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+)
+
+var (
+	// Initializations of extended Caddy Module Interface Guards
+	// https://caddyserver.com/docs/extending-caddy
+
+	// Din Transport Module
+	_ caddy.Module              = (*DinTransport)(nil)
+	_ caddy.Provisioner         = (*DinTransport)(nil)
+	_ caddy.CleanerUpper        = (*DinTransport)(nil)
+	_ http.RoundTripper         = (*DinTransport)(nil)
+	_ reverseproxy.TLSTransport = (*DinTransport)(nil)
+)
+
+// DinTransport is the http transport of the reverse proxy, which sends the requests to the providers with TLS settings
+// through a transport with those settings, such as a client certificate. It takes the options of the http transport,
+// which the transports of those providers are built from as well:
+//
+//	transport din {
+//		tls
+//		keepalive 10s
+//	}
+//
+// A reverse proxy with the din_reverse_proxy_policy and the http transport, or no transport, is switched to it.
+type DinTransport struct {
+	reverseproxy.HTTPTransport
+
+	ctx caddy.Context
+	// providerTransports holds the transport built for each provider transport with TLS settings
+	providerTransports   map[*http.Transport]*http.Transport
+	providerTransportsMu sync.Mutex
+}
+
+// CaddyModule returns the Caddy module information.
+func (*DinTransport) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.reverse_proxy.transport.din",
+		New: func() caddy.Module { return new(DinTransport) },
+	}
+}
+
+// dinTransports holds the din transports in use, which drop the transports they built for a provider when it is removed
+var dinTransports = struct {
+	sync.Mutex
+	m map[*DinTransport]struct{}
+}{m: make(map[*DinTransport]struct{})}
+
+// Provision sets up the http transport and keeps the context to build the transports of the providers with
+func (t *DinTransport) Provision(ctx caddy.Context) error {
+	t.register(ctx)
+	return t.HTTPTransport.Provision(ctx)
+}
+
+// register keeps the context to build the transports of the providers with, and adds the transport to dinTransports
+func (t *DinTransport) register(ctx caddy.Context) {
+	t.ctx = ctx
+	dinTransports.Lock()
+	dinTransports.m[t] = struct{}{}
+	dinTransports.Unlock()
+}
+
+// Cleanup closes the idle connections of the http transport and of the transports of the providers
+func (t *DinTransport) Cleanup() error {
+	dinTransports.Lock()
+	delete(dinTransports.m, t)
+	dinTransports.Unlock()
+
+	t.providerTransportsMu.Lock()
+	for _, rt := range t.providerTransports {
+		rt.CloseIdleConnections()
+	}
+	t.providerTransports = nil
+	t.providerTransportsMu.Unlock()
+	return t.HTTPTransport.Cleanup()
+}
+
+// releaseProviderTransports drops the transports the din transports built for a provider that was removed,
+// and closes their idle connections
+func releaseProviderTransports(p *provider) {
+	if p.transport == nil {
+		return
+	}
+	dinTransports.Lock()
+	defer dinTransports.Unlock()
+	for t := range dinTransports.m {
+		t.providerTransportsMu.Lock()
+		if rt, ok := t.providerTransports[p.transport]; ok {
+			rt.CloseIdleConnections()
+			delete(t.providerTransports, p.transport)
+		}
+		t.providerTransportsMu.Unlock()
+	}
+}
+
+// RoundTrip sends the request to the provider selected by DinSelect
+func (t *DinTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if p := selectedProvider(req); p != nil && p.transport != nil {
+		rt, err := t.providerTransport(p)
+		if err != nil {
+			return nil, err
+		}
+		// Providers with TLS settings are validated to have https urls
+		req.URL.Scheme = "https"
+		return rt.RoundTrip(req)
+	}
+	return t.HTTPTransport.RoundTrip(req)
+}
+
+// providerTransport returns the transport for the provider, built once from the options of the http transport
+// with the TLS settings of the provider
+func (t *DinTransport) providerTransport(p *provider) (*http.Transport, error) {
+	t.providerTransportsMu.Lock()
+	defer t.providerTransportsMu.Unlock()
+	if rt, ok := t.providerTransports[p.transport]; ok {
+		return rt, nil
+	}
+
+	// Build from a copy, as NewTransport sets the defaults and the h2c transport of the http transport it is called on
+	h := t.HTTPTransport
+	rt, err := h.NewTransport(t.ctx)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := p.transport.TLSClientConfig.Clone()
+	if rt.TLSClientConfig != nil {
+		// Keep the protocols negotiated for the configured http versions
+		tlsConfig.NextProtos = rt.TLSClientConfig.NextProtos
+	}
+	rt.TLSClientConfig = tlsConfig
+
+	if t.providerTransports == nil {
+		t.providerTransports = make(map[*http.Transport]*http.Transport)
+	}
+	t.providerTransports[p.transport] = rt
+	return rt, nil
+}
+
+// selectedProvider returns the provider DinSelect selected for the request, or nil if it isn't known
+func selectedProvider(req *http.Request) *provider {
+	repl, ok := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if !ok {
+		return nil
+	}
+	host, ok := repl.Get(RequestProviderKey)
+	if !ok {
+		return nil
+	}
+	var providers map[string]*provider
+	if v, ok := repl.Get(DinUpstreamsContextKey); ok {
+		providers = v.(map[string]*provider)
+	}
+	for _, p := range providers {
+		if p.host == host {
+			return p
+		}
+	}
+	return nil
+}
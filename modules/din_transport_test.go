@@ -0,0 +1,274 @@
+package modules
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	din_http "github.com/DIN-center/din-caddy-plugins/lib/http"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestDinTransportCaddyModule(t *testing.T) {
+	assert.Equal(t, caddy.ModuleID("http.reverse_proxy.transport.din"), new(DinTransport).CaddyModule().ID)
+
+	transport := new(DinTransport)
+	err := transport.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`din {
+		tls
+		keepalive 10s
+	}`))
+	assert.NoError(t, err)
+	assert.True(t, transport.TLSEnabled())
+	assert.Equal(t, caddy.Duration(10*time.Second), transport.KeepAlive.IdleConnTimeout)
+}
+
+func TestProviderMTLS(t *testing.T) {
+	dir := t.TempDir()
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(writeTLSClientCertificate(t, dir))
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x10"}`))
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	server.StartTLS()
+	defer server.Close()
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The httptest certificate is issued for example.com, which the server name override verifies against
+	p, err := NewProvider(server.URL + "/eth")
+	assert.NoError(t, err)
+	p.TLS = &din_http.TLSConfig{
+		CertFile:   filepath.Join(dir, "client.pem"),
+		KeyFile:    filepath.Join(dir, "client-key.pem"),
+		CAFile:     caFile,
+		ServerName: "example.com",
+	}
+	assert.NoError(t, p.validate())
+	d := &DinMiddleware{logger: zap.NewNop(), testMode: true}
+	assert.NoError(t, d.initializeProvider(p, din_http.NewHTTPClient(), zap.NewNop()))
+
+	// Health checks use the client of the provider, the network client has no client certificate
+	n := &network{
+		Name:       "eth",
+		HCMethod:   "eth_blockNumber",
+		HttpClient: din_http.NewHTTPClient(),
+		Providers:  map[string]*provider{p.host: p},
+		logger:     zap.NewNop(),
+	}
+	blockNumber, _, err := n.getLatestBlockNumber(p.HttpUrl, p.Headers, p.AuthClient())
+	assert.NoError(t, err)
+	assert.Equal(t, int64(16), blockNumber)
+	_, _, err = n.HttpClient.Post(p.HttpUrl, nil, []byte(`{}`), nil)
+	assert.Error(t, err)
+
+	// Proxied requests to the provider selected by DinSelect use the transport of the provider
+	u, _ := url.Parse(server.URL)
+	req, _ := http.NewRequest(http.MethodPost, "http://"+u.Host+"/eth", nil)
+	repl := caddy.NewReplacer()
+	repl.Set(DinUpstreamsContextKey, n.Providers)
+	repl.Set(RequestProviderKey, p.host)
+	req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl))
+	transport := new(DinTransport)
+	assert.NoError(t, transport.Provision(caddy.Context{}))
+	res, err := transport.RoundTrip(req)
+	assert.NoError(t, err)
+	if err == nil {
+		res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+	}
+
+	// A missing certificate fails provisioning
+	p, _ = NewProvider(server.URL + "/eth")
+	p.TLS = &din_http.TLSConfig{CertFile: filepath.Join(dir, "missing.pem"), KeyFile: filepath.Join(dir, "client-key.pem")}
+	assert.Error(t, d.initializeProvider(p, din_http.NewHTTPClient(), zap.NewNop()))
+}
+
+func TestDinTransportProviderTransport(t *testing.T) {
+	dir := t.TempDir()
+	writeTLSClientCertificate(t, dir)
+	p, err := NewProvider("https://eth.provider.com/v1")
+	assert.NoError(t, err)
+	p.TLS = &din_http.TLSConfig{
+		CertFile:   filepath.Join(dir, "client.pem"),
+		KeyFile:    filepath.Join(dir, "client-key.pem"),
+		ServerName: "node.provider.internal",
+	}
+	assert.NoError(t, p.validate())
+	d := &DinMiddleware{logger: zap.NewNop(), testMode: true}
+	assert.NoError(t, d.initializeProvider(p, din_http.NewHTTPClient(), zap.NewNop()))
+
+	transport := new(DinTransport)
+	assert.NoError(t, transport.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`din {
+		keepalive 10s
+		keepalive_idle_conns_per_host 8
+		response_header_timeout 5s
+	}`)))
+	assert.NoError(t, transport.Provision(caddy.Context{}))
+
+	// The transport of the provider takes the options of the http transport and the TLS settings of the provider
+	rt, err := transport.providerTransport(p)
+	assert.NoError(t, err)
+	assert.Equal(t, 10*time.Second, rt.IdleConnTimeout)
+	assert.Equal(t, 8, rt.MaxIdleConnsPerHost)
+	assert.Equal(t, 5*time.Second, rt.ResponseHeaderTimeout)
+	assert.Len(t, rt.TLSClientConfig.Certificates, 1)
+	assert.Equal(t, "node.provider.internal", rt.TLSClientConfig.ServerName)
+	assert.Contains(t, rt.TLSClientConfig.NextProtos, "h2")
+	assert.Empty(t, transport.Transport.TLSClientConfig.Certificates)
+
+	// It is built once per provider
+	rt2, err := transport.providerTransport(p)
+	assert.NoError(t, err)
+	assert.Same(t, rt, rt2)
+
+	// and dropped when the provider is removed
+	releaseProviderTransports(p)
+	assert.Empty(t, transport.providerTransports)
+	rt3, err := transport.providerTransport(p)
+	assert.NoError(t, err)
+	assert.NotSame(t, rt, rt3)
+	assert.NoError(t, transport.Cleanup())
+	assert.NotContains(t, dinTransports.m, transport)
+}
+
+func TestDinSelectUsesDinTransport(t *testing.T) {
+	d := &DinSelect{logger: zap.NewNop()}
+
+	// The http transport is switched to the din transport with its options
+	httpTransport := &reverseproxy.HTTPTransport{KeepAlive: &reverseproxy.KeepAlive{IdleConnTimeout: caddy.Duration(10 * time.Second)}}
+	assert.NoError(t, httpTransport.Provision(caddy.Context{}))
+	h := &reverseproxy.Handler{Transport: httpTransport}
+	assert.NoError(t, d.useDinTransport(caddy.Context{}, h))
+	assert.IsType(t, &DinTransport{}, h.Transport)
+	assert.Same(t, d.transport, h.Transport)
+	assert.Equal(t, caddy.Duration(10*time.Second), d.transport.KeepAlive.IdleConnTimeout)
+	assert.Same(t, httpTransport.Transport, d.transport.Transport)
+	assert.Contains(t, dinTransports.m, d.transport)
+	assert.NoError(t, d.Cleanup())
+	assert.NotContains(t, dinTransports.m, d.transport)
+
+	// The default transport is the din transport
+	d = &DinSelect{logger: zap.NewNop()}
+	h = &reverseproxy.Handler{}
+	assert.NoError(t, d.useDinTransport(caddy.Context{}, h))
+	assert.Same(t, d.transport, h.Transport)
+	assert.NotNil(t, d.transport.Transport)
+	assert.NoError(t, d.Cleanup())
+
+	// The din transport and other transports are kept
+	d = &DinSelect{logger: zap.NewNop()}
+	dinTransport := new(DinTransport)
+	h = &reverseproxy.Handler{Transport: dinTransport}
+	assert.NoError(t, d.useDinTransport(caddy.Context{}, h))
+	assert.Same(t, dinTransport, h.Transport)
+	assert.Nil(t, d.transport)
+	h = &reverseproxy.Handler{Transport: http.DefaultTransport}
+	assert.NoError(t, d.useDinTransport(caddy.Context{}, h))
+	assert.Same(t, http.DefaultTransport, h.Transport)
+	assert.Nil(t, d.transport)
+	assert.NoError(t, d.Cleanup())
+}
+
+func TestCaddyfileProviderTLS(t *testing.T) {
+	dinMiddleware := new(DinMiddleware)
+	err := dinMiddleware.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`din {
+		networks {
+			eth {
+				methods eth_blockNumber
+				providers {
+					https://eth.provider.com/v1 {
+						tls {
+							cert_file /run/secrets/provider-client.pem
+							key_file /run/secrets/provider-client-key.pem
+							ca_file /run/secrets/provider-ca.pem
+							server_name node.provider.internal
+							min_version tls1.3
+						}
+					}
+				}
+			}
+		}
+	}`))
+	assert.NoError(t, err)
+	assert.Equal(t, &din_http.TLSConfig{
+		CertFile:   "/run/secrets/provider-client.pem",
+		KeyFile:    "/run/secrets/provider-client-key.pem",
+		CAFile:     "/run/secrets/provider-ca.pem",
+		ServerName: "node.provider.internal",
+		MinVersion: "tls1.3",
+	}, dinMiddleware.Networks["eth"].Providers["eth.provider.com"].TLS)
+
+	err = new(DinMiddleware).UnmarshalCaddyfile(caddyfile.NewTestDispenser(`din {
+		networks {
+			eth {
+				methods eth_blockNumber
+				providers {
+					https://eth.provider.com/v1 {
+						tls {
+							insecure_skip_verify
+						}
+					}
+				}
+			}
+		}
+	}`))
+	assert.Error(t, err)
+}
+
+// writeTLSClientCertificate writes a self signed client certificate and its key to client.pem and client-key.pem in dir
+func writeTLSClientCertificate(t *testing.T, dir string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "din-caddy"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "client.pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "client-key.pem"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
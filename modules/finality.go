@@ -0,0 +1,250 @@
+package modules
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	prom "github.com/DIN-center/din-caddy-plugins/lib/prometheus"
+	"go.uber.org/zap"
+)
+
+// Block tags whose heads are tracked per provider
+const (
+	BlockTagSafe      = "safe"
+	BlockTagFinalized = "finalized"
+)
+
+// trackedBlockTags are the block tags polled from every provider by the finality health check
+var trackedBlockTags = []string{BlockTagSafe, BlockTagFinalized}
+
+// The block tags as JSON strings, as they appear in the body of a request referring to them
+var (
+	quotedBlockTagSafe      = []byte(`"` + BlockTagSafe + `"`)
+	quotedBlockTagFinalized = []byte(`"` + BlockTagFinalized + `"`)
+)
+
+// finalityHealthCheck polls the safe and finalized heads of every provider and updates the network's view of them.
+// Providers whose finalized head regresses, or lags more than FinalizedLagLimit blocks behind the network's finalized head,
+// are kept unhealthy until the next finality health check finds them consistent again.
+// Providers that don't support the block tags are not judged on them.
+// Only networks health checked with eth_blockNumber are polled, as the heads are read with eth_getBlockByNumber.
+func (n *network) finalityHealthCheck() {
+	if n.HCMethod != DefaultHCMethod {
+		return
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	regressed := make(map[string]bool)
+	for name, currentProvider := range n.Providers {
+		wg.Add(1)
+		go func(providerName string, provider *provider) {
+			defer wg.Done()
+			if n.pollProviderHeads(providerName, provider) {
+				mu.Lock()
+				regressed[provider.host] = true
+				mu.Unlock()
+			}
+		}(name, currentProvider)
+	}
+	wg.Wait()
+
+	for _, tag := range trackedBlockTags {
+		n.updateNetworkHead(tag)
+	}
+
+	networkFinalized := n.loadHeadBlockNumber(BlockTagFinalized)
+	for name, provider := range n.Providers {
+		fault := regressed[provider.host]
+		reason := HealthReasonFinalizedRegression
+		providerFinalized := provider.loadHeadBlockNumber(BlockTagFinalized)
+		if providerFinalized != 0 && providerFinalized+n.FinalizedLagLimit < networkFinalized {
+			n.logger.Warn("Provider finalized head is lagging behind the network",
+				zap.String("provider", name),
+				zap.String("network", n.Name),
+				zap.String("reason", HealthReasonFinalizedLag),
+				zap.Int64("provider_finalized_block_number", providerFinalized),
+				zap.Int64("network_finalized_block_number", networkFinalized),
+				zap.String("machine_id", n.machineID))
+			fault = true
+			reason = HealthReasonFinalizedLag
+		}
+		if fault {
+			provider.markUnhealthy(reason)
+		}
+		if provider.swapFinalityFault(fault) && !fault {
+			n.logger.Info("Provider finalized head is consistent with the network again", zap.String("provider", name), zap.String("network", n.Name), zap.String("machine_id", n.machineID))
+		}
+	}
+}
+
+// pollProviderHeads reads the safe and finalized heads of a provider and stores them.
+// It returns true if the finalized head of the provider went back since the last poll.
+func (n *network) pollProviderHeads(providerName string, provider *provider) bool {
+	regressed := false
+	for _, tag := range trackedBlockTags {
+		block, err := n.getBlock(provider.HttpUrl, provider.Headers, provider.AuthClient(), tag)
+		if err != nil {
+			n.logger.Debug("Error getting head for provider", zap.String("provider", providerName), zap.String("network", n.Name), zap.String("tag", tag), zap.Error(err), zap.String("machine_id", n.machineID))
+			continue
+		}
+		blockNumber, err := strconv.ParseInt(strings.TrimPrefix(block.Number, "0x"), 16, 64)
+		if err != nil {
+			n.logger.Debug("Error parsing head block number for provider", zap.String("provider", providerName), zap.String("network", n.Name), zap.String("tag", tag), zap.Error(err), zap.String("machine_id", n.machineID))
+			continue
+		}
+
+		previous := provider.swapHeadBlockNumber(tag, blockNumber)
+		if tag == BlockTagFinalized && blockNumber < previous {
+			n.logger.Warn("Provider finalized head regressed",
+				zap.String("provider", providerName),
+				zap.String("network", n.Name),
+				zap.String("reason", HealthReasonFinalizedRegression),
+				zap.Int64("previous_finalized_block_number", previous),
+				zap.Int64("finalized_block_number", blockNumber),
+				zap.String("machine_id", n.machineID))
+			regressed = true
+		}
+		n.PrometheusClient.HandleHeadMetric(&prom.PromHeadMetricData{
+			Network:     n.Name,
+			Provider:    provider.host,
+			Tag:         tag,
+			BlockNumber: blockNumber,
+		})
+	}
+	return regressed
+}
+
+// updateNetworkHead raises the network's head of the block tag to the median head reported by its providers.
+// The heads of a network never go back, a provider reporting a lower head is the one out of line.
+func (n *network) updateNetworkHead(tag string) {
+	heads := make([]int64, 0, len(n.Providers))
+	for _, provider := range n.Providers {
+		if head := provider.loadHeadBlockNumber(tag); head != 0 {
+			heads = append(heads, head)
+		}
+	}
+	if len(heads) == 0 {
+		return
+	}
+	sort.Slice(heads, func(i, j int) bool {
+		return heads[i] < heads[j]
+	})
+	raiseInt64(n.headBlockNumber(tag), heads[(len(heads)-1)/2])
+
+	n.PrometheusClient.HandleHeadMetric(&prom.PromHeadMetricData{
+		Network:     n.Name,
+		Tag:         tag,
+		BlockNumber: n.loadHeadBlockNumber(tag),
+	})
+}
+
+// providersForBlockTag returns the providers whose head of the block tag is at least the network's head,
+// so that requests for the tag are answered consistently with the network's view.
+// All providers are returned if the network has no view of the tag yet, or if no provider is consistent with it.
+func (n *network) providersForBlockTag(tag string) map[string]*provider {
+	networkHead := n.loadHeadBlockNumber(tag)
+	if networkHead == 0 {
+		return n.Providers
+	}
+	providers := make(map[string]*provider, len(n.Providers))
+	for host, provider := range n.Providers {
+		if provider.loadHeadBlockNumber(tag) >= networkHead {
+			providers[host] = provider
+		}
+	}
+	if len(providers) == 0 {
+		return n.Providers
+	}
+	return providers
+}
+
+// requestBlockTag returns the safe or finalized block tag a JSON-RPC request refers to, either as a parameter
+// or as a field of an object parameter such as the filter of eth_getLogs. It returns an empty string otherwise.
+// The body is only decoded if it contains one of the tags as a JSON string, so that most requests are not decoded at all.
+func requestBlockTag(body []byte) string {
+	if !bytes.Contains(body, quotedBlockTagSafe) && !bytes.Contains(body, quotedBlockTagFinalized) {
+		return ""
+	}
+	var request struct {
+		Params []interface{} `json:"params"`
+	}
+	if err := json.Unmarshal(body, &request); err != nil {
+		return ""
+	}
+	for _, value := range request.Params {
+		values := []interface{}{value}
+		if object, ok := value.(map[string]interface{}); ok {
+			values = values[:0]
+			for _, field := range object {
+				values = append(values, field)
+			}
+		}
+		for _, v := range values {
+			if tag, ok := v.(string); ok && (tag == BlockTagSafe || tag == BlockTagFinalized) {
+				return tag
+			}
+		}
+	}
+	return ""
+}
+
+// headBlockNumber returns the network's head of the block tag
+func (n *network) headBlockNumber(tag string) *int64 {
+	if tag == BlockTagSafe {
+		return &n.safeBlockNumber
+	}
+	return &n.finalizedBlockNumber
+}
+
+// loadHeadBlockNumber atomically loads the network's head of the block tag, 0 if not known
+func (n *network) loadHeadBlockNumber(tag string) int64 {
+	return atomic.LoadInt64(n.headBlockNumber(tag))
+}
+
+// headBlockNumber returns the provider's head of the block tag
+func (p *provider) headBlockNumber(tag string) *int64 {
+	if tag == BlockTagSafe {
+		return &p.safeBlockNumber
+	}
+	return &p.finalizedBlockNumber
+}
+
+// loadHeadBlockNumber atomically loads the head of the block tag last reported by the provider, 0 if not known
+func (p *provider) loadHeadBlockNumber(tag string) int64 {
+	return atomic.LoadInt64(p.headBlockNumber(tag))
+}
+
+// swapHeadBlockNumber atomically stores the head of the block tag reported by the provider, and returns the previous one
+func (p *provider) swapHeadBlockNumber(tag string, blockNumber int64) int64 {
+	return atomic.SwapInt64(p.headBlockNumber(tag), blockNumber)
+}
+
+// hasFinalityFault returns true if the finalized head of the provider was out of line at the last finality health check
+func (p *provider) hasFinalityFault() bool {
+	return atomic.LoadInt32(&p.finalityFault) == 1
+}
+
+// swapFinalityFault atomically stores whether the finalized head of the provider is out of line, and returns the previous value
+func (p *provider) swapFinalityFault(fault bool) bool {
+	var value int32
+	if fault {
+		value = 1
+	}
+	return atomic.SwapInt32(&p.finalityFault, value) == 1
+}
+
+// raiseInt64 atomically stores the value if it is higher than the current one
+func raiseInt64(addr *int64, value int64) {
+	for {
+		current := atomic.LoadInt64(addr)
+		if value <= current || atomic.CompareAndSwapInt64(addr, current, value) {
+			return
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package modules
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/DIN-center/din-caddy-plugins/lib/auth"
+	din_http "github.com/DIN-center/din-caddy-plugins/lib/http"
+	prom "github.com/DIN-center/din-caddy-plugins/lib/prometheus"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestBlockTag(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		expected string
+	}{
+		{name: "finalized block", body: `{"jsonrpc":"2.0","method":"eth_getBlockByNumber","params":["finalized", false],"id":1}`, expected: BlockTagFinalized},
+		{name: "safe balance", body: `{"jsonrpc":"2.0","method":"eth_getBalance","params":["0x407d73d8a49eeb85d32cf465507dd71d507100c1", "safe"],"id":1}`, expected: BlockTagSafe},
+		{name: "logs filter", body: `{"jsonrpc":"2.0","method":"eth_getLogs","params":[{"fromBlock":"0x1","toBlock":"finalized"}],"id":1}`, expected: BlockTagFinalized},
+		{name: "latest block", body: `{"jsonrpc":"2.0","method":"eth_getBlockByNumber","params":["latest", false],"id":1}`},
+		{name: "no params", body: `{"jsonrpc":"2.0","method":"eth_blockNumber","id":1}`},
+		{name: "batch", body: `[{"jsonrpc":"2.0","method":"eth_getBlockByNumber","params":["finalized", false],"id":1}]`},
+		{name: "not json", body: `finalized`},
+		{name: "tag outside of the params", body: `{"jsonrpc":"2.0","method":"eth_blockNumber","params":[],"id":"finalized"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, requestBlockTag([]byte(tt.body)))
+		})
+	}
+}
+
+// finalityTestChain serves the latest, safe and finalized heads of each provider URL
+type finalityTestChain struct {
+	mu    sync.Mutex
+	heads map[string]map[string]int64
+}
+
+func (c *finalityTestChain) setHead(url string, tag string, number int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.heads[url] == nil {
+		c.heads[url] = make(map[string]int64)
+	}
+	c.heads[url][tag] = number
+}
+
+func (c *finalityTestChain) post(url string, headers map[string]string, payload []byte, ac auth.IAuthClient) ([]byte, *int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	statusCode := http.StatusOK
+	for _, tag := range trackedBlockTags {
+		if strings.Contains(string(payload), `"`+tag+`"`) {
+			number, ok := c.heads[url][tag]
+			if !ok {
+				return []byte(`{"jsonrpc": "2.0", "id": 1, "error": {"code": -32602, "message": "unknown block"}}`), &statusCode, nil
+			}
+			return []byte(fmt.Sprintf(`{"jsonrpc": "2.0", "id": 1, "result": {"number": "0x%x", "hash": "0x%x"}}`, number, number)), &statusCode, nil
+		}
+	}
+	return []byte(`{"jsonrpc": "2.0", "id": 1, "result": "0x4c4b40"}`), &statusCode, nil
+}
+
+func TestFinalityHealthCheck(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	mockHttpClient := din_http.NewMockIHTTPClient(mockCtrl)
+	mockPrometheusClient := prom.NewMockIPrometheusClient(mockCtrl)
+
+	chain := &finalityTestChain{heads: make(map[string]map[string]int64)}
+	for _, url := range []string{"http://provider1", "http://provider2", "http://provider3"} {
+		chain.setHead(url, BlockTagSafe, 5000)
+		chain.setHead(url, BlockTagFinalized, 4950)
+	}
+	// provider4 doesn't support the block tags
+
+	mockHttpClient.EXPECT().Post(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(chain.post).AnyTimes()
+	mockPrometheusClient.EXPECT().HandleLatestBlockMetric(gomock.Any()).AnyTimes()
+	// The heads of every provider are reported, as well as the heads of the network
+	mockPrometheusClient.EXPECT().HandleHeadMetric(&prom.PromHeadMetricData{
+		Network:     "eth",
+		Provider:    "provider1",
+		Tag:         BlockTagFinalized,
+		BlockNumber: 4950,
+	}).MinTimes(1)
+	mockPrometheusClient.EXPECT().HandleHeadMetric(gomock.Any()).AnyTimes()
+
+	n := newChainIDTestNetwork(t, mockHttpClient, mockPrometheusClient, "http://provider1", "http://provider2", "http://provider3", "http://provider4")
+	n.FinalizedLagLimit = 10
+	checkProviders(t, n)
+	n.finalityHealthCheck()
+
+	assert.Equal(t, int64(5000), n.loadHeadBlockNumber(BlockTagSafe))
+	assert.Equal(t, int64(4950), n.loadHeadBlockNumber(BlockTagFinalized))
+	for _, p := range n.Providers {
+		assert.False(t, p.hasFinalityFault(), p.host)
+		assert.Equal(t, Healthy, p.getHealthStatus(), p.host)
+	}
+
+	// provider2 regresses its finalized head, provider3 lags behind the network
+	chain.setHead("http://provider1", BlockTagFinalized, 4982)
+	chain.setHead("http://provider2", BlockTagFinalized, 4940)
+	n.finalityHealthCheck()
+
+	assert.Equal(t, int64(4950), n.loadHeadBlockNumber(BlockTagFinalized))
+	assert.False(t, n.Providers["provider1"].hasFinalityFault())
+	assert.True(t, n.Providers["provider2"].hasFinalityFault())
+	assert.False(t, n.Providers["provider3"].hasFinalityFault())
+	assert.Equal(t, Unhealthy, n.Providers["provider2"].getHealthStatus())
+
+	chain.setHead("http://provider2", BlockTagFinalized, 4982)
+	n.finalityHealthCheck()
+	assert.Equal(t, int64(4982), n.loadHeadBlockNumber(BlockTagFinalized))
+	assert.False(t, n.Providers["provider2"].hasFinalityFault())
+	assert.True(t, n.Providers["provider3"].hasFinalityFault())
+	assert.Equal(t, Unhealthy, n.Providers["provider3"].getHealthStatus())
+
+	// The provider with a finalized head out of line stays unhealthy on regular health checks
+	checkProviders(t, n)
+	assert.Equal(t, Unhealthy, n.Providers["provider3"].getHealthStatus())
+	assert.False(t, n.Providers["provider4"].hasFinalityFault())
+
+	// Finalized requests only go to providers consistent with the network's view
+	providers := n.providersForBlockTag(BlockTagFinalized)
+	assert.Len(t, providers, 2)
+	assert.NotNil(t, providers["provider1"])
+	assert.NotNil(t, providers["provider2"])
+	assert.Len(t, n.providersForBlockTag(BlockTagSafe), 3)
+}
+
+func TestProvidersForBlockTagWithoutView(t *testing.T) {
+	n := newChainIDTestNetwork(t, nil, nil, "http://provider1", "http://provider2")
+	assert.Len(t, n.providersForBlockTag(BlockTagFinalized), 2)
+
+	// No provider consistent with the network's view falls back to all providers
+	n.finalizedBlockNumber = 100
+	assert.Len(t, n.providersForBlockTag(BlockTagFinalized), 2)
+}
@@ -0,0 +1,245 @@
+package modules
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/DIN-center/din-caddy-plugins/lib/auth"
+	prom "github.com/DIN-center/din-caddy-plugins/lib/prometheus"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// blockHashEntry is the hash the majority of the providers of a network reported for a block
+type blockHashEntry struct {
+	number int64
+	hash   string
+}
+
+// forkHealthCheck compares the block hash the providers of the network report at a common recent height.
+// Providers that disagree with the majority are on a minority fork and are kept unhealthy until they agree again.
+// The majority hashes are recorded, so that a later change of the canonical chain is reported as a reorg.
+// Only networks health checked with eth_blockNumber are compared, as block hashes are read with eth_getBlockByNumber.
+func (n *network) forkHealthCheck() {
+	if n.HCMethod != DefaultHCMethod {
+		return
+	}
+	height := n.getPercentileBlockNumber(0.5) - n.ForkCheckOffset
+	if height <= 0 {
+		return
+	}
+
+	hashes := n.sampleBlockHashes(height)
+	canonical, ok := majorityHash(hashes)
+	if !ok {
+		if len(hashes) > 1 {
+			n.logger.Warn("Providers disagree on the block hash without a majority",
+				zap.String("network", n.Name),
+				zap.Int64("block_number", height),
+				zap.Int("providers", len(hashes)),
+				zap.String("machine_id", n.machineID))
+		}
+		return
+	}
+
+	var referenceProvider *provider
+	for host, hash := range hashes {
+		provider := n.Providers[host]
+		if hash == canonical {
+			if referenceProvider == nil {
+				referenceProvider = provider
+			}
+			if provider.swapForked(false) {
+				n.logger.Info("Provider is back on the canonical chain", zap.String("provider", host), zap.String("network", n.Name), zap.String("machine_id", n.machineID))
+			}
+			continue
+		}
+		n.logger.Warn("Provider is on a minority fork",
+			zap.String("provider", host),
+			zap.String("network", n.Name),
+			zap.String("reason", HealthReasonFork),
+			zap.Int64("block_number", height),
+			zap.String("block_hash", hash),
+			zap.String("canonical_block_hash", canonical),
+			zap.String("machine_id", n.machineID))
+		provider.swapForked(true)
+		provider.markUnhealthy(HealthReasonFork)
+		n.PrometheusClient.HandleForkMetric(&prom.PromForkMetricData{
+			Network:  n.Name,
+			Provider: host,
+		})
+	}
+
+	n.recordCanonicalBlock(blockHashEntry{number: height, hash: canonical}, referenceProvider)
+}
+
+// sampleBlockHashes returns the hash each provider reports for the block at the given height, keyed by provider host.
+// Providers that fail to report it, for example because they haven't reached the height yet, are left out.
+func (n *network) sampleBlockHashes(height int64) map[string]string {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	hashes := make(map[string]string, len(n.Providers))
+	for name, currentProvider := range n.Providers {
+		wg.Add(1)
+		go func(providerName string, provider *provider) {
+			defer wg.Done()
+			hash, err := n.getBlockHash(provider.HttpUrl, provider.Headers, provider.AuthClient(), height)
+			if err != nil {
+				n.logger.Debug("Error getting block hash for provider", zap.String("provider", providerName), zap.String("network", n.Name), zap.Int64("block_number", height), zap.Error(err), zap.String("machine_id", n.machineID))
+				return
+			}
+			mu.Lock()
+			hashes[provider.host] = hash
+			mu.Unlock()
+		}(name, currentProvider)
+	}
+	wg.Wait()
+	return hashes
+}
+
+// majorityHash returns the hash reported by a strict majority of the providers
+func majorityHash(hashes map[string]string) (string, bool) {
+	counts := make(map[string]int, len(hashes))
+	for _, hash := range hashes {
+		counts[hash]++
+	}
+	for hash, count := range counts {
+		if count*2 > len(hashes) {
+			return hash, true
+		}
+	}
+	return "", false
+}
+
+// recordCanonicalBlock records the majority hash of a block. The previously recorded blocks are verified against the
+// reference provider first, newest first, and the blocks whose hash changed since they were recorded are reported as a reorg.
+// The depth of the reorg is the number of blocks between the newest and the oldest changed recorded block,
+// a lower bound of the actual depth as only the sampled heights are known.
+func (n *network) recordCanonicalBlock(entry blockHashEntry, referenceProvider *provider) {
+	recorded := []blockHashEntry{entry}
+	var newestReorged, oldestReorged int64
+	verified := false
+	for _, prev := range n.loadCanonicalBlocks() {
+		hash := entry.hash
+		if prev.number < entry.number {
+			if verified {
+				recorded = append(recorded, prev)
+				continue
+			}
+			var err error
+			hash, err = n.getBlockHash(referenceProvider.HttpUrl, referenceProvider.Headers, referenceProvider.AuthClient(), prev.number)
+			if err != nil {
+				n.logger.Debug("Error verifying recorded block hash", zap.String("network", n.Name), zap.Int64("block_number", prev.number), zap.Error(err), zap.String("machine_id", n.machineID))
+				verified = true
+				recorded = append(recorded, prev)
+				continue
+			}
+			recorded = append(recorded, blockHashEntry{number: prev.number, hash: hash})
+		} else if prev.number > entry.number {
+			// The network head moved back, the block will be sampled again
+			continue
+		}
+
+		// Blocks older than a block that didn't change are part of the same chain
+		if hash == prev.hash {
+			verified = true
+			continue
+		}
+		if newestReorged == 0 {
+			newestReorged = prev.number
+		}
+		oldestReorged = prev.number
+	}
+
+	if newestReorged != 0 {
+		depth := newestReorged - oldestReorged + 1
+		n.logger.Warn("Chain reorg detected",
+			zap.String("network", n.Name),
+			zap.Int64("reorg_depth", depth),
+			zap.Int64("oldest_reorged_block_number", oldestReorged),
+			zap.Int64("newest_reorged_block_number", newestReorged),
+			zap.String("machine_id", n.machineID))
+		n.PrometheusClient.HandleReorgMetric(&prom.PromReorgMetricData{
+			Network: n.Name,
+			Depth:   depth,
+		})
+	}
+
+	if len(recorded) > ForkHistorySize {
+		recorded = recorded[:ForkHistorySize]
+	}
+	n.storeCanonicalBlocks(recorded)
+}
+
+// blockHeader holds the fields of a block read by the health checks
+type blockHeader struct {
+	Number string `json:"number"`
+	Hash   string `json:"hash"`
+}
+
+// getBlockHash returns the hash of the block at the given height
+func (n *network) getBlockHash(httpUrl string, headers map[string]string, ac auth.IAuthClient, height int64) (string, error) {
+	block, err := n.getBlock(httpUrl, headers, ac, fmt.Sprintf("0x%x", height))
+	if err != nil {
+		return "", err
+	}
+	if block.Hash == "" {
+		return "", errors.New("Error getting block hash from response")
+	}
+	return block.Hash, nil
+}
+
+// getBlock returns the block at the given block number or tag, without its transactions
+func (n *network) getBlock(httpUrl string, headers map[string]string, ac auth.IAuthClient, blockParam string) (*blockHeader, error) {
+	payload := []byte(fmt.Sprintf(`{"jsonrpc":"2.0","method": "eth_getBlockByNumber","params":["%s", false],"id":1}`, blockParam))
+
+	resBytes, statusCode, err := n.providerClient(httpUrl).Post(httpUrl, headers, payload, ac)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error sending POST request")
+	}
+	if *statusCode != http.StatusOK {
+		return nil, errors.Errorf("unexpected status code %d", *statusCode)
+	}
+
+	var respObject struct {
+		Result *blockHeader `json:"result"`
+	}
+	if err := json.Unmarshal(resBytes, &respObject); err != nil {
+		return nil, errors.Wrap(err, "Error unmarshalling response")
+	}
+	if respObject.Result == nil {
+		return nil, errors.Errorf("block %s not found", blockParam)
+	}
+	return respObject.Result, nil
+}
+
+// loadCanonicalBlocks returns the recorded majority block hashes of the network, newest first
+func (n *network) loadCanonicalBlocks() []blockHashEntry {
+	n.canonicalBlocksMutex.RLock()
+	defer n.canonicalBlocksMutex.RUnlock()
+	return n.canonicalBlocks
+}
+
+// storeCanonicalBlocks replaces the recorded majority block hashes of the network. The slice is never modified in place.
+func (n *network) storeCanonicalBlocks(blocks []blockHashEntry) {
+	n.canonicalBlocksMutex.Lock()
+	defer n.canonicalBlocksMutex.Unlock()
+	n.canonicalBlocks = blocks
+}
+
+// onMinorityFork returns true if the provider disagreed with the majority of its network at the last fork check
+func (p *provider) onMinorityFork() bool {
+	return atomic.LoadInt32(&p.forked) == 1
+}
+
+// swapForked atomically stores whether the provider is on a minority fork, and returns the previous value
+func (p *provider) swapForked(forked bool) bool {
+	var value int32
+	if forked {
+		value = 1
+	}
+	return atomic.SwapInt32(&p.forked, value) == 1
+}
@@ -0,0 +1,157 @@
+package modules
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/DIN-center/din-caddy-plugins/lib/auth"
+	din_http "github.com/DIN-center/din-caddy-plugins/lib/http"
+	prom "github.com/DIN-center/din-caddy-plugins/lib/prometheus"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+// forkTestChain serves the head and the block hashes of each provider URL
+type forkTestChain struct {
+	mu     sync.Mutex
+	heads  map[string]int64
+	hashes map[string]map[int64]string
+}
+
+func (c *forkTestChain) setHash(url string, number int64, hash string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.hashes[url] == nil {
+		c.hashes[url] = make(map[int64]string)
+	}
+	c.hashes[url][number] = hash
+}
+
+func (c *forkTestChain) post(url string, headers map[string]string, payload []byte, ac auth.IAuthClient) ([]byte, *int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	statusCode := http.StatusOK
+	if strings.Contains(string(payload), "eth_getBlockByNumber") {
+		var number int64
+		fmt.Sscanf(string(payload[strings.Index(string(payload), `"0x`)+3:]), "%x", &number)
+		hash, ok := c.hashes[url][number]
+		if !ok {
+			return []byte(`{"jsonrpc": "2.0", "id": 1, "result": null}`), &statusCode, nil
+		}
+		return []byte(`{"jsonrpc": "2.0", "id": 1, "result": {"hash": "` + hash + `"}}`), &statusCode, nil
+	}
+	return []byte(fmt.Sprintf(`{"jsonrpc": "2.0", "id": 1, "result": "0x%x"}`, c.heads[url])), &statusCode, nil
+}
+
+func TestMajorityHash(t *testing.T) {
+	hash, ok := majorityHash(map[string]string{"a": "0x1", "b": "0x1", "c": "0x2"})
+	assert.True(t, ok)
+	assert.Equal(t, "0x1", hash)
+
+	_, ok = majorityHash(map[string]string{"a": "0x1", "b": "0x2"})
+	assert.False(t, ok)
+
+	_, ok = majorityHash(map[string]string{})
+	assert.False(t, ok)
+}
+
+func TestForkHealthCheck(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	mockHttpClient := din_http.NewMockIHTTPClient(mockCtrl)
+	mockPrometheusClient := prom.NewMockIPrometheusClient(mockCtrl)
+
+	chain := &forkTestChain{
+		heads: map[string]int64{
+			"http://provider1": 100,
+			"http://provider2": 100,
+			"http://provider3": 100,
+		},
+		hashes: make(map[string]map[int64]string),
+	}
+	chain.setHash("http://provider1", 98, "0xaa")
+	chain.setHash("http://provider2", 98, "0xaa")
+	chain.setHash("http://provider3", 98, "0xbb")
+
+	mockHttpClient.EXPECT().Post(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(chain.post).AnyTimes()
+	mockPrometheusClient.EXPECT().HandleLatestBlockMetric(gomock.Any()).AnyTimes()
+	mockPrometheusClient.EXPECT().HandleForkMetric(&prom.PromForkMetricData{
+		Network:  "eth",
+		Provider: "provider3",
+	}).Times(1)
+
+	n := newChainIDTestNetwork(t, mockHttpClient, mockPrometheusClient, "http://provider1", "http://provider2", "http://provider3")
+	checkProviders(t, n)
+	n.forkHealthCheck()
+
+	assert.Equal(t, Healthy, n.Providers["provider1"].getHealthStatus())
+	assert.Equal(t, Healthy, n.Providers["provider2"].getHealthStatus())
+	assert.Equal(t, Unhealthy, n.Providers["provider3"].getHealthStatus())
+	assert.Equal(t, []blockHashEntry{{number: 98, hash: "0xaa"}}, n.loadCanonicalBlocks())
+
+	// The provider on the minority fork stays unhealthy even though its block number is in line with the network
+	checkProviders(t, n)
+	assert.Equal(t, Unhealthy, n.Providers["provider3"].getHealthStatus())
+
+	// Once it agrees with the majority it is checked like the others
+	chain.setHash("http://provider3", 98, "0xaa")
+	n.forkHealthCheck()
+	assert.False(t, n.Providers["provider3"].onMinorityFork())
+	checkProviders(t, n)
+	_, ok := n.getCheckedProviderHCList("provider3")
+	assert.True(t, ok)
+}
+
+func TestForkHealthCheckReorg(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	mockHttpClient := din_http.NewMockIHTTPClient(mockCtrl)
+	mockPrometheusClient := prom.NewMockIPrometheusClient(mockCtrl)
+
+	urls := []string{"http://provider1", "http://provider2", "http://provider3"}
+	chain := &forkTestChain{heads: make(map[string]int64), hashes: make(map[string]map[int64]string)}
+	for _, url := range urls {
+		chain.heads[url] = 100
+		chain.setHash(url, 97, "0x97")
+		chain.setHash(url, 98, "0x98")
+		chain.setHash(url, 99, "0x99")
+	}
+
+	mockHttpClient.EXPECT().Post(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(chain.post).AnyTimes()
+	mockPrometheusClient.EXPECT().HandleLatestBlockMetric(gomock.Any()).AnyTimes()
+	mockPrometheusClient.EXPECT().HandleReorgMetric(&prom.PromReorgMetricData{
+		Network: "eth",
+		Depth:   2,
+	}).Times(1)
+
+	n := newChainIDTestNetwork(t, mockHttpClient, mockPrometheusClient, urls...)
+	n.storeCanonicalBlocks([]blockHashEntry{{number: 97, hash: "0x97"}, {number: 96, hash: "0x96"}})
+
+	// The recorded blocks are unchanged, so no reorg is reported
+	checkProviders(t, n)
+	n.forkHealthCheck()
+	assert.Equal(t, []blockHashEntry{{number: 98, hash: "0x98"}, {number: 97, hash: "0x97"}, {number: 96, hash: "0x96"}}, n.loadCanonicalBlocks())
+
+	for _, url := range urls {
+		chain.heads[url] = 101
+	}
+	checkProviders(t, n)
+	n.forkHealthCheck()
+
+	// Blocks 98 to 100 are replaced on every provider, the recorded blocks 98 and 99 changed
+	for _, url := range urls {
+		chain.heads[url] = 102
+		chain.setHash(url, 98, "0x98b")
+		chain.setHash(url, 99, "0x99b")
+		chain.setHash(url, 100, "0x100b")
+	}
+	checkProviders(t, n)
+	n.forkHealthCheck()
+	assert.Equal(t, []blockHashEntry{{number: 100, hash: "0x100b"}, {number: 99, hash: "0x99b"}, {number: 98, hash: "0x98b"}, {number: 97, hash: "0x97"}, {number: 96, hash: "0x96"}}, n.loadCanonicalBlocks())
+	for _, url := range urls {
+		p := n.Providers[strings.TrimPrefix(url, "http://")]
+		assert.False(t, p.onMinorityFork())
+		assert.Equal(t, Healthy, p.getHealthStatus())
+	}
+}
@@ -0,0 +1,248 @@
+package modules
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/DIN-center/din-caddy-plugins/lib/auth"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// startHeadSubscriptions starts tracking the heads of the providers that have a WebSocket URL
+// with a newHeads subscription, until the network is closed
+func (n *network) startHeadSubscriptions() {
+	for name, provider := range n.Providers {
+		if provider.WsUrl != "" {
+			go n.trackHeads(name, provider)
+		}
+	}
+}
+
+// trackHeads keeps a newHeads subscription open to the provider, and records every head it receives.
+// When the subscription drops, the health checks poll the provider again until it is resubscribed,
+// with a delay doubling from HeadSubscriptionRetryDelay up to MaxHeadSubscriptionRetryDelay between attempts.
+func (n *network) trackHeads(providerName string, provider *provider) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-n.quit:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	delay := HeadSubscriptionRetryDelay
+	for {
+		err := n.subscribeHeads(ctx, providerName, provider, func() {
+			delay = HeadSubscriptionRetryDelay
+		})
+		provider.dropHeadSubscription()
+		if ctx.Err() != nil {
+			return
+		}
+		n.logger.Warn("Head subscription dropped, falling back to polling", zap.String("provider", providerName), zap.String("network", n.Name), zap.Error(err), zap.Duration("retry_in", delay), zap.String("machine_id", n.machineID))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay *= 2
+		if delay > MaxHeadSubscriptionRetryDelay {
+			delay = MaxHeadSubscriptionRetryDelay
+		}
+	}
+}
+
+// subscribeHeads opens a newHeads subscription to the provider and records the heads it receives until it fails.
+// onHead is called for every head received.
+func (n *network) subscribeHeads(ctx context.Context, providerName string, provider *provider, onHead func()) error {
+	headers := make(http.Header, len(provider.Headers))
+	for k, v := range provider.Headers {
+		headers.Set(k, v)
+	}
+	options := []rpc.ClientOption{rpc.WithHeaders(headers), rpc.WithWebsocketDialer(headsDialer(provider))}
+	wsUrl := provider.WsUrl
+	if ac := provider.AuthClient(); ac != nil {
+		options = append(options, rpc.WithHTTPAuth(signedHeaders(ac, provider.WsUrl)))
+		// API keys sent in the query string are added to the URL, as the handshake request is built by the rpc client
+		if signer, ok := ac.(urlSigner); ok {
+			signed, err := signer.SignURL(wsUrl)
+			if err != nil {
+				return errors.Wrap(err, "Error signing websocket url")
+			}
+			wsUrl = signed
+		}
+	}
+	client, err := rpc.DialOptions(ctx, wsUrl, options...)
+	if err != nil {
+		return errors.Wrap(err, "Error dialing websocket")
+	}
+	defer client.Close()
+
+	heads := make(chan *blockHeader, HeadSubscriptionBufferSize)
+	sub, err := client.EthSubscribe(ctx, heads, "newHeads")
+	if err != nil {
+		return errors.Wrap(err, "Error subscribing to newHeads")
+	}
+	defer sub.Unsubscribe()
+	n.logger.Info("Subscribed to new heads", zap.String("provider", providerName), zap.String("network", n.Name), zap.String("machine_id", n.machineID))
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-sub.Err():
+			if err == nil {
+				err = errors.New("subscription closed")
+			}
+			return err
+		case head := <-heads:
+			blockNumber, err := strconv.ParseInt(strings.TrimPrefix(head.Number, "0x"), 16, 64)
+			if err != nil {
+				n.logger.Debug("Error parsing new head block number", zap.String("provider", providerName), zap.String("network", n.Name), zap.Error(err), zap.String("machine_id", n.machineID))
+				continue
+			}
+			onHead()
+			n.receiveHead(providerName, provider, blockNumber, time.Now())
+		}
+	}
+}
+
+// receiveHead stores the head received on the newHeads subscription of the provider. The head of the network follows
+// the subscriptions, so that the lag of the providers is measured against it as soon as a new block is seen rather than
+// on the next health check. A head too far from the network doesn't raise it, like on the health checks, so that one
+// faulty provider can't make every other provider lag; the next health check of the provider takes it out instead.
+func (n *network) receiveHead(providerName string, provider *provider, blockNumber int64, receivedAt time.Time) {
+	// The range is taken before the head is stored, so that the head isn't measured against itself
+	inRange := n.headInRange(blockNumber)
+	provider.storeSubscribedHead(blockNumber, receivedAt)
+	if !inRange {
+		n.logger.Debug("New head too far from the network", zap.String("provider", providerName), zap.String("network", n.Name), zap.Int64("block_number", blockNumber), zap.String("machine_id", n.machineID))
+		return
+	}
+	n.raiseLatestBlockNumber(blockNumber)
+}
+
+// headInRange returns whether the block number is within BlockNumberDelta of the 75th percentile block number of the
+// network, as blockNumberDeltaHealthCheck requires of the block numbers of the health checks
+func (n *network) headInRange(blockNumber int64) bool {
+	if len(n.Providers) == 1 {
+		return true
+	}
+	referenceBlock := n.getPercentileBlockNumber(0.75)
+	if referenceBlock == 0 {
+		// Not enough data to make a determination
+		return true
+	}
+	return blockNumber <= referenceBlock+n.BlockNumberDelta && blockNumber >= referenceBlock-n.BlockNumberDelta
+}
+
+// headsDialer returns the WebSocket dialer of the newHeads subscription of the provider,
+// using the TLS settings of the provider transport if it has one
+func headsDialer(provider *provider) websocket.Dialer {
+	dialer := websocket.Dialer{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		Proxy:           http.ProxyFromEnvironment,
+	}
+	if provider.transport != nil {
+		dialer.TLSClientConfig = provider.transport.TLSClientConfig
+	}
+	return dialer
+}
+
+// urlSigner is implemented by the auth clients that may add credentials to the query string of the request URL
+type urlSigner interface {
+	SignURL(rawURL string) (string, error)
+}
+
+// signedHeaders returns the headers the auth client adds to a request to the URL, for the WebSocket handshake
+func signedHeaders(ac auth.IAuthClient, url string) rpc.HTTPAuth {
+	return func(h http.Header) error {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		if err := ac.Sign(req); err != nil {
+			return err
+		}
+		for k, vs := range req.Header {
+			h[k] = vs
+		}
+		return nil
+	}
+}
+
+// providerHead returns the latest block number of the provider, along with the status code and latency of the request.
+// The head from the newHeads subscription of the provider is used if it is live, without sending a request,
+// in which case the latency is 0 so that it is left out of the latency percentiles.
+func (n *network) providerHead(provider *provider) (int64, int, time.Duration, error) {
+	start := time.Now()
+	if n.HCMethod == DefaultHCMethod {
+		if head, ok := provider.liveHead(start, n.headSubscriptionMaxAge(provider)); ok {
+			return head, http.StatusOK, 0, nil
+		}
+	}
+	blockNumber, statusCode, err := n.getLatestBlockNumber(provider.HttpUrl, provider.Headers, provider.AuthClient())
+	return blockNumber, statusCode, time.Since(start), err
+}
+
+// currentHead returns the head of the provider, from its newHeads subscription if it is live,
+// or else from the latest entry of its health check history
+func (n *network) currentHead(provider *provider, entries []healthCheckEntry) (int64, bool) {
+	if head, ok := provider.liveHead(time.Now(), n.headSubscriptionMaxAge(provider)); ok {
+		return head, true
+	}
+	if len(entries) == 0 {
+		return 0, false
+	}
+	return entries[0].blockNumber, true
+}
+
+// headSubscriptionMaxAge returns how long the last head received on a subscription is trusted. It is the health check
+// interval of the provider, or as many estimated block times as tolerated for a stale head if that is longer,
+// so that a subscription that stops delivering heads falls back to polling before the provider is taken for stuck.
+func (n *network) headSubscriptionMaxAge(p *provider) time.Duration {
+	maxAge := n.healthCheckInterval(p)
+	if blockTime := n.loadBlockTime(); blockTime > 0 && n.StaleBlockMultiplier > 0 {
+		if tolerated := blockTime * time.Duration(n.StaleBlockMultiplier); tolerated > maxAge {
+			maxAge = tolerated
+		}
+	}
+	return maxAge
+}
+
+// liveHead returns the head last received on the newHeads subscription of the provider,
+// if the subscription is up and received it less than maxAge ago
+func (p *provider) liveHead(now time.Time, maxAge time.Duration) (int64, bool) {
+	if atomic.LoadInt32(&p.headSubscribed) == 0 {
+		return 0, false
+	}
+	receivedAt := time.Unix(0, atomic.LoadInt64(&p.subscribedHeadAt))
+	if now.Sub(receivedAt) > maxAge {
+		return 0, false
+	}
+	return atomic.LoadInt64(&p.subscribedHead), true
+}
+
+// storeSubscribedHead atomically records a head received on the newHeads subscription of the provider
+func (p *provider) storeSubscribedHead(blockNumber int64, receivedAt time.Time) {
+	atomic.StoreInt64(&p.subscribedHead, blockNumber)
+	atomic.StoreInt64(&p.subscribedHeadAt, receivedAt.UnixNano())
+	atomic.StoreInt32(&p.headSubscribed, 1)
+}
+
+// dropHeadSubscription atomically records that the newHeads subscription of the provider is down,
+// until a head is received on a new one
+func (p *provider) dropHeadSubscription() {
+	atomic.StoreInt32(&p.headSubscribed, 0)
+}
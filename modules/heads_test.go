@@ -0,0 +1,155 @@
+package modules
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	din_http "github.com/DIN-center/din-caddy-plugins/lib/http"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// newHeadsService serves a newHeads subscription notifying the given heads
+type newHeadsService struct {
+	heads []string
+}
+
+func (s *newHeadsService) NewHeads(ctx context.Context) (*rpc.Subscription, error) {
+	notifier, _ := rpc.NotifierFromContext(ctx)
+	sub := notifier.CreateSubscription()
+	go func() {
+		for _, number := range s.heads {
+			notifier.Notify(sub.ID, &blockHeader{Number: number})
+		}
+	}()
+	return sub, nil
+}
+
+func TestTrackHeads(t *testing.T) {
+	server := rpc.NewServer()
+	assert.NoError(t, server.RegisterName("eth", &newHeadsService{heads: []string{"0x10", "0x11"}}))
+	var authorization string
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		server.WebsocketHandler([]string{"*"}).ServeHTTP(w, r)
+	}))
+	defer httpServer.Close()
+	defer server.Stop()
+
+	n := NewNetwork("eth")
+	n.logger = zap.NewNop()
+	p := &provider{
+		host:    "provider1",
+		WsUrl:   "ws" + strings.TrimPrefix(httpServer.URL, "http"),
+		Headers: map[string]string{"Authorization": "Bearer token"},
+	}
+	n.Providers["provider1"] = p
+	n.startHeadSubscriptions()
+	defer n.close()
+
+	assert.Eventually(t, func() bool {
+		head, ok := p.liveHead(time.Now(), time.Minute)
+		return ok && head == 0x11
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "Bearer token", authorization)
+	assert.Equal(t, int64(0x11), n.loadLatestBlockNumber())
+}
+
+func TestLiveHeadLag(t *testing.T) {
+	n := NewNetwork("eth")
+	n.logger = zap.NewNop()
+	n.HCInterval = 5
+	n.BlockLagLimit = 5
+	now := time.Now()
+	checkedAt := now.Add(-time.Second)
+	p1 := &provider{host: "provider1"}
+	p1.markHealthy(1)
+	p2 := &provider{host: "provider2"}
+	p2.markHealthy(1)
+	n.Providers = map[string]*provider{"provider1": p1, "provider2": p2}
+	n.CheckedProviders = map[string][]healthCheckEntry{
+		"provider1": {{blockNumber: 100, timestamp: &checkedAt}},
+		"provider2": {{blockNumber: 100, timestamp: &checkedAt}},
+	}
+	n.storeLatestBlockNumber(100)
+
+	// The live head of provider1 is taken over its last health check, and provider2 lags behind it
+	p1.storeSubscribedHead(110, now)
+	n.raiseLatestBlockNumber(110)
+	assert.Equal(t, int64(110), n.getPercentileBlockNumber(1))
+	n.evaluateCheckedProviders(now)
+	assert.True(t, p1.Healthy())
+	assert.Equal(t, Warning, p2.getHealthStatus())
+}
+
+func TestReceiveHeadOutOfRange(t *testing.T) {
+	n := NewNetwork("eth")
+	n.logger = zap.NewNop()
+	n.BlockNumberDelta = 10
+	checkedAt := time.Now().Add(-time.Second)
+	n.Providers = map[string]*provider{}
+	n.CheckedProviders = map[string][]healthCheckEntry{}
+	for _, name := range []string{"provider1", "provider2", "provider3"} {
+		n.Providers[name] = &provider{host: name}
+		n.CheckedProviders[name] = []healthCheckEntry{{blockNumber: 100, timestamp: &checkedAt}}
+	}
+	n.storeLatestBlockNumber(100)
+
+	// A head far ahead of the network is kept as the head of the provider, but doesn't raise the head of the network
+	p1 := n.Providers["provider1"]
+	n.receiveHead("provider1", p1, 1_000_000, time.Now())
+	head, ok := p1.liveHead(time.Now(), time.Minute)
+	assert.True(t, ok)
+	assert.Equal(t, int64(1_000_000), head)
+	assert.Equal(t, int64(100), n.loadLatestBlockNumber())
+
+	// A head within range raises it
+	n.receiveHead("provider2", n.Providers["provider2"], 105, time.Now())
+	assert.Equal(t, int64(105), n.loadLatestBlockNumber())
+}
+
+func TestProviderHead(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockHttpClient := din_http.NewMockIHTTPClient(ctrl)
+
+	n := NewNetwork("eth")
+	n.HttpClient = mockHttpClient
+	n.HCInterval = 5
+	p := &provider{HttpUrl: "http://provider1"}
+
+	// A live head is used without polling
+	p.storeSubscribedHead(200, time.Now())
+	head, statusCode, latency, err := n.providerHead(p)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(200), head)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, time.Duration(0), latency)
+
+	// A head older than the health check interval, or from a dropped subscription, falls back to polling
+	okStatus := http.StatusOK
+	mockHttpClient.EXPECT().Post("http://provider1", gomock.Any(), gomock.Any(), gomock.Any()).Return([]byte(`{"jsonrpc":"2.0","id":1,"result":"0xc9"}`), &okStatus, nil).Times(2)
+	p.storeSubscribedHead(200, time.Now().Add(-10*time.Second))
+	head, _, _, err = n.providerHead(p)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(201), head)
+
+	p.storeSubscribedHead(200, time.Now())
+	p.dropHeadSubscription()
+	head, _, _, err = n.providerHead(p)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(201), head)
+
+	// The head is trusted for as long as a stale head is tolerated
+	n.storeBlockTime(12 * time.Second)
+	p.storeSubscribedHead(200, time.Now().Add(-10*time.Second))
+	head, _, _, err = n.providerHead(p)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(200), head)
+}
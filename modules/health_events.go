@@ -0,0 +1,116 @@
+package modules
+
+import (
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// HealthChangedEvent is the name of the Caddy event emitted when the health status of a provider changes
+const HealthChangedEvent = "din.provider_health_changed"
+
+// Reasons for a provider to move to Warning or Unhealthy, reported with health transitions
+const (
+	HealthReasonBlockNumberError    = "block_number_error"
+	HealthReasonErrorStatusCode     = "error_status_code"
+	HealthReasonRateLimited         = "rate_limited"
+	HealthReasonProbeFailure        = "probe_failure"
+	HealthReasonAheadOfNetwork      = "ahead_of_network"
+	HealthReasonBehindNetwork       = "behind_network"
+	HealthReasonLagging             = "lagging"
+	HealthReasonStaleHead           = "stale_head"
+	HealthReasonSlow                = "slow"
+	HealthReasonChainIDMismatch     = "chain_id_mismatch"
+	HealthReasonFork                = "fork"
+	HealthReasonFinalizedRegression = "finalized_regression"
+	HealthReasonFinalizedLag        = "finalized_lag"
+	HealthReasonAuthUnavailable     = "auth_unavailable"
+	HealthReasonRecovered           = "recovered"
+)
+
+// healthEvent describes a change of the health status of a provider
+type healthEvent struct {
+	Event              string    `json:"event"`
+	Network            string    `json:"network"`
+	Provider           string    `json:"provider"`
+	OldStatus          string    `json:"old_status"`
+	NewStatus          string    `json:"new_status"`
+	Reason             string    `json:"reason"`
+	BlockNumber        int64     `json:"block_number"`
+	NetworkBlockNumber int64     `json:"network_block_number"`
+	Timestamp          time.Time `json:"timestamp"`
+	MachineID          string    `json:"machine_id"`
+}
+
+// data returns the event metadata passed to Caddy event handlers
+func (e *healthEvent) data() map[string]any {
+	return map[string]any{
+		"network":              e.Network,
+		"provider":             e.Provider,
+		"old_status":           e.OldStatus,
+		"new_status":           e.NewStatus,
+		"reason":               e.Reason,
+		"block_number":         e.BlockNumber,
+		"network_block_number": e.NetworkBlockNumber,
+	}
+}
+
+// healthEventSink receives the health transitions of the providers of a network
+type healthEventSink interface {
+	emitHealthEvent(event *healthEvent)
+}
+
+// reportHealthTransitions logs and emits a health event for every provider whose status differs from the status last
+// reported for it. Each transition is reported once, even when the checks of a provider and of its network report concurrently.
+func (n *network) reportHealthTransitions() {
+	for name, provider := range n.Providers {
+		newStatus := provider.getHealthStatus()
+		oldStatus := provider.swapReportedHealthStatus(newStatus)
+		if oldStatus == newStatus {
+			continue
+		}
+
+		reason := HealthReasonRecovered
+		if newStatus != Healthy {
+			reason = provider.getHealthReason()
+		}
+		var blockNumber int64
+		if entries, ok := n.getCheckedProviderHCList(provider.host); ok && len(entries) > 0 {
+			blockNumber = entries[0].blockNumber
+		}
+
+		n.logger.Info("Provider health changed",
+			zap.String("provider", name),
+			zap.String("network", n.Name),
+			zap.String("old_status", oldStatus.String()),
+			zap.String("new_status", newStatus.String()),
+			zap.String("reason", reason),
+			zap.String("machine_id", n.machineID))
+		if n.healthEvents == nil {
+			continue
+		}
+		n.healthEvents.emitHealthEvent(&healthEvent{
+			Event:              HealthChangedEvent,
+			Network:            n.Name,
+			Provider:           provider.host,
+			OldStatus:          oldStatus.String(),
+			NewStatus:          newStatus.String(),
+			Reason:             reason,
+			BlockNumber:        blockNumber,
+			NetworkBlockNumber: n.loadLatestBlockNumber(),
+			Timestamp:          time.Now().UTC(),
+			MachineID:          n.machineID,
+		})
+	}
+}
+
+// loadReportedHealthStatus atomically loads the health status last reported for the provider
+func (p *provider) loadReportedHealthStatus() HealthStatus {
+	return HealthStatus(atomic.LoadInt32((*int32)(&p.reportedHealthStatus)))
+}
+
+// swapReportedHealthStatus atomically records the health status reported for the provider, and returns the previous one
+func (p *provider) swapReportedHealthStatus(status HealthStatus) HealthStatus {
+	return HealthStatus(atomic.SwapInt32((*int32)(&p.reportedHealthStatus), int32(status)))
+}
@@ -0,0 +1,133 @@
+package modules
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// recordingEventSink records the health events emitted to it
+type recordingEventSink struct {
+	events []*healthEvent
+}
+
+func (s *recordingEventSink) emitHealthEvent(event *healthEvent) {
+	s.events = append(s.events, event)
+}
+
+func TestReportHealthTransitions(t *testing.T) {
+	sink := &recordingEventSink{}
+	n := NewNetwork("eth")
+	n.logger = zap.NewNop()
+	n.healthEvents = sink
+	n.Providers["provider1"] = &provider{host: "provider1"}
+	n.Providers["provider2"] = &provider{host: "provider2", healthStatus: Warning, reportedHealthStatus: Warning}
+	n.Providers["provider3"] = &provider{host: "provider3"}
+	n.CheckedProviders["provider1"] = []healthCheckEntry{{blockNumber: 90}}
+	n.storeLatestBlockNumber(100)
+
+	n.Providers["provider1"].markUnhealthy(HealthReasonStaleHead)
+	n.Providers["provider2"].markHealthy(DefaultHCThreshold)
+	// Flapping within a round is not reported
+	n.Providers["provider3"].markWarning(HealthReasonSlow)
+	n.Providers["provider3"].markHealthy(DefaultHCThreshold)
+	n.reportHealthTransitions()
+
+	assert.Equal(t, 2, len(sink.events))
+	byProvider := make(map[string]*healthEvent)
+	for _, event := range sink.events {
+		byProvider[event.Provider] = event
+	}
+
+	unhealthy := byProvider["provider1"]
+	assert.Equal(t, HealthChangedEvent, unhealthy.Event)
+	assert.Equal(t, "eth", unhealthy.Network)
+	assert.Equal(t, "Healthy", unhealthy.OldStatus)
+	assert.Equal(t, "Unhealthy", unhealthy.NewStatus)
+	assert.Equal(t, HealthReasonStaleHead, unhealthy.Reason)
+	assert.Equal(t, int64(90), unhealthy.BlockNumber)
+	assert.Equal(t, int64(100), unhealthy.NetworkBlockNumber)
+
+	recovered := byProvider["provider2"]
+	assert.Equal(t, "Warning", recovered.OldStatus)
+	assert.Equal(t, "Healthy", recovered.NewStatus)
+	assert.Equal(t, HealthReasonRecovered, recovered.Reason)
+}
+
+func TestHealthWebhookDelivery(t *testing.T) {
+	var attempts int32
+	var mu sync.Mutex
+	var received []healthEvent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+		// The first attempt fails and is retried
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		var event healthEvent
+		assert.NoError(t, json.Unmarshal(body, &event))
+		mu.Lock()
+		received = append(received, event)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	t.Setenv("DIN_TEST_WEBHOOK_TOKEN", "token")
+	webhook := &healthWebhook{URL: server.URL, Headers: map[string]string{"Authorization": "Bearer {env.DIN_TEST_WEBHOOK_TOKEN}"}}
+	assert.NoError(t, webhook.validate())
+	assert.NoError(t, webhook.provision(zap.NewNop()))
+	assert.Equal(t, DefaultHealthWebhookRetries, webhook.retries)
+	webhook.backoff = time.Millisecond
+	webhook.start()
+	defer webhook.stop()
+
+	webhook.enqueue(&healthEvent{Event: HealthChangedEvent, Network: "eth", Provider: "provider1", OldStatus: "Healthy", NewStatus: "Unhealthy", Reason: HealthReasonFork})
+
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(received) == 1
+	}, time.Second, 5*time.Millisecond)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&attempts))
+	assert.Equal(t, "provider1", received[0].Provider)
+	assert.Equal(t, HealthReasonFork, received[0].Reason)
+}
+
+func TestHealthWebhookWithoutRetries(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	// retries 0 makes a single delivery attempt rather than the default retries
+	noRetries := 0
+	webhook := &healthWebhook{URL: server.URL, Retries: &noRetries}
+	assert.NoError(t, webhook.validate())
+	assert.NoError(t, webhook.provision(zap.NewNop()))
+	webhook.backoff = time.Millisecond
+	defer webhook.stop()
+
+	assert.Error(t, webhook.deliver(&healthEvent{Event: HealthChangedEvent, Network: "eth", Provider: "provider1"}))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&attempts))
+}
+
+func TestHealthWebhookProvision(t *testing.T) {
+	negativeRetries := -1
+	assert.Error(t, (&healthWebhook{}).validate())
+	assert.Error(t, (&healthWebhook{URL: "http://localhost", Retries: &negativeRetries}).validate())
+	assert.Error(t, (&healthWebhook{URL: "ftp://localhost"}).provision(zap.NewNop()))
+	assert.Error(t, (&healthWebhook{URL: "{env.DIN_TEST_WEBHOOK_UNSET}"}).provision(zap.NewNop()))
+}
@@ -0,0 +1,203 @@
+package modules
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// healthWebhook posts the health transitions of the providers as JSON to an HTTP endpoint.
+// Events are delivered in order by a background worker, and failed deliveries are retried with exponential backoff.
+type healthWebhook struct {
+	// The URL the events are posted to. Placeholders such as {env.DIN_WEBHOOK_URL} are replaced at provision time.
+	URL string `json:"url"`
+	// Headers added to every request, for example for authentication. Placeholders in values are replaced at provision time.
+	Headers map[string]string `json:"headers,omitempty"`
+	// The timeout of a single delivery attempt. Defaults to 5s.
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+	// The number of times a failed delivery is retried. Defaults to 3, 0 disables the retries.
+	Retries *int `json:"retries,omitempty"`
+
+	url     string
+	headers map[string]string
+	retries int
+	client  *http.Client
+	queue   chan *healthEvent
+	quit    chan struct{}
+	backoff time.Duration
+	logger  *zap.Logger
+}
+
+// validate checks the webhook configuration
+func (w *healthWebhook) validate() error {
+	if w.URL == "" {
+		return fmt.Errorf("url must be set")
+	}
+	if w.Timeout < 0 {
+		return fmt.Errorf("timeout must not be negative, got %s", time.Duration(w.Timeout))
+	}
+	if w.Retries != nil && *w.Retries < 0 {
+		return fmt.Errorf("retries must not be negative, got %d", *w.Retries)
+	}
+	return nil
+}
+
+// provision resolves the placeholders of the webhook configuration and sets its defaults
+func (w *healthWebhook) provision(logger *zap.Logger) error {
+	repl := caddy.NewReplacer()
+	w.url = repl.ReplaceAll(w.URL, "")
+	parsed, err := url.Parse(w.url)
+	if err != nil || parsed.Host == "" || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+		return fmt.Errorf("url must be an http(s) url, got %q", w.URL)
+	}
+	w.headers = make(map[string]string, len(w.Headers))
+	for k, v := range w.Headers {
+		w.headers[k] = repl.ReplaceAll(v, "")
+	}
+
+	if w.Timeout == 0 {
+		w.Timeout = caddy.Duration(DefaultHealthWebhookTimeout)
+	}
+	w.retries = DefaultHealthWebhookRetries
+	if w.Retries != nil {
+		w.retries = *w.Retries
+	}
+	w.client = &http.Client{Timeout: time.Duration(w.Timeout)}
+	w.queue = make(chan *healthEvent, HealthWebhookQueueSize)
+	w.quit = make(chan struct{})
+	w.backoff = HealthWebhookRetryBackoff
+	w.logger = logger
+	return nil
+}
+
+// start delivers the queued events until stop is called
+func (w *healthWebhook) start() {
+	go func() {
+		for {
+			select {
+			case <-w.quit:
+				return
+			case event := <-w.queue:
+				if err := w.deliver(event); err != nil {
+					w.logger.Warn("Failed to deliver health event to webhook", zap.String("network", event.Network), zap.String("provider", event.Provider), zap.Error(err), zap.String("machine_id", event.MachineID))
+				}
+			}
+		}
+	}()
+}
+
+// stop stops the delivery of events. Events still queued are dropped.
+func (w *healthWebhook) stop() {
+	if w.quit != nil {
+		close(w.quit)
+	}
+}
+
+// enqueue queues an event for delivery without blocking the health checks. Events are dropped if the queue is full.
+func (w *healthWebhook) enqueue(event *healthEvent) {
+	select {
+	case w.queue <- event:
+	default:
+		w.logger.Warn("Health webhook queue is full, dropping event", zap.String("network", event.Network), zap.String("provider", event.Provider), zap.String("machine_id", event.MachineID))
+	}
+}
+
+// deliver posts the event to the webhook, retrying failed attempts with exponential backoff
+func (w *healthWebhook) deliver(event *healthEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return errors.Wrap(err, "Error marshalling health event")
+	}
+
+	backoff := w.backoff
+	for attempt := 0; ; attempt++ {
+		err = w.post(payload)
+		if err == nil || attempt >= w.retries {
+			return err
+		}
+		select {
+		case <-w.quit:
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// post sends a single delivery attempt
+func (w *healthWebhook) post(payload []byte) error {
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(payload))
+	if err != nil {
+		return errors.Wrap(err, "Error creating request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range w.headers {
+		req.Header.Set(k, v)
+	}
+	res, err := w.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "Error sending POST request")
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return errors.Errorf("unexpected status code %d", res.StatusCode)
+	}
+	return nil
+}
+
+// parseHealthWebhook parses a health_webhook block:
+//
+//	health_webhook https://alerts.example.com/din {
+//		header Authorization "Bearer {env.DIN_WEBHOOK_TOKEN}"
+//		timeout 5s
+//		retries 3
+//	}
+func parseHealthWebhook(dispenser *caddyfile.Dispenser) (*healthWebhook, error) {
+	webhook := &healthWebhook{}
+	if !dispenser.Args(&webhook.URL) {
+		return nil, dispenser.ArgErr()
+	}
+	for nesting := dispenser.Nesting(); dispenser.NextBlock(nesting); {
+		switch dispenser.Val() {
+		case "header":
+			var k, v string
+			if !dispenser.Args(&k, &v) {
+				return nil, dispenser.Errf("header should have key and value")
+			}
+			if webhook.Headers == nil {
+				webhook.Headers = make(map[string]string)
+			}
+			webhook.Headers[k] = v
+		case "timeout":
+			if !dispenser.NextArg() {
+				return nil, dispenser.ArgErr()
+			}
+			timeout, err := caddy.ParseDuration(dispenser.Val())
+			if err != nil {
+				return nil, dispenser.Errf("invalid timeout: %v", err)
+			}
+			webhook.Timeout = caddy.Duration(timeout)
+		case "retries":
+			if !dispenser.NextArg() {
+				return nil, dispenser.ArgErr()
+			}
+			retries, err := strconv.Atoi(dispenser.Val())
+			if err != nil {
+				return nil, dispenser.Errf("Error converting string to int: %v", err)
+			}
+			webhook.Retries = &retries
+		default:
+			return nil, dispenser.Errf("unknown health_webhook option %s", dispenser.Val())
+		}
+	}
+	return webhook, nil
+}
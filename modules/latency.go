@@ -0,0 +1,130 @@
+package modules
+
+import (
+	"math/rand"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"go.uber.org/zap"
+)
+
+// latencyHealthCheck updates the rolling p50 and p95 health check latencies of a provider from its health check history.
+// If the network has a latency threshold and the p95 latency of the provider exceeds it, HealthReasonSlow is returned
+// for the provider to be moved to Warning, so that a single slow health check doesn't demote a provider,
+// but a provider that is slow more often does. It returns an empty string otherwise.
+func (n *network) latencyHealthCheck(providerName string, provider *provider) string {
+	entries, ok := n.getCheckedProviderHCList(provider.host)
+	if !ok {
+		return ""
+	}
+	p50, p95 := latencyPercentiles(entries)
+	provider.storeLatency(p50, p95)
+
+	if n.LatencyThresholdMs == 0 {
+		return ""
+	}
+	threshold := time.Duration(n.LatencyThresholdMs) * time.Millisecond
+	if p95 > threshold {
+		n.logger.Warn("Provider health checks are slow",
+			zap.String("provider", providerName),
+			zap.String("network", n.Name),
+			zap.String("reason", HealthReasonSlow),
+			zap.Duration("latency_p50", p50),
+			zap.Duration("latency_p95", p95),
+			zap.Duration("latency_threshold", threshold),
+			zap.String("machine_id", n.machineID))
+		return HealthReasonSlow
+	}
+	return ""
+}
+
+// latencyPercentiles returns the p50 and p95 latencies of the health check entries that recorded a latency
+func latencyPercentiles(entries []healthCheckEntry) (time.Duration, time.Duration) {
+	latencies := make([]time.Duration, 0, len(entries))
+	for _, entry := range entries {
+		if entry.latency > 0 {
+			latencies = append(latencies, entry.latency)
+		}
+	}
+	if len(latencies) == 0 {
+		return 0, 0
+	}
+	sort.Slice(latencies, func(i, j int) bool {
+		return latencies[i] < latencies[j]
+	})
+	percentile := func(p float64) time.Duration {
+		return latencies[int(float64(len(latencies)-1)*p)]
+	}
+	return percentile(0.5), percentile(0.95)
+}
+
+// LatencyP50 returns the rolling median health check latency of the provider, 0 if not known
+func (p *provider) LatencyP50() time.Duration {
+	return time.Duration(atomic.LoadInt64(&p.latencyP50))
+}
+
+// LatencyP95 returns the rolling 95th percentile health check latency of the provider, 0 if not known
+func (p *provider) LatencyP95() time.Duration {
+	return time.Duration(atomic.LoadInt64(&p.latencyP95))
+}
+
+// storeLatency atomically stores the rolling health check latencies of the provider
+func (p *provider) storeLatency(p50, p95 time.Duration) {
+	atomic.StoreInt64(&p.latencyP50, int64(p50))
+	atomic.StoreInt64(&p.latencyP95, int64(p95))
+}
+
+// latencyWeightedSelection picks an available upstream of the pool at random, weighted by the inverse of the
+// median health check latency of its provider, so that slow providers get less traffic than fast ones.
+// Upstreams of providers without latency data are weighted like the average provider.
+// It returns nil if no upstream of the pool is available.
+func latencyWeightedSelection(pool reverseproxy.UpstreamPool, providers map[string]*provider) *reverseproxy.Upstream {
+	latencies := make(map[*reverseproxy.Upstream]time.Duration, len(providers))
+	for _, p := range providers {
+		latencies[p.upstream] = p.LatencyP50()
+	}
+
+	candidates := make([]*reverseproxy.Upstream, 0, len(pool))
+	weights := make([]float64, 0, len(pool))
+	var knownWeight float64
+	known := 0
+	for _, upstream := range pool {
+		if !upstream.Available() {
+			continue
+		}
+		var weight float64
+		if latency := latencies[upstream]; latency > 0 {
+			weight = 1 / latency.Seconds()
+			knownWeight += weight
+			known++
+		}
+		candidates = append(candidates, upstream)
+		weights = append(weights, weight)
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	defaultWeight := 1.0
+	if known > 0 {
+		defaultWeight = knownWeight / float64(known)
+	}
+	var total float64
+	for i := range weights {
+		if weights[i] == 0 {
+			weights[i] = defaultWeight
+		}
+		total += weights[i]
+	}
+
+	pick := rand.Float64() * total
+	for i, weight := range weights {
+		if pick < weight {
+			return candidates[i]
+		}
+		pick -= weight
+	}
+	return candidates[len(candidates)-1]
+}
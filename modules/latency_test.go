@@ -0,0 +1,131 @@
+package modules
+
+import (
+	"testing"
+	"time"
+
+	din_http "github.com/DIN-center/din-caddy-plugins/lib/http"
+	prom "github.com/DIN-center/din-caddy-plugins/lib/prometheus"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLatencyPercentiles(t *testing.T) {
+	entries := make([]healthCheckEntry, 0, 10)
+	for i := 1; i <= 10; i++ {
+		entries = append(entries, healthCheckEntry{blockNumber: int64(i), latency: time.Duration(i) * 10 * time.Millisecond})
+	}
+	// Entries recorded without a latency are left out
+	entries = append(entries, healthCheckEntry{blockNumber: 11})
+
+	p50, p95 := latencyPercentiles(entries)
+	assert.Equal(t, 50*time.Millisecond, p50)
+	assert.Equal(t, 90*time.Millisecond, p95)
+
+	p50, p95 = latencyPercentiles(nil)
+	assert.Equal(t, time.Duration(0), p50)
+	assert.Equal(t, time.Duration(0), p95)
+}
+
+func TestLatencyHealthCheck(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	n := newChainIDTestNetwork(t, din_http.NewMockIHTTPClient(mockCtrl), prom.NewMockIPrometheusClient(mockCtrl), "http://provider1", "http://provider2")
+	n.LatencyThresholdMs = 200
+
+	fast, slow := n.Providers["provider1"], n.Providers["provider2"]
+	for i := 0; i < 10; i++ {
+		now := time.Now()
+		n.addHealthCheckToCheckedProviderList(fast.host, healthCheckEntry{blockNumber: int64(i), timestamp: &now, latency: 50 * time.Millisecond})
+		latency := 50 * time.Millisecond
+		if i%3 == 0 {
+			latency = 400 * time.Millisecond
+		}
+		n.addHealthCheckToCheckedProviderList(slow.host, healthCheckEntry{blockNumber: int64(i), timestamp: &now, latency: latency})
+	}
+
+	assert.Equal(t, "", n.latencyHealthCheck("provider1", fast))
+	assert.Equal(t, HealthReasonSlow, n.latencyHealthCheck("provider2", slow))
+
+	assert.Equal(t, 50*time.Millisecond, fast.LatencyP95())
+	assert.Equal(t, 50*time.Millisecond, slow.LatencyP50())
+	assert.Equal(t, 400*time.Millisecond, slow.LatencyP95())
+
+	// Without a threshold the latency is tracked, but providers are not demoted
+	n.LatencyThresholdMs = 0
+	assert.Equal(t, "", n.latencyHealthCheck("provider2", slow))
+}
+
+// TestHealthCheckSingleTransition checks that a slow provider stays in Warning through its health check,
+// rather than being marked Healthy by the block number checks and moved back to Warning by the latency check
+func TestHealthCheckSingleTransition(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	mockHttpClient := din_http.NewMockIHTTPClient(mockCtrl)
+	mockPrometheusClient := prom.NewMockIPrometheusClient(mockCtrl)
+	mockHttpClient.EXPECT().Post(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(chainIDResponses(nil, nil)).AnyTimes()
+	mockPrometheusClient.EXPECT().HandleLatestBlockMetric(gomock.Any()).AnyTimes()
+	n := newChainIDTestNetwork(t, mockHttpClient, mockPrometheusClient, "http://provider1")
+	n.LatencyThresholdMs = 200
+
+	slow := n.Providers["provider1"]
+	for i := 0; i < 9; i++ {
+		now := time.Now()
+		n.addHealthCheckToCheckedProviderList(slow.host, healthCheckEntry{blockNumber: 0x4c4b40, timestamp: &now, latency: 400 * time.Millisecond})
+	}
+	slow.markWarning(HealthReasonSlow)
+
+	// Watch the status of the provider while it is checked
+	done := make(chan struct{})
+	sawHealthy := make(chan bool)
+	go func() {
+		seen := false
+		for {
+			select {
+			case <-done:
+				sawHealthy <- seen
+				return
+			default:
+				seen = seen || slow.Healthy()
+			}
+		}
+	}()
+	// The fast answers of the mock only bring the p95 latency under the threshold after a few health checks
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, healthCheckSucceeded, n.checkProvider("provider1", slow))
+	}
+	close(done)
+	assert.False(t, <-sawHealthy)
+	assert.Equal(t, Warning, slow.getHealthStatus())
+	assert.Equal(t, HealthReasonSlow, slow.getHealthReason())
+}
+
+func TestLatencyWeightedSelection(t *testing.T) {
+	fastUpstream := &reverseproxy.Upstream{Dial: "localhost:8000"}
+	slowUpstream := &reverseproxy.Upstream{Dial: "localhost:8001"}
+	newUpstream := &reverseproxy.Upstream{Dial: "localhost:8002"}
+	providers := map[string]*provider{
+		"localhost:8000": {upstream: fastUpstream, latencyP50: int64(10 * time.Millisecond)},
+		"localhost:8001": {upstream: slowUpstream, latencyP50: int64(90 * time.Millisecond)},
+	}
+	pool := reverseproxy.UpstreamPool{fastUpstream, slowUpstream}
+
+	counts := make(map[*reverseproxy.Upstream]int)
+	for i := 0; i < 2000; i++ {
+		counts[latencyWeightedSelection(pool, providers)]++
+	}
+	assert.Equal(t, 2000, counts[fastUpstream]+counts[slowUpstream])
+	// The fast provider gets about 90% of the traffic
+	assert.Greater(t, counts[fastUpstream], counts[slowUpstream]*4)
+	assert.Greater(t, counts[slowUpstream], 0)
+
+	// A provider without latency data is weighted like the average provider
+	providers["localhost:8002"] = &provider{upstream: newUpstream}
+	counts = make(map[*reverseproxy.Upstream]int)
+	for i := 0; i < 2000; i++ {
+		counts[latencyWeightedSelection(append(pool, newUpstream), providers)]++
+	}
+	assert.Greater(t, counts[newUpstream], counts[slowUpstream])
+	assert.Greater(t, counts[fastUpstream], counts[newUpstream])
+
+	assert.Nil(t, latencyWeightedSelection(reverseproxy.UpstreamPool{}, providers))
+}
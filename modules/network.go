@@ -7,6 +7,7 @@ import (
 	"sort"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/DIN-center/din-caddy-plugins/lib/auth"
@@ -17,117 +18,317 @@ import (
 )
 
 type network struct {
-	Name              string
+	// The name of the network, taken from its key in the din handler's networks map
+	Name              string `json:"-"`
 	quit              chan struct{}
 	latestBlockNumber int64
-	HttpClient        din_http.IHTTPClient
-	PrometheusClient  prom.IPrometheusClient
+	HttpClient        din_http.IHTTPClient   `json:"-"`
+	PrometheusClient  prom.IPrometheusClient `json:"-"`
 	logger            *zap.Logger
 	machineID         string
+	// Receives the health transitions of the providers, nil if they are only logged
+	healthEvents healthEventSink
 
 	// internal health check values
 	healthCheckListMutex sync.RWMutex
-	HCThreshold          int
-	CheckedProviders     map[string][]healthCheckEntry
+	// The number of consecutive failed health checks before a provider is marked unhealthy
+	HCThreshold      int                           `json:"healthcheck_threshold"`
+	CheckedProviders map[string][]healthCheckEntry `json:"-"`
 
 	// Registry configuration values
-	Providers               map[string]*provider `json:"providers"`
-	Methods                 []*string            `json:"methods"`
-	HCMethod                string               `json:"healthcheck_method"`
-	HCInterval              int                  `json:"healthcheck_interval_seconds"`
-	BlockLagLimit           int64                `json:"healthcheck_blocklag_limit"`
-	BlockNumberDelta        int64                `json:"block_number_delta"`
-	MaxRequestPayloadSizeKB int64                `json:"max_request_payload_size_kb"`
-	RequestAttemptCount     int                  `json:"request_attempt_count"`
+	// The providers of the network, keyed by the host of their URL
+	Providers map[string]*provider `json:"providers"`
+	// The JSON-RPC methods allowed on the network
+	Methods []*string `json:"methods"`
+	// The JSON-RPC method used to poll the latest block number of each provider
+	HCMethod string `json:"healthcheck_method"`
+	// The interval in seconds between health checks
+	HCInterval int `json:"healthcheck_interval_seconds"`
+	// The number of blocks a provider can lag behind the network before it is marked unhealthy
+	BlockLagLimit int64 `json:"healthcheck_blocklag_limit"`
+	// The number of blocks a provider can be ahead of or behind the 75th percentile of the network before it is marked unhealthy
+	BlockNumberDelta int64 `json:"block_number_delta"`
+	// The maximum size of a request body in KB
+	MaxRequestPayloadSizeKB int64 `json:"max_request_payload_size_kb"`
+	// The number of times a request is attempted before the failure is returned to the client
+	RequestAttemptCount int `json:"request_attempt_count"`
+	// The number of blocks the finalized head of a provider can lag behind the finalized head of the network before it is marked unhealthy
+	FinalizedLagLimit int64 `json:"finalized_lag_limit"`
+	// The p95 health check latency in milliseconds above which a provider is moved to Warning. 0 disables the check.
+	LatencyThresholdMs int64 `json:"healthcheck_latency_threshold_ms,omitempty"`
+	// A provider whose head hasn't advanced for this many expected block times while the network advances is moved to Warning.
+	// 0 disables the check.
+	StaleBlockMultiplier int `json:"stale_block_multiplier"`
+	// Additional JSON-RPC probes sent to every provider on each health check
+	Probes []*healthProbe `json:"probes,omitempty"`
+	// The number of blocks below the median head of the network at which block hashes are compared by the fork check,
+	// so that providers that haven't imported the newest blocks yet are not taken for a fork
+	ForkCheckOffset int64 `json:"fork_check_offset"`
+	// The chain id the providers are expected to report. If not set, the chain id reported by a majority of the providers is used.
+	ChainID uint64 `json:"chain_id,omitempty"`
+
+	// The chain id learned from the providers when ChainID is not set
+	expectedChainID uint64
+
+	// The block hashes the majority of the providers reported at previous fork checks, newest first
+	canonicalBlocksMutex sync.RWMutex
+	canonicalBlocks      []blockHashEntry
+
+	// The safe and finalized heads of the network, the median of the heads reported by its providers
+	safeBlockNumber      int64
+	finalizedBlockNumber int64
+
+	// The expected time between blocks in nanoseconds, estimated from the health check history
+	blockTime int64
+
+	// 1 while the network-wide health checks of a round are running, and when the last round started
+	roundRunning int32
+	lastRoundAt  time.Time
 }
 
 // NewNetwork creates a new network with the given name
 // Only put values in the struct definition that are constant
 // Don't kick off any Background processes here
 func NewNetwork(name string) *network {
-	return &network{
-		Name: name,
-		// Default health check values, to be overridden if specified in the Caddyfile
-		HCMethod:                DefaultHCMethod,
-		HCThreshold:             DefaultHCThreshold,
-		HCInterval:              DefaultHCInterval,
-		BlockLagLimit:           DefaultBlockLagLimit,
-		BlockNumberDelta:        DefaultBlockNumberDelta,
-		MaxRequestPayloadSizeKB: DefaultMaxRequestPayloadSizeKB,
-		RequestAttemptCount:     DefaultRequestAttemptCount,
+	n := &network{Name: name}
+	n.setDefaults()
+	return n
+}
 
-		CheckedProviders: make(map[string][]healthCheckEntry),
-		Providers:        make(map[string]*provider),
+// setDefaults sets the default values of a network, to be overridden if specified in the Caddyfile or JSON config
+func (n *network) setDefaults() {
+	n.HCMethod = DefaultHCMethod
+	n.HCThreshold = DefaultHCThreshold
+	n.HCInterval = DefaultHCInterval
+	n.BlockLagLimit = DefaultBlockLagLimit
+	n.BlockNumberDelta = DefaultBlockNumberDelta
+	n.MaxRequestPayloadSizeKB = DefaultMaxRequestPayloadSizeKB
+	n.RequestAttemptCount = DefaultRequestAttemptCount
+	n.FinalizedLagLimit = DefaultFinalizedLagLimit
+	n.StaleBlockMultiplier = DefaultStaleBlockMultiplier
+	n.ForkCheckOffset = DefaultForkCheckOffset
+
+	n.CheckedProviders = make(map[string][]healthCheckEntry)
+	n.Providers = make(map[string]*provider)
+	n.quit = make(chan struct{})
+}
+
+// UnmarshalJSON decodes a network from the JSON config, starting from the default values
+// so that settings left out of the config behave the same as in the Caddyfile.
+func (n *network) UnmarshalJSON(data []byte) error {
+	// networkJSON has the fields of network without its methods, so decoding it does not recurse
+	type networkJSON network
+	n.setDefaults()
+	if err := json.Unmarshal(data, (*networkJSON)(n)); err != nil {
+		return err
+	}
+	if n.Providers == nil {
+		n.Providers = make(map[string]*provider)
+	}
+	return nil
+}
+
+// validate checks the network configuration and the configuration of each of its providers
+func (n *network) validate() error {
+	if len(n.Providers) == 0 {
+		return fmt.Errorf("expected at least one provider")
+	}
+	if n.HCMethod == "" {
+		return fmt.Errorf("healthcheck_method must be set")
+	}
+	if n.HCThreshold < 0 {
+		return fmt.Errorf("healthcheck_threshold must not be negative, got %d", n.HCThreshold)
+	}
+	if n.HCInterval < 1 {
+		return fmt.Errorf("healthcheck_interval must be at least 1 second, got %d", n.HCInterval)
+	}
+	if n.BlockLagLimit < 0 {
+		return fmt.Errorf("healthcheck_blocklag_limit must not be negative, got %d", n.BlockLagLimit)
+	}
+	if n.BlockNumberDelta < 0 {
+		return fmt.Errorf("healthcheck_blocknumber_delta must not be negative, got %d", n.BlockNumberDelta)
+	}
+	if n.StaleBlockMultiplier < 0 {
+		return fmt.Errorf("stale_block_multiplier must not be negative, got %d", n.StaleBlockMultiplier)
+	}
+	if n.ForkCheckOffset < 0 {
+		return fmt.Errorf("fork_check_offset must not be negative, got %d", n.ForkCheckOffset)
+	}
+	if n.LatencyThresholdMs < 0 {
+		return fmt.Errorf("healthcheck_latency_threshold_ms must not be negative, got %d", n.LatencyThresholdMs)
+	}
+	if n.FinalizedLagLimit < 0 {
+		return fmt.Errorf("finalized_lag_limit must not be negative, got %d", n.FinalizedLagLimit)
+	}
+	if n.MaxRequestPayloadSizeKB < 1 {
+		return fmt.Errorf("max_request_payload_size_kb must be at least 1, got %d", n.MaxRequestPayloadSizeKB)
+	}
+	if n.RequestAttemptCount < 1 {
+		return fmt.Errorf("request_attempt_count must be at least 1, got %d", n.RequestAttemptCount)
+	}
+
+	probeNames := make(map[string]struct{}, len(n.Probes))
+	for _, probe := range n.Probes {
+		if err := probe.validate(); err != nil {
+			return fmt.Errorf("probe %s: %v", probe.Name, err)
+		}
+		if _, ok := probeNames[probe.Name]; ok {
+			return fmt.Errorf("probe %s is defined more than once", probe.Name)
+		}
+		probeNames[probe.Name] = struct{}{}
+	}
+
+	// Providers are identified by their host, the selection policy looks them up by it
+	for key, provider := range n.Providers {
+		if err := provider.validate(); err != nil {
+			return fmt.Errorf("provider %s: %v", provider.HttpUrl, err)
+		}
+		if key != provider.host {
+			return fmt.Errorf("provider %s must be keyed by its host %s, got %s", provider.HttpUrl, provider.host, key)
+		}
 	}
+	return nil
 }
 
 func (n *network) startHealthcheck() {
-	n.healthCheck()
-	ticker := time.NewTicker(time.Second * time.Duration(n.HCInterval))
+	n.startHeadSubscriptions()
+	n.scheduledHealthCheck(time.Now(), 0, true)
+	nextRound := time.Now().Add(time.Second * time.Duration(n.HCInterval))
+	ticker := time.NewTicker(HealthCheckTick)
 	go func() {
 		// Keep an index for RPC request IDs
-		for i := 0; ; i++ {
+		for i := 1; ; {
 			select {
 			// Cleanup if the quit channel gets closed. Right now nothing closes this channel, but
 			// once we integrate the authentication work there's code that should.
 			case <-n.quit:
 				ticker.Stop()
 				return
-			case <-ticker.C:
-				// Set up the healthcheck request with authentication for this provider.
-				n.healthCheck()
+			case now := <-ticker.C:
+				roundDue := !now.Before(nextRound)
+				n.scheduledHealthCheck(now, i, roundDue)
+				if roundDue {
+					nextRound = now.Add(time.Second * time.Duration(n.HCInterval))
+					i++
+				}
 			}
 		}
 	}()
 }
 
+// scheduledHealthCheck starts the health check of every provider that is due and not still being checked, and the
+// network-wide checks once every health check interval of the network unless the previous ones are still running.
+// The checks run in the background, so that a provider that is slow to answer doesn't hold up the others.
+// The providers whose health status changed are reported after each check, checks can move a provider back and forth,
+// only the outcome is reported.
+func (n *network) scheduledHealthCheck(now time.Time, round int, roundDue bool) {
+	for name, currentProvider := range n.dueProviders(now) {
+		if !currentProvider.startHealthCheck() {
+			continue
+		}
+		go func(providerName string, provider *provider) {
+			defer provider.finishHealthCheck()
+			outcome := n.checkProvider(providerName, provider)
+			n.scheduleHealthCheck(provider, outcome, time.Now())
+			n.reportHealthTransitions()
+		}(name, currentProvider)
+	}
+	if !roundDue || !atomic.CompareAndSwapInt32(&n.roundRunning, 0, 1) {
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&n.roundRunning, 0)
+		// The chain id rarely changes, so it is verified less often than the block number
+		if round%ChainIDCheckRounds == 0 {
+			n.verifyChainIDs()
+		}
+		n.forkHealthCheck()
+		n.finalityHealthCheck()
+		n.authHealthCheck()
+		// The providers checked since the previous round already had their lag and staleness evaluated
+		n.evaluateCheckedProviders(n.lastRoundAt)
+		n.lastRoundAt = now
+		n.reportHealthTransitions()
+	}()
+}
+
 type healthCheckEntry struct {
 	blockNumber int64
 	timestamp   *time.Time
+	// How long the provider took to answer the health check
+	latency time.Duration
 }
 
-func (n *network) healthCheck() {
-	// wait group to wait for all the providers to finish their health checks
-	var wg sync.WaitGroup
-	var blockTime time.Time
+// checkProvider runs the health check of a single provider and returns its outcome
+func (n *network) checkProvider(providerName string, provider *provider) healthCheckOutcome {
+	// a provider serving another chain stays unhealthy until it reports the expected chain id again
+	if reportedChainID, mismatch := n.chainIDMismatch(provider); mismatch {
+		n.handleChainIDMismatch(providerName, provider, reportedChainID)
+		return healthCheckHeld
+	}
+	// a provider on a minority fork, or with a finalized head out of line, stays unhealthy until
+	// the fork or finality health check finds it consistent with the network again
+	if provider.onMinorityFork() {
+		provider.markUnhealthy(HealthReasonFork)
+		return healthCheckHeld
+	}
+	if provider.hasFinalityFault() {
+		provider.markUnhealthy(HealthReasonFinalizedLag)
+		return healthCheckHeld
+	}
+	// get the latest block number from the current provider
+	providerBlockNumber, statusCode, latency, err := n.providerHead(provider)
+	if err != nil {
+		n.handleBlockNumberError(providerName, provider, statusCode, providerBlockNumber, err)
+		return healthCheckFailed
+	}
+	blockTime := time.Now()
 
-	for name, currentProvider := range n.Providers {
-		// check all of the providers simultaneously using async job management for more accurate blocknumber results.
-		wg.Add(1) // Increment the WaitGroup counter
-		go func(providerName string, provider *provider) {
-			defer wg.Done() // Decrement the counter when the goroutine completes
-			// get the latest block number from the current provider
-			providerBlockNumber, statusCode, err := n.getLatestBlockNumber(provider.HttpUrl, provider.Headers, provider.AuthClient())
-			if err != nil {
-				n.handleBlockNumberError(providerName, provider, statusCode, providerBlockNumber, err)
-				return
-			}
-			blockTime = time.Now()
+	if n.pingHealthCheck(providerName, provider, statusCode, providerBlockNumber) {
+		if statusCode == http.StatusTooManyRequests {
+			return healthCheckRateLimited
+		}
+		return healthCheckFailed
+	}
 
-			if n.pingHealthCheck(providerName, provider, statusCode, providerBlockNumber) {
-				return
-			}
+	if n.probeHealthCheck(providerName, provider) {
+		n.sendLatestBlockMetric(provider.host, statusCode, provider.getHealthStatus().String(), providerBlockNumber)
+		return healthCheckFailed
+	}
 
-			if n.blockNumberDeltaHealthCheck(providerName, provider, providerBlockNumber) {
-				return
-			}
+	if n.blockNumberDeltaHealthCheck(providerName, provider, providerBlockNumber) {
+		return healthCheckSucceeded
+	}
 
-			n.consistencyHealthCheck(providerName, provider, providerBlockNumber)
+	reason := n.consistencyHealthCheck(providerName, provider, providerBlockNumber)
 
-			n.sendLatestBlockMetric(provider.host, statusCode, provider.healthStatus.String(), providerBlockNumber)
+	// add the current provider to the checked providers map
+	n.addHealthCheckToCheckedProviderList(provider.host, healthCheckEntry{blockNumber: providerBlockNumber, timestamp: &blockTime, latency: latency})
 
-			// add the current provider to the checked providers map
-			n.addHealthCheckToCheckedProviderList(provider.host, healthCheckEntry{blockNumber: providerBlockNumber, timestamp: &blockTime})
-		}(name, currentProvider) // Pass the loop variable to the goroutine
+	// The latency and staleness of the provider are evaluated before its health status is set,
+	// so that a health check moves the provider at most once. Unhealthy providers recover through markHealthy.
+	latencyReason := n.latencyHealthCheck(providerName, provider)
+	if reason == "" && provider.getHealthStatus() != Unhealthy {
+		reason = latencyReason
+		if reason == "" {
+			history, _ := n.getCheckedProviderHCList(provider.host)
+			reason = n.stalenessHealthCheck(providerName, history, n.loadBlockTime())
+		}
 	}
-	// Wait for all goroutines to complete
-	wg.Wait()
+	if reason != "" {
+		provider.markWarning(reason)
+	} else {
+		provider.markHealthy(n.HCThreshold)
+	}
+
+	n.sendLatestBlockMetric(provider.host, statusCode, provider.getHealthStatus().String(), providerBlockNumber)
+	return healthCheckSucceeded
 }
 
 func (n *network) handleBlockNumberError(providerName string, provider *provider, statusCode int, providerBlockNumber int64, err error) {
 	n.logger.Warn("Error getting latest block number for provider", zap.String("provider", providerName), zap.String("network", n.Name), zap.Error(err), zap.String("machine_id", n.machineID))
-	provider.markPingFailure(n.HCThreshold)
-	n.sendLatestBlockMetric(provider.host, statusCode, provider.healthStatus.String(), providerBlockNumber)
+	provider.markPingFailure(n.HCThreshold, HealthReasonBlockNumberError)
+	n.sendLatestBlockMetric(provider.host, statusCode, provider.getHealthStatus().String(), providerBlockNumber)
 }
 
 func (n *network) pingHealthCheck(providerName string, provider *provider, statusCode int, providerBlockNumber int64) bool {
@@ -137,9 +338,9 @@ func (n *network) pingHealthCheck(providerName string, provider *provider, statu
 			provider.markPingWarning()
 		} else {
 			n.logger.Warn("Provider returned an error status code", zap.String("provider", providerName), zap.String("network", n.Name), zap.Int("status_code", statusCode), zap.String("machine_id", n.machineID))
-			provider.markPingFailure(n.HCThreshold)
+			provider.markPingFailure(n.HCThreshold, HealthReasonErrorStatusCode)
 		}
-		n.sendLatestBlockMetric(provider.host, statusCode, provider.healthStatus.String(), providerBlockNumber)
+		n.sendLatestBlockMetric(provider.host, statusCode, provider.getHealthStatus().String(), providerBlockNumber)
 		return true
 	}
 	provider.markPingSuccess(n.HCThreshold)
@@ -167,7 +368,7 @@ func (n *network) blockNumberDeltaHealthCheck(providerName string, provider *pro
 			zap.Int64("provider_block_number", providerBlockNumber),
 			zap.Int64("reference_block_number", referenceBlock),
 			zap.String("machine_id", n.machineID))
-		provider.markUnhealthy()
+		provider.markUnhealthy(HealthReasonAheadOfNetwork)
 		return true
 	} else if providerBlockNumber < referenceBlock-n.BlockNumberDelta {
 		n.logger.Warn("Provider is too far behind the network",
@@ -176,38 +377,34 @@ func (n *network) blockNumberDeltaHealthCheck(providerName string, provider *pro
 			zap.Int64("provider_block_number", providerBlockNumber),
 			zap.Int64("reference_block_number", referenceBlock),
 			zap.String("machine_id", n.machineID))
-		provider.markUnhealthy()
+		provider.markUnhealthy(HealthReasonBehindNetwork)
 		return true
 	}
 	return false
 }
 
-func (n *network) consistencyHealthCheck(providerName string, provider *provider, providerBlockNumber int64) {
+// consistencyHealthCheck compares the block number of the provider with the block numbers of the network, and returns
+// HealthReasonLagging if the provider lags behind it, or an empty string otherwise. It raises the latest block number of the network.
+func (n *network) consistencyHealthCheck(providerName string, provider *provider, providerBlockNumber int64) string {
 	// For a single provider, always consider it healthy if it's responding
 	if len(n.Providers) == 1 {
-		provider.markHealthy(n.HCThreshold)
-		n.latestBlockNumber = providerBlockNumber
-		return
+		n.storeLatestBlockNumber(providerBlockNumber)
+		return ""
 	}
 
 	referenceBlock := n.getPercentileBlockNumber(0.75)
 	if referenceBlock == 0 {
 		// First health check or not enough data
-		n.latestBlockNumber = providerBlockNumber
-		provider.markHealthy(n.HCThreshold)
-		return
+		n.storeLatestBlockNumber(providerBlockNumber)
+		return ""
 	}
 
 	// Update network's latest block number if we see a higher one
 	// Move this before the lag check to ensure we capture the highest block
-	if providerBlockNumber > n.latestBlockNumber {
-		n.latestBlockNumber = providerBlockNumber
-	}
-	
+	n.raiseLatestBlockNumber(providerBlockNumber)
+
 	// Also update latest block number with reference block if it's higher
-	if referenceBlock > n.latestBlockNumber {
-		n.latestBlockNumber = referenceBlock
-	}
+	n.raiseLatestBlockNumber(referenceBlock)
 
 	if providerBlockNumber+n.BlockLagLimit < referenceBlock {
 		n.logger.Warn("Provider is lagging behind",
@@ -216,10 +413,24 @@ func (n *network) consistencyHealthCheck(providerName string, provider *provider
 			zap.Int64("provider_block_number", providerBlockNumber),
 			zap.Int64("reference_block_number", referenceBlock),
 			zap.String("machine_id", n.machineID))
-		provider.markWarning()
-	} else {
-		provider.markHealthy(n.HCThreshold)
+		return HealthReasonLagging
 	}
+	return ""
+}
+
+// loadLatestBlockNumber atomically loads the latest block number seen on the network
+func (n *network) loadLatestBlockNumber() int64 {
+	return atomic.LoadInt64(&n.latestBlockNumber)
+}
+
+// storeLatestBlockNumber atomically stores the latest block number seen on the network
+func (n *network) storeLatestBlockNumber(blockNumber int64) {
+	atomic.StoreInt64(&n.latestBlockNumber, blockNumber)
+}
+
+// raiseLatestBlockNumber atomically stores the block number if it is higher than the latest block number seen on the network
+func (n *network) raiseLatestBlockNumber(blockNumber int64) {
+	raiseInt64(&n.latestBlockNumber, blockNumber)
 }
 
 func (n *network) sendLatestBlockMetric(providerName string, statusCode int, healthStatus string, providerBlockNumber int64) {
@@ -245,16 +456,123 @@ func (n *network) setCheckedProviderHCList(providerName string, newHealthCheckLi
 	n.CheckedProviders[providerName] = newHealthCheckList
 }
 
-// evaluateCheckedProviders loops through all of the checked providers and sets them as unhealthy if they are not the current provider
-func (n *network) evaluateCheckedProviders() {
+// clone returns a copy of the network configuration with its own providers map and health check loop.
+// The copy shares the network's clients, and carries over the block history recorded so far.
+func (n *network) clone() *network {
+	c := &network{
+		Name:             n.Name,
+		HttpClient:       n.HttpClient,
+		PrometheusClient: n.PrometheusClient,
+		logger:           n.logger,
+		machineID:        n.machineID,
+		healthEvents:     n.healthEvents,
+		quit:             make(chan struct{}),
+
+		HCThreshold:      n.HCThreshold,
+		CheckedProviders: make(map[string][]healthCheckEntry),
+
+		Providers:               make(map[string]*provider, len(n.Providers)),
+		Methods:                 n.Methods,
+		HCMethod:                n.HCMethod,
+		HCInterval:              n.HCInterval,
+		BlockLagLimit:           n.BlockLagLimit,
+		BlockNumberDelta:        n.BlockNumberDelta,
+		FinalizedLagLimit:       n.FinalizedLagLimit,
+		LatencyThresholdMs:      n.LatencyThresholdMs,
+		StaleBlockMultiplier:    n.StaleBlockMultiplier,
+		ForkCheckOffset:         n.ForkCheckOffset,
+		MaxRequestPayloadSizeKB: n.MaxRequestPayloadSizeKB,
+		RequestAttemptCount:     n.RequestAttemptCount,
+		Probes:                  n.Probes,
+		ChainID:                 n.ChainID,
+	}
+	c.storeLatestBlockNumber(n.loadLatestBlockNumber())
+	c.storeExpectedChainID(atomic.LoadUint64(&n.expectedChainID))
+	c.storeCanonicalBlocks(n.loadCanonicalBlocks())
+	c.storeBlockTime(n.loadBlockTime())
+	for _, tag := range trackedBlockTags {
+		raiseInt64(c.headBlockNumber(tag), n.loadHeadBlockNumber(tag))
+	}
+	for host, p := range n.Providers {
+		c.Providers[host] = p
+	}
+	n.healthCheckListMutex.RLock()
+	for host, history := range n.CheckedProviders {
+		c.CheckedProviders[host] = history
+	}
+	n.healthCheckListMutex.RUnlock()
+	return c
+}
+
+// sameRegistryConfig reports whether the network has the same values as the other network for the config synced from the registry
+func (n *network) sameRegistryConfig(o *network) bool {
+	return n.HCMethod == o.HCMethod &&
+		n.HCInterval == o.HCInterval &&
+		n.BlockLagLimit == o.BlockLagLimit &&
+		n.MaxRequestPayloadSizeKB == o.MaxRequestPayloadSizeKB &&
+		n.RequestAttemptCount == o.RequestAttemptCount
+}
+
+// adoptProviderState carries over the health state and block history that a previous network instance recorded for the provider
+func (n *network) adoptProviderState(p *provider, prevNetwork *network, prevProvider *provider) {
+	p.adoptHealthState(prevProvider)
+	if prevNetwork == nil {
+		return
+	}
+	if history, ok := prevNetwork.getCheckedProviderHCList(prevProvider.host); ok {
+		n.healthCheckListMutex.Lock()
+		if n.CheckedProviders == nil {
+			n.CheckedProviders = make(map[string][]healthCheckEntry)
+		}
+		n.CheckedProviders[p.host] = append([]healthCheckEntry(nil), history...)
+		n.healthCheckListMutex.Unlock()
+	}
+	n.raiseLatestBlockNumber(prevNetwork.loadLatestBlockNumber())
+	if atomic.LoadUint64(&n.expectedChainID) == 0 {
+		n.storeExpectedChainID(atomic.LoadUint64(&prevNetwork.expectedChainID))
+	}
+	if len(n.loadCanonicalBlocks()) == 0 {
+		n.storeCanonicalBlocks(prevNetwork.loadCanonicalBlocks())
+	}
+	for _, tag := range trackedBlockTags {
+		raiseInt64(n.headBlockNumber(tag), prevNetwork.loadHeadBlockNumber(tag))
+	}
+}
+
+// evaluateCheckedProviders sweeps the recorded health check history after each health check round.
+// Healthy providers whose last recorded block lags behind the network, or whose head is stuck while the network advances,
+// are moved to Warning. Providers that are already Warning or Unhealthy are left to the regular health checks, and so are
+// the providers checked after checkedSince, which already had their lag and staleness evaluated.
+func (n *network) evaluateCheckedProviders(checkedSince time.Time) {
 	// read lock the checked providers map
 	n.healthCheckListMutex.RLock()
 	defer n.healthCheckListMutex.RUnlock()
-	// loop through all of the checked providers and set them as unhealthy if they are not the current provider
+
+	// Keep the previous estimate while no provider advanced within its history
+	if blockTime := estimateBlockTime(n.CheckedProviders); blockTime > 0 {
+		n.storeBlockTime(blockTime)
+	}
+	blockTime := n.loadBlockTime()
+
 	checkedProviders := n.CheckedProviders
 	for providerName, healthCheckList := range checkedProviders {
-		if healthCheckList[0].blockNumber+n.BlockLagLimit < n.latestBlockNumber {
-			n.Providers[providerName].markWarning()
+		provider, ok := n.Providers[providerName]
+		if !ok {
+			// The provider has been removed from the network since it was checked
+			continue
+		}
+		if len(healthCheckList) == 0 || !provider.Healthy() {
+			continue
+		}
+		if timestamp := healthCheckList[0].timestamp; timestamp != nil && timestamp.After(checkedSince) {
+			continue
+		}
+		if head, _ := n.currentHead(provider, healthCheckList); head+n.BlockLagLimit < n.loadLatestBlockNumber() {
+			provider.markWarning(HealthReasonLagging)
+			continue
+		}
+		if reason := n.stalenessHealthCheck(providerName, healthCheckList, blockTime); reason != "" {
+			provider.markWarning(reason)
 		}
 	}
 }
@@ -262,32 +580,44 @@ func (n *network) evaluateCheckedProviders() {
 // addHealthCheckToCheckedProviderList adds a new healthCheckEntry to the beginning of the CheckedProviders healthCheck list for the given provider
 // the list will not exceed 10 entries
 func (n *network) addHealthCheckToCheckedProviderList(providerName string, healthCheckInput healthCheckEntry) {
+	n.healthCheckListMutex.Lock()
+	defer n.healthCheckListMutex.Unlock()
+
 	// if the provider is not in the checked providers map, add it with its initial block number and timestamp
-	currentHealthCheckList, ok := n.getCheckedProviderHCList(providerName)
+	currentHealthCheckList, ok := n.CheckedProviders[providerName]
 	if !ok {
-		n.setCheckedProviderHCList(providerName, []healthCheckEntry{healthCheckInput})
+		n.CheckedProviders[providerName] = []healthCheckEntry{healthCheckInput}
 		return
 	}
 
-	// to add a new healthCheckEntry to index 0 of the provider's slice, we need to make a new slice and copy the old slice to the new slice
+	// to add a new healthCheckEntry to index 0 of the provider's slice, we need to make a new slice and copy the old slice to the new slice.
+	// The old slice is never modified in place, so lists handed out by getCheckedProviderHCList stay consistent.
 	newHealthCheckList := []healthCheckEntry{healthCheckInput}
 
 	// if the old slice is full at 10 entries, we need to remove the last entry and append the rest of the entries to the new slice
 	if len(currentHealthCheckList) == 10 {
-		currentHealthCheckList = append(newHealthCheckList, currentHealthCheckList[:9]...)
-		n.setCheckedProviderHCList(providerName, currentHealthCheckList)
+		n.CheckedProviders[providerName] = append(newHealthCheckList, currentHealthCheckList[:9]...)
 	} else {
 		// if the old slice is not full, we can copy the old slice to the new slice and add the new entry to index 0
-		currentHealthCheckList = append(newHealthCheckList, currentHealthCheckList...)
-		n.setCheckedProviderHCList(providerName, currentHealthCheckList)
+		n.CheckedProviders[providerName] = append(newHealthCheckList, currentHealthCheckList...)
+	}
+}
+
+// providerClient returns the HTTP client of the provider with the URL if it has TLS settings, or else the client of the network
+func (n *network) providerClient(httpUrl string) din_http.IHTTPClient {
+	for _, p := range n.Providers {
+		if p.HttpUrl == httpUrl && p.transport != nil {
+			return p.httpClient
+		}
 	}
+	return n.HttpClient
 }
 
 func (n *network) getLatestBlockNumber(httpUrl string, headers map[string]string, ac auth.IAuthClient) (int64, int, error) {
 	payload := []byte(fmt.Sprintf(`{"jsonrpc":"2.0","method": "%s","params":[],"id":1}`, n.HCMethod))
 
 	// Send the POST request
-	resBytes, statusCode, err := n.HttpClient.Post(httpUrl, headers, []byte(payload), ac)
+	resBytes, statusCode, err := n.providerClient(httpUrl).Post(httpUrl, headers, []byte(payload), ac)
 	if err != nil {
 		return 0, 0, errors.Wrap(err, "Error sending POST request")
 	}
@@ -331,7 +661,9 @@ func (n *network) getLatestBlockNumber(httpUrl string, headers map[string]string
 }
 
 func (n *network) close() {
-	close(n.quit)
+	if n.quit != nil {
+		close(n.quit)
+	}
 }
 
 // getPercentileBlockNumber returns the block number at the specified percentile across all providers
@@ -344,10 +676,10 @@ func (n *network) getPercentileBlockNumber(percentile float64) int64 {
 	// Collect all block numbers
 	blockNumbers := make([]int64, 0, len(n.Providers))
 	for _, provider := range n.Providers {
-		// Get the most recent block number from the provider's health check entries
-		entries, ok := n.getCheckedProviderHCList(provider.host)
-		if ok && len(entries) > 0 {
-			blockNumbers = append(blockNumbers, entries[0].blockNumber)
+		// Get the live head of the provider, or the most recent block number from its health check entries
+		entries, _ := n.getCheckedProviderHCList(provider.host)
+		if head, ok := n.currentHead(provider, entries); ok {
+			blockNumbers = append(blockNumbers, head)
 		}
 	}
 
@@ -147,13 +147,13 @@ func TestHealthCheck(t *testing.T) {
 			}
 
 			// Run health check
-			tt.network.healthCheck()
+			checkProviders(t, tt.network)
 
 			// Verify results
 			for providerName, provider := range tt.network.Providers {
 				wantStatus := tt.wantProviderStatus[providerName]
 				if provider.healthStatus != wantStatus {
-					t.Errorf("healthCheck() for provider %s got status = %v, want %v",
+					t.Errorf("health check for provider %s got status = %v, want %v",
 						providerName, provider.healthStatus, wantStatus)
 				}
 			}
@@ -397,7 +397,7 @@ func TestConsistencyHealthCheck(t *testing.T) {
 		provider             *provider
 		blockNumber          int64
 		network              *network
-		want                 HealthStatus
+		wantReason           string
 		expectedLatestBlock  int64
 	}{
 		{
@@ -415,7 +415,6 @@ func TestConsistencyHealthCheck(t *testing.T) {
 				BlockLagLimit: 100,
 				HCThreshold:  3,
 			},
-			want:                Healthy,
 			expectedLatestBlock: 5000000,
 		},
 		{
@@ -440,7 +439,7 @@ func TestConsistencyHealthCheck(t *testing.T) {
 					"provider3": {{blockNumber: 5000000, timestamp: &timeNow}},
 				},
 			},
-			want:                Warning,
+			wantReason:          HealthReasonLagging,
 			expectedLatestBlock: 5000000,
 		},
 		{
@@ -463,7 +462,6 @@ func TestConsistencyHealthCheck(t *testing.T) {
 					"provider2": {{blockNumber: 5000000, timestamp: &timeNow}},
 				},
 			},
-			want:                Healthy,
 			expectedLatestBlock: 5000000,
 		},
 	}
@@ -471,10 +469,10 @@ func TestConsistencyHealthCheck(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			tt.network.logger = zap.NewNop()
-			tt.network.consistencyHealthCheck(tt.providerName, tt.provider, tt.blockNumber)
+			reason := tt.network.consistencyHealthCheck(tt.providerName, tt.provider, tt.blockNumber)
 
-			if tt.provider.healthStatus != tt.want {
-				t.Errorf("consistencyHealthCheck() health status = %v, want %v", tt.provider.healthStatus, tt.want)
+			if reason != tt.wantReason {
+				t.Errorf("consistencyHealthCheck() reason = %q, want %q", reason, tt.wantReason)
 			}
 
 			if tt.network.latestBlockNumber != tt.expectedLatestBlock {
@@ -756,7 +754,7 @@ func TestEvaluatecheckedProviders(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			tt.network.evaluateCheckedProviders()
+			tt.network.evaluateCheckedProviders(time.Now())
 
 			for providerName, provider := range tt.network.Providers {
 				if provider.healthStatus != tt.want[providerName].healthStatus {
@@ -838,4 +836,90 @@ func TestGetPercentileBlockNumber(t *testing.T) {
 			}
 		})
 	}
-}
\ No newline at end of file
+}
+func TestNetworkValidate(t *testing.T) {
+	newValidNetwork := func() *network {
+		n := NewNetwork("eth")
+		p, _ := NewProvider("http://localhost:8000")
+		n.Providers[p.host] = p
+		return n
+	}
+
+	tests := []struct {
+		name   string
+		modify func(n *network)
+		hasErr bool
+	}{
+		{
+			name:   "valid network",
+			modify: func(n *network) {},
+			hasErr: false,
+		},
+		{
+			name:   "no providers",
+			modify: func(n *network) { n.Providers = map[string]*provider{} },
+			hasErr: true,
+		},
+		{
+			name:   "request attempt count of 0",
+			modify: func(n *network) { n.RequestAttemptCount = 0 },
+			hasErr: true,
+		},
+		{
+			name:   "healthcheck interval of 0",
+			modify: func(n *network) { n.HCInterval = 0 },
+			hasErr: true,
+		},
+		{
+			name:   "max request payload size of 0",
+			modify: func(n *network) { n.MaxRequestPayloadSizeKB = 0 },
+			hasErr: true,
+		},
+		{
+			name:   "empty healthcheck method",
+			modify: func(n *network) { n.HCMethod = "" },
+			hasErr: true,
+		},
+		{
+			name: "invalid provider",
+			modify: func(n *network) {
+				p, _ := NewProvider("localhost:8001")
+				n.Providers["localhost:8001"] = p
+			},
+			hasErr: true,
+		},
+		{
+			name: "provider not keyed by its host",
+			modify: func(n *network) {
+				p, _ := NewProvider("http://localhost:8001")
+				n.Providers["other"] = p
+			},
+			hasErr: true,
+		},
+		{
+			name: "invalid probe",
+			modify: func(n *network) {
+				n.Probes = []*healthProbe{{Name: "syncing"}}
+			},
+			hasErr: true,
+		},
+		{
+			name: "duplicate probe names",
+			modify: func(n *network) {
+				n.Probes = []*healthProbe{{Name: "syncing", Method: "eth_syncing"}, {Name: "syncing", Method: "eth_syncing"}}
+			},
+			hasErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := newValidNetwork()
+			tt.modify(n)
+			err := n.validate()
+			if (err != nil) != tt.hasErr {
+				t.Errorf("validate() = %v, want error %v", err, tt.hasErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package modules
+
+import (
+	"fmt"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// evmStandardMethods are the JSON-RPC methods served by every EVM network
+var evmStandardMethods = []string{
+	"web3_sha3", "web3_clientVersion", "net_listening", "net_peerCount", "net_version",
+	"eth_call", "eth_getBalance", "eth_estimateGas", "eth_createAccessList", "eth_getStorageAt",
+	"eth_getCode", "eth_blockNumber", "eth_protocolVersion", "eth_syncing", "eth_sendRawTransaction",
+	"eth_chainId", "eth_getLogs", "eth_getTransactionByHash", "eth_getTransactionReceipt", "eth_getTransactionCount",
+	"eth_feeHistory", "eth_getBlockByNumber", "eth_getBlockByHash", "eth_gasPrice", "eth_getTransactionByBlockHashAndIndex",
+	"eth_getTransactionByBlockNumberAndIndex", "eth_getBlockTransactionCountByNumber", "eth_getBlockTransactionCountByHash", "eth_getUncleCountByBlockNumber", "eth_getUncleCountByBlockHash",
+	"eth_subscribe", "eth_unsubscribe", "eth_getUncleByBlockHashAndIndex", "eth_maxPriorityFeePerGas", "eth_getProof",
+}
+
+// builtinMethodSets are the method sets available in every din block, referenced by name with the method_set option
+var builtinMethodSets = map[string][]string{
+	"evm-standard": evmStandardMethods,
+	"polygon-bor": append(append([]string{}, evmStandardMethods...),
+		"bor_getSignersAtHash", "bor_getSnapshot", "bor_getRootHash", "bor_getAuthor", "bor_getCurrentValidators",
+		"bor_getCurrentProposer", "eth_getTransactionReceiptsByBlock", "eth_getBorBlockReceipt",
+	),
+}
+
+// caddyfileDefinitions holds the method sets and network templates defined so far in a din block.
+// They are only used while parsing the Caddyfile, networks hold the resolved settings.
+type caddyfileDefinitions struct {
+	methodSets map[string][]string
+	templates  map[string]*network
+}
+
+func newCaddyfileDefinitions() *caddyfileDefinitions {
+	return &caddyfileDefinitions{
+		methodSets: make(map[string][]string),
+		templates:  make(map[string]*network),
+	}
+}
+
+// methodSet returns the methods of a user defined or built-in method set
+func (defs *caddyfileDefinitions) methodSet(name string) ([]string, bool) {
+	if methods, ok := defs.methodSets[name]; ok {
+		return methods, true
+	}
+	methods, ok := builtinMethodSets[name]
+	return methods, ok
+}
+
+// expandMethodSets returns the methods of the named method sets, in order
+func (defs *caddyfileDefinitions) expandMethodSets(names []string) ([]string, error) {
+	if len(names) == 0 {
+		return nil, fmt.Errorf("expected at least one method set name")
+	}
+	var methods []string
+	for _, name := range names {
+		set, ok := defs.methodSet(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown method set %s", name)
+		}
+		methods = append(methods, set...)
+	}
+	return methods, nil
+}
+
+// defineMethodSet parses a method_set block, which lists methods and includes other method sets:
+//
+//	method_set evm-blast {
+//		method_set evm-standard
+//		methods eth_getBalanceValues
+//	}
+func (defs *caddyfileDefinitions) defineMethodSet(dispenser *caddyfile.Dispenser, name string) error {
+	if _, ok := defs.methodSet(name); ok {
+		return dispenser.Errf("method set %s is already defined", name)
+	}
+	var methods []string
+	for nesting := dispenser.Nesting(); dispenser.NextBlock(nesting); {
+		switch dispenser.Val() {
+		case "methods":
+			methods = append(methods, dispenser.RemainingArgs()...)
+		case "method_set":
+			expanded, err := defs.expandMethodSets(dispenser.RemainingArgs())
+			if err != nil {
+				return dispenser.Err(err.Error())
+			}
+			methods = append(methods, expanded...)
+		default:
+			return dispenser.Errf("unrecognized method set option: %s", dispenser.Val())
+		}
+	}
+	if len(methods) == 0 {
+		return dispenser.Errf("method set %s has no methods", name)
+	}
+	defs.methodSets[name] = dedupeMethods(methods)
+	return nil
+}
+
+// dedupeMethods removes repeated methods, keeping the first occurrence of each
+func dedupeMethods(methods []string) []string {
+	seen := make(map[string]struct{}, len(methods))
+	deduped := make([]string, 0, len(methods))
+	for _, method := range methods {
+		if _, ok := seen[method]; ok {
+			continue
+		}
+		seen[method] = struct{}{}
+		deduped = append(deduped, method)
+	}
+	return deduped
+}
+
+// toMethodList converts a list of method names to the method list of a network, without repeated methods
+func toMethodList(methods []string) []*string {
+	deduped := dedupeMethods(methods)
+	list := make([]*string, len(deduped))
+	for i := range deduped {
+		list[i] = &deduped[i]
+	}
+	return list
+}
+
+// applyTemplate copies the settings of a network template onto the network
+func (n *network) applyTemplate(template *network) {
+	n.Methods = append([]*string(nil), template.Methods...)
+	n.HCMethod = template.HCMethod
+	n.HCThreshold = template.HCThreshold
+	n.HCInterval = template.HCInterval
+	n.BlockLagLimit = template.BlockLagLimit
+	n.BlockNumberDelta = template.BlockNumberDelta
+	n.FinalizedLagLimit = template.FinalizedLagLimit
+	n.LatencyThresholdMs = template.LatencyThresholdMs
+	n.StaleBlockMultiplier = template.StaleBlockMultiplier
+	n.ForkCheckOffset = template.ForkCheckOffset
+	n.MaxRequestPayloadSizeKB = template.MaxRequestPayloadSizeKB
+	n.RequestAttemptCount = template.RequestAttemptCount
+	n.Probes = append([]*healthProbe(nil), template.Probes...)
+}
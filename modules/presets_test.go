@@ -0,0 +1,223 @@
+package modules
+
+import (
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/stretchr/testify/assert"
+)
+
+func methodNames(methods []*string) []string {
+	names := make([]string, len(methods))
+	for i, method := range methods {
+		names[i] = *method
+	}
+	return names
+}
+
+func TestBuiltinMethodSets(t *testing.T) {
+	assert.Equal(t, 35, len(builtinMethodSets["evm-standard"]))
+	assert.Equal(t, 43, len(builtinMethodSets["polygon-bor"]))
+	assert.Equal(t, evmStandardMethods, builtinMethodSets["polygon-bor"][:35])
+	assert.Equal(t, dedupeMethods(builtinMethodSets["polygon-bor"]), builtinMethodSets["polygon-bor"])
+}
+
+func TestDefineMethodSet(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected []string
+		hasErr   bool
+	}{
+		{
+			name: "methods and included set",
+			input: `method_set evm-blast {
+				method_set evm-standard
+				methods eth_getBalanceValues eth_call
+			}`,
+			expected: append(append([]string{}, evmStandardMethods...), "eth_getBalanceValues"),
+		},
+		{
+			name:   "unknown included set",
+			input:  `method_set custom { method_set unknown-set }`,
+			hasErr: true,
+		},
+		{
+			name:   "redefined built-in set",
+			input:  `method_set evm-standard { methods eth_call }`,
+			hasErr: true,
+		},
+		{
+			name:   "empty set",
+			input:  `method_set custom { }`,
+			hasErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defs := newCaddyfileDefinitions()
+			dispenser := caddyfile.NewTestDispenser(tt.input)
+			dispenser.Next()
+			var name string
+			assert.True(t, dispenser.Args(&name))
+			err := defs.defineMethodSet(dispenser, name)
+			if tt.hasErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			methods, ok := defs.methodSet(name)
+			assert.True(t, ok)
+			assert.Equal(t, tt.expected, methods)
+		})
+	}
+}
+
+func TestUnmarshalCaddyfileTemplates(t *testing.T) {
+	tests := []struct {
+		name      string
+		caddyfile string
+		check     func(t *testing.T, d *DinMiddleware)
+		hasErr    bool
+	}{
+		{
+			name: "network inherits and overrides a template",
+			caddyfile: `din {
+				method_set evm-blast {
+					method_set evm-standard
+					methods eth_getBalanceValues
+				}
+				network_template evm {
+					method_set evm-standard
+					healthcheck_interval 10
+					request_attempt_count 3
+				}
+				network_template blast {
+					template evm
+					method_set evm-blast
+				}
+				networks {
+					eth {
+						template evm
+						providers {
+							http://localhost:8000
+						}
+					}
+					blast-mainnet {
+						template blast
+						request_attempt_count 1
+						providers {
+							http://localhost:8001
+						}
+					}
+					polygon {
+						template evm
+						method_set polygon-bor
+						methods eth_getBlockReceipts
+						providers {
+							http://localhost:8002
+						}
+					}
+				}
+			}`,
+			check: func(t *testing.T, d *DinMiddleware) {
+				eth := d.Networks["eth"]
+				assert.Equal(t, evmStandardMethods, methodNames(eth.Methods))
+				assert.Equal(t, 10, eth.HCInterval)
+				assert.Equal(t, 3, eth.RequestAttemptCount)
+				assert.Equal(t, DefaultHCMethod, eth.HCMethod)
+
+				blast := d.Networks["blast-mainnet"]
+				assert.Equal(t, append(append([]string{}, evmStandardMethods...), "eth_getBalanceValues"), methodNames(blast.Methods))
+				assert.Equal(t, 10, blast.HCInterval)
+				assert.Equal(t, 1, blast.RequestAttemptCount)
+
+				polygon := d.Networks["polygon"]
+				assert.Equal(t, append(append([]string{}, builtinMethodSets["polygon-bor"]...), "eth_getBlockReceipts"), methodNames(polygon.Methods))
+			},
+		},
+		{
+			name: "template after other options",
+			caddyfile: `din {
+				network_template evm {
+					healthcheck_interval 10
+				}
+				networks {
+					eth {
+						request_attempt_count 1
+						template evm
+						providers {
+							http://localhost:8000
+						}
+					}
+				}
+			}`,
+			hasErr: true,
+		},
+		{
+			name: "unknown template",
+			caddyfile: `din {
+				networks {
+					eth {
+						template evm
+						providers {
+							http://localhost:8000
+						}
+					}
+				}
+			}`,
+			hasErr: true,
+		},
+		{
+			name: "unknown method set",
+			caddyfile: `din {
+				networks {
+					eth {
+						method_set evm-unknown
+						providers {
+							http://localhost:8000
+						}
+					}
+				}
+			}`,
+			hasErr: true,
+		},
+		{
+			name: "providers in a template",
+			caddyfile: `din {
+				network_template evm {
+					providers {
+						http://localhost:8000
+					}
+				}
+			}`,
+			hasErr: true,
+		},
+		{
+			name: "template defined twice",
+			caddyfile: `din {
+				network_template evm {
+					healthcheck_interval 10
+				}
+				network_template evm {
+					healthcheck_interval 20
+				}
+			}`,
+			hasErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := new(DinMiddleware)
+			err := d.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tt.caddyfile))
+			if tt.hasErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			tt.check(t, d)
+		})
+	}
+}
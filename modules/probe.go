@@ -0,0 +1,314 @@
+package modules
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/DIN-center/din-caddy-plugins/lib/auth"
+	din_http "github.com/DIN-center/din-caddy-plugins/lib/http"
+	prom "github.com/DIN-center/din-caddy-plugins/lib/prometheus"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// Probe assertion operators
+const (
+	ProbeOpExists       = "exists"
+	ProbeOpEqual        = "=="
+	ProbeOpNotEqual     = "!="
+	ProbeOpGreater      = ">"
+	ProbeOpGreaterEqual = ">="
+	ProbeOpLess         = "<"
+	ProbeOpLessEqual    = "<="
+)
+
+// healthProbe is an additional JSON-RPC request sent to every provider of a network on each health check.
+// The result of the request is checked against an assertion, and a failed probe counts as weight failed health checks.
+type healthProbe struct {
+	// The name of the probe, used in logs and metrics
+	Name string `json:"name"`
+	// The JSON-RPC method of the probe
+	Method string `json:"method"`
+	// The JSON encoded params array of the request. Defaults to [].
+	Params json.RawMessage `json:"params,omitempty"`
+	// The field of the result object to check. The whole result is checked if not set.
+	Field string `json:"field,omitempty"`
+	// The assertion operator, one of exists, ==, !=, >, >=, < and <=.
+	// If not set, the probe passes when the provider returns a result without a JSON-RPC error.
+	Operator string `json:"operator,omitempty"`
+	// The JSON encoded value the result is compared with. Hex strings are compared as numbers with numeric values.
+	Value json.RawMessage `json:"value,omitempty"`
+	// The number of failed health checks a failure of the probe counts as. Defaults to 1.
+	Weight int `json:"weight,omitempty"`
+}
+
+// validate checks the probe configuration
+func (hp *healthProbe) validate() error {
+	if hp.Name == "" {
+		return fmt.Errorf("name must be set")
+	}
+	if hp.Method == "" {
+		return fmt.Errorf("method must be set")
+	}
+	if len(hp.Params) > 0 {
+		var params []interface{}
+		if err := json.Unmarshal(hp.Params, &params); err != nil {
+			return fmt.Errorf("params must be a JSON array: %v", err)
+		}
+	}
+	if hp.Weight < 0 {
+		return fmt.Errorf("weight must not be negative, got %d", hp.Weight)
+	}
+	switch hp.Operator {
+	case "", ProbeOpExists:
+	case ProbeOpEqual, ProbeOpNotEqual:
+		if !json.Valid(hp.Value) {
+			return fmt.Errorf("operator %s needs a JSON value", hp.Operator)
+		}
+	case ProbeOpGreater, ProbeOpGreaterEqual, ProbeOpLess, ProbeOpLessEqual:
+		var value interface{}
+		if err := json.Unmarshal(hp.Value, &value); err != nil {
+			return fmt.Errorf("operator %s needs a numeric value", hp.Operator)
+		}
+		if _, ok := toBigInt(value); !ok {
+			return fmt.Errorf("operator %s needs a numeric value, got %s", hp.Operator, hp.Value)
+		}
+	default:
+		return fmt.Errorf("unknown operator %q", hp.Operator)
+	}
+	return nil
+}
+
+// parseProbes parses a probes block, which defines one probe per entry:
+//
+//	probes {
+//		syncing eth_syncing {
+//			assert == false
+//		}
+//		finalized eth_getBlockByNumber {
+//			params `["finalized", false]`
+//			field number
+//			assert exists
+//			weight 2
+//		}
+//	}
+func parseProbes(dispenser *caddyfile.Dispenser) ([]*healthProbe, error) {
+	var probes []*healthProbe
+	for nesting := dispenser.Nesting(); dispenser.NextBlock(nesting); {
+		probe := &healthProbe{Name: dispenser.Val()}
+		if !dispenser.Args(&probe.Method) {
+			return nil, dispenser.ArgErr()
+		}
+		for dispenser.NextBlock(nesting + 1) {
+			switch dispenser.Val() {
+			case "params":
+				if !dispenser.NextArg() {
+					return nil, dispenser.ArgErr()
+				}
+				probe.Params = json.RawMessage(dispenser.Val())
+			case "field":
+				if !dispenser.Args(&probe.Field) {
+					return nil, dispenser.ArgErr()
+				}
+			case "assert":
+				args := dispenser.RemainingArgs()
+				if len(args) == 0 || len(args) > 2 {
+					return nil, dispenser.ArgErr()
+				}
+				probe.Operator = args[0]
+				if len(args) == 2 {
+					probe.Value = probeValue(args[1])
+				}
+			case "weight":
+				if !dispenser.NextArg() {
+					return nil, dispenser.ArgErr()
+				}
+				weight, err := strconv.Atoi(dispenser.Val())
+				if err != nil {
+					return nil, dispenser.Errf("invalid probe weight: %v", err)
+				}
+				probe.Weight = weight
+			default:
+				return nil, dispenser.Errf("unrecognized probe option: %s", dispenser.Val())
+			}
+		}
+		if err := probe.validate(); err != nil {
+			return nil, dispenser.Errf("probe %s: %v", probe.Name, err)
+		}
+		probes = append(probes, probe)
+	}
+	return probes, nil
+}
+
+// probeValue returns the JSON value of an assertion argument. Arguments that aren't valid JSON, such as hex strings, are taken as strings.
+func probeValue(arg string) json.RawMessage {
+	if json.Valid([]byte(arg)) {
+		return json.RawMessage(arg)
+	}
+	value, _ := json.Marshal(arg)
+	return value
+}
+
+// weight returns the number of failed health checks a failure of the probe counts as
+func (hp *healthProbe) weight() int {
+	if hp.Weight == 0 {
+		return 1
+	}
+	return hp.Weight
+}
+
+// payload returns the JSON-RPC request of the probe
+func (hp *healthProbe) payload() []byte {
+	params := hp.Params
+	if len(params) == 0 {
+		params = json.RawMessage("[]")
+	}
+	return []byte(fmt.Sprintf(`{"jsonrpc":"2.0","method": "%s","params":%s,"id":1}`, hp.Method, params))
+}
+
+// run sends the probe to a provider and checks the result against the probe assertion
+func (hp *healthProbe) run(httpClient din_http.IHTTPClient, httpUrl string, headers map[string]string, ac auth.IAuthClient) error {
+	resBytes, statusCode, err := httpClient.Post(httpUrl, headers, hp.payload(), ac)
+	if err != nil {
+		return errors.Wrap(err, "Error sending POST request")
+	}
+	if *statusCode != http.StatusOK {
+		return errors.Errorf("unexpected status code %d", *statusCode)
+	}
+
+	var respObject struct {
+		Result json.RawMessage  `json:"result"`
+		Error  *json.RawMessage `json:"error"`
+	}
+	if err := json.Unmarshal(resBytes, &respObject); err != nil {
+		return errors.Wrap(err, "Error unmarshalling response")
+	}
+	if respObject.Error != nil {
+		return errors.Errorf("JSON-RPC error: %s", *respObject.Error)
+	}
+	if respObject.Result == nil {
+		return errors.New("no result in response")
+	}
+	return hp.check(respObject.Result)
+}
+
+// check evaluates the probe assertion against a JSON-RPC result
+func (hp *healthProbe) check(result json.RawMessage) error {
+	var actual interface{}
+	if err := json.Unmarshal(result, &actual); err != nil {
+		return errors.Wrap(err, "Error unmarshalling result")
+	}
+	if hp.Field != "" {
+		object, ok := actual.(map[string]interface{})
+		if !ok {
+			return errors.Errorf("result is not an object, can't read field %s", hp.Field)
+		}
+		actual = object[hp.Field]
+	}
+
+	if hp.Operator == "" {
+		return nil
+	}
+	if hp.Operator == ProbeOpExists {
+		if actual == nil {
+			return errors.New("result is null")
+		}
+		return nil
+	}
+
+	var expected interface{}
+	if err := json.Unmarshal(hp.Value, &expected); err != nil {
+		return errors.Wrap(err, "Error unmarshalling expected value")
+	}
+
+	switch hp.Operator {
+	case ProbeOpEqual:
+		if !probeValuesEqual(actual, expected) {
+			return errors.Errorf("expected %s, got %v", hp.Value, actual)
+		}
+	case ProbeOpNotEqual:
+		if probeValuesEqual(actual, expected) {
+			return errors.Errorf("expected a value other than %s", hp.Value)
+		}
+	default:
+		actualNumber, ok := toBigInt(actual)
+		if !ok {
+			return errors.Errorf("result %v is not a number", actual)
+		}
+		expectedNumber, _ := toBigInt(expected)
+		cmp := actualNumber.Cmp(expectedNumber)
+		passed := (hp.Operator == ProbeOpGreater && cmp > 0) ||
+			(hp.Operator == ProbeOpGreaterEqual && cmp >= 0) ||
+			(hp.Operator == ProbeOpLess && cmp < 0) ||
+			(hp.Operator == ProbeOpLessEqual && cmp <= 0)
+		if !passed {
+			return errors.Errorf("expected %s %s, got %s", hp.Operator, expectedNumber, actualNumber)
+		}
+	}
+	return nil
+}
+
+// probeValuesEqual compares two JSON values, comparing hex strings and numbers by their numeric value
+func probeValuesEqual(a, b interface{}) bool {
+	if aNumber, ok := toBigInt(a); ok {
+		if bNumber, ok := toBigInt(b); ok {
+			return aNumber.Cmp(bNumber) == 0
+		}
+	}
+	if aString, ok := a.(string); ok {
+		if bString, ok := b.(string); ok {
+			// Hex data such as eth_call results is case insensitive
+			return strings.EqualFold(aString, bString)
+		}
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// toBigInt converts a JSON number, or a hex or decimal quantity string, to a big integer
+func toBigInt(value interface{}) (*big.Int, bool) {
+	switch v := value.(type) {
+	case float64:
+		number, accuracy := big.NewFloat(v).Int(nil)
+		return number, accuracy == big.Exact
+	case string:
+		if strings.HasPrefix(v, "0x") || strings.HasPrefix(v, "0X") {
+			return new(big.Int).SetString(v[2:], 16)
+		}
+		return new(big.Int).SetString(v, 10)
+	}
+	return nil, false
+}
+
+// probeHealthCheck runs the probes of the network against a provider. Every failed probe counts as weight failed health checks.
+// It returns true if the provider is unhealthy after the probes.
+func (n *network) probeHealthCheck(providerName string, provider *provider) bool {
+	failedWeight := 0
+	for _, probe := range n.Probes {
+		if err := probe.run(n.providerClient(provider.HttpUrl), provider.HttpUrl, provider.Headers, provider.AuthClient()); err != nil {
+			n.logger.Warn("Provider failed health check probe",
+				zap.String("provider", providerName),
+				zap.String("network", n.Name),
+				zap.String("probe", probe.Name),
+				zap.Int("weight", probe.weight()),
+				zap.Error(err),
+				zap.String("machine_id", n.machineID))
+			n.PrometheusClient.HandleProbeFailureMetric(&prom.PromProbeFailureMetricData{
+				Network:  n.Name,
+				Provider: provider.host,
+				Probe:    probe.Name,
+			})
+			failedWeight += probe.weight()
+		}
+	}
+	if failedWeight == 0 {
+		return false
+	}
+	provider.markProbeFailure(failedWeight, n.HCThreshold)
+	return !provider.Healthy() && !provider.Warning()
+}
@@ -0,0 +1,161 @@
+package modules
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/DIN-center/din-caddy-plugins/lib/auth"
+	din_http "github.com/DIN-center/din-caddy-plugins/lib/http"
+	prom "github.com/DIN-center/din-caddy-plugins/lib/prometheus"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthProbeCheck(t *testing.T) {
+	tests := []struct {
+		name   string
+		probe  healthProbe
+		result string
+		hasErr bool
+	}{
+		{name: "not syncing", probe: healthProbe{Operator: "==", Value: json.RawMessage(`false`)}, result: `false`},
+		{name: "syncing", probe: healthProbe{Operator: "==", Value: json.RawMessage(`false`)}, result: `{"currentBlock": "0x1", "highestBlock": "0x2"}`, hasErr: true},
+		{name: "enough peers", probe: healthProbe{Operator: ">=", Value: json.RawMessage(`3`)}, result: `"0x5"`},
+		{name: "too few peers", probe: healthProbe{Operator: ">=", Value: json.RawMessage(`3`)}, result: `"0x2"`, hasErr: true},
+		{name: "peers compared with a hex value", probe: healthProbe{Operator: ">", Value: json.RawMessage(`"0x4"`)}, result: `"0x5"`},
+		{name: "finalized block exists", probe: healthProbe{Operator: "exists"}, result: `{"number": "0x10"}`},
+		{name: "finalized block missing", probe: healthProbe{Operator: "exists"}, result: `null`, hasErr: true},
+		{name: "field", probe: healthProbe{Field: "number", Operator: "<=", Value: json.RawMessage(`16`)}, result: `{"number": "0x10"}`},
+		{name: "field on a non object result", probe: healthProbe{Field: "number", Operator: "exists"}, result: `"0x10"`, hasErr: true},
+		{name: "eth_call result", probe: healthProbe{Operator: "==", Value: json.RawMessage(`"0x00000000000000000000000000000000000000000000000000000000000000AB"`)}, result: `"0x00000000000000000000000000000000000000000000000000000000000000ab"`},
+		{name: "not equal", probe: healthProbe{Operator: "!=", Value: json.RawMessage(`"0x0"`)}, result: `"0x0"`, hasErr: true},
+		{name: "comparison with a non number result", probe: healthProbe{Operator: "<", Value: json.RawMessage(`3`)}, result: `"syncing"`, hasErr: true},
+		{name: "no assertion", probe: healthProbe{}, result: `null`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.probe.check(json.RawMessage(tt.result))
+			if tt.hasErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestHealthProbeValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		probe  healthProbe
+		hasErr bool
+	}{
+		{name: "valid", probe: healthProbe{Name: "peers", Method: "net_peerCount", Operator: ">=", Value: json.RawMessage(`3`), Weight: 2}},
+		{name: "missing name", probe: healthProbe{Method: "eth_syncing"}, hasErr: true},
+		{name: "missing method", probe: healthProbe{Name: "syncing"}, hasErr: true},
+		{name: "params not an array", probe: healthProbe{Name: "finalized", Method: "eth_getBlockByNumber", Params: json.RawMessage(`"finalized"`)}, hasErr: true},
+		{name: "negative weight", probe: healthProbe{Name: "syncing", Method: "eth_syncing", Weight: -1}, hasErr: true},
+		{name: "unknown operator", probe: healthProbe{Name: "syncing", Method: "eth_syncing", Operator: "~="}, hasErr: true},
+		{name: "equality without value", probe: healthProbe{Name: "syncing", Method: "eth_syncing", Operator: "=="}, hasErr: true},
+		{name: "comparison with a non number value", probe: healthProbe{Name: "peers", Method: "net_peerCount", Operator: ">", Value: json.RawMessage(`"many"`)}, hasErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.probe.validate()
+			if tt.hasErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestProbeHealthCheck(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	mockHttpClient := din_http.NewMockIHTTPClient(mockCtrl)
+	mockPrometheusClient := prom.NewMockIPrometheusClient(mockCtrl)
+
+	peerCounts := map[string]string{
+		"http://provider1": "0x10",
+		"http://provider2": "0x1",
+	}
+	mockHttpClient.EXPECT().Post(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(url string, headers map[string]string, payload []byte, ac auth.IAuthClient) ([]byte, *int, error) {
+			statusCode := http.StatusOK
+			switch {
+			case strings.Contains(string(payload), "net_peerCount"):
+				return []byte(`{"jsonrpc": "2.0", "id": 1, "result": "` + peerCounts[url] + `"}`), &statusCode, nil
+			case strings.Contains(string(payload), "eth_syncing"):
+				return []byte(`{"jsonrpc": "2.0", "id": 1, "result": false}`), &statusCode, nil
+			}
+			return []byte(`{"jsonrpc": "2.0", "id": 1, "result": "0x4c4b40"}`), &statusCode, nil
+		}).AnyTimes()
+	mockPrometheusClient.EXPECT().HandleLatestBlockMetric(gomock.Any()).AnyTimes()
+	mockPrometheusClient.EXPECT().HandleProbeFailureMetric(&prom.PromProbeFailureMetricData{
+		Network:  "eth",
+		Provider: "provider2",
+		Probe:    "peers",
+	}).Times(1)
+
+	n := newChainIDTestNetwork(t, mockHttpClient, mockPrometheusClient, "http://provider1", "http://provider2")
+	n.Probes = []*healthProbe{
+		{Name: "syncing", Method: "eth_syncing", Operator: "==", Value: json.RawMessage(`false`)},
+		{Name: "peers", Method: "net_peerCount", Operator: ">=", Value: json.RawMessage(`3`), Weight: 3},
+	}
+
+	// A single failure of a probe weighing more than the healthcheck threshold marks the provider unhealthy
+	checkProviders(t, n)
+	assert.Equal(t, Healthy, n.Providers["provider1"].getHealthStatus())
+	assert.Equal(t, Unhealthy, n.Providers["provider2"].getHealthStatus())
+	_, ok := n.getCheckedProviderHCList("provider2")
+	assert.False(t, ok)
+}
+
+func TestParseProbes(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected []*healthProbe
+		hasErr   bool
+	}{
+		{
+			name: "probes",
+			input: "probes {\n" +
+				"syncing eth_syncing {\n assert == false\n }\n" +
+				"finalized eth_getBlockByNumber {\n params `[\"finalized\", false]`\n field number\n assert exists\n weight 2\n }\n" +
+				"peers net_peerCount {\n assert >= 0x3\n }\n" +
+				"reachable web3_clientVersion\n" +
+				"}",
+			expected: []*healthProbe{
+				{Name: "syncing", Method: "eth_syncing", Operator: "==", Value: json.RawMessage(`false`)},
+				{Name: "finalized", Method: "eth_getBlockByNumber", Params: json.RawMessage(`["finalized", false]`), Field: "number", Operator: "exists", Weight: 2},
+				{Name: "peers", Method: "net_peerCount", Operator: ">=", Value: json.RawMessage(`"0x3"`)},
+				{Name: "reachable", Method: "web3_clientVersion"},
+			},
+		},
+		{name: "missing method", input: "probes {\n syncing\n }", hasErr: true},
+		{name: "unknown option", input: "probes {\n syncing eth_syncing {\n expect false\n }\n }", hasErr: true},
+		{name: "invalid weight", input: "probes {\n syncing eth_syncing {\n weight high\n }\n }", hasErr: true},
+		{name: "invalid probe", input: "probes {\n peers net_peerCount {\n assert > many\n }\n }", hasErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dispenser := caddyfile.NewTestDispenser(tt.input)
+			dispenser.Next()
+			probes, err := parseProbes(dispenser)
+			if tt.hasErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, probes)
+		})
+	}
+}
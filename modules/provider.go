@@ -1,9 +1,16 @@
 package modules
 
 import (
+	"fmt"
+	"net/http"
 	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/DIN-center/din-caddy-plugins/lib/auth"
+	"github.com/DIN-center/din-caddy-plugins/lib/auth/credentials"
 	"github.com/DIN-center/din-caddy-plugins/lib/auth/siwe"
 	din_http "github.com/DIN-center/din-caddy-plugins/lib/http"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
@@ -11,24 +18,75 @@ import (
 )
 
 type provider struct {
-	HttpUrl      string
-	path         string
-	host         string
-	Headers      map[string]string
-	upstream     *reverseproxy.Upstream
-	httpClient   *din_http.HTTPClient
-	logger       *zap.Logger
+	// The URL of the provider. The path and host are derived from it when the provider is provisioned.
+	HttpUrl string `json:"http_url"`
+	path    string
+	host    string
+	// The WebSocket URL of the provider. If set, the head of the provider is tracked with a newHeads subscription,
+	// and polled by the health checks only while the subscription is down.
+	WsUrl string `json:"ws_url,omitempty"`
+	// Headers added to every request sent to the provider
+	Headers map[string]string `json:"headers,omitempty"`
+	// The TLS settings of the connections to the provider. Proxied requests, health checks, the newHeads subscription
+	// and SIWE sessions all use them.
+	TLS *din_http.TLSConfig `json:"tls,omitempty"`
+	// The transport with the TLS settings of the provider, nil if it has none
+	transport  *http.Transport
+	upstream   *reverseproxy.Upstream
+	httpClient *din_http.HTTPClient
+	logger     *zap.Logger
+	// The priority of the provider, 0 being the highest
+	Priority int `json:"priority"`
+	// The health check interval of the provider in seconds, overriding the interval of its network if set
+	HCInterval int `json:"healthcheck_interval_seconds,omitempty"`
+	quit       chan struct{}
+
+	// Health state, written by the health check goroutines and read on every request.
+	// Transitions are serialized by healthMu, and healthStatus is published atomically so that
+	// request handling can read it without taking the lock.
+	healthMu     sync.Mutex
 	failures     int
 	successes    int
 	healthStatus HealthStatus // 0 = Healthy, 1 = Warning, 2 = Unhealthy
-	Priority     int
-	quit         chan struct{}
+	// Why the provider last moved to Warning or Unhealthy, see the HealthReason constants
+	healthReason string
+	// When the provider is due for its next health check, and the number of consecutive failed or rate limited health checks
+	nextHealthCheck    time.Time
+	healthCheckBackoff int
+	// The health status last reported as a health transition
+	reportedHealthStatus HealthStatus
+	// 1 while a health check of the provider is running
+	healthChecking int32
 
 	// Registry Configuration Values
-	Methods []*string            `json:"methods"`
-	Auth    *siwe.SIWEClientAuth `json:"auth"`
+	Methods []*string            `json:"methods,omitempty"`
+	Auth    *siwe.SIWEClientAuth `json:"auth,omitempty"`
+	// The API key, bearer token, basic or OAuth2 credentials of the provider, used instead of SIWE auth
+	Credentials *credentials.ClientAuth `json:"credentials,omitempty"`
+	// The auth type the registry set Auth or Credentials from, empty for providers without registry auth
+	authType string
 
 	consecutiveHealthyChecks int
+
+	// The chain id last reported by the provider, 0 if not known
+	chainID uint64
+	// 1 if the provider disagreed with the majority of its network on a block hash at the last fork check
+	forked int32
+	// The safe and finalized heads last reported by the provider, 0 if not known
+	safeBlockNumber      int64
+	finalizedBlockNumber int64
+	// 1 if the finalized head of the provider was out of line at the last finality health check
+	finalityFault int32
+	// The rolling p50 and p95 health check latencies of the provider in nanoseconds
+	latencyP50 int64
+	latencyP95 int64
+	// The head last received on the newHeads subscription of the provider, when it was received in unix nanoseconds,
+	// and 1 if the subscription is up
+	subscribedHead   int64
+	subscribedHeadAt int64
+	headSubscribed   int32
+	// 1 if the auth of the provider was unhealthy at the last auth health check
+	authFault int32
 }
 
 func NewProvider(urlStr string) (*provider, error) {
@@ -45,86 +103,242 @@ func NewProvider(urlStr string) (*provider, error) {
 	return p, nil
 }
 
-// Available indicates whether the Caddy upstream is available, and
-// whether the provider's healthchecks indicate the upstream is healthy.
+// validate checks the provider configuration
+func (p *provider) validate() error {
+	if p.WsUrl != "" {
+		wsUrl, err := url.Parse(p.WsUrl)
+		if err != nil || wsUrl.Host == "" || (wsUrl.Scheme != "ws" && wsUrl.Scheme != "wss") {
+			return fmt.Errorf("ws_url must be a ws(s) url, got %q", p.WsUrl)
+		}
+	}
+	url, err := url.Parse(p.HttpUrl)
+	if err != nil {
+		return fmt.Errorf("invalid url: %v", err)
+	}
+	if url.Scheme != "http" && url.Scheme != "https" {
+		return fmt.Errorf("url must start with http:// or https://")
+	}
+	if url.Host == "" {
+		return fmt.Errorf("url must include a host")
+	}
+	if p.Priority < 0 || p.Priority >= MaxPriority {
+		return fmt.Errorf("priority must be between 0 and %d, got %d", MaxPriority-1, p.Priority)
+	}
+	if p.HCInterval < 0 {
+		return fmt.Errorf("healthcheck_interval must not be negative, got %d", p.HCInterval)
+	}
+	if p.TLS != nil {
+		if url.Scheme != "https" {
+			return fmt.Errorf("tls requires an https url")
+		}
+		if p.WsUrl != "" && !strings.HasPrefix(p.WsUrl, "wss://") {
+			return fmt.Errorf("tls requires a wss ws_url")
+		}
+		if err := p.TLS.Validate(); err != nil {
+			return fmt.Errorf("invalid tls: %v", err)
+		}
+	}
+	if p.Auth != nil && p.Credentials != nil {
+		return fmt.Errorf("auth and credentials can't both be set")
+	}
+	if p.Auth != nil {
+		if err := p.Auth.Validate(); err != nil {
+			return fmt.Errorf("invalid auth: %v", err)
+		}
+	}
+	if p.Credentials != nil {
+		if err := p.Credentials.Validate(); err != nil {
+			return fmt.Errorf("invalid credentials: %v", err)
+		}
+	}
+	return nil
+}
+
+// Available indicates whether the Caddy upstream is available,
+// whether the provider's healthchecks indicate the upstream is healthy, and whether requests to it can be authenticated.
 func (p *provider) Available() bool {
-	return p.upstream.Available() && p.Healthy()
+	return p.upstream.Available() && p.Healthy() && p.authAvailable()
 }
 
 func (p *provider) IsAvailableWithWarning() bool {
-	return p.upstream.Available() && p.Warning()
+	return p.upstream.Available() && p.Warning() && p.authAvailable()
 }
 
+// AuthClient returns the client authenticating requests to the provider, or nil if the provider has no auth
 func (p *provider) AuthClient() auth.IAuthClient {
-	if p.Auth == nil {
-		return nil
+	if p.Auth != nil {
+		return p.Auth
 	}
-	return p.Auth
+	if p.Credentials != nil {
+		return p.Credentials
+	}
+	return nil
+}
+
+// stopCredentials stops the token refreshes of the provider credentials
+func (p *provider) stopCredentials() {
+	if p.Credentials != nil {
+		p.Credentials.Stop()
+	}
+}
+
+// clone returns a copy of the provider configuration sharing the same upstream and clients.
+// The copy starts from the current health state of the provider.
+func (p *provider) clone() *provider {
+	c := &provider{
+		HttpUrl:     p.HttpUrl,
+		WsUrl:       p.WsUrl,
+		path:        p.path,
+		host:        p.host,
+		Headers:     p.Headers,
+		TLS:         p.TLS,
+		transport:   p.transport,
+		upstream:    p.upstream,
+		httpClient:  p.httpClient,
+		logger:      p.logger,
+		Priority:    p.Priority,
+		HCInterval:  p.HCInterval,
+		quit:        p.quit,
+		Methods:     p.Methods,
+		Auth:        p.Auth,
+		Credentials: p.Credentials,
+		authType:    p.authType,
+	}
+	c.adoptHealthState(p)
+	return c
+}
+
+// adoptHealthState copies the health status, circuit counters and reported chain id of a previous instance of the same provider
+func (p *provider) adoptHealthState(prev *provider) {
+	prev.healthMu.Lock()
+	status, failures, successes, consecutiveHealthyChecks, reason := prev.getHealthStatus(), prev.failures, prev.successes, prev.consecutiveHealthyChecks, prev.healthReason
+	nextHealthCheck, healthCheckBackoff := prev.nextHealthCheck, prev.healthCheckBackoff
+	prev.healthMu.Unlock()
+
+	p.healthMu.Lock()
+	defer p.healthMu.Unlock()
+	p.setHealthStatus(status)
+	p.failures = failures
+	p.successes = successes
+	p.consecutiveHealthyChecks = consecutiveHealthyChecks
+	p.healthReason = reason
+	p.nextHealthCheck = nextHealthCheck
+	p.healthCheckBackoff = healthCheckBackoff
+	p.storeChainID(prev.loadChainID())
+	p.swapForked(prev.onMinorityFork())
+	for _, tag := range trackedBlockTags {
+		p.swapHeadBlockNumber(tag, prev.loadHeadBlockNumber(tag))
+	}
+	p.swapFinalityFault(prev.hasFinalityFault())
+	p.storeLatency(prev.LatencyP50(), prev.LatencyP95())
+	p.swapReportedHealthStatus(prev.loadReportedHealthStatus())
+}
+
+// getHealthStatus atomically loads the current health status of the provider
+func (p *provider) getHealthStatus() HealthStatus {
+	return HealthStatus(atomic.LoadInt32((*int32)(&p.healthStatus)))
+}
+
+// setHealthStatus atomically publishes a new health status. Callers must hold healthMu.
+func (p *provider) setHealthStatus(status HealthStatus) {
+	atomic.StoreInt32((*int32)(&p.healthStatus), int32(status))
+}
+
+// setDegradedStatus publishes a Warning or Unhealthy status, and records why the status changed. Callers must hold healthMu.
+func (p *provider) setDegradedStatus(status HealthStatus, reason string) {
+	if p.getHealthStatus() != status {
+		p.healthReason = reason
+	}
+	p.setHealthStatus(status)
+}
+
+// getHealthReason returns why the provider last moved to Warning or Unhealthy
+func (p *provider) getHealthReason() string {
+	p.healthMu.Lock()
+	defer p.healthMu.Unlock()
+	return p.healthReason
 }
 
 // markPingFailure records the failure, and if the failure count exceeds the healthcheck threshold
 // marks the upstream as unhealthy
-func (p *provider) markPingFailure(hcThreshold int) {
+func (p *provider) markPingFailure(hcThreshold int, reason string) {
+	p.healthMu.Lock()
+	defer p.healthMu.Unlock()
 	p.failures++
 	p.successes = 0
-	if p.healthStatus == Healthy && p.failures > hcThreshold {
-		p.healthStatus = Unhealthy
+	if p.getHealthStatus() == Healthy && p.failures > hcThreshold {
+		p.setDegradedStatus(Unhealthy, reason)
+	}
+}
+
+// markProbeFailure records failed health check probes as weight failures, and if the failure count exceeds
+// the healthcheck threshold marks the upstream as unhealthy
+func (p *provider) markProbeFailure(weight int, hcThreshold int) {
+	p.healthMu.Lock()
+	defer p.healthMu.Unlock()
+	p.failures += weight
+	p.successes = 0
+	if p.getHealthStatus() != Unhealthy && p.failures > hcThreshold {
+		p.setDegradedStatus(Unhealthy, HealthReasonProbeFailure)
+		p.consecutiveHealthyChecks = 0
 	}
 }
 
 func (p *provider) markPingWarning() {
+	p.healthMu.Lock()
+	defer p.healthMu.Unlock()
 	p.successes = 0
 	p.failures = 0
-	p.healthStatus = Warning
+	p.setDegradedStatus(Warning, HealthReasonRateLimited)
 }
 
 // markPingSuccess records a successful healthcheck, and if the success count exceeds the healthcheck
 // threshold marks the upstream as healthy
 func (p *provider) markPingSuccess(hcThreshold int) {
+	p.healthMu.Lock()
+	defer p.healthMu.Unlock()
 	p.successes++
-	if p.healthStatus == Unhealthy && p.successes > hcThreshold {
+	if p.getHealthStatus() == Unhealthy && p.successes > hcThreshold {
 		p.failures = 0
-		p.healthStatus = Healthy
+		p.setHealthStatus(Healthy)
 	}
 }
 
 func (p *provider) markHealthy(hcThreshold int) {
-	if p.healthStatus == Unhealthy {
+	p.healthMu.Lock()
+	defer p.healthMu.Unlock()
+	if p.getHealthStatus() == Unhealthy {
 		p.consecutiveHealthyChecks++
 		if p.consecutiveHealthyChecks > hcThreshold {
-			p.healthStatus = Healthy
+			p.setHealthStatus(Healthy)
 			p.consecutiveHealthyChecks = 0
 		}
 		return
 	}
 	p.consecutiveHealthyChecks = 0
-	p.healthStatus = Healthy
+	p.setHealthStatus(Healthy)
 }
 
-func (p *provider) markWarning() {
-	p.healthStatus = Warning
+func (p *provider) markWarning(reason string) {
+	p.healthMu.Lock()
+	defer p.healthMu.Unlock()
+	p.setDegradedStatus(Warning, reason)
 	p.consecutiveHealthyChecks = 0
 }
 
-func (p *provider) markUnhealthy() {
-	p.healthStatus = Unhealthy
+func (p *provider) markUnhealthy(reason string) {
+	p.healthMu.Lock()
+	defer p.healthMu.Unlock()
+	p.setDegradedStatus(Unhealthy, reason)
 	p.consecutiveHealthyChecks = 0
 }
 
 // Healthy returns True if the node is passing healthchecks, False otherwise
 func (p *provider) Healthy() bool {
-	if p.healthStatus == Healthy {
-		return true
-	} else {
-		return false
-	}
+	return p.getHealthStatus() == Healthy
 }
 
 // Warning returns True if the node is returning warning in healthchecks, False otherwise
 func (p *provider) Warning() bool {
-	if p.healthStatus == Warning {
-		return true
-	} else {
-		return false
-	}
+	return p.getHealthStatus() == Warning
 }
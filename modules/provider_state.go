@@ -0,0 +1,83 @@
+package modules
+
+import (
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// providerStates is a process-wide pool of provider health records, keyed by network name and provider URL.
+// Caddy builds a fresh DinMiddleware on every config reload. The pool outlives a single middleware instance so
+// that the new instance can pick up the health status, circuit counters and block history of the one it replaces.
+// Records are reference counted per middleware instance and dropped once no loaded config uses the provider.
+var providerStates = caddy.NewUsagePool()
+
+// providerStateRecord points at the most recently provisioned instance of a provider and the network it belongs to.
+type providerStateRecord struct {
+	mu       sync.Mutex
+	network  *network
+	provider *provider
+}
+
+// providerStateKey returns the key of a provider in the process-wide state pool
+func providerStateKey(networkName, providerUrl string) string {
+	return networkName + "|" + providerUrl
+}
+
+// trackProviderState registers the provider with the process-wide state pool. If a previous instance of the same
+// provider on the same network is already tracked, the provider adopts its health state before taking its place.
+func (d *DinMiddleware) trackProviderState(n *network, p *provider) {
+	key := providerStateKey(n.Name, p.HttpUrl)
+
+	d.stateMu.Lock()
+	record, ok := d.providerStates[key]
+	if !ok {
+		// Only take a single reference per middleware instance, it is released in Cleanup()
+		value, _ := providerStates.LoadOrStore(key, &providerStateRecord{})
+		record = value.(*providerStateRecord)
+		if d.providerStates == nil {
+			d.providerStates = make(map[string]*providerStateRecord)
+		}
+		d.providerStates[key] = record
+	}
+	d.stateMu.Unlock()
+
+	record.mu.Lock()
+	defer record.mu.Unlock()
+	if record.provider != nil && record.provider != p {
+		n.adoptProviderState(p, record.network, record.provider)
+		d.logger.Debug("Restored provider health state", zap.String("network", n.Name), zap.String("provider", p.HttpUrl), zap.String("health_status", p.healthStatus.String()), zap.String("machine_id", d.machineID))
+	}
+	record.network = n
+	record.provider = p
+}
+
+// untrackProviderState drops the reference this middleware instance holds on the state of a provider it no longer
+// serves, such as a provider removed by a registry sync, so that the state isn't kept, and listed on the admin API,
+// until the next config reload
+func (d *DinMiddleware) untrackProviderState(networkName string, p *provider) {
+	key := providerStateKey(networkName, p.HttpUrl)
+
+	d.stateMu.Lock()
+	defer d.stateMu.Unlock()
+	if _, ok := d.providerStates[key]; !ok {
+		return
+	}
+	delete(d.providerStates, key)
+	if _, err := providerStates.Delete(key); err != nil {
+		d.logger.Warn("Failed to release provider state", zap.String("key", key), zap.Error(err))
+	}
+}
+
+// releaseProviderStates drops the references this middleware instance holds on the process-wide provider states
+func (d *DinMiddleware) releaseProviderStates() {
+	d.stateMu.Lock()
+	defer d.stateMu.Unlock()
+	for key := range d.providerStates {
+		if _, err := providerStates.Delete(key); err != nil {
+			d.logger.Warn("Failed to release provider state", zap.String("key", key), zap.Error(err))
+		}
+	}
+	d.providerStates = nil
+}
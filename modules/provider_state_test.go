@@ -0,0 +1,79 @@
+package modules
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestTrackProviderState(t *testing.T) {
+	timeNow := time.Now()
+	providerUrl := "http://state-test-provider:8545"
+	key := providerStateKey("state-test-network", providerUrl)
+
+	// The first middleware instance tracks a provider and records its health
+	previous := &DinMiddleware{logger: zap.NewNop()}
+	previousNetwork := NewNetwork("state-test-network")
+	previousProvider, err := NewProvider(providerUrl)
+	assert.NoError(t, err)
+	previousNetwork.Providers[previousProvider.host] = previousProvider
+	previous.trackProviderState(previousNetwork, previousProvider)
+
+	previousProvider.markUnhealthy(HealthReasonBlockNumberError)
+	previousProvider.failures = 4
+	previousNetwork.addHealthCheckToCheckedProviderList(previousProvider.host, healthCheckEntry{blockNumber: 100, timestamp: &timeNow})
+	previousNetwork.latestBlockNumber = 100
+
+	// A config reload builds a new middleware instance with the same provider
+	current := &DinMiddleware{logger: zap.NewNop()}
+	currentNetwork := NewNetwork("state-test-network")
+	currentProvider, err := NewProvider(providerUrl)
+	assert.NoError(t, err)
+	currentNetwork.Providers[currentProvider.host] = currentProvider
+	current.trackProviderState(currentNetwork, currentProvider)
+
+	assert.Equal(t, Unhealthy, currentProvider.healthStatus)
+	assert.Equal(t, 4, currentProvider.failures)
+	assert.Equal(t, int64(100), currentNetwork.latestBlockNumber)
+	history, ok := currentNetwork.getCheckedProviderHCList(currentProvider.host)
+	assert.True(t, ok)
+	assert.Equal(t, 1, len(history))
+	assert.Equal(t, int64(100), history[0].blockNumber)
+
+	refs, ok := providerStates.References(key)
+	assert.True(t, ok)
+	assert.Equal(t, 2, refs)
+
+	// Tracking the same provider twice in one instance does not take another reference
+	current.trackProviderState(currentNetwork, currentProvider)
+	refs, _ = providerStates.References(key)
+	assert.Equal(t, 2, refs)
+
+	// Unloading the previous config keeps the state for the current one
+	previous.releaseProviderStates()
+	refs, ok = providerStates.References(key)
+	assert.True(t, ok)
+	assert.Equal(t, 1, refs)
+
+	current.releaseProviderStates()
+	_, ok = providerStates.References(key)
+	assert.False(t, ok)
+}
+
+func TestTrackProviderStateNewProvider(t *testing.T) {
+	d := &DinMiddleware{logger: zap.NewNop()}
+	n := NewNetwork("state-test-new-network")
+	p, err := NewProvider("http://state-test-new-provider:8545")
+	assert.NoError(t, err)
+	n.Providers[p.host] = p
+
+	d.trackProviderState(n, p)
+	defer d.releaseProviderStates()
+
+	assert.Equal(t, Healthy, p.healthStatus)
+	assert.Equal(t, 0, p.failures)
+	_, ok := n.getCheckedProviderHCList(p.host)
+	assert.False(t, ok)
+}
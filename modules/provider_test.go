@@ -3,6 +3,8 @@ package modules
 import (
 	"testing"
 
+	"github.com/DIN-center/din-caddy-plugins/lib/auth/siwe"
+	din_http "github.com/DIN-center/din-caddy-plugins/lib/http"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
 )
 
@@ -131,7 +133,7 @@ func TestMarkPingFailure(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			tt.provider.markPingFailure(tt.hcThresh)
+			tt.provider.markPingFailure(tt.hcThresh, HealthReasonBlockNumberError)
 			if tt.provider.healthStatus != tt.output {
 				t.Errorf("markPingFailure() = %v, want %v", tt.provider.healthStatus, tt.output)
 			}
@@ -279,7 +281,7 @@ func TestMarkWarning(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			tt.provider.markWarning()
+			tt.provider.markWarning(HealthReasonLagging)
 			if tt.provider.healthStatus != tt.expectedHealthStatus {
 				t.Errorf("healthStatus = %v, want %v", tt.provider.healthStatus, tt.expectedHealthStatus)
 			}
@@ -328,7 +330,7 @@ func TestMarkUnhealthy(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			tt.provider.markUnhealthy()
+			tt.provider.markUnhealthy(HealthReasonBlockNumberError)
 			if tt.provider.healthStatus != tt.expectedHealthStatus {
 				t.Errorf("healthStatus = %v, want %v", tt.provider.healthStatus, tt.expectedHealthStatus)
 			}
@@ -338,3 +340,106 @@ func TestMarkUnhealthy(t *testing.T) {
 		})
 	}
 }
+
+func TestProviderValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		provider *provider
+		hasErr   bool
+	}{
+		{
+			name:     "valid provider",
+			provider: &provider{HttpUrl: "https://eth.rpc.test.cloud/key", Priority: 1},
+			hasErr:   false,
+		},
+		{
+			name:     "url without scheme",
+			provider: &provider{HttpUrl: "localhost:8000"},
+			hasErr:   true,
+		},
+		{
+			name:     "url without host",
+			provider: &provider{HttpUrl: "http:///key"},
+			hasErr:   true,
+		},
+		{
+			name:     "priority above max priority",
+			provider: &provider{HttpUrl: "http://localhost:8000", Priority: MaxPriority},
+			hasErr:   true,
+		},
+		{
+			name:     "negative priority",
+			provider: &provider{HttpUrl: "http://localhost:8000", Priority: -1},
+			hasErr:   true,
+		},
+		{
+			name:     "valid ws url",
+			provider: &provider{HttpUrl: "https://eth.rpc.test.cloud/key", WsUrl: "wss://eth.rpc.test.cloud/key"},
+			hasErr:   false,
+		},
+		{
+			name:     "ws url with http scheme",
+			provider: &provider{HttpUrl: "https://eth.rpc.test.cloud/key", WsUrl: "https://eth.rpc.test.cloud/key"},
+			hasErr:   true,
+		},
+		{
+			name:     "negative healthcheck interval",
+			provider: &provider{HttpUrl: "http://localhost:8000", HCInterval: -1},
+			hasErr:   true,
+		},
+		{
+			name: "mtls provider",
+			provider: &provider{
+				HttpUrl: "https://eth.rpc.test.cloud/key",
+				WsUrl:   "wss://eth.rpc.test.cloud/key",
+				TLS:     &din_http.TLSConfig{CertFile: "client.pem", KeyFile: "client-key.pem", MinVersion: "tls1.3"},
+			},
+			hasErr: false,
+		},
+		{
+			name:     "tls with http url",
+			provider: &provider{HttpUrl: "http://localhost:8000", TLS: &din_http.TLSConfig{CAFile: "ca.pem"}},
+			hasErr:   true,
+		},
+		{
+			name: "tls with ws url",
+			provider: &provider{
+				HttpUrl: "https://eth.rpc.test.cloud/key",
+				WsUrl:   "ws://eth.rpc.test.cloud/key",
+				TLS:     &din_http.TLSConfig{CAFile: "ca.pem"},
+			},
+			hasErr: true,
+		},
+		{
+			name:     "tls cert without key",
+			provider: &provider{HttpUrl: "https://eth.rpc.test.cloud/key", TLS: &din_http.TLSConfig{CertFile: "client.pem"}},
+			hasErr:   true,
+		},
+		{
+			name:     "tls unknown min version",
+			provider: &provider{HttpUrl: "https://eth.rpc.test.cloud/key", TLS: &din_http.TLSConfig{MinVersion: "1.3"}},
+			hasErr:   true,
+		},
+		{
+			name: "siwe auth without sessions",
+			provider: &provider{
+				HttpUrl: "http://localhost:8000",
+				Auth: &siwe.SIWEClientAuth{
+					ProviderURL:  "http://localhost:8000/auth",
+					SessionCount: 0,
+					Signer:       &siwe.SigningConfig{SignerURL: "http://localhost:9000"},
+				},
+			},
+			hasErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.provider.validate()
+			if (err != nil) != tt.hasErr {
+				t.Errorf("validate() = %v, want error %v", err, tt.hasErr)
+			}
+		})
+	}
+}
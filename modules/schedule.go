@@ -0,0 +1,131 @@
+package modules
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// healthCheckOutcome is the outcome of the health check of a single provider, which decides when it is checked next
+type healthCheckOutcome int
+
+const (
+	// The provider answered the health check
+	healthCheckSucceeded healthCheckOutcome = iota
+	// The provider failed to answer the health check, or answered it with an error
+	healthCheckFailed
+	// The provider answered the health check with 429 Too Many Requests
+	healthCheckRateLimited
+	// The provider was not checked, as it is held unhealthy by the chain id, fork or finality health checks
+	healthCheckHeld
+)
+
+// healthCheckInterval returns the health check interval of the provider, its own if set or else the one of the network
+func (n *network) healthCheckInterval(p *provider) time.Duration {
+	if p.HCInterval > 0 {
+		return time.Second * time.Duration(p.HCInterval)
+	}
+	return time.Second * time.Duration(n.HCInterval)
+}
+
+// dueProviders returns the providers whose next health check is due at the given time, keyed like the providers of the network
+func (n *network) dueProviders(now time.Time) map[string]*provider {
+	due := make(map[string]*provider)
+	for name, provider := range n.Providers {
+		if !now.Before(provider.getNextHealthCheck()) {
+			due[name] = provider
+		}
+	}
+	return due
+}
+
+// scheduleHealthCheck schedules the next health check of the provider after a health check with the given outcome:
+//   - failing and rate limited providers back off exponentially, up to MaxHealthCheckBackoff,
+//     so that they are not polled at the rate of healthy providers
+//   - unhealthy providers that answered are rechecked RecoveringHealthCheckSpeedup times faster,
+//     so that they are back in rotation soon after they recover
+//   - the other providers are checked at their health check interval
+//
+// Every delay is jittered by up to HealthCheckJitter, so that the providers of a network are not all polled at the same instant.
+func (n *network) scheduleHealthCheck(p *provider, outcome healthCheckOutcome, now time.Time) {
+	interval := n.healthCheckInterval(p)
+	var delay time.Duration
+	switch outcome {
+	case healthCheckFailed, healthCheckRateLimited:
+		delay = backoffDelay(interval, p.increaseHealthCheckBackoff())
+	case healthCheckSucceeded:
+		p.resetHealthCheckBackoff()
+		delay = interval
+		if p.getHealthStatus() == Unhealthy {
+			delay = interval / RecoveringHealthCheckSpeedup
+		}
+	default:
+		delay = interval
+	}
+	p.setNextHealthCheck(now.Add(jitter(delay)))
+}
+
+// backoffDelay returns the interval doubled for every consecutive failed health check after the first, up to MaxHealthCheckBackoff.
+// The interval is never shortened, even if it is longer than MaxHealthCheckBackoff.
+func backoffDelay(interval time.Duration, failures int) time.Duration {
+	delay := interval
+	for i := 1; i < failures && delay < MaxHealthCheckBackoff; i++ {
+		delay *= 2
+	}
+	if delay > MaxHealthCheckBackoff && interval < MaxHealthCheckBackoff {
+		delay = MaxHealthCheckBackoff
+	}
+	return delay
+}
+
+// jitter returns the delay moved at random by up to HealthCheckJitter of it, never below HealthCheckTick
+func jitter(delay time.Duration) time.Duration {
+	spread := time.Duration(float64(delay) * HealthCheckJitter)
+	if spread > 0 {
+		delay += time.Duration(rand.Int63n(int64(2*spread))) - spread
+	}
+	if delay < HealthCheckTick {
+		return HealthCheckTick
+	}
+	return delay
+}
+
+// getNextHealthCheck returns when the provider is due for its next health check, the zero time if it is due now
+func (p *provider) getNextHealthCheck() time.Time {
+	p.healthMu.Lock()
+	defer p.healthMu.Unlock()
+	return p.nextHealthCheck
+}
+
+// setNextHealthCheck sets when the provider is due for its next health check
+func (p *provider) setNextHealthCheck(next time.Time) {
+	p.healthMu.Lock()
+	defer p.healthMu.Unlock()
+	p.nextHealthCheck = next
+}
+
+// increaseHealthCheckBackoff records a failed or rate limited health check, and returns the number of consecutive ones
+func (p *provider) increaseHealthCheckBackoff() int {
+	p.healthMu.Lock()
+	defer p.healthMu.Unlock()
+	p.healthCheckBackoff++
+	return p.healthCheckBackoff
+}
+
+// resetHealthCheckBackoff records a health check the provider answered
+func (p *provider) resetHealthCheckBackoff() {
+	p.healthMu.Lock()
+	defer p.healthMu.Unlock()
+	p.healthCheckBackoff = 0
+}
+
+// startHealthCheck records that a health check of the provider is running. It returns false if one already is,
+// so that a provider that is slow to answer is not checked again before it does.
+func (p *provider) startHealthCheck() bool {
+	return atomic.CompareAndSwapInt32(&p.healthChecking, 0, 1)
+}
+
+// finishHealthCheck records that the health check of the provider is done
+func (p *provider) finishHealthCheck() {
+	atomic.StoreInt32(&p.healthChecking, 0)
+}
@@ -0,0 +1,113 @@
+package modules
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	tests := []struct {
+		name     string
+		interval time.Duration
+		failures int
+		want     time.Duration
+	}{
+		{name: "first failure", interval: 5 * time.Second, failures: 1, want: 5 * time.Second},
+		{name: "doubles", interval: 5 * time.Second, failures: 3, want: 20 * time.Second},
+		{name: "capped", interval: 5 * time.Second, failures: 20, want: MaxHealthCheckBackoff},
+		{name: "long interval is kept", interval: 5 * time.Minute, failures: 3, want: 5 * time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, backoffDelay(tt.interval, tt.failures))
+		})
+	}
+}
+
+func TestJitter(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		delay := jitter(10 * time.Second)
+		assert.GreaterOrEqual(t, delay, 9*time.Second)
+		assert.Less(t, delay, 11*time.Second)
+	}
+	assert.Equal(t, HealthCheckTick, jitter(0))
+}
+
+func TestScheduleHealthCheck(t *testing.T) {
+	now := time.Now()
+	within := func(t *testing.T, p *provider, delay time.Duration) {
+		next := p.getNextHealthCheck().Sub(now)
+		spread := time.Duration(float64(delay) * HealthCheckJitter)
+		assert.GreaterOrEqual(t, next, delay-spread)
+		assert.LessOrEqual(t, next, delay+spread)
+	}
+
+	n := NewNetwork("eth")
+	n.HCInterval = 8
+
+	t.Run("healthy provider is checked at the network interval", func(t *testing.T) {
+		p := &provider{}
+		n.scheduleHealthCheck(p, healthCheckSucceeded, now)
+		within(t, p, 8*time.Second)
+	})
+
+	t.Run("provider interval overrides the network interval", func(t *testing.T) {
+		p := &provider{HCInterval: 20}
+		n.scheduleHealthCheck(p, healthCheckSucceeded, now)
+		within(t, p, 20*time.Second)
+	})
+
+	t.Run("failing provider backs off until it answers", func(t *testing.T) {
+		p := &provider{}
+		n.scheduleHealthCheck(p, healthCheckFailed, now)
+		n.scheduleHealthCheck(p, healthCheckRateLimited, now)
+		n.scheduleHealthCheck(p, healthCheckFailed, now)
+		within(t, p, 32*time.Second)
+		n.scheduleHealthCheck(p, healthCheckSucceeded, now)
+		within(t, p, 8*time.Second)
+	})
+
+	t.Run("recovering provider is rechecked faster", func(t *testing.T) {
+		p := &provider{healthStatus: Unhealthy}
+		n.scheduleHealthCheck(p, healthCheckSucceeded, now)
+		within(t, p, 2*time.Second)
+	})
+
+	t.Run("held provider is checked at its interval", func(t *testing.T) {
+		p := &provider{healthStatus: Unhealthy}
+		n.scheduleHealthCheck(p, healthCheckHeld, now)
+		within(t, p, 8*time.Second)
+	})
+}
+
+func TestDueProviders(t *testing.T) {
+	now := time.Now()
+	n := NewNetwork("eth")
+	n.Providers["new"] = &provider{host: "new"}
+	n.Providers["due"] = &provider{host: "due", nextHealthCheck: now.Add(-time.Second)}
+	n.Providers["later"] = &provider{host: "later", nextHealthCheck: now.Add(time.Second)}
+
+	due := n.dueProviders(now)
+	assert.Equal(t, 2, len(due))
+	assert.NotNil(t, due["new"])
+	assert.NotNil(t, due["due"])
+}
+
+// checkProviders runs the scheduled health check of every provider of the network, as the health check ticker does
+// once they are all due, and waits for the checks to finish
+func checkProviders(t *testing.T, n *network) {
+	t.Helper()
+	// Past the next health check of every provider, however far it was scheduled or backed off
+	n.scheduledHealthCheck(time.Now().Add(time.Hour), 1, false)
+	assert.Eventually(t, func() bool {
+		for _, p := range n.Providers {
+			if atomic.LoadInt32(&p.healthChecking) != 0 {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, time.Millisecond)
+}
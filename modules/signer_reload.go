@@ -0,0 +1,64 @@
+package modules
+
+import (
+	"time"
+
+	"github.com/DIN-center/din-caddy-plugins/lib/auth/siwe"
+	"go.uber.org/zap"
+)
+
+// startSignerReload reads the key files of the siwe signers again every SignerReloadInterval, until the middleware is closed
+func (d *DinMiddleware) startSignerReload() {
+	ticker := time.NewTicker(SignerReloadInterval)
+	go func() {
+		for {
+			select {
+			case <-d.quit:
+				ticker.Stop()
+				return
+			case <-ticker.C:
+				d.reloadSigners()
+			}
+		}
+	}()
+}
+
+// reloadSigners reloads the key of every signer in use. When the key of a signer changed, the sessions of the providers
+// signing with it are established again with the new key, rather than when they are next renewed.
+func (d *DinMiddleware) reloadSigners() {
+	// Signers and auth clients are shared between providers, so each is reloaded and rotated once
+	clients := make(map[*siwe.SigningConfig][]*siwe.SIWEClientAuth)
+	if d.DefaultSiweSigner != nil {
+		clients[d.DefaultSiweSigner] = nil
+	}
+	seen := make(map[*siwe.SIWEClientAuth]struct{})
+	for _, network := range d.getNetworks() {
+		for _, provider := range network.Providers {
+			if provider.Auth == nil || provider.Auth.Signer == nil {
+				continue
+			}
+			if _, ok := seen[provider.Auth]; ok {
+				continue
+			}
+			seen[provider.Auth] = struct{}{}
+			clients[provider.Auth.Signer] = append(clients[provider.Auth.Signer], provider.Auth)
+		}
+	}
+
+	for signer, authClients := range clients {
+		changed, err := signer.Reload()
+		if err != nil {
+			d.logger.Warn("Error reloading signer key, keeping the current key", zap.Error(err), zap.String("machine_id", d.machineID))
+			continue
+		}
+		if !changed {
+			continue
+		}
+		d.logger.Info("Signer key rotated, establishing sessions with the new key", zap.String("address", signer.Address), zap.Int("auth_clients", len(authClients)), zap.String("machine_id", d.machineID))
+		for _, ac := range authClients {
+			if err := ac.Rotate(); err != nil {
+				d.logger.Warn("Error establishing sessions with the new signer key", zap.String("provider", ac.ProviderURL), zap.Error(err), zap.String("machine_id", d.machineID))
+			}
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package modules
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/DIN-center/din-caddy-plugins/lib/auth/siwe"
+	"github.com/ethereum/go-ethereum/crypto"
+	siwego "github.com/spruceid/siwe-go"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestReloadSigners(t *testing.T) {
+	// The auth server hands out the address of the signer as the session token
+	authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var signed struct {
+			Message string `json:"msg"`
+		}
+		json.Unmarshal(body, &signed)
+		message, err := siwego.ParseMessage(signed.Message)
+		if err != nil {
+			w.Write([]byte(fmt.Sprintf(`{"error": %q}`, err.Error())))
+			return
+		}
+		w.Write([]byte(fmt.Sprintf(`{"headers": {"x-api-key": %q}}`, message.GetAddress().String())))
+	}))
+	defer authServer.Close()
+
+	key, _ := crypto.GenerateKey()
+	keyFile := filepath.Join(t.TempDir(), "din-secret-key")
+	assert.NoError(t, os.WriteFile(keyFile, []byte(fmt.Sprintf("%x", crypto.FromECDSA(key))), 0600))
+	signer := &siwe.SigningConfig{SecretFile: keyFile}
+	assert.NoError(t, signer.LoadKey())
+
+	client := siwe.NewSIWEClient(authServer.URL, 2, signer)
+	assert.NoError(t, client.Start(zap.NewNop()))
+	sessionToken := func(i int) string {
+		return client.SessionTokens[i].Headers["x-api-key"]
+	}
+	assert.Equal(t, crypto.PubkeyToAddress(key.PublicKey).String(), sessionToken(0))
+
+	d := &DinMiddleware{DefaultSiweSigner: signer, logger: zap.NewNop()}
+	n := NewNetwork("eth")
+	n.Providers["provider1"] = &provider{host: "provider1", Auth: client}
+	n.Providers["provider2"] = &provider{host: "provider2", Auth: client}
+	d.Networks = map[string]*network{"eth": n}
+
+	// Sessions are kept while the key is unchanged
+	d.reloadSigners()
+	assert.Equal(t, crypto.PubkeyToAddress(key.PublicKey).String(), sessionToken(1))
+
+	// Every session is established again with a rotated key
+	rotated, _ := crypto.GenerateKey()
+	assert.NoError(t, os.WriteFile(keyFile, []byte(fmt.Sprintf("%x", crypto.FromECDSA(rotated))), 0600))
+	d.reloadSigners()
+	assert.Equal(t, crypto.PubkeyToAddress(rotated.PublicKey).String(), sessionToken(0))
+	assert.Equal(t, crypto.PubkeyToAddress(rotated.PublicKey).String(), sessionToken(1))
+}
@@ -0,0 +1,95 @@
+package modules
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// stalenessHealthCheck returns HealthReasonStaleHead if the head of the provider hasn't advanced for StaleBlockMultiplier
+// expected block times while the network advanced past it, for the provider to be moved to Warning, or an empty string otherwise.
+// As the history holds the last 10 health checks, a stuck head is only seen within that window, the lag check catches
+// providers that stay stuck for longer.
+func (n *network) stalenessHealthCheck(providerName string, healthCheckList []healthCheckEntry, blockTime time.Duration) string {
+	if n.StaleBlockMultiplier == 0 || blockTime == 0 || len(healthCheckList) == 0 {
+		return ""
+	}
+	head := healthCheckList[0].blockNumber
+	if head >= n.loadLatestBlockNumber() {
+		// The whole network is at the provider's head, a chain halt is not the provider's fault
+		return ""
+	}
+	tolerance := time.Duration(n.StaleBlockMultiplier) * blockTime
+	if staleFor := headStaleFor(healthCheckList); staleFor > tolerance {
+		n.logger.Warn("Provider head is not advancing",
+			zap.String("provider", providerName),
+			zap.String("network", n.Name),
+			zap.String("reason", HealthReasonStaleHead),
+			zap.Int64("provider_block_number", head),
+			zap.Int64("network_block_number", n.loadLatestBlockNumber()),
+			zap.Duration("stale_for", staleFor),
+			zap.Duration("expected_block_time", blockTime),
+			zap.String("machine_id", n.machineID))
+		return HealthReasonStaleHead
+	}
+	return ""
+}
+
+// estimateBlockTime returns the median time between blocks seen across the health check histories of the providers,
+// 0 if no provider advanced within its history
+func estimateBlockTime(histories map[string][]healthCheckEntry) time.Duration {
+	samples := make([]time.Duration, 0, len(histories))
+	for _, history := range histories {
+		if len(history) < 2 || history[0].timestamp == nil {
+			continue
+		}
+		newest := history[0]
+		for i := len(history) - 1; i > 0; i-- {
+			oldest := history[i]
+			if oldest.timestamp == nil {
+				continue
+			}
+			blocks := newest.blockNumber - oldest.blockNumber
+			elapsed := newest.timestamp.Sub(*oldest.timestamp)
+			if blocks > 0 && elapsed > 0 {
+				samples = append(samples, elapsed/time.Duration(blocks))
+			}
+			break
+		}
+	}
+	if len(samples) == 0 {
+		return 0
+	}
+	sort.Slice(samples, func(i, j int) bool {
+		return samples[i] < samples[j]
+	})
+	return samples[(len(samples)-1)/2]
+}
+
+// headStaleFor returns for how long the newest block number of the history has been reported, within the history
+func headStaleFor(history []healthCheckEntry) time.Duration {
+	if len(history) == 0 || history[0].timestamp == nil {
+		return 0
+	}
+	newest := history[0]
+	since := *newest.timestamp
+	for _, entry := range history[1:] {
+		if entry.blockNumber != newest.blockNumber || entry.timestamp == nil {
+			break
+		}
+		since = *entry.timestamp
+	}
+	return newest.timestamp.Sub(since)
+}
+
+// loadBlockTime atomically loads the expected time between blocks of the network, 0 if not known
+func (n *network) loadBlockTime() time.Duration {
+	return time.Duration(atomic.LoadInt64(&n.blockTime))
+}
+
+// storeBlockTime atomically stores the expected time between blocks of the network
+func (n *network) storeBlockTime(blockTime time.Duration) {
+	atomic.StoreInt64(&n.blockTime, int64(blockTime))
+}
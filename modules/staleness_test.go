@@ -0,0 +1,82 @@
+package modules
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// historyAt returns a health check history, newest first, with one entry per interval ending at end
+func historyAt(end time.Time, interval time.Duration, blockNumbers ...int64) []healthCheckEntry {
+	history := make([]healthCheckEntry, len(blockNumbers))
+	for i, blockNumber := range blockNumbers {
+		timestamp := end.Add(-time.Duration(i) * interval)
+		history[i] = healthCheckEntry{blockNumber: blockNumber, timestamp: &timestamp}
+	}
+	return history
+}
+
+func TestEstimateBlockTime(t *testing.T) {
+	now := time.Now()
+	histories := map[string][]healthCheckEntry{
+		// 4 blocks in 20 seconds
+		"provider1": historyAt(now, 5*time.Second, 104, 103, 102, 101, 100),
+		// 2 blocks in 20 seconds
+		"provider2": historyAt(now, 5*time.Second, 102, 102, 101, 101, 100),
+		// stuck
+		"provider3": historyAt(now, 5*time.Second, 100, 100, 100, 100, 100),
+		// no timestamps
+		"provider4": {{blockNumber: 110}, {blockNumber: 100}},
+	}
+	assert.Equal(t, 5*time.Second, estimateBlockTime(histories))
+	assert.Equal(t, time.Duration(0), estimateBlockTime(map[string][]healthCheckEntry{"provider3": histories["provider3"]}))
+}
+
+func TestHeadStaleFor(t *testing.T) {
+	now := time.Now()
+	assert.Equal(t, 15*time.Second, headStaleFor(historyAt(now, 5*time.Second, 100, 100, 100, 100, 99)))
+	assert.Equal(t, time.Duration(0), headStaleFor(historyAt(now, 5*time.Second, 101, 100)))
+	assert.Equal(t, time.Duration(0), headStaleFor(nil))
+}
+
+func TestEvaluateCheckedProvidersStaleHead(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name          string
+		latestBlock   int64
+		otherHistory  []int64
+		stuckStatus   HealthStatus
+		multiplier    int
+		wantStatus    HealthStatus
+		wantBlockTime time.Duration
+	}{
+		{name: "stuck provider is demoted", latestBlock: 106, otherHistory: []int64{106, 105, 104, 103, 102}, stuckStatus: Healthy, multiplier: 3, wantStatus: Warning, wantBlockTime: 5 * time.Second},
+		{name: "whole network halted", latestBlock: 100, otherHistory: []int64{100, 100, 100, 100, 100}, stuckStatus: Healthy, multiplier: 3, wantStatus: Healthy},
+		{name: "within tolerance", latestBlock: 106, otherHistory: []int64{106, 105, 104, 103, 102}, stuckStatus: Healthy, multiplier: 10, wantStatus: Healthy, wantBlockTime: 5 * time.Second},
+		{name: "disabled", latestBlock: 106, otherHistory: []int64{106, 105, 104, 103, 102}, stuckStatus: Healthy, multiplier: 0, wantStatus: Healthy, wantBlockTime: 5 * time.Second},
+		{name: "unhealthy provider is left unhealthy", latestBlock: 106, otherHistory: []int64{106, 105, 104, 103, 102}, stuckStatus: Unhealthy, multiplier: 3, wantStatus: Unhealthy, wantBlockTime: 5 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := NewNetwork("eth")
+			n.logger = zap.NewNop()
+			n.BlockLagLimit = 10
+			n.StaleBlockMultiplier = tt.multiplier
+			n.Providers["provider1"] = &provider{host: "provider1"}
+			n.Providers["provider2"] = &provider{host: "provider2", healthStatus: tt.stuckStatus}
+			n.CheckedProviders["provider1"] = historyAt(now, 5*time.Second, tt.otherHistory...)
+			// provider2 has reported block 100 for 20 seconds
+			n.CheckedProviders["provider2"] = historyAt(now, 5*time.Second, 100, 100, 100, 100, 100)
+			n.storeLatestBlockNumber(tt.latestBlock)
+
+			n.evaluateCheckedProviders(time.Now())
+
+			assert.Equal(t, Healthy, n.Providers["provider1"].getHealthStatus())
+			assert.Equal(t, tt.wantStatus, n.Providers["provider2"].getHealthStatus())
+			assert.Equal(t, tt.wantBlockTime, n.loadBlockTime())
+		})
+	}
+}